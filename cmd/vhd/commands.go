@@ -13,7 +13,9 @@ import (
 	"os/exec"
 	"errors"
 	"strings"
+	"flag"
 
+	"rpucella.net/virtual-hard-drive/internal/storage"
 	"rpucella.net/virtual-hard-drive/internal/util"
 	"rpucella.net/virtual-hard-drive/internal/virtualfs"
 )
@@ -37,6 +39,9 @@ func maxLength(strings []string) int {
 }
 
 func log(comm string, text string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	clearBarLocked()
 	fmt.Printf("[%s] %s\n", comm, text)
 }
 
@@ -58,10 +63,10 @@ func initializeCommands() map[string]command {
 		1, 1, commandInfo, "info <file>", "Show remote file information",
 	}
 	commands["get"] = command{
-		1, -1, commandGet, "get <file> ...", "Download remote files to disk",
+		1, -1, commandGet, "get [-r] [-o <local-dest>] [-existing skip|overwrite|rename] [-limit <rate>] <folder/file> ... [<local-dest>]", "Download remote files (and folders with -r) to disk",
 	}
 	commands["put"] = command{
-		1, -1, commandPut, "put <local-file/folder> ... [<folder>]", "Upload local files to remote folder",
+		1, -1, commandPut, "put [-f] [-limit <rate>] <local-file/folder> ... [<folder>]", "Upload local files to remote folder (-f to replace existing files, -limit for a bandwidth limit such as 5MB/s)",
 	}
 	commands["catalog"] = command{
 		0, 1, commandCatalog, "catalog [<folder>]", "Show catalog at remote folder",
@@ -75,12 +80,57 @@ func initializeCommands() map[string]command {
 	commands["mv"] = command{
 		2, -1, commandMv, "mv <folder/file> ... <folder/file>", "Move remote folder or file",
 	}
+	commands["cp"] = command{
+		2, -1, commandCp, "cp [-r] <folder/file> ... <folder/file>", "Copy remote folder (with -r) or file, possibly to another drive",
+	}
+	commands["sync"] = command{
+		2, -1, commandSync, "sync [-dry-run] [-delete] [-limit <rate>] <local-folder> <folder> | <folder> <local-folder>", "Copy new and changed files from first folder to second folder",
+	}
+	commands["diff"] = command{
+		2, 2, commandDiff, "diff <local-folder> <folder>", "Show files that differ between local folder and remote folder",
+	}
+	commands["mount"] = command{
+		1, 5, commandMount, "mount [-cache <local-folder>] [-cache-size <size>] <mountpoint>", "Mount the drives as a read-only filesystem (until interrupted)",
+	}
+	commands["serve-webdav"] = command{
+		0, 2, commandServeWebDAV, "serve-webdav [-addr <address>]", "Serve the drives over WebDAV (users are configured in config.yaml)",
+	}
+	commands["serve"] = command{
+		0, 2, commandServe, "serve [-addr <address>]", "Serve a JSON API to the drives (tokens are configured in config.yaml)",
+	}
 	commands["find"] = command{
-		1, 1, commandFind, "find <string>", "Find folders/files containing <string> (case insensitive)",
+		0, -1, commandFind, "find [-in <folder>] [-name|-path <glob>] [-regex|-path-regex <regexp>] [-i] [-type f|d] [-size <sizes>] [-created|-updated <dates>] [-uuid <uuid>] [-metadata <text>] [-tag <tag>] [-attr <name>[=<value>]] [-maxdepth <n>] [-format path|long|json] [<string>]", "Find folders/files matching all conditions (<string>: name contains <string>, case insensitive)",
+	}
+	commands["search"] = command{
+		1, -1, commandSearch, "search [-n <count>] <word> ...", "Search folders/files of all drives by name, path, tags and attributes, best matches first (words match as prefixes)",
+	}
+	commands["du"] = command{
+		0, 4, commandDu, "du [-h] [-d <depth>] [<folder>]", "Show logical and stored size of remote folder and its subfolders (-h for KiB, MiB, GiB)",
+	}
+	commands["stats"] = command{
+		1, 1, commandStats, "stats <drive>", "Show file counts, sizes, largest files and types of a drive",
+	}
+	commands["tag"] = command{
+		1, -1, commandTag, "tag add|remove <tag> <folder/file> ... | tag list [<folder/file>]", "Add or remove a tag on folders/files, or list tags (of all drives if no folder/file)",
+	}
+	commands["attr"] = command{
+		2, 4, commandAttr, "attr set <folder/file> <name> <value> | attr get <folder/file> [<name>] | attr unset <folder/file> <name>", "Set, show or remove attributes of a folder/file",
+	}
+	commands["quota"] = command{
+		0, 6, commandQuota, "quota [<drive>] | quota set [-size <size>] [-files <count>] <drive>", "Show files and bytes used by drives against their quotas, or set the quota of a drive (0 for no limit)",
+	}
+	commands["repair"] = command{
+		0, 1, commandRepair, "repair [<folder/file>]", "Restore missing copies/shards of files on mirror and erasure drives",
 	}
 	commands["script"] = command{
 		0, 1, commandScript, "script [<name>]", "Run script from VHDCONFIG/scripts folder",
 	}
+	commands["migrate"] = command{
+		1, 1, commandMigrate, "migrate <drive>", "Move objects of a drive to the current storage layout",
+	}
+	commands["rm"] = command{
+		1, -1, commandRm, "rm [-r] <folder/file> ...", "Delete remote folder (with -r) or file permanently",
+	}
 	commands["trash"] = command{
 		1, 1, commandTrash, "trash <folder/file>", "Send folder/file to trash folder for the drive",
 	}
@@ -116,13 +166,22 @@ func commandLs(args []string, ctxt *context) error {
 		}
 		curr = newCurr
 	}
-	names := make([]string, 0, len(curr.ContentList()))
-	for _, k := range curr.ContentList() {
-		names = append(names, k)
+	names, err := curr.ContentList()
+	if err != nil {
+		return fmt.Errorf("ls: %w", err)
 	}
 	sort.Strings(names)
+	subs := make([]virtualfs.VirtualFS, 0, len(names))
 	for _, k := range names {
-		sub, _ := curr.GetContent(k)
+		sub, found, err := curr.GetContent(k)
+		if err != nil {
+			return fmt.Errorf("ls: %w", err)
+		}
+		if found {
+			subs = append(subs, sub)
+		}
+	}
+	for _, sub := range subs {
 		if dir := sub.AsDir(); dir != nil { 
 			count, err := dir.CountFiles()
 			if err != nil {
@@ -132,9 +191,8 @@ func commandLs(args []string, ctxt *context) error {
 		}
 	}
 	tFormat := "2006-01-02 15:04"
-	for _, k := range names {
-		file, _ := curr.GetContent(k)
-		if file := file.AsFile(); file != nil { 
+	for _, sub := range subs {
+		if file := sub.AsFile(); file != nil { 
 			fmt.Printf(" %16s   %s\n", file.Updated().Format(tFormat), file.Name())
 		}
 	}
@@ -177,6 +235,9 @@ func commandInfo(args []string, ctxt *context) error {
 	if file == nil {
 		return fmt.Errorf("file %s is not a file", fileObj.Name())
 	}
+	if err := printAnnotations(fileObj); err != nil {
+		return fmt.Errorf("info: %w", err)
+	}
 	err = fileObj.Drive().Storage().RemoteInfo(file.UUID(), file.Metadata())
 	if err != nil {
 		return fmt.Errorf("remote: %w", err)
@@ -203,33 +264,279 @@ func isDirectory(path string) (bool, error) {
 	return fileInfo.IsDir(), nil
 }
 
+// What to do when a downloaded file already exists locally.
+const (
+	EXISTING_SKIP = "skip"
+	EXISTING_OVERWRITE = "overwrite"
+	EXISTING_RENAME = "rename"
+)
+
+// First name of the form "name (n).ext" that does not exist locally.
+func availableName(localPath string) (string, error) {
+	ext := filepath.Ext(localPath)
+	base := strings.TrimSuffix(localPath, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		exists, err := isExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// Download a remote file to `localPath`, setting its modification time to
+// the time the file was last updated in the catalog. The file is written to
+// a temporary file first, so that a failed download leaves nothing behind.
+func downloadFile(fileObj virtualfs.VirtualFS, localPath string, existing string) error {
+	file := fileObj.AsFile()
+	startFile(localPath, file.Size())
+	defer endFile()
+	exists, err := isExists(localPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		switch existing {
+		case EXISTING_SKIP:
+			log("get", fmt.Sprintf("skipping %s (exists)", localPath))
+			return nil
+		case EXISTING_RENAME:
+			if localPath, err = availableName(localPath); err != nil {
+				return err
+			}
+		}
+	}
+	log("get", fmt.Sprintf("File %s", fileObj.Path()))
+	log("get", fmt.Sprintf("UUID %s", file.UUID()))
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".vhd-get-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := storage.Download(fileObj.Drive().Storage(), file.UUID(), file.Metadata(), tmp); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close: %v", err)
+	}
+	// Temporary files are created private.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("os.Chmod: %v", err)
+	}
+	if err := os.Chtimes(tmp.Name(), file.Updated(), file.Updated()); err != nil {
+		return fmt.Errorf("os.Chtimes: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return fmt.Errorf("os.Rename: %v", err)
+	}
+	log("get", fmt.Sprintf("get %s", localPath))
+	return nil
+}
+
 func commandGet(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "download folders recursively")
+	output := flags.String("o", "", "local destination")
+	existing := flags.String("existing", EXISTING_OVERWRITE, "skip, overwrite or rename existing local files")
+	limit := flags.String("limit", "", "bandwidth limit, such as 5MB/s")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	restore, err := limitTransfers(ctxt, *limit)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	defer restore()
+	if *existing != EXISTING_SKIP && *existing != EXISTING_OVERWRITE && *existing != EXISTING_RENAME {
+		return fmt.Errorf("get: unknown policy for existing files: %s", *existing)
+	}
+	dest := *output
+	if dest == "" && len(args) > 1 {
+		// Check the last argument. Does it describe a remote file/folder or a local destination?
+		last := args[len(args) - 1]
+		remoteObj, _ := virtualfs.CheckPath(ctxt.pwd, last)
+		if remoteObj == nil {
+			dest = last
+			args = args[:len(args) - 1]
+		} else if exists, _ := isExists(last); exists {
+			return fmt.Errorf("get: last arg is a local file/folder and a remote file/folder")
+		}
+	}
 	srcPaths, err := virtualfs.ExpandPaths(ctxt.pwd, args)
 	if err != nil {
 		return fmt.Errorf("get: %s", err)
 	}
+	// Without a destination, or with an existing local folder as destination,
+	// entries are downloaded under their remote names.
+	intoFolder := true
+	if dest == "" {
+		dest = "."
+	} else if isDir, err := isDirectory(dest); err != nil || !isDir {
+		if len(srcPaths) > 1 {
+			return fmt.Errorf("get: destination %s is not a folder", dest)
+		}
+		intoFolder = false
+	}
+	files, bytes, err := remoteTotal(ctxt, srcPaths, *recursive)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	defer startProgress(ctxt, "get", files, bytes)()
 	for _, srcPath := range srcPaths {
 		log("get", "----------------------------------------")
-		log("get", fmt.Sprintf("File %s", srcPath))
-		fileObj, err := virtualfs.NavigateFile(ctxt.pwd, srcPath)
+		srcObj, err := virtualfs.NavigatePath(ctxt.pwd, srcPath)
 		if err != nil {
 			return fmt.Errorf("get: %w", err)
 		}
-		file := fileObj.AsFile()
-		if file == nil {
-			return fmt.Errorf("file %s is not a file", fileObj.Name())
+		localPath := dest
+		if intoFolder {
+			localPath = filepath.Join(dest, srcObj.Name())
 		}
-		log("get", fmt.Sprintf("UUID %s", file.UUID()))
-		err = fileObj.Drive().Storage().DownloadFile(file.UUID(), file.Metadata(), fileObj.Name())
+		if srcObj.IsFile() {
+			if err := downloadFile(srcObj, localPath, *existing); err != nil {
+				return fmt.Errorf("get: %w", err)
+			}
+			continue
+		}
+		if !*recursive {
+			return fmt.Errorf("get: %s is a folder (use -r)", srcObj.Path())
+		}
+		// Recreate the tree under `localPath`.
+		localPaths := map[virtualfs.VirtualFS]string{srcObj: localPath}
+		err = virtualfs.Walk(srcObj, func(vfs virtualfs.VirtualFS) error {
+			path := localPath
+			if vfs != srcObj {
+				path = filepath.Join(localPaths[vfs.Parent()], vfs.Name())
+			}
+			if vfs.IsFile() {
+				return downloadFile(vfs, path, *existing)
+			}
+			localPaths[vfs] = path
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return fmt.Errorf("os.MkdirAll: %v", err)
+			}
+			return nil
+		})
 		if err != nil {
 			return fmt.Errorf("get: %w", err)
 		}
-		log("get", fmt.Sprintf("get %s", fileObj.Name()))
 	}
 	return nil
 }
 
+// Files and bytes downloaded by get of `srcPaths`, with -1 bytes if the
+// size of a file is unknown.
+func remoteTotal(ctxt *context, srcPaths []string, recursive bool) (int, int64, error) {
+	files, bytes := 0, int64(0)
+	for _, srcPath := range srcPaths {
+		srcObj, err := virtualfs.NavigatePath(ctxt.pwd, srcPath)
+		if err != nil || (srcObj.IsDir() && !recursive) {
+			continue
+		}
+		err = virtualfs.Walk(srcObj, func(obj virtualfs.VirtualFS) error {
+			if file := obj.AsFile(); file != nil {
+				files++
+				if file.Size() < 0 || bytes < 0 {
+					bytes = -1
+				} else {
+					bytes += file.Size()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return files, bytes, nil
+}
+
+// Upload local file `srcFilePath` to `destFolder` under name `name`.
+// If `existing` is not nil, it is the file to update with the new content.
+func uploadFile(comm string, srcFilePath string, destFolder virtualfs.VirtualFS, name string, existing virtualfs.VirtualFS) error {
+	newUUID := uuid.NewString()
+	drive := destFolder.Drive()
+	if drive == nil {
+		return fmt.Errorf("no drive for folder: %s", destFolder.Path())
+	}
+	info, err := os.Stat(srcFilePath)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %v", err)
+	}
+	startFile(srcFilePath, storage.UploadSize(drive.Storage(), info.Size()))
+	defer endFile()
+	// Upload to storage.
+	log(comm, fmt.Sprintf("source %s", srcFilePath))
+	log(comm, fmt.Sprintf("UUID %s", newUUID))
+	metadata, size, hash, err := uploadContent(drive.Storage(), srcFilePath, newUUID)
+	if err != nil {
+		return err
+	}
+	log(comm, fmt.Sprintf("put %s", name))
+	if existing != nil {
+		// Existing file now refers to the new object.
+		return virtualfs.ReplaceContent(existing, newUUID, metadata, size, hash)
+	}
+	// Add file to catalog.
+	_, err = virtualfs.CreateFile(destFolder, name, newUUID, metadata, size, hash)
+	return err
+}
+
+// Upload local file `srcFilePath` as object `uuid`, returning the metadata
+// of the object along with the size and hash of what was uploaded. The hash
+// is computed as the content streams to storage. Storage reading from a
+// local file on its own (mirror and erasure drives) needs a pass to hash
+// the file first.
+func uploadContent(store storage.Storage, srcFilePath string, uuid string) (string, int64, string, error) {
+	if _, ok := store.(storage.Streamer); !ok {
+		hash, size, err := util.HashFile(srcFilePath)
+		if err != nil {
+			return "", 0, "", err
+		}
+		metadata, err := store.UploadFile(srcFilePath, uuid)
+		return metadata, size, hash, err
+	}
+	f, err := os.Open(srcFilePath)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("os.Open: %v", err)
+	}
+	defer f.Close()
+	crc := util.NewCRCWriter(io.Discard)
+	counter := &countWriter{}
+	metadata, err := storage.Upload(store, io.TeeReader(f, io.MultiWriter(crc, counter)), uuid)
+	if err != nil {
+		return "", 0, "", err
+	}
+	return metadata, counter.n, util.FormatHash(crc.Sum()), nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
 func commandPut(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	force := flags.Bool("f", false, "replace existing files")
+	limit := flags.String("limit", "", "bandwidth limit, such as 5MB/s")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	restore, err := limitTransfers(ctxt, *limit)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer restore()
 	destFolder := ctxt.pwd
 	lastArg := len(args)
 	failures := make([]error, 0)
@@ -238,15 +545,20 @@ func commandPut(args []string, ctxt *context) error {
 	process = func(srcFilePath string, destFolder virtualfs.VirtualFS) error {
 		log("put", "----------------------------------------")
 		srcName := filepath.Base(srcFilePath)
-		_, found := destFolder.GetContent(srcName)
-		if found {
-			// Confirm overwrite? Or force user to delete first?
+		existing, found, err := destFolder.GetContent(srcName)
+		if err != nil {
+			return err
+		}
+		if found && !*force {
 			return fmt.Errorf("file %s already exists in %s", srcName, destFolder.Path())
 		}
 		isDir, err := isDirectory(srcFilePath)
 		if err != nil {
 			return err
 		}
+		if found && isDir != existing.IsDir() {
+			return fmt.Errorf("cannot replace %s by %s", existing.Path(), srcFilePath)
+		}
 		if isDir {
 			if destFolder.IsRoot() {
 				return fmt.Errorf("put: cannot create drive")
@@ -254,10 +566,13 @@ func commandPut(args []string, ctxt *context) error {
 			if err := virtualfs.ValidateName(srcName); err != nil {
 				return err
 			}
-			log("put", fmt.Sprintf("creating directory %s", srcName))
-			dirObj, err := virtualfs.CreateDirectory(destFolder, srcName)
-			if err != nil {
-				return err
+			dirObj := existing
+			if !found {
+				log("put", fmt.Sprintf("creating directory %s", srcName))
+				dirObj, err = virtualfs.CreateDirectory(destFolder, srcName)
+				if err != nil {
+					return err
+				}
 			}
 			files, err := ioutil.ReadDir(srcFilePath)
 			if err != nil {
@@ -274,21 +589,7 @@ func commandPut(args []string, ctxt *context) error {
 				}
 			}
 		} else { 
-			newUUID := uuid.NewString()
-			drive := destFolder.Drive()
-			if drive == nil {
-				return fmt.Errorf("put: no drive for folder: %s", destFolder.Path())
-			}
-			// Upload to storage.
-			log("put", fmt.Sprintf("source %s", srcFilePath))
-			log("put", fmt.Sprintf("UUID %s", newUUID))
-			metadata, err := drive.Storage().UploadFile(srcFilePath, newUUID)
-			if err != nil {
-				return fmt.Errorf("put: %w", err)
-			}
-			log("put", fmt.Sprintf("put %s", srcName))
-			// Add file to catalog.
-			if _, err := virtualfs.CreateFile(destFolder, srcName, newUUID, metadata); err != nil {
+			if err := uploadFile("put", srcFilePath, destFolder, srcName, existing); err != nil {
 				return fmt.Errorf("put: %w", err)
 			}
 		}
@@ -315,6 +616,22 @@ func commandPut(args []string, ctxt *context) error {
 			lastArg = lastArg - 1
 		}
 	}
+	files, replaced, bytes := 0, 0, int64(0)
+	for i := 0; i < lastArg; i++ {
+		f, r, b, err := localAddition(args[i], destFolder.Drive(), destFolder, *force)
+		if err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+		files += f
+		replaced += r
+		bytes += b
+	}
+	if err := virtualfs.CheckQuota(destFolder.Drive(), files, bytes); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if destFolder.Drive() != nil {
+		defer startProgress(ctxt, "put", files + replaced, bytes)()
+	}
 	for i := 0; i < lastArg; i++ {
 		if err := process(args[i], destFolder); err != nil {
 			failures = append(failures, err)
@@ -415,20 +732,107 @@ func commandMv(args []string, ctxt *context) error {
 	return nil
 }
 
-func commandFind(args []string, ctxt *context) error {
-	curr := ctxt.pwd
-	// Search is case-insensitive.
-	findString := strings.ToLower(args[0])
-	results := curr.Find(findString)
-	sort.Slice(results, func(i int, j int) bool {
-		return results[i].Path() < results[j].Path()
-	})
-	for _, r := range results {
-		fmt.Println(r.Path())
+// Parse the flags of a command, returning the remaining arguments.
+// At least `min` arguments must remain.
+func parseFlags(flags *flag.FlagSet, args []string, min int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() < min {
+		return nil, fmt.Errorf("too few arguments")
+	}
+	return flags.Args(), nil
+}
+
+// Limit the transfers of a command to `rate`, such as 5MB/s, in place of
+// the limit of all transfers from the settings, until the function returned
+// is called. The limits of drives still apply.
+func limitTransfers(ctxt *context, rate string) (func(), error) {
+	if rate == "" {
+		return func() {}, nil
+	}
+	bytes, err := util.ParseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	limiter := ctxt.root.Limiter()
+	previous := limiter.Rate()
+	limiter.SetRate(bytes)
+	return func() {
+		limiter.SetRate(previous)
+	}, nil
+}
+
+func commandCp(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("cp", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "copy folders recursively")
+	args, err := parseFlags(flags, args, 2)
+	if err != nil {
+		return fmt.Errorf("cp: %w", err)
+	}
+	srcPaths, err := virtualfs.ExpandPaths(ctxt.pwd, args[:len(args) - 1])
+	if err != nil {
+		return fmt.Errorf("cp: %w", err)
+	}
+	tgtPath := args[len(args) - 1]
+	// Copy under the source's own name when `tgtName` is empty.
+	copyTo := func(srcPath string, tgtParent virtualfs.VirtualFS, tgtName string) error {
+		srcObj, err := virtualfs.NavigatePath(ctxt.pwd, srcPath)
+		if err != nil {
+			return err
+		}
+		if tgtName == "" {
+			tgtName = srcObj.Name()
+		}
+		if srcObj.IsDir() && !*recursive {
+			return fmt.Errorf("%s is a folder (use -r)", srcObj.Path())
+		}
+		newObj, err := virtualfs.Copy(srcObj, tgtParent, tgtName)
+		if err != nil {
+			return err
+		}
+		log("cp", fmt.Sprintf("%s -> %s", srcObj.Path(), newObj.Path()))
+		return nil
+	}
+	// Check destination path.
+	tgtObj, err := virtualfs.CheckPath(ctxt.pwd, tgtPath)
+	if err != nil {
+		return fmt.Errorf("cp: %w", err)
+	}
+
+	// Target exists, and it's a directory.
+	if tgtObj != nil && tgtObj.IsDir() {
+		if err := checkCopies(ctxt, srcPaths, tgtObj); err != nil {
+			return fmt.Errorf("cp: %w", err)
+		}
+		// Copy every source to the target.
+		for _, srcPath := range srcPaths {
+			if err := copyTo(srcPath, tgtObj, ""); err != nil {
+				return fmt.Errorf("cp: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Target name doesn't exist. So we're copying a single source under a new name.
+	if len(srcPaths) > 1 {
+		return fmt.Errorf("cp: cannot copy multiple files to a single name")
+	}
+	tgtParent, tgtName, err := virtualfs.NavigateParent(ctxt.pwd, tgtPath)
+	if err != nil {
+		return fmt.Errorf("cp: %w", err)
+	}
+	if err := checkCopies(ctxt, srcPaths, tgtParent); err != nil {
+		return fmt.Errorf("cp: %w", err)
+	}
+	if err := copyTo(srcPaths[0], tgtParent, tgtName); err != nil {
+		return fmt.Errorf("cp: %w", err)
 	}
 	return nil
 }
 
+
 func commandScript(args []string, ctxt *context) error {
 	available := make([]string, 0)
 	scriptsFolder, err := util.ScriptsFolder()
@@ -481,7 +885,7 @@ func commandTrash(args []string, ctxt *context) error {
 	if srcDrive == nil {
 		return fmt.Errorf("trash: source path is /")
 	}
-	tgtPath := srcDrive.Name() + "/trash"
+	tgtPath := "/" + srcDrive.Name() + "/trash"
 	// Check destination path.
 	tgtObj, err := virtualfs.CheckPath(ctxt.pwd, tgtPath)
 	if err != nil {
@@ -504,3 +908,103 @@ func commandTrash(args []string, ctxt *context) error {
 	}
 	return nil
 }
+
+func commandRm(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "delete folders recursively")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("rm: %w", err)
+	}
+	srcPaths, err := virtualfs.ExpandPaths(ctxt.pwd, args)
+	if err != nil {
+		return fmt.Errorf("rm: %w", err)
+	}
+	for _, srcPath := range srcPaths {
+		srcObj, err := virtualfs.NavigatePath(ctxt.pwd, srcPath)
+		if err != nil {
+			return fmt.Errorf("rm: %w", err)
+		}
+		if srcObj.IsDir() && !*recursive {
+			return fmt.Errorf("rm: %s is a folder (use -r)", srcObj.Path())
+		}
+		path := srcObj.Path()
+		if err := virtualfs.Delete(srcObj); err != nil {
+			return fmt.Errorf("rm: %w", err)
+		}
+		log("rm", fmt.Sprintf("removed %s", path))
+	}
+	return nil
+}
+
+func commandMigrate(args []string, ctxt *context) error {
+	driveObj, err := virtualfs.NavigateDirectory(ctxt.root.AsVirtualFS(), "/" + args[0])
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	drive := driveObj.AsDrive()
+	if drive == nil {
+		return fmt.Errorf("migrate: %s is not a drive", args[0])
+	}
+	migrator, ok := drive.Storage().(storage.Migrator)
+	if !ok {
+		return fmt.Errorf("migrate: nothing to migrate for %s", drive.Storage().Name())
+	}
+	count, err := migrator.Migrate()
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	log("migrate", fmt.Sprintf("objects moved: %d", count))
+	return nil
+}
+
+func commandRepair(args []string, ctxt *context) error {
+	curr := ctxt.pwd
+	if len(args) > 0 {
+		newCurr, err := virtualfs.NavigatePath(ctxt.pwd, args[0])
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		curr = newCurr
+	}
+	checked := 0
+	repaired := 0
+	failures := make([]error, 0)
+	err := virtualfs.Walk(curr, func(obj virtualfs.VirtualFS) error {
+		file := obj.AsFile()
+		if file == nil {
+			return nil
+		}
+		replicated, ok := obj.Drive().Storage().(storage.Replicated)
+		if !ok {
+			return nil
+		}
+		checked++
+		metadata, count, err := replicated.Repair(file.UUID(), file.Metadata(), file.Hash())
+		if metadata != file.Metadata() {
+			if err := virtualfs.UpdateMetadata(obj, metadata); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", obj.Path(), err))
+			log("repair", fmt.Sprintf("FAILED %s - %s", obj.Path(), err))
+			return nil
+		}
+		if count > 0 {
+			repaired++
+			log("repair", fmt.Sprintf("%s: %d replica(s) restored", obj.Path(), count))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("repair: %w", err)
+	}
+	log("repair", fmt.Sprintf("files checked: %d", checked))
+	log("repair", fmt.Sprintf("files repaired: %d", repaired))
+	if len(failures) > 0 {
+		log("repair", fmt.Sprintf("failures: %d", len(failures)))
+		return fmt.Errorf("repair: %d file(s) could not be repaired", len(failures))
+	}
+	return nil
+}
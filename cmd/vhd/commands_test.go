@@ -0,0 +1,506 @@
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func newTestContext(t *testing.T, drives ...string) (*context, *vhdtest.Env) {
+	t.Helper()
+	env := vhdtest.New(t, drives...)
+	ctxt := &context{
+		initializeCommands(),
+		env.Root,
+		env.Root.AsVirtualFS(),
+		false,
+	}
+	return ctxt, env
+}
+
+// Run a command, returning whatever it printed to stdout.
+func run(t *testing.T, ctxt *context, comm string, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	cmdErr := processCommand(ctxt, comm, args)
+	w.Close()
+	os.Stdout = stdout
+	return <-done, cmdErr
+}
+
+func mustRun(t *testing.T, ctxt *context, comm string, args ...string) string {
+	t.Helper()
+	output, err := run(t, ctxt, comm, args...)
+	if err != nil {
+		t.Fatalf("%s %v: %v", comm, args, err)
+	}
+	return output
+}
+
+// Create a local file tree from a map of relative paths to contents.
+func localTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("os.MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+	}
+	return dir
+}
+
+// Change to a fresh temporary directory for the duration of the test.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("os.Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("os.Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func navigate(t *testing.T, ctxt *context, path string) virtualfs.VirtualFS {
+	t.Helper()
+	obj, err := virtualfs.NavigatePath(ctxt.root.AsVirtualFS(), path)
+	if err != nil {
+		t.Fatalf("NavigatePath(%s): %v", path, err)
+	}
+	return obj
+}
+
+func TestPutAndGet(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{
+		"project/a.txt": "content a",
+		"project/sub/b.txt": "content b",
+		"project/.hidden": "hidden",
+	})
+	mustRun(t, ctxt, "cd", "/alpha")
+	mustRun(t, ctxt, "put", filepath.Join(src, "project"))
+
+	a := navigate(t, ctxt, "/alpha/project/a.txt").AsFile()
+	if got := env.Memory["alpha"].Object(a.UUID()); string(got) != "content a" {
+		t.Errorf("stored content = %q", got)
+	}
+	navigate(t, ctxt, "/alpha/project/sub/b.txt")
+	if obj, _ := virtualfs.CheckPath(ctxt.root.AsVirtualFS(), "/alpha/project/.hidden"); obj != nil {
+		t.Errorf("hidden file was uploaded")
+	}
+
+	dir := chdirTemp(t)
+	mustRun(t, ctxt, "get", "project/sub/b.txt")
+	got, err := os.ReadFile(filepath.Join(dir, "b.txt"))
+	if err != nil || string(got) != "content b" {
+		t.Errorf("downloaded %q, %v", got, err)
+	}
+}
+
+func TestTransferLimit(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "a"})
+	ctxt.root.Limiter().SetRate(1 << 20)
+	mustRun(t, ctxt, "put", "-limit", "5MB/s", filepath.Join(src, "a.txt"), "/alpha")
+	navigate(t, ctxt, "/alpha/a.txt")
+	// The limit of the settings is back after the command.
+	if rate := ctxt.root.Limiter().Rate(); rate != 1 << 20 {
+		t.Errorf("rate after put = %d", rate)
+	}
+	if _, err := run(t, ctxt, "get", "-limit", "fast", "/alpha/a.txt"); err == nil {
+		t.Errorf("get with an invalid limit should fail")
+	}
+}
+
+func TestPutIntoFolder(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	mustRun(t, ctxt, "mkdir", "/alpha/docs")
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"), "/alpha/docs")
+	navigate(t, ctxt, "/alpha/docs/a.txt")
+	navigate(t, ctxt, "/alpha/docs/b.txt")
+
+	// Existing names are reported as failures and left alone.
+	output := mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha/docs")
+	if !strings.Contains(output, "failures: 1") {
+		t.Errorf("put of an existing name did not report a failure:\n%s", output)
+	}
+}
+
+func TestPutUploadFailure(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "a"})
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1})
+	output := mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	if !strings.Contains(output, "failures: 1") {
+		t.Errorf("upload failure not reported:\n%s", output)
+	}
+	if obj, _ := virtualfs.CheckPath(ctxt.root.AsVirtualFS(), "/alpha/a.txt"); obj != nil {
+		t.Errorf("file added to catalog despite failed upload")
+	}
+}
+
+func TestGetFailures(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	dir := chdirTemp(t)
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{DownloadFailureRate: 1})
+	if _, err := run(t, ctxt, "get", "/alpha/a.txt"); err == nil {
+		t.Errorf("get should fail when the download fails")
+	}
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{CorruptionRate: 1})
+	mustRun(t, ctxt, "get", "/alpha/a.txt")
+	got, _ := os.ReadFile(filepath.Join(dir, "a.txt"))
+	if string(got) == "content a" {
+		t.Errorf("expected corrupted content")
+	}
+
+	if _, err := run(t, ctxt, "get", "/alpha/missing.txt"); err == nil {
+		t.Errorf("get of a missing file should fail")
+	}
+}
+
+func TestMv(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+	mustRun(t, ctxt, "cd", "/alpha")
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"), filepath.Join(src, "c.txt"))
+	mustRun(t, ctxt, "mkdir", "docs")
+
+	// Rename.
+	mustRun(t, ctxt, "mv", "a.txt", "renamed.txt")
+	navigate(t, ctxt, "/alpha/renamed.txt")
+
+	// Move several files into a folder.
+	mustRun(t, ctxt, "mv", "b.txt", "c.txt", "docs")
+	navigate(t, ctxt, "/alpha/docs/b.txt")
+	navigate(t, ctxt, "/alpha/docs/c.txt")
+
+	// Glob.
+	mustRun(t, ctxt, "mv", "docs/*.txt", ".")
+	navigate(t, ctxt, "/alpha/b.txt")
+	navigate(t, ctxt, "/alpha/c.txt")
+
+	if _, err := run(t, ctxt, "mv", "b.txt", "c.txt", "new.txt"); err == nil {
+		t.Errorf("renaming several files at once should fail")
+	}
+}
+
+func TestMvAcrossDrives(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"project/a.txt": "content a", "project/sub/b.txt": "content b"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "project"), "/alpha")
+	oldA := navigate(t, ctxt, "/alpha/project/a.txt").AsFile()
+
+	mustRun(t, ctxt, "mv", "/alpha/project", "/beta")
+	if obj, _ := virtualfs.CheckPath(ctxt.root.AsVirtualFS(), "/alpha/project"); obj != nil {
+		t.Errorf("source still in catalog after move")
+	}
+	if env.Memory["alpha"].Object(oldA.UUID()) != nil {
+		t.Errorf("source object not deleted after move")
+	}
+	a := navigate(t, ctxt, "/beta/project/a.txt").AsFile()
+	if got := env.Memory["beta"].Object(a.UUID()); string(got) != "content a" {
+		t.Errorf("moved content = %q", got)
+	}
+	b := navigate(t, ctxt, "/beta/project/sub/b.txt").AsFile()
+	if got := env.Memory["beta"].Object(b.UUID()); string(got) != "content b" {
+		t.Errorf("moved content = %q", got)
+	}
+	if !a.Created().Equal(oldA.Created()) {
+		t.Errorf("creation time not preserved")
+	}
+
+	// A failed copy leaves the source alone and nothing at the target.
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1})
+	if _, err := run(t, ctxt, "mv", "/beta/project", "/alpha"); err == nil {
+		t.Fatalf("move with failing uploads should fail")
+	}
+	navigate(t, ctxt, "/beta/project/sub/b.txt")
+	if obj, _ := virtualfs.CheckPath(ctxt.root.AsVirtualFS(), "/alpha/project"); obj != nil {
+		t.Errorf("partial copy left at target")
+	}
+}
+
+func TestCp(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"a.txt": "content a"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	mustRun(t, ctxt, "mkdir", "/alpha/docs")
+
+	mustRun(t, ctxt, "cp", "/alpha/a.txt", "/beta/copy.txt")
+	a := navigate(t, ctxt, "/alpha/a.txt").AsFile()
+	c := navigate(t, ctxt, "/beta/copy.txt").AsFile()
+	if a.UUID() == c.UUID() {
+		t.Errorf("copy shares the UUID of the original")
+	}
+	if got := env.Memory["beta"].Object(c.UUID()); string(got) != "content a" {
+		t.Errorf("copied content = %q", got)
+	}
+
+	mustRun(t, ctxt, "cp", "/alpha/a.txt", "/alpha/docs")
+	if _, err := run(t, ctxt, "cp", "/alpha/docs", "/beta"); err == nil {
+		t.Errorf("copying a folder without -r should fail")
+	}
+	mustRun(t, ctxt, "cp", "-r", "/alpha/docs", "/beta")
+	navigate(t, ctxt, "/beta/docs/a.txt")
+	if _, err := run(t, ctxt, "cp", "-r", "/alpha/docs", "/alpha/docs/sub"); err == nil {
+		t.Errorf("copying a folder into itself should fail")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "a"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	mustRun(t, ctxt, "mkdir", "/alpha/trash")
+	mustRun(t, ctxt, "mkdir", "/alpha/old")
+
+	mustRun(t, ctxt, "trash", "/alpha/a.txt")
+	navigate(t, ctxt, "/alpha/trash/a.txt")
+	mustRun(t, ctxt, "cd", "/alpha")
+	mustRun(t, ctxt, "trash", "old")
+	navigate(t, ctxt, "/alpha/trash/old/")
+
+	if _, err := run(t, ctxt, "trash", "missing"); err == nil {
+		t.Errorf("trash of a missing entry should fail")
+	}
+}
+
+func TestFind(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"Report.pdf": "r", "notes.txt": "n"})
+	mustRun(t, ctxt, "mkdir", "/alpha/reports")
+	mustRun(t, ctxt, "put", filepath.Join(src, "Report.pdf"), "/alpha/reports")
+	mustRun(t, ctxt, "put", filepath.Join(src, "notes.txt"), "/beta")
+
+	output := mustRun(t, ctxt, "find", "REPORT")
+	want := "/alpha/reports/\n/alpha/reports/Report.pdf\n"
+	if output != want {
+		t.Errorf("find output = %q, want %q", output, want)
+	}
+	mustRun(t, ctxt, "cd", "/beta")
+	output = mustRun(t, ctxt, "find", "report")
+	if output != "" {
+		t.Errorf("find in /beta = %q, want nothing", output)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ctxt, env := newTestContext(t)
+	a := storage.NewMemory("a")
+	b := storage.NewMemory("b")
+	env.AddDrive(t, "mirrored", storage.NewMirror([]string{"a", "b"}, []storage.Storage{a, b}))
+	ctxt.root = env.Root
+	ctxt.pwd = env.Root.AsVirtualFS()
+
+	src := localTree(t, map[string]string{"a.txt": "content a", "b.txt": "content b"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"), "/mirrored")
+	fileA := navigate(t, ctxt, "/mirrored/a.txt").AsFile()
+	b.Drop(fileA.UUID())
+
+	output := mustRun(t, ctxt, "info", "/mirrored/a.txt")
+	if !strings.Contains(output, b.Name() + "  lost") {
+		t.Errorf("info does not report the lost replica:\n%s", output)
+	}
+	output = mustRun(t, ctxt, "repair", "/mirrored")
+	if !strings.Contains(output, "files repaired: 1") {
+		t.Errorf("unexpected repair output:\n%s", output)
+	}
+	if got := b.Object(fileA.UUID()); string(got) != "content a" {
+		t.Errorf("replica content = %q", got)
+	}
+
+	// Without a healthy replica, repair fails.
+	a.Drop(fileA.UUID())
+	b.Drop(fileA.UUID())
+	if _, err := run(t, ctxt, "repair", "/mirrored"); err == nil {
+		t.Errorf("repair without a healthy replica should fail")
+	}
+}
+
+func TestCpWithinDrive(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	mustRun(t, ctxt, "cp", "/alpha/a.txt", "/alpha/b.txt")
+	mustRun(t, ctxt, "cp", "/alpha/a.txt", "/alpha/c.txt")
+	a := navigate(t, ctxt, "/alpha/a.txt").AsFile()
+	shared := a.UUID()
+	if b := navigate(t, ctxt, "/alpha/b.txt").AsFile(); b.UUID() != shared {
+		t.Errorf("copy within a drive does not share the storage object")
+	}
+
+	// Removing one copy keeps the shared object.
+	mustRun(t, ctxt, "rm", "/alpha/a.txt")
+	if env.Memory["alpha"].Object(shared) == nil {
+		t.Fatalf("shared object deleted while still referenced")
+	}
+
+	// Updating a copy gives it its own object.
+	update := localTree(t, map[string]string{"b.txt": "new content"})
+	mustRun(t, ctxt, "put", "-f", filepath.Join(update, "b.txt"), "/alpha")
+	b := navigate(t, ctxt, "/alpha/b.txt").AsFile()
+	if b.UUID() == shared {
+		t.Fatalf("updated copy still refers to the shared object")
+	}
+	if got := env.Memory["alpha"].Object(b.UUID()); string(got) != "new content" {
+		t.Errorf("updated content = %q", got)
+	}
+	if got := env.Memory["alpha"].Object(shared); string(got) != "content a" {
+		t.Errorf("other copy content = %q", got)
+	}
+
+	// Removing the last reference deletes the object.
+	mustRun(t, ctxt, "rm", "/alpha/c.txt")
+	if env.Memory["alpha"].Object(shared) != nil {
+		t.Errorf("object not deleted with its last reference")
+	}
+}
+
+func TestRm(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"docs/a.txt": "a", "docs/sub/b.txt": "b"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "docs"), "/alpha")
+	b := navigate(t, ctxt, "/alpha/docs/sub/b.txt").AsFile()
+
+	if _, err := run(t, ctxt, "rm", "/alpha/docs"); err == nil {
+		t.Errorf("rm of a folder without -r should fail")
+	}
+	mustRun(t, ctxt, "rm", "-r", "/alpha/docs")
+	if obj, _ := virtualfs.CheckPath(ctxt.root.AsVirtualFS(), "/alpha/docs"); obj != nil {
+		t.Errorf("folder still in catalog")
+	}
+	if env.Memory["alpha"].Object(b.UUID()) != nil {
+		t.Errorf("object of removed file not deleted")
+	}
+	// The catalog agrees.
+	env.Reload(t)
+	if obj, _ := virtualfs.CheckPath(env.Root.AsVirtualFS(), "/alpha/docs"); obj != nil {
+		t.Errorf("folder still in reloaded catalog")
+	}
+}
+
+func TestGetRecursive(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"project/a.txt": "content a", "project/sub/b.txt": "content b"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "project"), "/alpha")
+
+	if _, err := run(t, ctxt, "get", "/alpha/project", t.TempDir()); err == nil {
+		t.Errorf("get of a folder without -r should fail")
+	}
+	dest := t.TempDir()
+	mustRun(t, ctxt, "get", "-r", "/alpha/project", dest)
+	got, err := os.ReadFile(filepath.Join(dest, "project", "sub", "b.txt"))
+	if err != nil || string(got) != "content b" {
+		t.Errorf("downloaded %q, %v", got, err)
+	}
+	b := navigate(t, ctxt, "/alpha/project/sub/b.txt").AsFile()
+	info, err := os.Stat(filepath.Join(dest, "project", "sub", "b.txt"))
+	if err != nil || !info.ModTime().Equal(b.Updated()) {
+		t.Errorf("modification time not restored: %v", err)
+	}
+
+	// Explicit destination name.
+	mustRun(t, ctxt, "get", "-r", "-o", filepath.Join(dest, "copy"), "/alpha/project")
+	if _, err := os.Stat(filepath.Join(dest, "copy", "a.txt")); err != nil {
+		t.Errorf("get -o: %v", err)
+	}
+}
+
+func TestGetExisting(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "remote"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/alpha")
+	dest := localTree(t, map[string]string{"a.txt": "local"})
+	local := filepath.Join(dest, "a.txt")
+
+	mustRun(t, ctxt, "get", "-existing", "skip", "/alpha/a.txt", dest)
+	if got, _ := os.ReadFile(local); string(got) != "local" {
+		t.Errorf("skip: local file = %q", got)
+	}
+	mustRun(t, ctxt, "get", "-existing", "rename", "/alpha/a.txt", dest)
+	if got, _ := os.ReadFile(filepath.Join(dest, "a (1).txt")); string(got) != "remote" {
+		t.Errorf("rename: renamed file = %q", got)
+	}
+	mustRun(t, ctxt, "get", "/alpha/a.txt", dest)
+	if got, _ := os.ReadFile(local); string(got) != "remote" {
+		t.Errorf("overwrite: local file = %q", got)
+	}
+	if _, err := run(t, ctxt, "get", "-existing", "merge", "/alpha/a.txt", dest); err == nil {
+		t.Errorf("unknown policy should fail")
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	other := &context{initializeCommands(), env.Reload(t), nil, false}
+	other.pwd = other.root.AsVirtualFS()
+	src := localTree(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	mustRun(t, ctxt, "mkdir", "/alpha/docs")
+	mustRun(t, ctxt, "cd", "/alpha/docs")
+	mustRun(t, other, "ls", "/alpha")
+
+	// Each session sees the changes of the other before running a command.
+	mustRun(t, other, "mv", "/alpha/docs", "/alpha/papers")
+	output := mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"))
+	if !strings.Contains(output, "no longer exists") {
+		t.Errorf("put output = %q", output)
+	}
+	if ctxt.pwd.Path() != "/alpha/" {
+		t.Errorf("working folder = %s", ctxt.pwd.Path())
+	}
+	navigate(t, ctxt, "/alpha/a.txt")
+	if _, err := run(t, ctxt, "put", filepath.Join(src, "b.txt"), "/alpha/docs"); err == nil {
+		t.Errorf("put to moved folder should fail")
+	}
+	mustRun(t, ctxt, "put", filepath.Join(src, "b.txt"), "/alpha/papers")
+	mustRun(t, other, "cd", "/alpha/papers")
+	if output := mustRun(t, other, "ls"); !strings.Contains(output, "b.txt") {
+		t.Errorf("ls = %q", output)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctxt, env := newTestContext(t)
+	env.AddDrive(t, "local", storage.NewMetered(storage.NewLocalFileSystem(t.TempDir()), nil))
+	env.AddDrive(t, "memory", storage.NewMetered(storage.NewMemory("memory"), nil))
+	ctxt.root = env.Root
+	ctxt.pwd = env.Root.AsVirtualFS()
+
+	if output := mustRun(t, ctxt, "migrate", "local"); !strings.Contains(output, "objects moved: 0") {
+		t.Errorf("migrate local = %q", output)
+	}
+	if _, err := run(t, ctxt, "migrate", "memory"); err == nil || !strings.Contains(err.Error(), "nothing to migrate") {
+		t.Errorf("migrate of storage without layouts: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Differences between a local folder and a remote folder, file by file.
+// Files are matched by relative path as for sync, and compared using the
+// size and hash recorded in the catalog: nothing is downloaded.
+
+const (
+	DIFF_LOCAL = "local only"
+	DIFF_REMOTE = "remote only"
+	DIFF_CHANGED = "differs"
+	DIFF_UNKNOWN = "unknown"      // Same size, but no stored hash.
+)
+
+type difference struct {
+	kind string
+	rel string
+}
+
+func diffFolders(local string, remote virtualfs.VirtualFS) ([]difference, error) {
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+	localFiles, _, err := scanLocal(local)
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, _, err := scanRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	state := loadSyncState(local, remote.Path())
+	all := make(map[string]bool)
+	for rel := range localFiles {
+		all[rel] = true
+	}
+	for rel := range remoteFiles {
+		all[rel] = true
+	}
+	result := make([]difference, 0)
+	for _, rel := range sortedKeys(all) {
+		info, isLocal := localFiles[rel]
+		fileObj, isRemote := remoteFiles[rel]
+		if !isRemote {
+			result = append(result, difference{DIFF_LOCAL, rel})
+			continue
+		}
+		if !isLocal {
+			result = append(result, difference{DIFF_REMOTE, rel})
+			continue
+		}
+		if entry, found := state.Files[rel]; found && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() && entry.UUID == fileObj.AsFile().UUID() {
+			continue
+		}
+		same, known, err := compareContent(filepath.Join(local, filepath.FromSlash(rel)), info, fileObj)
+		if err != nil {
+			return nil, err
+		}
+		if !known {
+			result = append(result, difference{DIFF_UNKNOWN, rel})
+		} else if !same {
+			result = append(result, difference{DIFF_CHANGED, rel})
+		}
+	}
+	return result, nil
+}
+
+func commandDiff(args []string, ctxt *context) error {
+	if isDir, err := isDirectory(args[0]); err != nil || !isDir {
+		return fmt.Errorf("diff: %s is not a local folder", args[0])
+	}
+	remote, err := virtualfs.NavigateDirectory(ctxt.pwd, args[1])
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	differences, err := diffFolders(args[0], remote)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	for _, d := range differences {
+		fmt.Printf(" %-12s %s\n", d.kind, d.rel)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+)
+
+func TestDiff(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"same.txt": "same", "changed.txt": "old", "remote.txt": "r", "sub/legacy.txt": "legacy"})
+	mustRun(t, ctxt, "mkdir", "/alpha/project")
+	mustRun(t, ctxt, "sync", src, "/alpha/project")
+
+	os.WriteFile(filepath.Join(src, "changed.txt"), []byte("new"), 0600)
+	os.Remove(filepath.Join(src, "remote.txt"))
+	os.WriteFile(filepath.Join(src, "local.txt"), []byte("l"), 0600)
+	// A file uploaded before hashes were recorded.
+	legacy := navigate(t, ctxt, "/alpha/project/sub/legacy.txt")
+	env.Catalog.UpdateFileContent(legacy.CatalogId(), legacy.AsFile().UUID(), legacy.AsFile().Updated(), "", -1, "")
+	ctxt.root = env.Reload(t)
+	ctxt.pwd = ctxt.root.AsVirtualFS()
+	os.WriteFile(filepath.Join(src, "sub", "legacy.txt"), []byte("legacy"), 0600)
+
+	// Nothing is downloaded.
+	env.Faulty["alpha"].SetFaults(storage.Faults{DownloadFailureRate: 1})
+	output := mustRun(t, ctxt, "diff", src, "/alpha/project")
+	want := " differs      changed.txt\n" +
+		" local only   local.txt\n" +
+		" remote only  remote.txt\n" +
+		" unknown      sub/legacy.txt\n"
+	if output != want {
+		t.Errorf("diff output = %q, want %q", output, want)
+	}
+}
@@ -0,0 +1,359 @@
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Space used by folders and drives, from the sizes recorded in the catalog
+// without reading the storage. Logical bytes add up the sizes of files.
+// Stored bytes count every storage object once, since copies within a
+// drive share their object, at the size the storage keeps it: with every
+// copy on a mirror drive, and with parity on an erasure drive.
+
+type usage struct {
+	files int
+	folders int
+	unknown int          // Files of unknown size, counted in neither total.
+	logical int64
+	stored int64
+	objects int
+}
+
+func (u *usage) add(other usage) {
+	u.files += other.files
+	u.folders += other.folders
+	u.unknown += other.unknown
+	u.logical += other.logical
+	u.stored += other.stored
+	u.objects += other.objects
+}
+
+// Usage of a folder or drive and of every folder below it, by catalog
+// identifier, read from the catalog in a single pass over the files below
+// it. The files of a folder are added to the folder, and then to the
+// folders above it as totals are summed up. A storage object shared by
+// several folders is instead added once to every folder above its files,
+// where it is not summed up again.
+type usageTree struct {
+	vfs virtualfs.VirtualFS                        // The folder or drive.
+	top int                                        // Its catalog identifier.
+	folders map[int]catalog.DirectoryDescriptor    // Below top.
+	children map[int][]int                         // Sorted by name.
+	own map[int]*usage                             // Summed up.
+	shared map[int]*usage                          // Not summed up.
+	totals map[int]usage
+}
+
+func newUsageTree(vfs virtualfs.VirtualFS) (*usageTree, error) {
+	top, folders, err := virtualfs.Subfolders(vfs)
+	if err != nil {
+		return nil, err
+	}
+	t := &usageTree{vfs, top, folders, make(map[int][]int), make(map[int]*usage), make(map[int]*usage), make(map[int]usage)}
+	t.own[top] = &usage{}
+	t.shared[top] = &usage{}
+	for id, folder := range folders {
+		t.own[id] = &usage{}
+		t.shared[id] = &usage{}
+		t.children[folder.ParentId] = append(t.children[folder.ParentId], id)
+	}
+	for _, ids := range t.children {
+		sort.Slice(ids, func(i int, j int) bool {
+			return folders[ids[i]].Name < folders[ids[j]].Name
+		})
+	}
+	return t, nil
+}
+
+// Add up the files below the folder, calling `visit` on every file of
+// known size, and compute the totals of every folder.
+func (t *usageTree) walk(visit func(catalog.FileDescriptor)) error {
+	// Files of known size holding the current object.
+	object := make([]catalog.FileDescriptor, 0)
+	addObject := func() {
+		if len(object) == 0 {
+			return
+		}
+		stored := storage.StoredSize(t.vfs.Drive().Storage(), object[0].Size, object[0].Metadata)
+		dirs := make(map[int]bool)
+		for _, file := range object {
+			dirs[file.DirectoryId] = true
+		}
+		if len(dirs) == 1 {
+			u := t.own[object[0].DirectoryId]
+			u.objects++
+			u.stored += stored
+		} else {
+			counted := make(map[int]bool)
+			for dirId := range dirs {
+				for id := dirId; !counted[id]; id = t.folders[id].ParentId {
+					counted[id] = true
+					t.shared[id].objects++
+					t.shared[id].stored += stored
+					if id == t.top {
+						break
+					}
+				}
+			}
+		}
+		object = object[:0]
+	}
+	err := virtualfs.WalkFiles(t.vfs, func(file catalog.FileDescriptor) error {
+		if len(object) > 0 && object[0].UUID != file.UUID {
+			addObject()
+		}
+		u := t.own[file.DirectoryId]
+		if u == nil {
+			// In a folder created since the folders were read.
+			return nil
+		}
+		u.files++
+		if file.Size < 0 {
+			u.unknown++
+			return nil
+		}
+		u.logical += file.Size
+		if visit != nil {
+			visit(file)
+		}
+		object = append(object, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	addObject()
+	t.sum(t.top)
+	return nil
+}
+
+// Record the totals of folder `id` and of the folders below it, and return
+// the usage summed up from its files.
+func (t *usageTree) sum(id int) usage {
+	u := *t.own[id]
+	for _, child := range t.children[id] {
+		u.add(t.sum(child))
+		u.folders++
+	}
+	total := u
+	total.add(*t.shared[id])
+	t.totals[id] = total
+	return u
+}
+
+// Path of folder `id`.
+func (t *usageTree) path(id int) string {
+	if id == t.top {
+		return t.vfs.Path()
+	}
+	folder := t.folders[id]
+	return t.path(folder.ParentId) + folder.Name + "/"
+}
+
+func (t *usageTree) total() usage {
+	return t.totals[t.top]
+}
+
+// Print the totals of folder `id` and of the folders at most `depth` levels
+// below it (if not negative), each after the folders it holds.
+func (t *usageTree) print(id int, depth int, human bool) {
+	if depth != 0 {
+		for _, child := range t.children[id] {
+			t.print(child, depth - 1, human)
+		}
+	}
+	u := t.totals[id]
+	fmt.Printf(" %12s %12s   %s\n", formatBytes(u.logical, human), formatBytes(u.stored, human), t.path(id))
+}
+
+// Usage of folder or drive `vfs` and of every folder below it.
+func usageTreeOf(vfs virtualfs.VirtualFS) (*usageTree, error) {
+	t, err := newUsageTree(vfs)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.walk(nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func formatBytes(size int64, human bool) string {
+	if human {
+		return util.FormatSize(size)
+	}
+	return fmt.Sprintf("%d", size)
+}
+
+func commandDu(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	human := flags.Bool("h", false, "sizes in KiB, MiB, GiB")
+	depth := flags.Int("d", 1, "levels of folders listed below the folder")
+	args, err := parseFlags(flags, args, 0)
+	if err != nil {
+		return fmt.Errorf("du: %w", err)
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("du: too many arguments")
+	}
+	curr := ctxt.pwd
+	if len(args) > 0 {
+		newCurr, err := virtualfs.NavigateDirectory(ctxt.pwd, args[0])
+		if err != nil {
+			return fmt.Errorf("du: %w", err)
+		}
+		curr = newCurr
+	}
+	fmt.Printf(" %12s %12s   %s\n", "logical", "stored", "folder")
+	var total usage
+	if curr.IsRoot() {
+		// Drives share no objects, so their totals add up.
+		drives := ctxt.root.Drives()
+		names := make([]string, 0, len(drives))
+		for name := range drives {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			t, err := usageTreeOf(drives[name].AsVirtualFS())
+			if err != nil {
+				return fmt.Errorf("du: %w", err)
+			}
+			if *depth != 0 {
+				t.print(t.top, *depth - 1, *human)
+			}
+			total.add(t.total())
+		}
+		fmt.Printf(" %12s %12s   %s\n", formatBytes(total.logical, *human), formatBytes(total.stored, *human), curr.Path())
+	} else {
+		t, err := usageTreeOf(curr)
+		if err != nil {
+			return fmt.Errorf("du: %w", err)
+		}
+		t.print(t.top, *depth, *human)
+		total = t.total()
+	}
+	if total.unknown > 0 {
+		fmt.Printf("%d file(s) of unknown size not counted\n", total.unknown)
+	}
+	return nil
+}
+
+// Upper bounds of the size histogram of stats.
+var histogramBounds = []int64{1 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30}
+
+const STATS_TOP = 10
+
+func commandStats(args []string, ctxt *context) error {
+	name := strings.Trim(args[0], "/")
+	drive, found := ctxt.root.Drives()[name]
+	if !found {
+		return fmt.Errorf("stats: no drive %s", name)
+	}
+	t, err := newUsageTree(drive.AsVirtualFS())
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	histogram := make([]int, len(histogramBounds) + 1)
+	type largeFile struct {
+		size int64
+		path string
+	}
+	largest := make([]largeFile, 0, STATS_TOP + 1)
+	type typeUsage struct {
+		ext string
+		files int
+		size int64
+	}
+	types := make(map[string]*typeUsage)
+	err = t.walk(func(file catalog.FileDescriptor) {
+		bucket := sort.Search(len(histogramBounds), func(i int) bool {
+			return file.Size < histogramBounds[i]
+		})
+		histogram[bucket]++
+		if len(largest) < STATS_TOP || file.Size >= largest[len(largest) - 1].size {
+			largest = append(largest, largeFile{file.Size, t.path(file.DirectoryId) + file.Name})
+			sort.Slice(largest, func(i int, j int) bool {
+				if largest[i].size != largest[j].size {
+					return largest[i].size > largest[j].size
+				}
+				return largest[i].path < largest[j].path
+			})
+			if len(largest) > STATS_TOP {
+				largest = largest[:STATS_TOP]
+			}
+		}
+		ext := strings.ToLower(path.Ext(file.Name))
+		if ext == "" {
+			ext = "(none)"
+		}
+		if types[ext] == nil {
+			types[ext] = &typeUsage{ext: ext}
+		}
+		types[ext].files++
+		types[ext].size += file.Size
+	})
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	u := t.total()
+
+	fmt.Printf("Drive:       %s\n", drive.Name())
+	fmt.Printf("Storage:     %s\n", drive.Storage().Name())
+	if u.unknown > 0 {
+		fmt.Printf("Files:       %d (%d of unknown size)\n", u.files, u.unknown)
+	} else {
+		fmt.Printf("Files:       %d\n", u.files)
+	}
+	fmt.Printf("Folders:     %d\n", u.folders)
+	fmt.Printf("Objects:     %d\n", u.objects)
+	fmt.Printf("Logical:     %s\n", util.FormatSize(u.logical))
+	if u.logical > 0 {
+		fmt.Printf("Stored:      %s (%.2fx logical)\n", util.FormatSize(u.stored), float64(u.stored) / float64(u.logical))
+	} else {
+		fmt.Printf("Stored:      %s\n", util.FormatSize(u.stored))
+	}
+
+	fmt.Printf("Sizes:\n")
+	for i, count := range histogram {
+		label := ">= " + util.FormatSize(histogramBounds[len(histogramBounds) - 1])
+		if i < len(histogramBounds) {
+			label = "< " + util.FormatSize(histogramBounds[i])
+		}
+		fmt.Printf(" %12s %8d\n", label, count)
+	}
+
+	fmt.Printf("Largest files:\n")
+	for _, file := range largest {
+		fmt.Printf(" %12s   %s\n", util.FormatSize(file.size), file.path)
+	}
+
+	byType := make([]*typeUsage, 0, len(types))
+	for _, t := range types {
+		byType = append(byType, t)
+	}
+	sort.Slice(byType, func(i int, j int) bool {
+		if byType[i].size != byType[j].size {
+			return byType[i].size > byType[j].size
+		}
+		return byType[i].ext < byType[j].ext
+	})
+	if len(byType) > STATS_TOP {
+		byType = byType[:STATS_TOP]
+	}
+	fmt.Printf("Types:\n")
+	for _, t := range byType {
+		fmt.Printf(" %12s %8d   %s\n", util.FormatSize(t.size), t.files, t.ext)
+	}
+	return nil
+}
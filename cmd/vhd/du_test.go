@@ -0,0 +1,52 @@
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDu(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{
+		"media/movie.mov": strings.Repeat("x", 3000),
+		"media/clips/clip.mov": strings.Repeat("c", 500),
+		"docs/notes.txt": "notes",
+	})
+	mustRun(t, ctxt, "put", filepath.Join(src, "media"), filepath.Join(src, "docs"), "/alpha")
+	// Copies within a drive share their storage object.
+	mustRun(t, ctxt, "cp", "/alpha/media/movie.mov", "/alpha/docs/movie-copy.mov")
+
+	want := "      logical       stored   folder\n" +
+		"         3005         3005   /alpha/docs/\n" +
+		"         3500         3500   /alpha/media/\n" +
+		"         6505         3505   /alpha/\n"
+	if output := mustRun(t, ctxt, "du", "/alpha"); output != want {
+		t.Errorf("du = %q, want %q", output, want)
+	}
+	output := mustRun(t, ctxt, "du", "-h", "-d", "3", "/")
+	for _, line := range []string{"      500 B        500 B   /alpha/media/clips/\n", "      6.4 KiB      3.4 KiB   /alpha/\n", "          0 B          0 B   /beta/\n"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("du -h -d 3 / = %q, missing %q", output, line)
+		}
+	}
+	if !strings.Contains(output, "/alpha/docs/\n        500 B        500 B   /alpha/media/clips/\n") || !strings.HasSuffix(output, "   /\n") {
+		t.Errorf("du -h -d 3 / = %q, subfolders should come first", output)
+	}
+
+	output = mustRun(t, ctxt, "stats", "alpha")
+	for _, line := range []string{
+		"Files:       4\n", "Folders:     3\n", "Objects:     3\n", "Stored:      3.4 KiB (0.54x logical)\n",
+		"    < 1.0 KiB        2\n    < 1.0 MiB        2\n",
+		"Largest files:\n      2.9 KiB   /alpha/docs/movie-copy.mov\n      2.9 KiB   /alpha/media/movie.mov\n        500 B   /alpha/media/clips/clip.mov\n",
+		"Types:\n      6.3 KiB        3   .mov\n          5 B        1   .txt\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("stats = %q, missing %q", output, line)
+		}
+	}
+	if _, err := run(t, ctxt, "stats", "gamma"); err == nil {
+		t.Errorf("stats of a missing drive should fail")
+	}
+}
@@ -0,0 +1,380 @@
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/vhdlink"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+	"rpucella.net/virtual-hard-drive/pkg/vhd"
+)
+
+// Find folders and files matching every condition given on the command
+// line. Conditions on sizes, times, UUIDs and metadata only match files.
+// Tags and attributes are looked up in the catalog beforehand.
+
+const (
+	FIND_FORMAT_PATH = "path"
+	FIND_FORMAT_LONG = "long"
+	FIND_FORMAT_JSON = "json"
+)
+
+type findFilter func(virtualfs.VirtualFS) bool
+
+func commandFind(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	in := flags.String("in", "", "folder to search instead of the current folder")
+	name := flags.String("name", "", "glob on names")
+	pathGlob := flags.String("path", "", "glob on full paths")
+	regex := flags.String("regex", "", "regular expression on names")
+	pathRegex := flags.String("path-regex", "", "regular expression on full paths")
+	ignoreCase := flags.Bool("i", false, "ignore case in names and paths")
+	kind := flags.String("type", "", "f for files, d for folders")
+	size := flags.String("size", "", "+<size>, -<size>, or <size>..<size>")
+	created := flags.String("created", "", "range of creation dates")
+	updated := flags.String("updated", "", "range of update dates")
+	uuid := flags.String("uuid", "", "prefix of the UUID of the storage object")
+	metadata := flags.String("metadata", "", "text in the storage metadata")
+	tag := flags.String("tag", "", "tag of the folder/file")
+	attr := flags.String("attr", "", "<name> or <name>=<value>, attribute of the folder/file")
+	maxDepth := flags.Int("maxdepth", -1, "levels below the searched folder")
+	format := flags.String("format", FIND_FORMAT_PATH, "path, long or json")
+	args, err := parseFlags(flags, args, 0)
+	if err != nil {
+		return fmt.Errorf("find: %w", err)
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("find: too many arguments")
+	}
+	if *format != FIND_FORMAT_PATH && *format != FIND_FORMAT_LONG && *format != FIND_FORMAT_JSON {
+		return fmt.Errorf("find: unknown format %s", *format)
+	}
+	filters := make([]findFilter, 0)
+	if len(args) > 0 {
+		// Search is case-insensitive.
+		text := strings.ToLower(args[0])
+		filters = append(filters, func(obj virtualfs.VirtualFS) bool {
+			return strings.Contains(strings.ToLower(obj.Name()), text)
+		})
+	}
+	patterns := []struct{
+		pattern string
+		glob bool
+		onPath bool
+	}{
+		{*name, true, false}, {*pathGlob, true, true}, {*regex, false, false}, {*pathRegex, false, true},
+	}
+	for _, p := range patterns {
+		if p.pattern == "" {
+			continue
+		}
+		filter, err := matchFilter(p.pattern, p.glob, p.onPath, *ignoreCase)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		filters = append(filters, filter)
+	}
+	switch *kind {
+	case "":
+	case "f":
+		filters = append(filters, func(obj virtualfs.VirtualFS) bool { return obj.IsFile() })
+	case "d":
+		filters = append(filters, func(obj virtualfs.VirtualFS) bool { return obj.IsDir() })
+	default:
+		return fmt.Errorf("find: unknown type %s", *kind)
+	}
+	if *size != "" {
+		min, max, err := parseSizeRange(*size)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		filters = append(filters, fileFilter(func(file virtualfs.File) bool {
+			return file.Size() >= 0 && file.Size() >= min && (max < 0 || file.Size() <= max)
+		}))
+	}
+	for _, r := range []struct{
+		spec string
+		get func(virtualfs.File) time.Time
+	}{
+		{*created, virtualfs.File.Created}, {*updated, virtualfs.File.Updated},
+	} {
+		if r.spec == "" {
+			continue
+		}
+		from, to, err := parseTimeRange(r.spec)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		get := r.get
+		filters = append(filters, fileFilter(func(file virtualfs.File) bool {
+			t := get(file)
+			return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+		}))
+	}
+	if *uuid != "" {
+		prefix := strings.ToLower(*uuid)
+		filters = append(filters, fileFilter(func(file virtualfs.File) bool {
+			return strings.HasPrefix(strings.ToLower(file.UUID()), prefix)
+		}))
+	}
+	if *metadata != "" {
+		filters = append(filters, fileFilter(func(file virtualfs.File) bool {
+			return strings.Contains(file.Metadata(), *metadata)
+		}))
+	}
+	if *tag != "" {
+		refs, err := ctxt.root.Catalog().FindTagged(*tag)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		filters = append(filters, refFilter(refs))
+	}
+	if *attr != "" {
+		nameValue := strings.SplitN(*attr, "=", 2)
+		value := ""
+		if len(nameValue) > 1 {
+			value = nameValue[1]
+		}
+		refs, err := ctxt.root.Catalog().FindAttribute(nameValue[0], value)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		filters = append(filters, refFilter(refs))
+	}
+
+	curr := ctxt.pwd
+	if *in != "" {
+		newCurr, err := virtualfs.NavigateDirectory(ctxt.pwd, *in)
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		curr = newCurr
+	}
+	results, err := findEntries(curr, filters, *maxDepth)
+	if err != nil {
+		return fmt.Errorf("find: %w", err)
+	}
+	sort.Slice(results, func(i int, j int) bool {
+		return results[i].Path() < results[j].Path()
+	})
+	switch *format {
+	case FIND_FORMAT_PATH:
+		for _, r := range results {
+			fmt.Println(r.Path())
+		}
+	case FIND_FORMAT_LONG:
+		tFormat := "2006-01-02 15:04"
+		for _, r := range results {
+			size, updated := "", ""
+			if file := r.AsFile(); file != nil {
+				size = "?"
+				if file.Size() >= 0 {
+					size = util.FormatSize(file.Size())
+				}
+				updated = file.Updated().Format(tFormat)
+			}
+			fmt.Printf(" %10s %16s   %s\n", size, updated, r.Path())
+		}
+	case FIND_FORMAT_JSON:
+		entries := make([]vhd.Entry, 0, len(results))
+		for _, r := range results {
+			entries = append(entries, vhdlink.NewEntry(r).(vhd.Entry))
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("find: %w", err)
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+// Folders and files under `start` (included), at most `maxDepth` levels
+// below it if not negative, matching all filters. Drives are searched but
+// never listed.
+func findEntries(start virtualfs.VirtualFS, filters []findFilter, maxDepth int) ([]virtualfs.VirtualFS, error) {
+	results := make([]virtualfs.VirtualFS, 0)
+	depths := map[virtualfs.VirtualFS]int{start: 0}
+	err := virtualfs.Walk(start, func(obj virtualfs.VirtualFS) error {
+		depth, found := depths[obj]
+		if !found {
+			depth = depths[obj.Parent()] + 1
+		}
+		depths[obj] = depth
+		if !obj.IsRoot() && !obj.IsDrive() && matchAll(obj, filters) {
+			results = append(results, obj)
+		}
+		if obj.IsDir() && depth == maxDepth {
+			return virtualfs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func matchAll(obj virtualfs.VirtualFS, filters []findFilter) bool {
+	for _, filter := range filters {
+		if !filter(obj) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter on files only.
+func fileFilter(match func(virtualfs.File) bool) findFilter {
+	return func(obj virtualfs.VirtualFS) bool {
+		file := obj.AsFile()
+		return file != nil && match(file)
+	}
+}
+
+// Filter on the folders and files of `refs`, found in the catalog.
+func refFilter(refs []catalog.EntryRef) findFilter {
+	set := make(map[catalog.EntryRef]bool, len(refs))
+	for _, ref := range refs {
+		set[ref] = true
+	}
+	return func(obj virtualfs.VirtualFS) bool {
+		return set[virtualfs.EntryRef(obj)]
+	}
+}
+
+// Filter on names, or full paths without a trailing /, by glob (where * and
+// ? match any characters and any character, including /) or by regular
+// expression (matching anywhere unless anchored).
+func matchFilter(pattern string, glob bool, onPath bool, ignoreCase bool) (findFilter, error) {
+	expr := pattern
+	if glob {
+		expr = strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1)
+		expr = "^" + strings.Replace(expr, "\\?", ".", -1) + "$"
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	r, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+	return func(obj virtualfs.VirtualFS) bool {
+		if onPath {
+			return r.MatchString(strings.TrimSuffix(obj.Path(), "/"))
+		}
+		return r.MatchString(obj.Name())
+	}, nil
+}
+
+// Sizes written +<size> (more than), -<size> (less than), <size> (exactly),
+// or <size>..<size> (inclusive, either end may be left out). Returns the
+// inclusive bounds, with max = -1 if there is no upper bound.
+func parseSizeRange(s string) (int64, int64, error) {
+	parse := func(text string, missing int64) (int64, error) {
+		if text == "" {
+			return missing, nil
+		}
+		return util.ParseSize(text)
+	}
+	switch {
+	case strings.HasPrefix(s, "+"):
+		size, err := util.ParseSize(s[1:])
+		return size + 1, -1, err
+	case strings.HasPrefix(s, "-"):
+		size, err := util.ParseSize(s[1:])
+		if err == nil && size == 0 {
+			// No file is smaller, and max = -1 would mean no upper bound.
+			return 0, 0, fmt.Errorf("no size is less than 0")
+		}
+		return 0, size - 1, err
+	case strings.Contains(s, ".."):
+		bounds := strings.SplitN(s, "..", 2)
+		min, err := parse(bounds[0], 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		max, err := parse(bounds[1], -1)
+		return min, max, err
+	}
+	size, err := util.ParseSize(s)
+	return size, size, err
+}
+
+// Time ranges written <date>, <date>..<date>, <date>.. or ..<date>, in local
+// time, where a date is YYYY, YYYY-MM, or YYYY-MM-DD and covers the whole
+// year, month, or day. Returns [from, to), zero times standing for no bound.
+func parseTimeRange(s string) (time.Time, time.Time, error) {
+	if !strings.Contains(s, "..") {
+		from, to, err := parseDate(s)
+		return from, to, err
+	}
+	bounds := strings.SplitN(s, "..", 2)
+	var from, to time.Time
+	if bounds[0] != "" {
+		start, _, err := parseDate(bounds[0])
+		if err != nil {
+			return from, to, err
+		}
+		from = start
+	}
+	if bounds[1] != "" {
+		_, end, err := parseDate(bounds[1])
+		if err != nil {
+			return from, to, err
+		}
+		to = end
+	}
+	return from, to, nil
+}
+
+// The start of a date, and the start of the next one.
+func parseDate(s string) (time.Time, time.Time, error) {
+	layouts := []struct{
+		layout string
+		years, months, days int
+	}{
+		{"2006", 1, 0, 0}, {"2006-01", 0, 1, 0}, {"2006-01-02", 0, 0, 1},
+	}
+	for _, l := range layouts {
+		if len(s) != len(l.layout) {
+			continue
+		}
+		start, err := time.ParseInLocation(l.layout, s, time.Local)
+		if err != nil {
+			break
+		}
+		return start, start.AddDate(l.years, l.months, l.days), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date: %s (expected YYYY, YYYY-MM or YYYY-MM-DD)", s)
+}
+
+// Search the full-text index of the catalog, without loading any drive.
+func commandSearch(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	count := flags.Int("n", 20, "maximum number of results (0 for all)")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	results, err := ctxt.root.Catalog().Search(strings.Join(args, " "), *count)
+	if err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	for _, r := range results {
+		if r.Kind == catalog.KIND_FILE {
+			fmt.Println(r.Path)
+		} else {
+			fmt.Println(r.Path + "/")
+		}
+	}
+	return nil
+}
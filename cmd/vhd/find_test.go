@@ -0,0 +1,90 @@
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindPredicates(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{
+		"movie.mov": strings.Repeat("x", 3000),
+		"clip.MOV": "clip",
+		"notes.txt": "notes",
+	})
+	mustRun(t, ctxt, "mkdir", "/alpha/media")
+	mustRun(t, ctxt, "mkdir", "/alpha/docs")
+	mustRun(t, ctxt, "put", filepath.Join(src, "movie.mov"), filepath.Join(src, "clip.MOV"), "/alpha/media")
+	mustRun(t, ctxt, "put", filepath.Join(src, "notes.txt"), "/alpha/docs")
+	movie := navigate(t, ctxt, "/alpha/media/movie.mov").AsFile()
+	lastYear := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	env.Catalog.UpdateFileContent(navigate(t, ctxt, "/alpha/media/movie.mov").CatalogId(), movie.UUID(), lastYear, movie.Metadata(), movie.Size(), movie.Hash())
+	mustRun(t, ctxt, "cd", "/alpha")
+
+	tests := []struct{
+		args []string
+		want string
+	}{
+		{[]string{"-name", "*.mov"}, "/alpha/media/movie.mov\n"},
+		{[]string{"-i", "-name", "*.mov"}, "/alpha/media/clip.MOV\n/alpha/media/movie.mov\n"},
+		{[]string{"-path", "/alpha/d*"}, "/alpha/docs/\n/alpha/docs/notes.txt\n"},
+		{[]string{"-i", "-regex", "^c"}, "/alpha/media/clip.MOV\n"},
+		{[]string{"-path-regex", "media/.*\\.mov$"}, "/alpha/media/movie.mov\n"},
+		{[]string{"-type", "d"}, "/alpha/docs/\n/alpha/media/\n"},
+		{[]string{"-type", "f", "-size", "+1KB", "-updated", "2025"}, "/alpha/media/movie.mov\n"},
+		{[]string{"-size", "-1KB"}, "/alpha/docs/notes.txt\n/alpha/media/clip.MOV\n"},
+		{[]string{"-updated", "2025-06-01..2025-06"}, "/alpha/media/movie.mov\n"},
+		{[]string{"-updated", "..2025-05"}, ""},
+		{[]string{"-uuid", movie.UUID()[:8]}, "/alpha/media/movie.mov\n"},
+		{[]string{"-maxdepth", "1"}, "/alpha/docs/\n/alpha/media/\n"},
+		{[]string{"-in", "/alpha/docs", "note"}, "/alpha/docs/notes.txt\n"},
+		{[]string{"-type", "f", "MOV"}, "/alpha/media/clip.MOV\n/alpha/media/movie.mov\n"},
+	}
+	for _, test := range tests {
+		if output := mustRun(t, ctxt, "find", test.args...); output != test.want {
+			t.Errorf("find %v = %q, want %q", test.args, output, test.want)
+		}
+	}
+
+	output := mustRun(t, ctxt, "find", "-format", "json", "-name", "movie.mov")
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &entries); err != nil {
+		t.Fatalf("json output %q: %v", output, err)
+	}
+	if len(entries) != 1 || entries[0]["size"] != 3000.0 || entries[0]["uuid"] != movie.UUID() {
+		t.Errorf("json output = %v", entries)
+	}
+	output = mustRun(t, ctxt, "find", "-format", "long", "-name", "movie.mov")
+	if !strings.Contains(output, "2.9 KiB") || !strings.Contains(output, "2025-06-01") {
+		t.Errorf("long output = %q", output)
+	}
+
+	for _, args := range [][]string{{"-updated", "last year"}, {"-size", "huge"}, {"-size", "-0"}, {"-type", "x"}, {"-format", "xml"}, {"-regex", "("}} {
+		if _, err := run(t, ctxt, "find", args...); err == nil {
+			t.Errorf("find %v should fail", args)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"report-2024.pdf": "r", "notes.txt": "n"})
+	mustRun(t, ctxt, "mkdir", "/alpha/reports")
+	mustRun(t, ctxt, "put", filepath.Join(src, "report-2024.pdf"), "/alpha/reports")
+	mustRun(t, ctxt, "put", filepath.Join(src, "notes.txt"), "/beta")
+
+	if output := mustRun(t, ctxt, "search", "rep"); output != "/alpha/reports/report-2024.pdf\n/alpha/reports/\n" {
+		t.Errorf("search rep = %q", output)
+	}
+	if output := mustRun(t, ctxt, "search", "-n", "1", "report", "2024"); output != "/alpha/reports/report-2024.pdf\n" {
+		t.Errorf("search report 2024 = %q", output)
+	}
+	mustRun(t, ctxt, "mv", "/alpha/reports", "/alpha/archived")
+	if output := mustRun(t, ctxt, "search", "2024"); output != "/alpha/archived/report-2024.pdf\n" {
+		t.Errorf("search after mv = %q", output)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"strings"
 	"bufio"
+	"path"
+	"sort"
 	"unicode"
 	
 	"rpucella.net/virtual-hard-drive/internal/virtualfs"
@@ -63,7 +65,7 @@ Y88b   d88P 888 888d888 888888 888  888  8888b.  888      8888888888 888    888
 
 func loop(ctxt *context) {
 	
-	fmt.Println(BANNER)
+	fmt.Printf("%s\n", BANNER)
 
 	reader := bufio.NewReader(os.Stdin)
 
@@ -104,10 +106,39 @@ func processCommand(ctxt *context, comm string, args []string) error {
 	if commObj.maxArgCount >= 0 && len(args) > commObj.maxArgCount {
 		return fmt.Errorf("%s: too many arguments (expected %d)", comm, commObj.maxArgCount)
 	}
+	if err := refresh(ctxt); err != nil {
+		return fmt.Errorf("%s: %w", comm, err)
+	}
 	err := commObj.process(args, ctxt)
 	return err
 }
 
+// Reload the drives changed by another process since they were loaded, and
+// find the working folder again in the reloaded tree.
+func refresh(ctxt *context) error {
+	pwd := ctxt.pwd.Path()
+	reloaded, err := ctxt.root.Refresh()
+	if err != nil {
+		return fmt.Errorf("cannot check catalog: %w", err)
+	}
+	if len(reloaded) == 0 {
+		return nil
+	}
+	sort.Strings(reloaded)
+	log("vhd", fmt.Sprintf("reloading changed drive(s): %s", strings.Join(reloaded, ", ")))
+	// Fall back to the closest folder that still exists.
+	for dir := pwd; ; dir = path.Dir(strings.TrimSuffix(dir, "/")) {
+		newPwd, err := virtualfs.NavigateDirectory(ctxt.root.AsVirtualFS(), dir)
+		if err == nil {
+			if dir != pwd {
+				log("vhd", fmt.Sprintf("folder %s no longer exists", pwd))
+			}
+			ctxt.pwd = newPwd
+			return nil
+		}
+	}
+}
+
 // Split a line into fields at spaces.
 // Do not split within double quotes "...".
 //
@@ -0,0 +1,58 @@
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"rpucella.net/virtual-hard-drive/internal/fusefs"
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+const CACHE_FOLDER = "cache"
+const CACHE_SIZE = "10GB"
+
+func commandMount(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	cacheFolder := flags.String("cache", "", "folder for downloaded content (default ~/.vhd/cache)")
+	cacheSize := flags.String("cache-size", CACHE_SIZE, "bytes of downloaded content kept, such as 1GB (0 for no limit)")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	if *cacheFolder == "" {
+		if *cacheFolder, err = util.ConfigFile(CACHE_FOLDER); err != nil {
+			return fmt.Errorf("mount: %w", err)
+		}
+	}
+	limit, err := util.ParseSize(*cacheSize)
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	cache, err := fusefs.NewCache(*cacheFolder, limit)
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	server, err := fusefs.Mount(ctxt.root, args[0], cache, func(text string) {
+		log("mount", text)
+	})
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	log("mount", fmt.Sprintf("mounted at %s (read-only) - interrupt or unmount to stop", args[0]))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log("mount", fmt.Sprintf("cannot unmount: %s", err))
+		}
+	}()
+	server.Wait()
+	signal.Stop(signals)
+	log("mount", "unmounted")
+	return nil
+}
@@ -0,0 +1,210 @@
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Progress of put, get and sync, reported to by the storage of drives (see
+// util/progress.go). On a terminal, a progress bar is redrawn in place
+// below the log lines. Otherwise, a progress line is logged every
+// PROGRESS_INTERVAL. Transfers shorter than that stay quiet.
+
+const (
+	PROGRESS_REFRESH = 200 * time.Millisecond
+	PROGRESS_INTERVAL = 10 * time.Second
+	PROGRESS_BAR_WIDTH = 24
+)
+
+type progressDisplay struct {
+	comm string
+	progress *util.Progress
+	tty bool
+	shown bool              // Whether progress was shown, to show a summary.
+	stop chan bool
+	stopped chan bool
+}
+
+// The progress being displayed, if any. Commands run one at a time.
+var display *progressDisplay
+
+// Guards the output while a progress bar is drawn, so that log lines do not
+// run into the bar.
+var outputMu sync.Mutex
+var barDrawn bool
+
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+// Display the progress of a transfer of `files` files and `bytes` bytes (-1
+// if unknown) until the function returned is called.
+func startProgress(ctxt *context, comm string, files int, bytes int64) func() {
+	d := &progressDisplay{
+		comm: comm,
+		progress: ctxt.root.Progress(),
+		tty: isTerminal(),
+		stop: make(chan bool),
+		stopped: make(chan bool),
+	}
+	d.progress.Start(files, bytes)
+	display = d
+	go d.run()
+	return func() {
+		close(d.stop)
+		<-d.stopped
+		snapshot := d.progress.Snapshot()
+		d.progress.Stop()
+		display = nil
+		if d.shown {
+			clearBar()
+			log(comm, summarizeProgress(snapshot))
+		}
+	}
+}
+
+func (d *progressDisplay) run() {
+	defer close(d.stopped)
+	interval := PROGRESS_INTERVAL
+	if d.tty {
+		interval = PROGRESS_REFRESH
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.shown = true
+			snapshot := d.progress.Snapshot()
+			if d.tty {
+				drawBar(formatBar(snapshot))
+			} else {
+				log(d.comm, formatProgress(snapshot))
+			}
+		}
+	}
+}
+
+// Report the start and end of the transfer of a file of `bytes` bytes to
+// the progress displayed, if any.
+func startFile(name string, bytes int64) {
+	if display != nil {
+		display.progress.StartFile(name, bytes)
+	}
+}
+
+func endFile() {
+	if display != nil {
+		display.progress.EndFile()
+	}
+}
+
+func drawBar(bar string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Printf("\r\033[K%s", bar)
+	barDrawn = true
+}
+
+func clearBar() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	clearBarLocked()
+}
+
+func clearBarLocked() {
+	if barDrawn {
+		fmt.Printf("\r\033[K")
+		barDrawn = false
+	}
+}
+
+func percent(done int64, total int64) string {
+	if total <= 0 {
+		return "?%"
+	}
+	return fmt.Sprintf("%d%%", done * 100 / total)
+}
+
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		return "?"
+	}
+	return d.Round(time.Second).String()
+}
+
+func formatAmount(done int64, total int64) string {
+	if total < 0 {
+		return util.FormatSize(done)
+	}
+	return fmt.Sprintf("%s of %s", util.FormatSize(done), util.FormatSize(total))
+}
+
+// Progress as a line, such as
+//   45% 1.2 GiB of 2.6 GiB, file 4 of 10, 5.0 MiB/s, ETA 4m40s - movie.mov 30%
+func formatProgress(s util.ProgressSnapshot) string {
+	parts := []string{formatAmount(s.Done, s.Total)}
+	if s.Total >= 0 {
+		parts[0] = percent(s.Done, s.Total) + " " + parts[0]
+	}
+	if s.Files > 1 {
+		parts = append(parts, fmt.Sprintf("file %d of %d", currentFile(s), s.Files))
+	}
+	parts = append(parts, util.FormatSize(int64(s.Rate)) + "/s")
+	if s.ETA >= 0 {
+		parts = append(parts, "ETA " + formatDuration(s.ETA))
+	}
+	line := strings.Join(parts, ", ")
+	if s.File != "" {
+		line = fmt.Sprintf("%s - %s %s", line, filepath.Base(s.File), percent(s.FileDone, s.FileTotal))
+	}
+	return line
+}
+
+// Progress as a bar, such as
+//   [==========>             ]  45%  1.2 GiB / 2.6 GiB  4/10  5.0 MiB/s  ETA 4m40s  movie.mov
+func formatBar(s util.ProgressSnapshot) string {
+	filled := 0
+	if s.Total > 0 {
+		filled = int(s.Done * PROGRESS_BAR_WIDTH / s.Total)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < PROGRESS_BAR_WIDTH {
+		bar = bar + ">" + strings.Repeat(" ", PROGRESS_BAR_WIDTH - filled - 1)
+	}
+	amount := util.FormatSize(s.Done)
+	if s.Total >= 0 {
+		amount = amount + " / " + util.FormatSize(s.Total)
+	}
+	parts := []string{"[" + bar + "]", fmt.Sprintf("%4s", percent(s.Done, s.Total)), amount}
+	if s.Files > 1 {
+		parts = append(parts, fmt.Sprintf("%d/%d", currentFile(s), s.Files))
+	}
+	parts = append(parts, util.FormatSize(int64(s.Rate)) + "/s", "ETA " + formatDuration(s.ETA))
+	if s.File != "" {
+		parts = append(parts, filepath.Base(s.File))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// Number of the file being transferred, from 1.
+func currentFile(s util.ProgressSnapshot) int {
+	if s.File != "" && s.FilesDone < s.Files {
+		return s.FilesDone + 1
+	}
+	return s.FilesDone
+}
+
+func summarizeProgress(s util.ProgressSnapshot) string {
+	return fmt.Sprintf("transferred %s in %s (%s/s)", util.FormatSize(s.Done), formatDuration(s.Elapsed), util.FormatSize(int64(s.Rate)))
+}
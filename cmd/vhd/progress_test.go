@@ -0,0 +1,53 @@
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+func TestFormatProgress(t *testing.T) {
+	s := util.ProgressSnapshot{
+		Active: true,
+		Files: 10,
+		FilesDone: 3,
+		Total: 2600 << 20,
+		Done: 1170 << 20,
+		File: "/home/alice/movies/movie.mov",
+		FileTotal: 1000,
+		FileDone: 300,
+		Rate: 5 << 20,
+		ETA: 286 * time.Second,
+	}
+	want := "45% 1.1 GiB of 2.5 GiB, file 4 of 10, 5.0 MiB/s, ETA 4m46s - movie.mov 30%"
+	if got := formatProgress(s); got != want {
+		t.Errorf("formatProgress = %q, want %q", got, want)
+	}
+	want = "[==========>             ]   45%  1.1 GiB / 2.5 GiB  4/10  5.0 MiB/s  ETA 4m46s  movie.mov"
+	if got := formatBar(s); got != want {
+		t.Errorf("formatBar = %q, want %q", got, want)
+	}
+
+	// A single file of unknown size.
+	s = util.ProgressSnapshot{Active: true, Files: 1, Total: -1, Done: 2048, File: "a.bin", FileTotal: 2048, FileDone: 2048, Rate: 1024, ETA: -1}
+	if got := formatProgress(s); got != "2.0 KiB, 1.0 KiB/s - a.bin 100%" {
+		t.Errorf("formatProgress of unknown size = %q", got)
+	}
+}
+
+func TestPutProgress(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"docs/a.txt": "aaa", "docs/b.txt": "bbbbb"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "docs"), "/alpha")
+	// Memory storage does not report its transfers, so only files count.
+	s := ctxt.root.Progress().Snapshot()
+	if s.Active || s.Files != 2 || s.FilesDone != 2 || s.File != "" {
+		t.Errorf("progress after put = %+v", s)
+	}
+	if display != nil {
+		t.Errorf("progress still displayed after put")
+	}
+}
@@ -0,0 +1,202 @@
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Quotas of drives, and the pre-flight checks of put, cp and sync, which
+// add up what a transfer would store on a drive before starting it.
+
+// Bytes sent to and stored by drive `d` for an object holding `size` bytes,
+// counting the copies of a mirror drive and the parity of an erasure drive.
+func uploadSize(d virtualfs.Drive, size int64) int64 {
+	if d == nil {
+		return size
+	}
+	return storage.UploadSize(d.Storage(), size)
+}
+
+// New files, replaced files and bytes that putting local file or folder
+// `srcPath` in remote folder `destFolder` of drive `d` adds to the drive, as
+// put would, with `destFolder` nil if it is yet to be created. Files that
+// cannot be read are left to put to report.
+func localAddition(srcPath string, d virtualfs.Drive, destFolder virtualfs.VirtualFS, force bool) (int, int, int64, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return 0, 0, 0, nil
+	}
+	var existing virtualfs.VirtualFS
+	found := false
+	if destFolder != nil {
+		existing, found, err = destFolder.GetContent(filepath.Base(srcPath))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if found && (!force || info.IsDir() != existing.IsDir()) {
+		// Skipped by put.
+		return 0, 0, 0, nil
+	}
+	if !info.IsDir() {
+		if found {
+			return 0, 1, uploadSize(d, info.Size()), nil
+		}
+		return 1, 0, uploadSize(d, info.Size()), nil
+	}
+	entries, err := ioutil.ReadDir(srcPath)
+	if err != nil {
+		return 0, 0, 0, nil
+	}
+	files, replaced, bytes := 0, 0, int64(0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		f, r, b, err := localAddition(filepath.Join(srcPath, entry.Name()), d, existing, force)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		files += f
+		replaced += r
+		bytes += b
+	}
+	return files, replaced, bytes, nil
+}
+
+// Files and bytes that copying remote folder or file `src` to a folder of
+// drive `dest` adds to it. Copies within a drive share the objects of the
+// original, so only their files count.
+func remoteAddition(src virtualfs.VirtualFS, dest virtualfs.Drive) (int, int64, error) {
+	files, bytes := 0, int64(0)
+	sameDrive := src.Drive() != nil && src.Drive().Name() == dest.Name()
+	err := virtualfs.Walk(src, func(obj virtualfs.VirtualFS) error {
+		if file := obj.AsFile(); file != nil {
+			files++
+			if !sameDrive && file.Size() > 0 {
+				bytes += uploadSize(dest, file.Size())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return files, bytes, nil
+}
+
+// Check that copies of `srcPaths` fit in the drive of `tgtFolder`. Paths
+// that cannot be found are left to cp to report.
+func checkCopies(ctxt *context, srcPaths []string, tgtFolder virtualfs.VirtualFS) error {
+	dest := tgtFolder.Drive()
+	if dest == nil {
+		return nil
+	}
+	files, bytes := 0, int64(0)
+	for _, srcPath := range srcPaths {
+		if srcObj, err := virtualfs.NavigatePath(ctxt.pwd, srcPath); err == nil {
+			f, b, err := remoteAddition(srcObj, dest)
+			if err != nil {
+				return err
+			}
+			files += f
+			bytes += b
+		}
+	}
+	return virtualfs.CheckQuota(dest, files, bytes)
+}
+
+func commandQuota(args []string, ctxt *context) error {
+	if len(args) > 0 && args[0] == "set" {
+		return setQuota(args[1:], ctxt)
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("quota: too many arguments")
+	}
+	drives := ctxt.root.Drives()
+	names := make([]string, 0, len(drives))
+	for name := range drives {
+		names = append(names, name)
+	}
+	if len(args) > 0 {
+		name := strings.Trim(args[0], "/")
+		if _, found := drives[name]; !found {
+			return fmt.Errorf("quota: no drive %s", name)
+		}
+		names = []string{name}
+	}
+	sort.Strings(names)
+	fmt.Printf(" %-16s %20s %24s\n", "drive", "files", "size")
+	for _, name := range names {
+		quota, err := virtualfs.Quota(drives[name])
+		if err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+		usage, err := virtualfs.Usage(drives[name])
+		if err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+		files := strconv.Itoa(usage.Files)
+		if quota.Files > 0 {
+			files = fmt.Sprintf("%d / %d", usage.Files, quota.Files)
+		}
+		size := util.FormatSize(usage.Bytes)
+		if quota.Bytes > 0 {
+			size = fmt.Sprintf("%s / %s", util.FormatSize(usage.Bytes), util.FormatSize(quota.Bytes))
+		}
+		fmt.Printf(" %-16s %20s %24s\n", name, files, size)
+	}
+	return nil
+}
+
+// Change the limits given by flags, keeping the others.
+func setQuota(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("quota", flag.ContinueOnError)
+	size := flags.String("size", "", "limit of bytes stored, such as 500GB (0 for none)")
+	files := flags.String("files", "", "limit of files (0 for none)")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("quota: usage: quota set [-size <size>] [-files <count>] <drive>")
+	}
+	name := strings.Trim(args[0], "/")
+	drive, found := ctxt.root.Drives()[name]
+	if !found {
+		return fmt.Errorf("quota: no drive %s", name)
+	}
+	quota, err := virtualfs.Quota(drive)
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	if *size != "" {
+		bytes, err := util.ParseSize(*size)
+		if err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+		quota.Bytes = bytes
+	}
+	if *files != "" {
+		count, err := strconv.Atoi(*files)
+		if err != nil || count < 0 {
+			return fmt.Errorf("quota: invalid file count: %s", *files)
+		}
+		quota.Files = count
+	}
+	if err := virtualfs.SetQuota(drive, quota); err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	return nil
+}
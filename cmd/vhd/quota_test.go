@@ -0,0 +1,87 @@
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func TestQuota(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{
+		"docs/a.txt": strings.Repeat("a", 600),
+		"docs/b.txt": strings.Repeat("b", 600),
+		"docs/.hidden": strings.Repeat("h", 5000),
+		"big.bin": strings.Repeat("x", 2000),
+	})
+	mustRun(t, ctxt, "quota", "set", "-size", "2KB", "-files", "3", "alpha")
+	if output := mustRun(t, ctxt, "quota", "alpha"); !strings.Contains(output, "alpha") || !strings.Contains(output, "0 / 3") || !strings.Contains(output, "0 B / 2.0 KiB") {
+		t.Errorf("quota alpha = %q", output)
+	}
+
+	// Hidden files are not uploaded, so not counted.
+	mustRun(t, ctxt, "put", filepath.Join(src, "docs"), "/alpha")
+	_, err := run(t, ctxt, "put", filepath.Join(src, "big.bin"), "/alpha")
+	if !errors.Is(err, virtualfs.ErrQuota) || !strings.Contains(err.Error(), "over the limit of 2.0 KiB") {
+		t.Fatalf("put over quota: %v", err)
+	}
+	if _, found, _ := navigate(t, ctxt, "/alpha").GetContent("big.bin"); found {
+		t.Errorf("put over quota should not upload")
+	}
+
+	// Copies within a drive share their object, but count as files.
+	mustRun(t, ctxt, "cp", "/alpha/docs/a.txt", "/alpha/a-copy.txt")
+	if _, err := run(t, ctxt, "cp", "/alpha/docs/b.txt", "/alpha/b-copy.txt"); !errors.Is(err, virtualfs.ErrQuota) {
+		t.Errorf("cp over file quota: %v", err)
+	}
+	mustRun(t, ctxt, "quota", "set", "-files", "0", "alpha")
+	mustRun(t, ctxt, "put", filepath.Join(src, "big.bin"), "/beta")
+	if _, err := run(t, ctxt, "cp", "/beta/big.bin", "/alpha"); !errors.Is(err, virtualfs.ErrQuota) {
+		t.Errorf("cp across drives over quota: %v", err)
+	}
+
+	// Sync checks the files it would copy before writing anything.
+	mustRun(t, ctxt, "mkdir", "/alpha/synced")
+	if _, err := run(t, ctxt, "sync", src, "/alpha/synced"); !errors.Is(err, virtualfs.ErrQuota) {
+		t.Errorf("sync over quota: %v", err)
+	}
+	if content, _ := navigate(t, ctxt, "/alpha/synced").ContentList(); len(content) != 0 {
+		t.Errorf("sync over quota wrote %v", content)
+	}
+	mustRun(t, ctxt, "quota", "set", "-size", "0", "alpha")
+	mustRun(t, ctxt, "sync", src, "/alpha/synced")
+
+	output := mustRun(t, ctxt, "quota")
+	if !strings.Contains(output, "beta") || !strings.Contains(output, "     6 ") {
+		t.Errorf("quota = %q", output)
+	}
+	if _, err := run(t, ctxt, "quota", "set", "-files", "many", "alpha"); err == nil {
+		t.Errorf("invalid file count should fail")
+	}
+	if _, err := run(t, ctxt, "quota", "gamma"); err == nil {
+		t.Errorf("quota of a missing drive should fail")
+	}
+}
+
+func TestQuotaOfMirror(t *testing.T) {
+	ctxt, env := newTestContext(t)
+	env.AddDrive(t, "mirrored", storage.NewMirror([]string{"a", "b"}, []storage.Storage{storage.NewMemory("a"), storage.NewMemory("b")}))
+	ctxt.root = env.Root
+	ctxt.pwd = env.Root.AsVirtualFS()
+	src := localTree(t, map[string]string{"a.txt": strings.Repeat("a", 600), "b.txt": strings.Repeat("b", 600)})
+
+	// Both copies count, so 600 bytes take 1200 of the quota.
+	mustRun(t, ctxt, "quota", "set", "-size", "2KB", "mirrored")
+	mustRun(t, ctxt, "put", filepath.Join(src, "a.txt"), "/mirrored")
+	if output := mustRun(t, ctxt, "quota", "mirrored"); !strings.Contains(output, "1.2 KiB / 2.0 KiB") {
+		t.Errorf("quota mirrored = %q", output)
+	}
+	if _, err := run(t, ctxt, "put", filepath.Join(src, "b.txt"), "/mirrored"); !errors.Is(err, virtualfs.ErrQuota) {
+		t.Errorf("put over quota of mirror: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+
+	"rpucella.net/virtual-hard-drive/internal/api"
+	"rpucella.net/virtual-hard-drive/internal/davfs"
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+func commandServeWebDAV(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("serve-webdav", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return fmt.Errorf("serve-webdav: %w", err)
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("serve-webdav: too many arguments")
+	}
+	settings, err := util.LoadSettings()
+	if err != nil {
+		return fmt.Errorf("serve-webdav: %w", err)
+	}
+	if len(settings.WebDAV.Users) == 0 {
+		return fmt.Errorf("serve-webdav: no users configured in %s", util.CONFIG_SETTINGS)
+	}
+	handler := davfs.NewHandler(ctxt.root, settings.WebDAV.Users, func(text string) {
+		log("webdav", text)
+	})
+	log("webdav", fmt.Sprintf("serving on %s", *addr))
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		return fmt.Errorf("serve-webdav: %w", err)
+	}
+	return nil
+}
+
+func commandServe(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:8081", "address to listen on")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("serve: too many arguments")
+	}
+	settings, err := util.LoadSettings()
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	if len(settings.API.Tokens) == 0 {
+		return fmt.Errorf("serve: no tokens configured in %s", util.CONFIG_SETTINGS)
+	}
+	handler := api.NewHandler(ctxt.root, settings.API.Tokens, func(text string) {
+		log("serve", text)
+	})
+	log("serve", fmt.Sprintf("serving on %s", *addr))
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,630 @@
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Synchronization between a local folder and a remote folder.
+//
+// Files are matched by their path relative to the folders being synced.
+// Hidden files and folders (starting with .) are ignored on both sides, and
+// never deleted: with -delete, a folder holding any is kept.
+// A file is unchanged if its size and modification time are the same as
+// when it was last synced (as recorded in the state file) and the remote file
+// still refers to the same storage object; otherwise, if the remote file
+// has a stored hash, the hash of the local file is compared to it.
+
+const SYNC_FOLDER = "sync"
+
+type syncState struct {
+	Local string                 `json:"local"`
+	Remote string                `json:"remote"`
+	Files map[string]syncEntry   `json:"files"`
+}
+
+type syncEntry struct {
+	Size int64     `json:"size"`
+	ModTime int64  `json:"mtime"`
+	UUID string    `json:"uuid"`
+}
+
+// The state file for a pair of folders lives in ~/.vhd/sync.
+func syncStatePath(local string, remote string) (string, error) {
+	folder, err := util.ConfigFile(SYNC_FOLDER)
+	if err != nil {
+		return "", err
+	}
+	key := crc32.Checksum([]byte(local + "\n" + remote), crc32.MakeTable(util.GCS_POLY))
+	return filepath.Join(folder, util.FormatHash(key) + ".json"), nil
+}
+
+func loadSyncState(local string, remote string) *syncState {
+	state := &syncState{local, remote, make(map[string]syncEntry)}
+	statePath, err := syncStatePath(local, remote)
+	if err != nil {
+		return state
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return state
+	}
+	saved := &syncState{}
+	// A state file for other folders (a hash collision) is ignored.
+	if err := json.Unmarshal(data, saved); err != nil || saved.Local != local || saved.Remote != remote || saved.Files == nil {
+		return state
+	}
+	return saved
+}
+
+func (state *syncState) save() error {
+	statePath, err := syncStatePath(state.Local, state.Remote)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %v", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+	if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %v", err)
+	}
+	return nil
+}
+
+func (state *syncState) record(rel string, info fs.FileInfo, fileObj virtualfs.VirtualFS) {
+	state.Files[rel] = syncEntry{info.Size(), info.ModTime().UnixNano(), fileObj.AsFile().UUID()}
+}
+
+// Files and folders of a local tree, by relative path.
+func scanLocal(root string) (map[string]fs.FileInfo, map[string]bool, error) {
+	files := make(map[string]fs.FileInfo)
+	dirs := make(map[string]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			dirs[rel] = true
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, dirs, nil
+}
+
+// Files and folders of a remote tree, by relative path.
+func scanRemote(root virtualfs.VirtualFS) (map[string]virtualfs.VirtualFS, map[string]virtualfs.VirtualFS, error) {
+	files := make(map[string]virtualfs.VirtualFS)
+	dirs := make(map[string]virtualfs.VirtualFS)
+	paths := map[virtualfs.VirtualFS]string{root: ""}
+	err := virtualfs.Walk(root, func(vfs virtualfs.VirtualFS) error {
+		if vfs == root {
+			return nil
+		}
+		parent, found := paths[vfs.Parent()]
+		if !found || strings.HasPrefix(vfs.Name(), ".") {
+			// Inside a hidden folder.
+			return nil
+		}
+		rel := path.Join(parent, vfs.Name())
+		if vfs.IsFile() {
+			files[rel] = vfs
+		} else {
+			dirs[rel] = vfs
+			paths[vfs] = rel
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, dirs, nil
+}
+
+// Compare local file `localPath` with remote file `fileObj` by size and
+// stored hash, without downloading anything. The result is not known if
+// the sizes agree but the remote file has no stored hash.
+func compareContent(localPath string, info fs.FileInfo, fileObj virtualfs.VirtualFS) (bool, bool, error) {
+	file := fileObj.AsFile()
+	if file.Size() >= 0 && file.Size() != info.Size() {
+		return false, true, nil
+	}
+	if file.Hash() == "" {
+		return false, false, nil
+	}
+	hash, _, err := util.HashFile(localPath)
+	if err != nil {
+		return false, false, err
+	}
+	return hash == file.Hash(), true, nil
+}
+
+// Check whether local file `localPath` has the same content as remote file
+// `fileObj`, using the state of the last sync if any.
+func sameContent(localPath string, info fs.FileInfo, fileObj virtualfs.VirtualFS, entry *syncEntry) (bool, error) {
+	file := fileObj.AsFile()
+	if entry != nil && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() && entry.UUID == file.UUID() {
+		return true, nil
+	}
+	same, known, err := compareContent(localPath, info, fileObj)
+	if err != nil || known {
+		return same, err
+	}
+	// Without a hash, fall back on the modification time set by get.
+	return info.ModTime().Unix() == file.Updated().Unix(), nil
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch m := m.(type) {
+	case map[string]fs.FileInfo:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]virtualfs.VirtualFS:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Whether folder `rel`, holding entries `names`, is left empty once the
+// entries in `deleted` are deleted. Entries not listed by the scan, such as
+// hidden files, keep their folder.
+func leftEmpty(rel string, names []string, deleted map[string]bool) bool {
+	for _, name := range names {
+		if !deleted[path.Join(rel, name)] {
+			return false
+		}
+	}
+	return true
+}
+
+type syncCounts struct {
+	copied int
+	updated int
+	deleted int
+	unchanged int
+	failures []error
+}
+
+func (counts *syncCounts) fail(err error) {
+	counts.failures = append(counts.failures, err)
+	log("sync", fmt.Errorf("SKIPPED - %w", err).Error())
+}
+
+func commandSync(args []string, ctxt *context) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be done")
+	deleteExtraneous := flags.Bool("delete", false, "delete files missing from the source")
+	limit := flags.String("limit", "", "bandwidth limit, such as 5MB/s")
+	args, err := parseFlags(flags, args, 2)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	restore, err := limitTransfers(ctxt, *limit)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	defer restore()
+	if len(args) != 2 {
+		return fmt.Errorf("sync: expected a local folder and a remote folder")
+	}
+	// The direction is given by the order of the arguments.
+	localFirst, _ := isDirectory(args[0])
+	remoteFirst, _ := virtualfs.NavigateDirectory(ctxt.pwd, args[0])
+	remoteSecond, _ := virtualfs.NavigateDirectory(ctxt.pwd, args[1])
+	var counts *syncCounts
+	if localFirst && remoteSecond != nil {
+		if remoteFirst != nil {
+			return fmt.Errorf("sync: first arg is a local folder and a remote folder")
+		}
+		counts, err = syncUp(ctxt, args[0], remoteSecond, *deleteExtraneous, *dryRun)
+	} else if remoteFirst != nil && !localFirst {
+		if isDir, err := isDirectory(args[1]); err == nil && !isDir {
+			return fmt.Errorf("sync: %s is not a folder", args[1])
+		}
+		counts, err = syncDown(ctxt, remoteFirst, args[1], *deleteExtraneous, *dryRun)
+	} else {
+		return fmt.Errorf("sync: expected a local folder and a remote folder")
+	}
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	log("sync", "----------------------------------------")
+	log("sync", fmt.Sprintf("copied: %d  updated: %d  deleted: %d  unchanged: %d", counts.copied, counts.updated, counts.deleted, counts.unchanged))
+	if len(counts.failures) > 0 {
+		log("sync", fmt.Sprintf("failures: %d", len(counts.failures)))
+		for _, err := range counts.failures {
+			log("sync", err.Error())
+		}
+		return fmt.Errorf("sync: %d file(s) failed", len(counts.failures))
+	}
+	return nil
+}
+
+// Sync remote folder `remote` with local folder `local`.
+func syncUp(ctxt *context, local string, remote virtualfs.VirtualFS, deleteExtraneous bool, dryRun bool) (*syncCounts, error) {
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+	localFiles, localDirs, err := scanLocal(local)
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, remoteDirs, err := scanRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	state := loadSyncState(local, remote.Path())
+	newState := &syncState{state.Local, state.Remote, make(map[string]syncEntry)}
+	counts := &syncCounts{}
+
+	// Files to copy or update, decided before writing anything so that the
+	// quota of the drive can be checked first, and the progress of the
+	// whole sync shown.
+	uploads := make([]string, 0)
+	addedFiles, addedBytes := 0, int64(0)
+	for _, rel := range sortedKeys(localFiles) {
+		info := localFiles[rel]
+		localPath := filepath.Join(local, filepath.FromSlash(rel))
+		if _, found := remoteDirs[rel]; found {
+			counts.fail(fmt.Errorf("%s is a folder in %s", rel, remote.Path()))
+			continue
+		}
+		existing, found := remoteFiles[rel]
+		if found {
+			var entry *syncEntry
+			if e, ok := state.Files[rel]; ok {
+				entry = &e
+			}
+			same, err := sameContent(localPath, info, existing, entry)
+			if err != nil {
+				counts.fail(err)
+				continue
+			}
+			if same {
+				counts.unchanged++
+				newState.record(rel, info, existing)
+				continue
+			}
+		} else {
+			addedFiles++
+		}
+		addedBytes += uploadSize(remote.Drive(), info.Size())
+		uploads = append(uploads, rel)
+	}
+	if err := virtualfs.CheckQuota(remote.Drive(), addedFiles, addedBytes); err != nil {
+		return nil, err
+	}
+	if remote.Drive() != nil && !dryRun {
+		defer startProgress(ctxt, "sync", len(uploads), addedBytes)()
+	}
+
+	for _, rel := range sortedKeys(localDirs) {
+		if _, found := remoteDirs[rel]; found {
+			continue
+		}
+		if _, found := remoteFiles[rel]; found {
+			counts.fail(fmt.Errorf("%s is a file in %s", rel, remote.Path()))
+			continue
+		}
+		log("sync", fmt.Sprintf("mkdir %s", rel))
+		if dryRun {
+			continue
+		}
+		parent, found := remote, true
+		if dir := path.Dir(rel); dir != "." {
+			parent, found = remoteDirs[dir]
+		}
+		if !found {
+			// Parent could not be created.
+			continue
+		}
+		dirObj, err := virtualfs.CreateDirectory(parent, path.Base(rel))
+		if err != nil {
+			counts.fail(err)
+			continue
+		}
+		remoteDirs[rel] = dirObj
+	}
+
+	for _, rel := range uploads {
+		info := localFiles[rel]
+		localPath := filepath.Join(local, filepath.FromSlash(rel))
+		existing, found := remoteFiles[rel]
+		if found {
+			log("sync", fmt.Sprintf("update %s", rel))
+		} else {
+			log("sync", fmt.Sprintf("copy %s", rel))
+		}
+		if dryRun {
+			continue
+		}
+		parent, parentFound := remote, true
+		if dir := path.Dir(rel); dir != "." {
+			parent, parentFound = remoteDirs[dir]
+		}
+		if !parentFound {
+			continue
+		}
+		if err := uploadFile("sync", localPath, parent, path.Base(rel), existing); err != nil {
+			counts.fail(err)
+			continue
+		}
+		if found {
+			counts.updated++
+		} else {
+			counts.copied++
+		}
+		if fileObj, ok, err := parent.GetContent(path.Base(rel)); err == nil && ok {
+			newState.record(rel, info, fileObj)
+		}
+	}
+
+	if deleteExtraneous {
+		// Only the files and folders listed by the scan are deleted, deepest
+		// first, so that a folder is deleted only once emptied.
+		deleted := make(map[string]bool)
+		for _, rel := range sortedKeys(remoteFiles) {
+			if _, found := localFiles[rel]; found {
+				continue
+			}
+			log("sync", fmt.Sprintf("delete %s", rel))
+			if !dryRun {
+				if err := virtualfs.Delete(remoteFiles[rel]); err != nil {
+					counts.fail(err)
+					continue
+				}
+				counts.deleted++
+			}
+			deleted[rel] = true
+		}
+		extraneous := make([]string, 0)
+		for _, rel := range sortedKeys(remoteDirs) {
+			if !localDirs[rel] {
+				extraneous = append(extraneous, rel)
+			}
+		}
+		for i := len(extraneous) - 1; i >= 0; i-- {
+			rel := extraneous[i]
+			names, err := remoteDirs[rel].ContentList()
+			if err != nil {
+				counts.fail(err)
+				continue
+			}
+			if !leftEmpty(rel, names, deleted) {
+				log("sync", fmt.Sprintf("keep %s/, which holds entries not synced", rel))
+				continue
+			}
+			log("sync", fmt.Sprintf("delete %s/", rel))
+			if !dryRun {
+				if err := virtualfs.Delete(remoteDirs[rel]); err != nil {
+					counts.fail(err)
+					continue
+				}
+			}
+			deleted[rel] = true
+		}
+	}
+
+	if !dryRun {
+		if err := newState.save(); err != nil {
+			log("sync", fmt.Sprintf("cannot save state: %s", err))
+		}
+	}
+	return counts, nil
+}
+
+// Sync local folder `local` with remote folder `remote`.
+func syncDown(ctxt *context, remote virtualfs.VirtualFS, local string, deleteExtraneous bool, dryRun bool) (*syncCounts, error) {
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return nil, fmt.Errorf("os.MkdirAll: %v", err)
+		}
+	}
+	localFiles, localDirs, err := scanLocal(local)
+	if err != nil && !(dryRun && errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+	remoteFiles, remoteDirs, err := scanRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	state := loadSyncState(local, remote.Path())
+	newState := &syncState{state.Local, state.Remote, make(map[string]syncEntry)}
+	counts := &syncCounts{}
+
+	// Files to copy or update, decided before writing anything so that the
+	// progress of the whole sync can be shown.
+	downloads := make([]string, 0)
+	bytes := int64(0)
+	for _, rel := range sortedKeys(remoteFiles) {
+		fileObj := remoteFiles[rel]
+		localPath := filepath.Join(local, filepath.FromSlash(rel))
+		if localDirs[rel] {
+			counts.fail(fmt.Errorf("%s is a folder in %s", rel, local))
+			continue
+		}
+		info, found := localFiles[rel]
+		if found {
+			var entry *syncEntry
+			if e, ok := state.Files[rel]; ok {
+				entry = &e
+			}
+			same, err := sameContent(localPath, info, fileObj, entry)
+			if err != nil {
+				counts.fail(err)
+				continue
+			}
+			if same {
+				counts.unchanged++
+				newState.record(rel, info, fileObj)
+				continue
+			}
+		}
+		if size := fileObj.AsFile().Size(); size < 0 || bytes < 0 {
+			bytes = -1
+		} else {
+			bytes += size
+		}
+		downloads = append(downloads, rel)
+	}
+	if !dryRun {
+		defer startProgress(ctxt, "sync", len(downloads), bytes)()
+	}
+
+	for _, rel := range sortedKeys(remoteDirs) {
+		if localDirs[rel] {
+			continue
+		}
+		if _, found := localFiles[rel]; found {
+			counts.fail(fmt.Errorf("%s is a file in %s", rel, local))
+			continue
+		}
+		log("sync", fmt.Sprintf("mkdir %s", rel))
+		if dryRun {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(local, filepath.FromSlash(rel)), 0755); err != nil {
+			counts.fail(fmt.Errorf("os.MkdirAll: %v", err))
+		}
+	}
+
+	for _, rel := range downloads {
+		fileObj := remoteFiles[rel]
+		localPath := filepath.Join(local, filepath.FromSlash(rel))
+		_, found := localFiles[rel]
+		if found {
+			log("sync", fmt.Sprintf("update %s", rel))
+		} else {
+			log("sync", fmt.Sprintf("copy %s", rel))
+		}
+		if dryRun {
+			continue
+		}
+		if err := downloadFile(fileObj, localPath, EXISTING_OVERWRITE); err != nil {
+			counts.fail(err)
+			continue
+		}
+		if found {
+			counts.updated++
+		} else {
+			counts.copied++
+		}
+		if info, err := os.Stat(localPath); err == nil {
+			newState.record(rel, info, fileObj)
+		}
+	}
+
+	if deleteExtraneous {
+		// Only the files and folders listed by the scan are deleted, deepest
+		// first, so that a folder is deleted only once emptied.
+		deleted := make(map[string]bool)
+		for _, rel := range sortedKeys(localFiles) {
+			if _, found := remoteFiles[rel]; found {
+				continue
+			}
+			log("sync", fmt.Sprintf("delete %s", rel))
+			if !dryRun {
+				if err := os.Remove(filepath.Join(local, filepath.FromSlash(rel))); err != nil {
+					counts.fail(fmt.Errorf("os.Remove: %v", err))
+					continue
+				}
+				counts.deleted++
+			}
+			deleted[rel] = true
+		}
+		extraneous := make([]string, 0)
+		for _, rel := range sortedKeys(localDirs) {
+			if _, found := remoteDirs[rel]; !found {
+				extraneous = append(extraneous, rel)
+			}
+		}
+		for i := len(extraneous) - 1; i >= 0; i-- {
+			rel := extraneous[i]
+			dirPath := filepath.Join(local, filepath.FromSlash(rel))
+			dirEntries, err := os.ReadDir(dirPath)
+			if err != nil {
+				counts.fail(fmt.Errorf("os.ReadDir: %v", err))
+				continue
+			}
+			names := make([]string, 0, len(dirEntries))
+			for _, dirEntry := range dirEntries {
+				names = append(names, dirEntry.Name())
+			}
+			if !leftEmpty(rel, names, deleted) {
+				log("sync", fmt.Sprintf("keep %s/, which holds entries not synced", rel))
+				continue
+			}
+			log("sync", fmt.Sprintf("delete %s/", rel))
+			if !dryRun {
+				if err := os.Remove(dirPath); err != nil {
+					counts.fail(fmt.Errorf("os.Remove: %v", err))
+					continue
+				}
+			}
+			deleted[rel] = true
+		}
+	}
+
+	if !dryRun {
+		if err := newState.save(); err != nil {
+			log("sync", fmt.Sprintf("cannot save state: %s", err))
+		}
+	}
+	return counts, nil
+}
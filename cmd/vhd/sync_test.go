@@ -0,0 +1,156 @@
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+func TestSyncUp(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a", "sub/b.txt": "content b", ".hidden": "h"})
+	mustRun(t, ctxt, "mkdir", "/alpha/project")
+
+	output := mustRun(t, ctxt, "sync", "-dry-run", src, "/alpha/project")
+	if !strings.Contains(output, "copy sub/b.txt") {
+		t.Errorf("dry run does not report copy:\n%s", output)
+	}
+	if _, found, _ := navigate(t, ctxt, "/alpha/project").GetContent("a.txt"); found {
+		t.Fatalf("dry run uploaded a file")
+	}
+
+	output = mustRun(t, ctxt, "sync", src, "/alpha/project")
+	if !strings.Contains(output, "copied: 2  updated: 0  deleted: 0  unchanged: 0") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	b := navigate(t, ctxt, "/alpha/project/sub/b.txt").AsFile()
+	hash, _, _ := util.HashFile(filepath.Join(src, "sub", "b.txt"))
+	if b.Size() != int64(len("content b")) || b.Hash() != hash {
+		t.Errorf("size/hash not recorded: %d %q", b.Size(), b.Hash())
+	}
+	if _, found, _ := navigate(t, ctxt, "/alpha/project").GetContent(".hidden"); found {
+		t.Errorf("hidden file synced")
+	}
+
+	output = mustRun(t, ctxt, "sync", src, "/alpha/project")
+	if !strings.Contains(output, "unchanged: 2") {
+		t.Errorf("unchanged tree not skipped:\n%s", output)
+	}
+
+	// Change a file, add and remove files.
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("new content a"), 0600)
+	os.Remove(filepath.Join(src, "sub", "b.txt"))
+	os.Remove(filepath.Join(src, "sub"))
+	os.WriteFile(filepath.Join(src, "c.txt"), []byte("content c"), 0600)
+	output = mustRun(t, ctxt, "sync", "-delete", src, "/alpha/project")
+	if !strings.Contains(output, "copied: 1  updated: 1  deleted: 1  unchanged: 0") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	a := navigate(t, ctxt, "/alpha/project/a.txt").AsFile()
+	if got := env.Memory["alpha"].Object(a.UUID()); string(got) != "new content a" {
+		t.Errorf("updated content = %q", got)
+	}
+	if _, found, _ := navigate(t, ctxt, "/alpha/project").GetContent("sub"); found {
+		t.Errorf("extraneous folder not deleted")
+	}
+}
+
+func TestSyncUnchangedByHash(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a"})
+	mustRun(t, ctxt, "mkdir", "/alpha/project")
+	mustRun(t, ctxt, "sync", src, "/alpha/project")
+	// Same content with a new modification time is not uploaded again.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(src, "a.txt"), later, later)
+	output := mustRun(t, ctxt, "sync", src, "/alpha/project")
+	if !strings.Contains(output, "unchanged: 1") {
+		t.Errorf("touched file uploaded again:\n%s", output)
+	}
+}
+
+func TestSyncFailures(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a", "b.txt": "content b"})
+	mustRun(t, ctxt, "mkdir", "/alpha/project")
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1})
+	output, err := run(t, ctxt, "sync", src, "/alpha/project")
+	if err == nil {
+		t.Errorf("sync with failing uploads should fail")
+	}
+	if !strings.Contains(output, "failures: 2") {
+		t.Errorf("failures not reported:\n%s", output)
+	}
+}
+
+func TestSyncDown(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"project/a.txt": "content a", "project/sub/b.txt": "content b"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "project"), "/alpha")
+	dest := filepath.Join(t.TempDir(), "copy")
+
+	output := mustRun(t, ctxt, "sync", "/alpha/project", dest)
+	if !strings.Contains(output, "copied: 2") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "sub", "b.txt"))
+	if err != nil || string(got) != "content b" {
+		t.Errorf("synced %q, %v", got, err)
+	}
+
+	os.WriteFile(filepath.Join(dest, "a.txt"), []byte("local change"), 0600)
+	os.WriteFile(filepath.Join(dest, "extra.txt"), []byte("extra"), 0600)
+	output = mustRun(t, ctxt, "sync", "-delete", "/alpha/project", dest)
+	if !strings.Contains(output, "copied: 0  updated: 1  deleted: 1  unchanged: 1") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "a.txt")); string(got) != "content a" {
+		t.Errorf("local change not overwritten: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "extra.txt")); err == nil {
+		t.Errorf("extraneous file not deleted")
+	}
+}
+
+func TestSyncDeleteKeepsHidden(t *testing.T) {
+	ctxt, env := newTestContext(t, "alpha")
+	src := localTree(t, map[string]string{"a.txt": "content a"})
+	mustRun(t, ctxt, "mkdir", "/alpha/project")
+	mustRun(t, ctxt, "mkdir", "/alpha/project/old")
+	mustRun(t, ctxt, "mkdir", "/alpha/project/old/sub")
+	mustRun(t, ctxt, "mkdir", "/alpha/project/gone")
+	env.PutFile(t, "/alpha/project/old/sub/b.txt", "content b")
+	env.PutFile(t, "/alpha/project/old/.keep", "k")
+	env.PutFile(t, "/alpha/project/gone/c.txt", "content c")
+
+	output := mustRun(t, ctxt, "sync", "-delete", src, "/alpha/project")
+	if !strings.Contains(output, "deleted: 2") || !strings.Contains(output, "keep old/") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	project := navigate(t, ctxt, "/alpha/project")
+	if names, _ := project.ContentList(); len(names) != 2 {
+		t.Errorf("project holds %v, want a.txt and old", names)
+	}
+	if names, _ := navigate(t, ctxt, "/alpha/project/old").ContentList(); len(names) != 1 || names[0] != ".keep" {
+		t.Errorf("old holds %v, want .keep only", names)
+	}
+
+	// The same down, with a local repository in an extraneous folder.
+	dest := localTree(t, map[string]string{"a.txt": "content a", "extra/.git/HEAD": "ref", "extra/b.txt": "b", "gone/c.txt": "c"})
+	output = mustRun(t, ctxt, "sync", "-delete", "/alpha/project", dest)
+	if !strings.Contains(output, "deleted: 2") || !strings.Contains(output, "keep extra/") {
+		t.Errorf("unexpected sync output:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "extra", ".git", "HEAD")); err != nil {
+		t.Errorf("hidden file deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "gone")); err == nil {
+		t.Errorf("extraneous folder not deleted")
+	}
+}
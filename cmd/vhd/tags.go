@@ -0,0 +1,152 @@
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Tags and user-defined attributes of folders and files.
+
+func commandTag(args []string, ctxt *context) error {
+	switch args[0] {
+	case "add", "remove":
+		if len(args) < 3 {
+			return fmt.Errorf("tag: usage: tag %s <tag> <folder/file> ...", args[0])
+		}
+		tag := args[1]
+		paths, err := virtualfs.ExpandPaths(ctxt.pwd, args[2:])
+		if err != nil {
+			return fmt.Errorf("tag: %w", err)
+		}
+		for _, path := range paths {
+			obj, err := virtualfs.NavigatePath(ctxt.pwd, path)
+			if err != nil {
+				return fmt.Errorf("tag: %w", err)
+			}
+			if args[0] == "add" {
+				err = virtualfs.AddTag(obj, tag)
+			} else {
+				err = virtualfs.RemoveTag(obj, tag)
+			}
+			if err != nil {
+				return fmt.Errorf("tag: %w", err)
+			}
+		}
+		return nil
+	case "list":
+		if len(args) > 2 {
+			return fmt.Errorf("tag: usage: tag list [<folder/file>]")
+		}
+		if len(args) == 1 {
+			return listAllTags(ctxt)
+		}
+		obj, err := virtualfs.NavigatePath(ctxt.pwd, args[1])
+		if err != nil {
+			return fmt.Errorf("tag: %w", err)
+		}
+		annotations, err := virtualfs.Annotations(obj)
+		if err != nil {
+			return fmt.Errorf("tag: %w", err)
+		}
+		for _, tag := range annotations.Tags {
+			fmt.Println(tag)
+		}
+		return nil
+	}
+	return fmt.Errorf("tag: unknown subcommand %s", args[0])
+}
+
+// Tags of all drives, with the number of folders and files having them.
+func listAllTags(ctxt *context) error {
+	tags, err := ctxt.root.Catalog().FetchTags()
+	if err != nil {
+		return fmt.Errorf("tag: %w", err)
+	}
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	for _, tag := range names {
+		fmt.Printf(" %6d  %s\n", tags[tag], tag)
+	}
+	return nil
+}
+
+func commandAttr(args []string, ctxt *context) error {
+	usage := map[string]string{
+		"set": "attr set <folder/file> <name> <value>",
+		"get": "attr get <folder/file> [<name>]",
+		"unset": "attr unset <folder/file> <name>",
+	}
+	counts := map[string][2]int{"set": {4, 4}, "get": {2, 3}, "unset": {3, 3}}
+	count, found := counts[args[0]]
+	if !found {
+		return fmt.Errorf("attr: unknown subcommand %s", args[0])
+	}
+	if len(args) < count[0] || len(args) > count[1] {
+		return fmt.Errorf("attr: usage: %s", usage[args[0]])
+	}
+	obj, err := virtualfs.NavigatePath(ctxt.pwd, args[1])
+	if err != nil {
+		return fmt.Errorf("attr: %w", err)
+	}
+	switch args[0] {
+	case "set":
+		err = virtualfs.SetAttribute(obj, args[2], args[3])
+	case "unset":
+		err = virtualfs.RemoveAttribute(obj, args[2])
+	case "get":
+		var annotations catalog.Annotations
+		annotations, err = virtualfs.Annotations(obj)
+		if err != nil {
+			break
+		}
+		if len(args) == 3 {
+			value, found := annotations.Attributes[args[2]]
+			if !found {
+				return fmt.Errorf("attr: no attribute %s on %s", args[2], obj.Path())
+			}
+			fmt.Println(value)
+			break
+		}
+		printAttributes(annotations.Attributes, "")
+	}
+	if err != nil {
+		return fmt.Errorf("attr: %w", err)
+	}
+	return nil
+}
+
+// Attributes as name=value, sorted by name.
+func printAttributes(attributes map[string]string, indent string) {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s%s=%s\n", indent, name, attributes[name])
+	}
+}
+
+// Print the tags and attributes of an entry, as part of its information.
+func printAnnotations(obj virtualfs.VirtualFS) error {
+	annotations, err := virtualfs.Annotations(obj)
+	if err != nil {
+		return err
+	}
+	if len(annotations.Tags) > 0 {
+		fmt.Printf("Tags:        %s\n", strings.Join(annotations.Tags, ", "))
+	}
+	if len(annotations.Attributes) > 0 {
+		fmt.Printf("Attributes:\n")
+		printAttributes(annotations.Attributes, "  ")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTagsAndAttributes(t *testing.T) {
+	ctxt, _ := newTestContext(t, "alpha", "beta")
+	src := localTree(t, map[string]string{"contracts/acme.pdf": "a", "contracts/globex.pdf": "g", "notes.txt": "n"})
+	mustRun(t, ctxt, "put", filepath.Join(src, "contracts"), filepath.Join(src, "notes.txt"), "/alpha")
+	mustRun(t, ctxt, "cd", "/alpha")
+
+	mustRun(t, ctxt, "tag", "add", "legal-hold", "contracts/*", "contracts")
+	mustRun(t, ctxt, "tag", "add", "draft", "notes.txt")
+	mustRun(t, ctxt, "attr", "set", "contracts/acme.pdf", "client", "acme")
+	if output := mustRun(t, ctxt, "tag", "list", "contracts/acme.pdf"); output != "legal-hold\n" {
+		t.Errorf("tag list = %q", output)
+	}
+	if output := mustRun(t, ctxt, "tag", "list"); output != "      1  draft\n      3  legal-hold\n" {
+		t.Errorf("tag list of all drives = %q", output)
+	}
+	if output := mustRun(t, ctxt, "attr", "get", "contracts/acme.pdf", "client"); output != "acme\n" {
+		t.Errorf("attr get = %q", output)
+	}
+	output := mustRun(t, ctxt, "info", "contracts/acme.pdf")
+	if !strings.Contains(output, "Tags:        legal-hold\n") || !strings.Contains(output, "  client=acme\n") {
+		t.Errorf("info = %q", output)
+	}
+
+	tests := []struct{
+		args []string
+		want string
+	}{
+		{[]string{"-tag", "legal-hold"}, "/alpha/contracts/\n/alpha/contracts/acme.pdf\n/alpha/contracts/globex.pdf\n"},
+		{[]string{"-tag", "legal-hold", "-type", "f", "globex"}, "/alpha/contracts/globex.pdf\n"},
+		{[]string{"-attr", "client"}, "/alpha/contracts/acme.pdf\n"},
+		{[]string{"-attr", "client=acme"}, "/alpha/contracts/acme.pdf\n"},
+		{[]string{"-attr", "client=globex"}, ""},
+	}
+	for _, test := range tests {
+		if output := mustRun(t, ctxt, "find", test.args...); output != test.want {
+			t.Errorf("find %v = %q, want %q", test.args, output, test.want)
+		}
+	}
+	if output := mustRun(t, ctxt, "search", "acme"); output != "/alpha/contracts/acme.pdf\n" {
+		t.Errorf("search acme = %q", output)
+	}
+
+	// Annotations follow their entry across drives.
+	mustRun(t, ctxt, "mv", "/alpha/contracts", "/beta")
+	if output := mustRun(t, ctxt, "find", "-in", "/", "-attr", "client=acme"); output != "/beta/contracts/acme.pdf\n" {
+		t.Errorf("find after move = %q", output)
+	}
+	if output := mustRun(t, ctxt, "tag", "list", "/beta/contracts"); output != "legal-hold\n" {
+		t.Errorf("tag list after move = %q", output)
+	}
+
+	mustRun(t, ctxt, "tag", "remove", "draft", "notes.txt")
+	mustRun(t, ctxt, "attr", "unset", "/beta/contracts/acme.pdf", "client")
+	if output := mustRun(t, ctxt, "tag", "list"); output != "      3  legal-hold\n" {
+		t.Errorf("tag list after removal = %q", output)
+	}
+	if _, err := run(t, ctxt, "attr", "get", "/beta/contracts/acme.pdf", "client"); err == nil {
+		t.Errorf("attr get of removed attribute should fail")
+	}
+	for _, args := range [][]string{{"add", "two words", "notes.txt"}, {"add", "x", "/alpha"}, {"list", "missing.txt"}, {"frob"}} {
+		if _, err := run(t, ctxt, "tag", args...); err == nil {
+			t.Errorf("tag %v should fail", args)
+		}
+	}
+	if _, err := run(t, ctxt, "attr", "set", "notes.txt", "client", ""); err == nil {
+		t.Errorf("attr set with an empty value should fail")
+	}
+}
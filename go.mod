@@ -3,9 +3,12 @@ module rpucella.net/virtual-hard-drive
 go 1.16
 
 require (
-	cloud.google.com/go/storage v1.20.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.11 // indirect
-	google.golang.org/api v0.67.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	cloud.google.com/go/storage v1.20.0
+	github.com/google/uuid v1.3.0
+	github.com/hanwen/go-fuse/v2 v2.1.0
+	github.com/mattn/go-sqlite3 v1.14.11
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
+	google.golang.org/api v0.67.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
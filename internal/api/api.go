@@ -0,0 +1,350 @@
+
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/vhdlink"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+	"rpucella.net/virtual-hard-drive/pkg/vhd"
+)
+
+// JSON API over HTTP to a virtualfs tree, for scripts, on top of the
+// vhd library.
+//
+//   GET  /api/list?path=/drive/folder          entries of a folder
+//   GET  /api/stat?path=/drive/file            a single entry
+//   POST /api/mkdir?path=/drive/folder         create a folder
+//   POST /api/move?from=/drive/a&to=/drive/b   move or rename, like mv
+//   PUT  /api/files?path=/drive/file           upload the request body
+//                                              (&overwrite=true to replace)
+//   GET  /api/files?path=/drive/file           download as the response body
+//   GET  /api/find?path=/drive&q=text          case-insensitive search by name
+//   POST /api/trash?path=/drive/file           move to the drive's trash folder
+//
+// Paths are absolute. Entries are returned in the JSON form of vhd.Entry.
+// Errors are returned as {"error": "..."}.
+
+type Server struct {
+	client *vhd.Client
+	tokens map[string]string
+	log func(string)
+}
+
+type httpError struct {
+	status int
+	msg string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &httpError{status, fmt.Sprintf(format, args...)}
+}
+
+// Handler serving the API for `root` to clients presenting one of
+// `tokens`, mapping token names to SHA-256 hashes of the tokens. Every
+// request is reported to `log`.
+func NewHandler(root virtualfs.Root, tokens map[string]string, log func(string)) http.Handler {
+	s := &Server{client: vhdlink.NewClient(root).(*vhd.Client), tokens: tokens, log: log}
+	mux := http.NewServeMux()
+	mux.Handle("/api/list", s.endpoint("GET", s.list))
+	mux.Handle("/api/stat", s.endpoint("GET", s.stat))
+	mux.Handle("/api/mkdir", s.endpoint("POST", s.mkdir))
+	mux.Handle("/api/move", s.endpoint("POST", s.move))
+	mux.Handle("/api/files", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			s.endpoint("PUT", s.upload).ServeHTTP(w, r)
+		} else {
+			s.endpoint("GET", s.download).ServeHTTP(w, r)
+		}
+	}))
+	mux.Handle("/api/find", s.endpoint("GET", s.find))
+	mux.Handle("/api/trash", s.endpoint("POST", s.trash))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		name, ok := checkToken(tokens, r)
+		if !ok {
+			name = "-"
+			writeError(rec, errorf(http.StatusUnauthorized, "missing or invalid token"))
+		} else if err := s.client.Refresh(); err != nil {
+			// See the changes made by other processes sharing the catalog.
+			writeError(rec, err)
+		} else {
+			mux.ServeHTTP(rec, r)
+		}
+		s.log(fmt.Sprintf("%s %s %s %d %dB %s", name, r.Method, r.URL.RequestURI(), rec.status, rec.written, time.Since(start).Round(time.Millisecond)))
+	})
+}
+
+// The name of the token presented as "Authorization: Bearer <token>".
+func checkToken(tokens map[string]string, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	for name, h := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(h))) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Records the status and size of responses, for logging.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	written int64
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (s *Server) endpoint(method string, process func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+			return
+		}
+		if err := process(w, r); err != nil {
+			writeError(w, err)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), map[string]string{"error": err.Error()})
+}
+
+// HTTP status for an error of the API or of the vhd library.
+func statusOf(err error) int {
+	var httpErr *httpError
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.status
+	case errors.Is(err, vhd.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, vhd.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, vhd.ErrInvalid), errors.Is(err, vhd.ErrNotDir), errors.Is(err, vhd.ErrIsDir):
+		return http.StatusBadRequest
+	case errors.Is(err, vhd.ErrExist), errors.Is(err, vhd.ErrNotEmpty), errors.Is(err, vhd.ErrStale):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// The value of parameter `name`, which must be an absolute path.
+func pathParam(r *http.Request, name string) (string, error) {
+	path := r.URL.Query().Get(name)
+	if path == "" {
+		return "", errorf(http.StatusBadRequest, "missing parameter %s", name)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", errorf(http.StatusBadRequest, "path %s is not absolute", path)
+	}
+	return path, nil
+}
+
+func boolParam(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errorf(http.StatusBadRequest, "invalid value for %s: %s", name, value)
+	}
+	return b, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	entries, err := s.client.List(path)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entries)
+	return nil
+}
+
+func (s *Server) stat(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	entry, err := s.client.Stat(path)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entry)
+	return nil
+}
+
+func (s *Server) mkdir(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	entry, err := s.client.Mkdir(path)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, entry)
+	return nil
+}
+
+// Move `from` into folder `to` if it exists, and to path `to` otherwise.
+func (s *Server) move(w http.ResponseWriter, r *http.Request) error {
+	from, err := pathParam(r, "from")
+	if err != nil {
+		return err
+	}
+	to, err := pathParam(r, "to")
+	if err != nil {
+		return err
+	}
+	entry, err := s.client.Move(from, to)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entry)
+	return nil
+}
+
+// Upload the request body to `path`. The body is streamed to storage,
+// and the catalog is only updated once the upload has succeeded.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	overwrite, err := boolParam(r, "overwrite")
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	if _, err := s.client.Stat(path); err == nil {
+		status = http.StatusOK
+	}
+	entry, err := s.client.Upload(path, r.Body, overwrite)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, status, entry)
+	return nil
+}
+
+// Stream the content of `path` as the response body.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	entry, err := s.client.Stat(path)
+	if err != nil {
+		return err
+	}
+	if entry.IsDir() {
+		return errorf(http.StatusBadRequest, "not a file: %s", path)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"` + entry.UUID + `"`)
+	if entry.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	}
+	if entry.Hash != "" {
+		w.Header().Set("X-Vhd-Crc32c", entry.Hash)
+	}
+	err = s.client.Download(path, w)
+	var storageErr *vhd.StorageError
+	if errors.As(err, &storageErr) {
+		// Too late to report an error: cut the response short instead.
+		s.log(fmt.Sprintf("%s %s: download failed: %s", r.Method, r.URL.RequestURI(), err))
+		panic(http.ErrAbortHandler)
+	}
+	// Other errors happen before any content is written.
+	return err
+}
+
+func (s *Server) find(w http.ResponseWriter, r *http.Request) error {
+	path := "/"
+	if r.URL.Query().Get("path") != "" {
+		var err error
+		if path, err = pathParam(r, "path"); err != nil {
+			return err
+		}
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return errorf(http.StatusBadRequest, "missing parameter q")
+	}
+	entries, err := s.client.Find(path, q)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entries)
+	return nil
+}
+
+// Move `path` to the trash folder at the top of its drive, like trash.
+func (s *Server) trash(w http.ResponseWriter, r *http.Request) error {
+	path, err := pathParam(r, "path")
+	if err != nil {
+		return err
+	}
+	src, err := s.client.Stat(path)
+	if err != nil {
+		return err
+	}
+	if src.Kind == vhd.KindRoot || src.Kind == vhd.KindDrive {
+		return errorf(http.StatusForbidden, "cannot trash %s", src.Path)
+	}
+	drive := strings.SplitN(strings.TrimPrefix(src.Path, "/"), "/", 2)[0]
+	trash, err := s.client.Stat("/" + drive + "/trash")
+	if err != nil || !trash.IsDir() {
+		return errorf(http.StatusConflict, "drive %s has no trash folder", drive)
+	}
+	if src.Path == trash.Path || strings.HasPrefix(src.Path, trash.Path + "/") {
+		return errorf(http.StatusConflict, "%s is already in the trash", src.Path)
+	}
+	entry, err := s.client.Move(src.Path, trash.Path)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entry)
+	return nil
+}
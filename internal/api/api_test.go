@@ -0,0 +1,283 @@
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+	"rpucella.net/virtual-hard-drive/pkg/vhd"
+)
+
+const TOKEN = "s3cr3t"
+
+func newServer(t *testing.T) (*httptest.Server, *vhdtest.Env) {
+	t.Helper()
+	env := vhdtest.New(t, "alpha", "beta")
+	sum := sha256.Sum256([]byte(TOKEN))
+	tokens := map[string]string{"scripts": hex.EncodeToString(sum[:])}
+	server := httptest.NewServer(NewHandler(env.Root, tokens, func(string) {}))
+	t.Cleanup(server.Close)
+	return server, env
+}
+
+func call(t *testing.T, server *httptest.Server, method string, endpoint string, params url.Values, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL + endpoint + "?" + params.Encode(), strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer " + TOKEN)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, endpoint, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func decode(t *testing.T, body string, value interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), value); err != nil {
+		t.Fatalf("cannot decode %q: %v", body, err)
+	}
+}
+
+func path(p string) url.Values {
+	return url.Values{"path": {p}}
+}
+
+func TestAuth(t *testing.T) {
+	server, _ := newServer(t)
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + TOKEN} {
+		req, _ := http.NewRequest("GET", server.URL + "/api/list?path=/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("authorization %q: status %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	server, _ := newServer(t)
+	status, body := call(t, server, "GET", "/api/list", path("/"), "")
+	var entries []vhd.Entry
+	decode(t, body, &entries)
+	if status != http.StatusOK || len(entries) != 2 || entries[0].Name != "alpha" || entries[0].Kind != vhd.KindDrive {
+		t.Errorf("list / = %d %s", status, body)
+	}
+	if status, body := call(t, server, "POST", "/api/mkdir", path("/alpha/docs"), ""); status != http.StatusCreated {
+		t.Errorf("mkdir = %d %s", status, body)
+	}
+	if status, _ := call(t, server, "POST", "/api/mkdir", path("/alpha/docs"), ""); status != http.StatusConflict {
+		t.Errorf("mkdir of existing folder: status %d", status)
+	}
+	if status, _ := call(t, server, "POST", "/api/mkdir", path("/gamma"), ""); status != http.StatusForbidden {
+		t.Errorf("mkdir of drive: status %d", status)
+	}
+	if status, _ := call(t, server, "POST", "/api/mkdir", path("/alpha/missing/docs"), ""); status != http.StatusNotFound {
+		t.Errorf("mkdir in missing folder: status %d", status)
+	}
+	if status, _ := call(t, server, "GET", "/api/mkdir", path("/alpha/other"), ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("mkdir with GET: status %d", status)
+	}
+	status, body = call(t, server, "GET", "/api/stat", path("/alpha/docs"), "")
+	var entry vhd.Entry
+	decode(t, body, &entry)
+	if status != http.StatusOK || entry.Kind != vhd.KindFolder || entry.Name != "docs" {
+		t.Errorf("stat = %d %s", status, body)
+	}
+	if status, _ := call(t, server, "GET", "/api/stat", path("/alpha/missing"), ""); status != http.StatusNotFound {
+		t.Errorf("stat of missing entry: status %d", status)
+	}
+	if status, _ := call(t, server, "GET", "/api/stat", path("alpha"), ""); status != http.StatusBadRequest {
+		t.Errorf("stat of relative path: status %d", status)
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	server, env := newServer(t)
+	status, body := call(t, server, "PUT", "/api/files", path("/alpha/a.txt"), "content a")
+	var entry vhd.Entry
+	decode(t, body, &entry)
+	if status != http.StatusCreated || entry.Size != 9 || entry.Hash == "" {
+		t.Fatalf("upload = %d %s", status, body)
+	}
+	if got := env.Memory["alpha"].Object(entry.UUID); string(got) != "content a" {
+		t.Errorf("stored content = %q", got)
+	}
+	if status, body := call(t, server, "GET", "/api/files", path("/alpha/a.txt"), ""); status != http.StatusOK || body != "content a" {
+		t.Errorf("download = %d %q", status, body)
+	}
+	if status, _ := call(t, server, "GET", "/api/list", path("/alpha/a.txt"), ""); status != http.StatusBadRequest {
+		t.Errorf("list of a file: status %d", status)
+	}
+	if status, _ := call(t, server, "PUT", "/api/files", path("/alpha/a.txt"), "new content"); status != http.StatusConflict {
+		t.Errorf("upload over existing file: status %d", status)
+	}
+	params := path("/alpha/a.txt")
+	params.Set("overwrite", "true")
+	status, body = call(t, server, "PUT", "/api/files", params, "new content")
+	var replaced vhd.Entry
+	decode(t, body, &replaced)
+	if status != http.StatusOK || replaced.UUID == entry.UUID {
+		t.Errorf("upload with overwrite = %d %s", status, body)
+	}
+	if env.Memory["alpha"].Object(entry.UUID) != nil {
+		t.Errorf("old content not deleted")
+	}
+	if status, body := call(t, server, "GET", "/api/files", path("/alpha/a.txt"), ""); body != "new content" {
+		t.Errorf("download after overwrite = %d %q", status, body)
+	}
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1})
+	if status, _ := call(t, server, "PUT", "/api/files", path("/alpha/b.txt"), "b"); status != http.StatusInternalServerError {
+		t.Errorf("upload with failing storage: status %d", status)
+	}
+	if obj, _ := virtualfs.CheckPath(env.Root.AsVirtualFS(), "/alpha/b.txt"); obj != nil {
+		t.Errorf("file added to catalog despite failed upload")
+	}
+}
+
+func TestMoveFindTrash(t *testing.T) {
+	server, env := newServer(t)
+	call(t, server, "POST", "/api/mkdir", path("/alpha/docs"), "")
+	call(t, server, "POST", "/api/mkdir", path("/alpha/trash"), "")
+	call(t, server, "PUT", "/api/files", path("/alpha/a.txt"), "content a")
+
+	// Into an existing folder.
+	status, body := call(t, server, "POST", "/api/move", url.Values{"from": {"/alpha/a.txt"}, "to": {"/alpha/docs"}}, "")
+	var entry vhd.Entry
+	decode(t, body, &entry)
+	if status != http.StatusOK || entry.Path != "/alpha/docs/a.txt" {
+		t.Errorf("move = %d %s", status, body)
+	}
+	// Renaming across drives.
+	status, body = call(t, server, "POST", "/api/move", url.Values{"from": {"/alpha/docs/a.txt"}, "to": {"/beta/b.txt"}}, "")
+	decode(t, body, &entry)
+	if status != http.StatusOK || entry.Path != "/beta/b.txt" {
+		t.Errorf("move across drives = %d %s", status, body)
+	}
+	if status, body := call(t, server, "GET", "/api/files", path("/beta/b.txt"), ""); body != "content a" {
+		t.Errorf("download moved file = %d %q", status, body)
+	}
+	if status, _ := call(t, server, "POST", "/api/move", url.Values{"from": {"/alpha"}, "to": {"/beta"}}, ""); status != http.StatusForbidden {
+		t.Errorf("move of drive: status %d", status)
+	}
+
+	call(t, server, "PUT", "/api/files", path("/alpha/docs/report.pdf"), "pdf")
+	status, body = call(t, server, "GET", "/api/find", url.Values{"path": {"/alpha"}, "q": {"REPORT"}}, "")
+	var entries []vhd.Entry
+	decode(t, body, &entries)
+	if status != http.StatusOK || len(entries) != 1 || entries[0].Path != "/alpha/docs/report.pdf" {
+		t.Errorf("find = %d %s", status, body)
+	}
+
+	status, body = call(t, server, "POST", "/api/trash", path("/alpha/docs"), "")
+	decode(t, body, &entry)
+	if status != http.StatusOK || !strings.HasPrefix(entry.Path, "/alpha/trash/docs") {
+		t.Errorf("trash = %d %s", status, body)
+	}
+	if _, err := virtualfs.NavigateFile(env.Root.AsVirtualFS(), "/alpha/trash/docs/report.pdf"); err != nil {
+		t.Errorf("trashed file: %v", err)
+	}
+	if status, _ := call(t, server, "POST", "/api/trash", path("/beta/b.txt"), ""); status != http.StatusConflict {
+		t.Errorf("trash without trash folder: status %d", status)
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	server, env := newServer(t)
+	call(t, server, "POST", "/api/mkdir", path("/alpha/docs"), "")
+	var wg sync.WaitGroup
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			call(t, server, "PUT", "/api/files", path("/alpha/docs/" + name), "content " + name)
+			call(t, server, "GET", "/api/list", path("/alpha/docs"), "")
+		}(name)
+	}
+	wg.Wait()
+	dir, err := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha/docs")
+	if err != nil {
+		t.Fatalf("NavigateDirectory: %v", err)
+	}
+	content, err := dir.ContentList()
+	if err != nil {
+		t.Fatalf("ContentList: %v", err)
+	}
+	if len(content) != len(names) {
+		t.Errorf("%d files uploaded, expected %d", len(content), len(names))
+	}
+}
+
+func TestDownloadFailure(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	sum := sha256.Sum256([]byte(TOKEN))
+	tokens := map[string]string{"scripts": hex.EncodeToString(sum[:])}
+	var mu sync.Mutex
+	logged := make([]string, 0)
+	server := httptest.NewServer(NewHandler(env.Root, tokens, func(text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, text)
+	}))
+	defer server.Close()
+	call(t, server, "PUT", "/api/files", path("/alpha/a.txt"), "content a")
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{DownloadFailureRate: 1})
+	req, _ := http.NewRequest("GET", server.URL + "/api/files?" + path("/alpha/a.txt").Encode(), nil)
+	req.Header.Set("Authorization", "Bearer " + TOKEN)
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("failed download not cut short")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	found := false
+	for _, text := range logged {
+		if strings.Contains(text, "download failed") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("failed download not logged: %v", logged)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	server, env := newServer(t)
+	call(t, server, "GET", "/api/list", path("/alpha"), "")
+	// Another process sharing the catalog creates a folder.
+	alpha, _ := virtualfs.NavigateDirectory(env.Reload(t).AsVirtualFS(), "/alpha")
+	if _, err := virtualfs.CreateDirectory(alpha, "docs"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	if status, body := call(t, server, "GET", "/api/stat", path("/alpha/docs"), ""); status != http.StatusOK {
+		t.Errorf("stat of folder created elsewhere = %d %s", status, body)
+	}
+}
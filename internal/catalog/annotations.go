@@ -0,0 +1,248 @@
+
+package catalog
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tags and user-defined attributes of folders and files, in tables `tags`
+// and `attributes` (see MIGRATIONS), apart from the metadata of files which
+// belongs to the storage. Entries are given by kind and id, since folders
+// and files are numbered separately. Tags and attributes are deleted along
+// with their entry, and are indexed in the tags column of the full-text
+// index as "tag ... name value ...".
+
+type queryer interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+func checkAnnotated(kind string) error {
+	if kind != KIND_FILE && kind != KIND_FOLDER {
+		return fmt.Errorf("cannot annotate %s", kind)
+	}
+	return nil
+}
+
+func fetchAnnotations(q queryer, kind string, id int) (Annotations, error) {
+	annotations := Annotations{make([]string, 0), make(map[string]string)}
+	rows, err := q.Query("SELECT tag FROM tags WHERE kind = ? AND entryId = ? ORDER BY tag", kind, id)
+	if err != nil {
+		return annotations, fmt.Errorf("Query(tags): %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return annotations, fmt.Errorf("rows.Scan: %w", err)
+		}
+		annotations.Tags = append(annotations.Tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return annotations, fmt.Errorf("Query(tags): %w", err)
+	}
+	rows, err = q.Query("SELECT name, value FROM attributes WHERE kind = ? AND entryId = ?", kind, id)
+	if err != nil {
+		return annotations, fmt.Errorf("Query(attributes): %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return annotations, fmt.Errorf("rows.Scan: %w", err)
+		}
+		annotations.Attributes[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return annotations, fmt.Errorf("Query(attributes): %w", err)
+	}
+	return annotations, nil
+}
+
+// Update the tags column of the row of an entry in the full-text index.
+func indexAnnotations(tx *sql.Tx, kind string, id int) error {
+	annotations, err := fetchAnnotations(tx, kind, id)
+	if err != nil {
+		return err
+	}
+	words := annotations.Tags
+	names := make([]string, 0, len(annotations.Attributes))
+	for name := range annotations.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		words = append(words, name, annotations.Attributes[name])
+	}
+	if _, err := tx.Exec("UPDATE search SET tags = ? WHERE docid = ?", strings.Join(words, " "), searchDocid(kind, id)); err != nil {
+		return fmt.Errorf("tx.Exec(search): %w", err)
+	}
+	return nil
+}
+
+func deleteAnnotations(tx *sql.Tx, kind string, id int) error {
+	if _, err := tx.Exec("DELETE FROM tags WHERE kind = ? AND entryId = ?", kind, id); err != nil {
+		return fmt.Errorf("tx.Exec(tags): %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM attributes WHERE kind = ? AND entryId = ?", kind, id); err != nil {
+		return fmt.Errorf("tx.Exec(attributes): %w", err)
+	}
+	return nil
+}
+
+// Run `query` to change the annotations of an entry, and index them.
+func (c *sqlCatalog) annotate(kind string, id int, query string, args ...interface{}) error {
+	if err := checkAnnotated(kind); err != nil {
+		return err
+	}
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(query, args...); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	if err := indexAnnotations(tx, kind, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCatalog) FetchAnnotations(kind string, id int) (Annotations, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return Annotations{}, err
+	}
+	defer db.Close()
+	return fetchAnnotations(db, kind, id)
+}
+
+// Adding a tag twice has no effect.
+func (c *sqlCatalog) AddTag(kind string, id int, tag string) error {
+	return c.annotate(kind, id, "INSERT OR IGNORE INTO tags (kind, entryId, tag) VALUES (?, ?, ?)", kind, id, tag)
+}
+
+func (c *sqlCatalog) RemoveTag(kind string, id int, tag string) error {
+	return c.annotate(kind, id, "DELETE FROM tags WHERE kind = ? AND entryId = ? AND tag = ?", kind, id, tag)
+}
+
+// Set or replace attribute `name` of an entry.
+func (c *sqlCatalog) SetAttribute(kind string, id int, name string, value string) error {
+	return c.annotate(kind, id, "INSERT OR REPLACE INTO attributes (kind, entryId, name, value) VALUES (?, ?, ?, ?)", kind, id, name, value)
+}
+
+func (c *sqlCatalog) RemoveAttribute(kind string, id int, name string) error {
+	return c.annotate(kind, id, "DELETE FROM attributes WHERE kind = ? AND entryId = ? AND name = ?", kind, id, name)
+}
+
+// Give entry `to` the tags and attributes of entry `from`, of the same kind,
+// such as a copy and its original.
+func (c *sqlCatalog) CopyAnnotations(kind string, from int, to int) error {
+	if err := checkAnnotated(kind); err != nil {
+		return err
+	}
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT OR IGNORE INTO tags (kind, entryId, tag) SELECT kind, ?, tag FROM tags WHERE kind = ? AND entryId = ?", to, kind, from); err != nil {
+		return fmt.Errorf("tx.Exec(tags): %w", err)
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO attributes (kind, entryId, name, value) SELECT kind, ?, name, value FROM attributes WHERE kind = ? AND entryId = ?", to, kind, from); err != nil {
+		return fmt.Errorf("tx.Exec(attributes): %w", err)
+	}
+	if err := indexAnnotations(tx, kind, to); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
+// Tags in use, with the number of entries having them.
+func (c *sqlCatalog) FetchTags() (map[string]int, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT tag, count(*) FROM tags GROUP BY tag")
+	if err != nil {
+		return nil, fmt.Errorf("db.Query(tags): %w", err)
+	}
+	defer rows.Close()
+	tags := make(map[string]int)
+	for rows.Next() {
+		var tag string
+		var count int
+		if err := rows.Scan(&tag, &count); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		tags[tag] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("db.Query(tags): %w", err)
+	}
+	return tags, nil
+}
+
+func fetchEntryRefs(c *sqlCatalog, query string, args ...interface{}) ([]EntryRef, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db.Query: %w", err)
+	}
+	defer rows.Close()
+	refs := make([]EntryRef, 0)
+	for rows.Next() {
+		var ref EntryRef
+		if err := rows.Scan(&ref.Kind, &ref.Id); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("db.Query: %w", err)
+	}
+	return refs, nil
+}
+
+// Entries of all drives having tag `tag`.
+func (c *sqlCatalog) FindTagged(tag string) ([]EntryRef, error) {
+	return fetchEntryRefs(c, "SELECT kind, entryId FROM tags WHERE tag = ?", tag)
+}
+
+// Entries of all drives having attribute `name`, with value `value` unless
+// `value` is empty.
+func (c *sqlCatalog) FindAttribute(name string, value string) ([]EntryRef, error) {
+	if value == "" {
+		return fetchEntryRefs(c, "SELECT kind, entryId FROM attributes WHERE name = ?", name)
+	}
+	return fetchEntryRefs(c, "SELECT kind, entryId FROM attributes WHERE name = ? AND value = ?", name, value)
+}
@@ -0,0 +1,76 @@
+
+package catalog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	c, err := Create(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	archive, _ := c.CreateDrive("archive", "", "local", "/tmp/archive")
+	folder, _ := c.CreateDirectory(archive, "contracts", -1)
+	file, _ := c.CreateFile(archive, "2024.pdf", "uuid1", folder, time.Now(), time.Now(), "", 1, "")
+
+	c.AddTag(KIND_FILE, file, "legal-hold")
+	c.AddTag(KIND_FILE, file, "legal-hold")
+	c.AddTag(KIND_FILE, file, "signed")
+	c.AddTag(KIND_FOLDER, folder, "legal-hold")
+	c.SetAttribute(KIND_FILE, file, "client", "globex")
+	c.SetAttribute(KIND_FILE, file, "client", "acme")
+	annotations, err := c.FetchAnnotations(KIND_FILE, file)
+	if err != nil {
+		t.Fatalf("FetchAnnotations: %v", err)
+	}
+	if !equalPaths(annotations.Tags, "legal-hold", "signed") || len(annotations.Attributes) != 1 || annotations.Attributes["client"] != "acme" {
+		t.Errorf("annotations = %v", annotations)
+	}
+	if tags, _ := c.FetchTags(); len(tags) != 2 || tags["legal-hold"] != 2 || tags["signed"] != 1 {
+		t.Errorf("tags = %v", tags)
+	}
+	if refs, _ := c.FindTagged("signed"); len(refs) != 1 || refs[0] != (EntryRef{KIND_FILE, file}) {
+		t.Errorf("tagged signed = %v", refs)
+	}
+	if refs, _ := c.FindAttribute("client", "acme"); len(refs) != 1 {
+		t.Errorf("client=acme = %v", refs)
+	}
+	if refs, _ := c.FindAttribute("client", "globex"); len(refs) != 0 {
+		t.Errorf("client=globex = %v", refs)
+	}
+	// Tags and attributes are searchable.
+	if got := searchPaths(t, c, "acme"); !equalPaths(got, "/archive/contracts/2024.pdf") {
+		t.Errorf("search acme = %v", got)
+	}
+	if got := searchPaths(t, c, "legal"); len(got) != 2 {
+		t.Errorf("search legal = %v", got)
+	}
+	if err := c.AddTag(KIND_DRIVE, archive, "x"); err == nil {
+		t.Errorf("tagging a drive should fail")
+	}
+
+	copied, _ := c.CreateFile(archive, "copy.pdf", "uuid1", folder, time.Now(), time.Now(), "", 1, "")
+	if err := c.CopyAnnotations(KIND_FILE, file, copied); err != nil {
+		t.Fatalf("CopyAnnotations: %v", err)
+	}
+	if annotations, _ := c.FetchAnnotations(KIND_FILE, copied); !equalPaths(annotations.Tags, "legal-hold", "signed") || annotations.Attributes["client"] != "acme" {
+		t.Errorf("annotations of copy = %v", annotations)
+	}
+
+	c.RemoveTag(KIND_FILE, file, "signed")
+	c.RemoveAttribute(KIND_FILE, file, "client")
+	if got := searchPaths(t, c, "acme"); !equalPaths(got, "/archive/contracts/copy.pdf") {
+		t.Errorf("search acme after removal = %v", got)
+	}
+	// Annotations go away with their entry.
+	c.DeleteFile(copied)
+	if refs, _ := c.FindTagged("signed"); len(refs) != 0 {
+		t.Errorf("tagged signed after delete = %v", refs)
+	}
+	if refs, _ := c.FindAttribute("client", ""); len(refs) != 0 {
+		t.Errorf("client after delete = %v", refs)
+	}
+}
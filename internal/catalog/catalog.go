@@ -7,6 +7,13 @@ import (
 
 // What's an abstract interface to a catalog?
 
+// Kinds of entries, in search results and annotations.
+const (
+	KIND_FILE = "file"
+	KIND_FOLDER = "folder"
+	KIND_DRIVE = "drive"
+)
+
 type DriveDescriptor struct {
 	Id int
 	Name string
@@ -29,17 +36,78 @@ type FileDescriptor struct {
 	Created time.Time
 	Updated time.Time
 	Metadata string
+	Size int64          // -1 if unknown.
+	Hash string         // CRC32C of the content, "" if unknown.
+}
+
+type SearchResult struct {
+	Kind string         // KIND_FILE, KIND_FOLDER or KIND_DRIVE.
+	Id int              // Identifier of the file, folder or drive.
+	Path string         // Full path, /drive/folder/file.
+	Score float64       // Higher is better.
+}
+
+// Tags and user-defined attributes of a folder or file.
+type Annotations struct {
+	Tags []string                  // Sorted.
+	Attributes map[string]string
+}
+
+// A folder or file, by kind (KIND_FILE or KIND_FOLDER) and identifier.
+type EntryRef struct {
+	Kind string
+	Id int
+}
+
+// Limits of a drive, 0 for no limit.
+type Quota struct {
+	Bytes int64
+	Files int
+}
+
+// Space used by a drive, as counted against its quota.
+type DriveUsage struct {
+	Files int
+	Bytes int64        // Stored by storage objects, counted once, files of unknown size not counted.
 }
 
 type Catalog interface {
 	FetchDrives() (map[int]DriveDescriptor, error)
+	CreateDrive(string, string, string, string) (int, error)
 	FetchFiles(int) (map[int]FileDescriptor, error)
 	FetchDirectories(int) (map[int]DirectoryDescriptor, error)
-	CreateFile(int, string, string, int, time.Time, time.Time, string) (int, error)
+	FetchDirectoryContent(int, int) (map[int]DirectoryDescriptor, map[int]FileDescriptor, error)
+	CreateFile(int, string, string, int, time.Time, time.Time, string, int64, string) (int, error)
 	CreateDirectory(int, string, int) (int, error)
 	UpdateFile(int, string, int) error
+	UpdateFileContent(int, string, time.Time, string, int64, string) error
+	UpdateObjectMetadata(int, string, string) error
 	UpdateDirectory(int, string, int) error
+	DeleteFile(int) error
+	DeleteDirectory(int) error
 	CountFilesInDirectory(int) (int, error)
 	CountFilesInDrive(int) (int, error)
+	CountReferences(int, string) (int, error)
+	DriveVersion(int) (int64, error)
+	Search(string, int) ([]SearchResult, error)
+	FetchAnnotations(string, int) (Annotations, error)
+	AddTag(string, int, string) error
+	RemoveTag(string, int, string) error
+	SetAttribute(string, int, string, string) error
+	RemoveAttribute(string, int, string) error
+	CopyAnnotations(string, int, int) error
+	FetchTags() (map[string]int, error)
+	FindTagged(string) ([]EntryRef, error)
+	FindAttribute(string, string) ([]EntryRef, error)
+	FetchQuota(int) (Quota, error)
+	SetQuota(int, Quota) error
+	FetchDriveUsage(int, func(int64, string) int64) (DriveUsage, error)
+	FetchSubdirectories(int, int) (map[int]DirectoryDescriptor, error)
+	WalkFiles(int, int, func(FileDescriptor) error) error
+	// Advisory lock held while writing to the catalog, so that processes
+	// sharing a catalog do not interleave their writes. Lock blocks until
+	// the lock is available, and can be taken again by the same process.
+	Lock() error
+	Unlock() error
 }
 
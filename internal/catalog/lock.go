@@ -0,0 +1,53 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The writer lock is an flock on a file next to the database, not on the
+// database itself: SQLite uses POSIX locks on the database, which the
+// process loses as soon as it closes any descriptor of that file.
+
+func (c *sqlCatalog) Lock() error {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	if c.lockCount > 0 {
+		c.lockCount++
+		return nil
+	}
+	f, err := os.OpenFile(c.dbPath + ".lock", os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return fmt.Errorf("syscall.Flock: %v", err)
+	}
+	c.lockFile = f
+	c.lockCount = 1
+	return nil
+}
+
+func (c *sqlCatalog) Unlock() error {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	if c.lockCount == 0 {
+		return fmt.Errorf("catalog not locked")
+	}
+	c.lockCount--
+	if c.lockCount > 0 {
+		return nil
+	}
+	f := c.lockFile
+	c.lockFile = nil
+	// Closing the file releases the lock.
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package catalog
+
+import (
+	"fmt"
+)
+
+// No writer lock on other platforms: processes sharing a catalog still
+// detect each other's changes through the version of drives.
+
+func (c *sqlCatalog) Lock() error {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	c.lockCount++
+	return nil
+}
+
+func (c *sqlCatalog) Unlock() error {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	if c.lockCount == 0 {
+		return fmt.Errorf("catalog not locked")
+	}
+	c.lockCount--
+	return nil
+}
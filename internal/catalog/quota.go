@@ -0,0 +1,83 @@
+
+package catalog
+
+import (
+	"fmt"
+)
+
+// Quotas of drives, in columns quotaBytes and quotaFiles of table drives
+// (see MIGRATIONS). They are only recorded here: commands check them before
+// writing to a drive.
+
+func (c *sqlCatalog) FetchQuota(driveId int) (Quota, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return Quota{}, err
+	}
+	defer db.Close()
+
+	row := db.QueryRow("SELECT quotaBytes, quotaFiles FROM drives WHERE id = ?", driveId)
+	var quota Quota
+	if err := row.Scan(&quota.Bytes, &quota.Files); err != nil {
+		return Quota{}, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	return quota, nil
+}
+
+func (c *sqlCatalog) SetQuota(driveId int, quota Quota) error {
+	if quota.Bytes < 0 || quota.Files < 0 {
+		return fmt.Errorf("negative quota")
+	}
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE drives SET quotaBytes = ?, quotaFiles = ? WHERE id = ?", quota.Bytes, quota.Files, driveId)
+	if err != nil {
+		return fmt.Errorf("db.Exec: %w", err)
+	}
+	if count, err := result.RowsAffected(); err == nil && count == 0 {
+		return fmt.Errorf("no drive %d", driveId)
+	}
+	return nil
+}
+
+// Files of a drive, and bytes of its storage objects, as given by `stored`
+// from the size and metadata of every object (their size if nil). Copies of
+// a file within a drive share their object, which is counted once.
+func (c *sqlCatalog) FetchDriveUsage(driveId int, stored func(int64, string) int64) (DriveUsage, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return DriveUsage{}, err
+	}
+	defer db.Close()
+
+	row := db.QueryRow("SELECT count(*) FROM files WHERE driveId = ?", driveId)
+	var usage DriveUsage
+	if err := row.Scan(&usage.Files); err != nil {
+		return DriveUsage{}, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	// The metadata is that of the row holding the maximum size.
+	rows, err := db.Query("SELECT max(size), metadata FROM files WHERE driveId = ? AND size >= 0 GROUP BY uuid", driveId)
+	if err != nil {
+		return DriveUsage{}, fmt.Errorf("db.Query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var size int64
+		var metadata string
+		if err := rows.Scan(&size, &metadata); err != nil {
+			return DriveUsage{}, fmt.Errorf("error reading files table: %w", err)
+		}
+		if stored != nil {
+			size = stored(size, metadata)
+		}
+		usage.Bytes += size
+	}
+	if err := rows.Err(); err != nil {
+		return DriveUsage{}, fmt.Errorf("error reading files table: %w", err)
+	}
+	return usage, nil
+}
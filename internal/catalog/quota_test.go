@@ -0,0 +1,45 @@
+
+package catalog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	c, err := Create(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	archive, _ := c.CreateDrive("archive", "", "local", "/tmp/archive")
+	if quota, err := c.FetchQuota(archive); err != nil || quota != (Quota{}) {
+		t.Errorf("quota of new drive = %v, %v", quota, err)
+	}
+	if err := c.SetQuota(archive, Quota{Bytes: 1 << 30, Files: 100}); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	if quota, _ := c.FetchQuota(archive); quota != (Quota{Bytes: 1 << 30, Files: 100}) {
+		t.Errorf("quota = %v", quota)
+	}
+	if err := c.SetQuota(archive, Quota{Bytes: -1}); err == nil {
+		t.Errorf("negative quota should be refused")
+	}
+	if err := c.SetQuota(archive + 1, Quota{Files: 1}); err == nil {
+		t.Errorf("quota of missing drive should fail")
+	}
+
+	c.CreateFile(archive, "a", "uuid1", -1, time.Now(), time.Now(), "", 100, "")
+	c.CreateFile(archive, "copy of a", "uuid1", -1, time.Now(), time.Now(), "", 100, "")
+	c.CreateFile(archive, "b", "uuid2", -1, time.Now(), time.Now(), "", 20, "")
+	c.CreateFile(archive, "unknown", "uuid3", -1, time.Now(), time.Now(), "", -1, "")
+	if usage, err := c.FetchDriveUsage(archive, nil); err != nil || usage != (DriveUsage{Files: 4, Bytes: 120}) {
+		t.Errorf("usage = %v, %v", usage, err)
+	}
+	mirrored := func(size int64, metadata string) int64 {
+		return 2 * size
+	}
+	if usage, err := c.FetchDriveUsage(archive, mirrored); err != nil || usage != (DriveUsage{Files: 4, Bytes: 240}) {
+		t.Errorf("stored usage = %v, %v", usage, err)
+	}
+}
@@ -0,0 +1,219 @@
+
+package catalog
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Full-text index of drives, folders and files, in FTS4 table `search`
+// (see MIGRATIONS), with columns name, path, tags and description. Paths
+// are /drive/folder/file. The docid of a row is 4 * id + kind of its entry.
+// The index is kept up to date by the methods writing to the catalog, in
+// the same transaction as the write. The tags column holds the tags and
+// attributes of folders and files (see annotations.go).
+
+var searchKinds = []string{KIND_FILE, KIND_FOLDER, KIND_DRIVE}
+
+// Weights of the columns when ranking results.
+var searchWeights = []float64{4, 1, 3, 2}
+
+func searchDocid(kind string, id int) int64 {
+	for i, k := range searchKinds {
+		if k == kind {
+			return int64(id) * 4 + int64(i)
+		}
+	}
+	panic("unknown kind " + kind)
+}
+
+// Path of folder `dirId` of drive `driveId`, or of the drive itself if
+// `dirId` is -1. The name of a missing drive is empty.
+func folderPath(tx *sql.Tx, driveId int, dirId int) (string, error) {
+	var drive string
+	if err := tx.QueryRow("SELECT coalesce((SELECT name FROM drives WHERE id = ?), '')", driveId).Scan(&drive); err != nil {
+		return "", fmt.Errorf("tx.QueryRow: %w", err)
+	}
+	rows, err := tx.Query(`WITH RECURSIVE ancestors(name, parentId, depth) AS (
+	                         SELECT name, parentId, 0 FROM directories WHERE id = ?
+	                         UNION ALL
+	                         SELECT directories.name, directories.parentId, ancestors.depth + 1
+	                           FROM directories, ancestors
+	                           WHERE directories.id = ancestors.parentId
+	                       ) SELECT name FROM ancestors ORDER BY depth DESC`, dirId)
+	if err != nil {
+		return "", fmt.Errorf("tx.Query: %w", err)
+	}
+	defer rows.Close()
+	path := "/" + drive
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", fmt.Errorf("rows.Scan: %w", err)
+		}
+		path = path + "/" + name
+	}
+	return path, rows.Err()
+}
+
+// Add or update the row of an entry, keeping its tags.
+func indexEntry(tx *sql.Tx, kind string, id int, name string, path string, description string) error {
+	docid := searchDocid(kind, id)
+	result, err := tx.Exec("UPDATE search SET name = ?, path = ?, description = ? WHERE docid = ?", name, path, description, docid)
+	if err != nil {
+		return fmt.Errorf("tx.Exec(search): %w", err)
+	}
+	if count, _ := result.RowsAffected(); count > 0 {
+		return nil
+	}
+	if _, err := tx.Exec("INSERT INTO search (docid, name, path, tags, description) VALUES (?, ?, ?, '', ?)", docid, name, path, description); err != nil {
+		return fmt.Errorf("tx.Exec(search): %w", err)
+	}
+	return nil
+}
+
+// Index file `id`, in folder `dirId` of drive `driveId`.
+func indexFile(tx *sql.Tx, id int, driveId int, name string, dirId int) error {
+	parent, err := folderPath(tx, driveId, dirId)
+	if err != nil {
+		return err
+	}
+	return indexEntry(tx, KIND_FILE, id, name, parent + "/" + name, "")
+}
+
+// Index folder `id` of drive `driveId`, and the paths of everything below it
+// if it was at `oldPath` before.
+func indexFolder(tx *sql.Tx, id int, driveId int, name string, parentId int, oldPath string) error {
+	parent, err := folderPath(tx, driveId, parentId)
+	if err != nil {
+		return err
+	}
+	path := parent + "/" + name
+	if err := indexEntry(tx, KIND_FOLDER, id, name, path, ""); err != nil {
+		return err
+	}
+	if oldPath == "" || oldPath == path {
+		return nil
+	}
+	// Lengths are in characters for SQLite.
+	_, err = tx.Exec(`WITH RECURSIVE subfolders(id) AS (
+	                    SELECT id FROM directories WHERE parentId = ?
+	                    UNION ALL
+	                    SELECT directories.id FROM directories, subfolders WHERE directories.parentId = subfolders.id
+	                  ) UPDATE search SET path = ? || substr(path, ?)
+	                    WHERE docid IN (SELECT id * 4 + 1 FROM subfolders
+	                                    UNION ALL
+	                                    SELECT id * 4 FROM files WHERE directoryId = ? OR directoryId IN subfolders)`,
+		id, path, utf8.RuneCountInString(oldPath) + 1, id)
+	if err != nil {
+		return fmt.Errorf("tx.Exec(search): %w", err)
+	}
+	return nil
+}
+
+func unindexEntry(tx *sql.Tx, kind string, id int) error {
+	if _, err := tx.Exec("DELETE FROM search WHERE docid = ?", searchDocid(kind, id)); err != nil {
+		return fmt.Errorf("tx.Exec(search): %w", err)
+	}
+	return nil
+}
+
+// Full-text query matching entries with words starting with every word of
+// `query`, ignoring case and accents. Operators of the FTS query syntax are
+// not available.
+func searchQuery(query string) string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = word + "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// Entries matching every word of `query`, as a prefix, in their name, path,
+// tags or description, best matches first. At most `limit` results are
+// returned, unless `limit` is not positive.
+func (c *sqlCatalog) Search(query string, limit int) ([]SearchResult, error) {
+	match := searchQuery(query)
+	if match == "" {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+	db, err := openDB(c)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT docid, path, matchinfo(search, 'pcnx') FROM search WHERE search MATCH ?", match)
+	if err != nil {
+		return nil, fmt.Errorf("db.Query(search): %w", err)
+	}
+	defer rows.Close()
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var docid int64
+		var path string
+		var info []byte
+		if err := rows.Scan(&docid, &path, &info); err != nil {
+			return nil, fmt.Errorf("error reading search table: %w", err)
+		}
+		results = append(results, SearchResult{
+			Kind: searchKinds[docid % 4],
+			Id: int(docid / 4),
+			Path: path,
+			Score: searchScore(info),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("db.Query(search): %w", err)
+	}
+	sort.Slice(results, func(i int, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if len(results[i].Path) != len(results[j].Path) {
+			return len(results[i].Path) < len(results[j].Path)
+		}
+		return results[i].Path < results[j].Path
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// Score of a result from its matchinfo 'pcnx': for every word and column,
+// the hits in the row weighted by the column and by the rarity of the word
+// in that column (TF-IDF). Matchinfo is in native byte order, little-endian
+// on all supported platforms.
+func searchScore(info []byte) float64 {
+	values := make([]uint32, len(info) / 4)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(info[4 * i:])
+	}
+	if len(values) < 3 {
+		return 0
+	}
+	phrases, columns, rows := int(values[0]), int(values[1]), float64(values[2])
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for col := 0; col < columns && col < len(searchWeights); col++ {
+			x := 3 + 3 * (p * columns + col)
+			if x + 2 >= len(values) {
+				return score
+			}
+			hits, rowsWithHits := float64(values[x]), float64(values[x + 2])
+			if hits > 0 {
+				score += searchWeights[col] * hits * math.Log(1 + rows / rowsWithHits)
+			}
+		}
+	}
+	return score
+}
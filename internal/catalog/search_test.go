@@ -0,0 +1,111 @@
+
+package catalog
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func searchPaths(t *testing.T, c Catalog, query string) []string {
+	t.Helper()
+	results, err := c.Search(query, 0)
+	if err != nil {
+		t.Fatalf("Search(%s): %v", query, err)
+	}
+	paths := make([]string, 0, len(results))
+	for _, r := range results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func equalPaths(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearch(t *testing.T) {
+	c, err := Create(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	archive, _ := c.CreateDrive("archive", "Old university stuff", "local", "/tmp/archive")
+	photos, _ := c.CreateDrive("photos", "", "local", "/tmp/photos")
+	thesis, _ := c.CreateDirectory(archive, "Thèse", -1)
+	drafts, _ := c.CreateDirectory(archive, "drafts", thesis)
+	c.CreateFile(archive, "chapter1.tex", "uuid1", drafts, time.Now(), time.Now(), "", 1, "")
+	c.CreateFile(archive, "thesis-final.pdf", "uuid2", -1, time.Now(), time.Now(), "", 1, "")
+	c.CreateFile(photos, "thesis-defense.jpg", "uuid3", -1, time.Now(), time.Now(), "", 1, "")
+
+	// Prefixes, across drives, ignoring case and accents, names first.
+	if got := searchPaths(t, c, "THES"); !equalPaths(got, "/archive/Thèse", "/archive/thesis-final.pdf", "/photos/thesis-defense.jpg", "/archive/Thèse/drafts", "/archive/Thèse/drafts/chapter1.tex") {
+		t.Errorf("search thes = %v", got)
+	}
+	// Every word must match.
+	if got := searchPaths(t, c, "these chap"); !equalPaths(got, "/archive/Thèse/drafts/chapter1.tex") {
+		t.Errorf("search these chap = %v", got)
+	}
+	if got := searchPaths(t, c, "university"); !equalPaths(got, "/archive") {
+		t.Errorf("search university = %v", got)
+	}
+	results, _ := c.Search("chapter1", 1)
+	if len(results) != 1 || results[0].Kind != KIND_FILE || results[0].Path != "/archive/Thèse/drafts/chapter1.tex" {
+		t.Errorf("search chapter1 = %+v", results)
+	}
+
+	// Moving a folder moves everything below it.
+	if err := c.UpdateDirectory(drafts, "old drafts", -1); err != nil {
+		t.Fatalf("UpdateDirectory: %v", err)
+	}
+	if got := searchPaths(t, c, "chapter1"); !equalPaths(got, "/archive/old drafts/chapter1.tex") {
+		t.Errorf("search after move = %v", got)
+	}
+	if got := searchPaths(t, c, "these chap"); len(got) != 0 {
+		t.Errorf("search after move = %v", got)
+	}
+	if err := c.DeleteDirectory(thesis); err != nil {
+		t.Fatalf("DeleteDirectory: %v", err)
+	}
+	if got := searchPaths(t, c, "these"); len(got) != 0 {
+		t.Errorf("search after delete = %v", got)
+	}
+	if _, err := c.Search("  ?! ", 0); err == nil {
+		t.Errorf("search without words should fail")
+	}
+}
+
+func TestSearchMigration(t *testing.T) {
+	// A catalog created before the index.
+	dbPath := filepath.Join(t.TempDir(), "catalog.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		SCHEMA,
+		"INSERT INTO drives (id, name, description, host, address) VALUES (1, 'archive', '', 'local', '/tmp')",
+		"INSERT INTO directories (id, driveId, name, parentId) VALUES (1, 1, 'projects', -1), (2, 1, 'compiler', 1)",
+		"INSERT INTO files (driveId, name, directoryId, uuid, created, updated, metadata) VALUES (1, 'lexer.go', 2, 'uuid', 0, 0, ''), (1, 'readme', -1, 'uuid', 0, 0, '')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("db.Exec: %v", err)
+		}
+	}
+	c := Open(dbPath)
+	if got := searchPaths(t, c, "compiler"); !equalPaths(got, "/archive/projects/compiler", "/archive/projects/compiler/lexer.go") {
+		t.Errorf("search compiler = %v", got)
+	}
+	if got := searchPaths(t, c, "readme"); !equalPaths(got, "/archive/readme") {
+		t.Errorf("search readme = %v", got)
+	}
+}
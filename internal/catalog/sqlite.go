@@ -3,7 +3,9 @@ package catalog
 
 import (
 	"fmt"
+	"os"
 	"time"
+	"sync"
 	"database/sql"
 
 	"rpucella.net/virtual-hard-drive/internal/util"
@@ -13,6 +15,115 @@ import (
 
 const CONFIG_SQLITE = "catalog.db"
 
+// Keep in sync with schema.sql.
+const SCHEMA = `
+CREATE TABLE drives (
+  id integer primary key,
+  name text,
+  description text,
+  host text,
+  address text
+);
+
+CREATE TABLE directories (
+  id integer primary key,
+  driveId integer,
+  name text,
+  parentId integer
+);
+
+CREATE TABLE files (
+  id integer primary key,
+  driveId integer,
+  name text,
+  directoryId integer,
+  uuid text,
+  created int,
+  updated int,
+  metadata text
+);
+`
+
+// Schema migrations, in order. The version of a catalog (PRAGMA user_version)
+// is the number of migrations applied to it. Catalogs created from SCHEMA are
+// at version 0, and are migrated the first time they are opened.
+var MIGRATIONS = []string{
+	// 1: size and CRC32C of files.
+	`ALTER TABLE files ADD COLUMN size integer DEFAULT -1;
+	 ALTER TABLE files ADD COLUMN hash text DEFAULT '';`,
+	// 2: change counter of drives, bumped by every write to their folders
+	// and files, whoever makes it.
+	`ALTER TABLE drives ADD COLUMN version integer DEFAULT 0;
+	 CREATE TRIGGER files_insert AFTER INSERT ON files BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = NEW.driveId;
+	 END;
+	 CREATE TRIGGER files_update AFTER UPDATE ON files BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = OLD.driveId OR id = NEW.driveId;
+	 END;
+	 CREATE TRIGGER files_delete AFTER DELETE ON files BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = OLD.driveId;
+	 END;
+	 CREATE TRIGGER directories_insert AFTER INSERT ON directories BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = NEW.driveId;
+	 END;
+	 CREATE TRIGGER directories_update AFTER UPDATE ON directories BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = OLD.driveId OR id = NEW.driveId;
+	 END;
+	 CREATE TRIGGER directories_delete AFTER DELETE ON directories BEGIN
+	   UPDATE drives SET version = version + 1 WHERE id = OLD.driveId;
+	 END;`,
+	// 3: indices for loading folders one at a time, and counting references
+	// to storage objects.
+	`CREATE INDEX directories_parent ON directories (parentId, driveId);
+	 CREATE INDEX files_directory ON files (directoryId, driveId);
+	 CREATE INDEX files_uuid ON files (driveId, uuid);`,
+	// 4: full-text index of drives, folders and files (see search.go).
+	`CREATE VIRTUAL TABLE search USING fts4(name, path, tags, description, prefix="2,3", tokenize=unicode61);
+	 INSERT INTO search (docid, name, path, tags, description)
+	   SELECT id * 4 + 2, name, '/' || name, '', coalesce(description, '') FROM drives;
+	 WITH RECURSIVE paths(id, path) AS (
+	   SELECT directories.id, '/' || drives.name || '/' || directories.name FROM directories, drives
+	     WHERE directories.parentId = -1 AND drives.id = directories.driveId
+	   UNION ALL
+	   SELECT directories.id, paths.path || '/' || directories.name FROM directories, paths
+	     WHERE directories.parentId = paths.id
+	 ) INSERT INTO search (docid, name, path, tags, description)
+	     SELECT directories.id * 4 + 1, directories.name, paths.path, '', '' FROM directories, paths
+	       WHERE directories.id = paths.id;
+	 WITH RECURSIVE paths(id, path) AS (
+	   SELECT directories.id, '/' || drives.name || '/' || directories.name FROM directories, drives
+	     WHERE directories.parentId = -1 AND drives.id = directories.driveId
+	   UNION ALL
+	   SELECT directories.id, paths.path || '/' || directories.name FROM directories, paths
+	     WHERE directories.parentId = paths.id
+	 ) INSERT INTO search (docid, name, path, tags, description)
+	     SELECT files.id * 4, files.name, paths.path || '/' || files.name, '', '' FROM files, paths
+	       WHERE files.directoryId = paths.id;
+	 INSERT INTO search (docid, name, path, tags, description)
+	   SELECT files.id * 4, files.name, '/' || drives.name || '/' || files.name, '', '' FROM files, drives
+	     WHERE files.directoryId = -1 AND drives.id = files.driveId;`,
+	// 5: tags and user-defined attributes of folders and files (see
+	// annotations.go).
+	`CREATE TABLE tags (
+	   kind text,
+	   entryId integer,
+	   tag text,
+	   PRIMARY KEY (kind, entryId, tag)
+	 );
+	 CREATE INDEX tags_tag ON tags (tag);
+	 CREATE TABLE attributes (
+	   kind text,
+	   entryId integer,
+	   name text,
+	   value text,
+	   PRIMARY KEY (kind, entryId, name)
+	 );
+	 CREATE INDEX attributes_name ON attributes (name, value);`,
+	// 6: quotas of drives, 0 for no limit (see quota.go).
+	`ALTER TABLE drives ADD COLUMN quotaBytes integer DEFAULT 0;
+	 ALTER TABLE drives ADD COLUMN quotaFiles integer DEFAULT 0;`,
+}
+
 type config struct {
 	Type string
 	Location string
@@ -21,6 +132,11 @@ type config struct {
 
 type sqlCatalog struct {
 	dbPath string
+	migrateOnce sync.Once
+	migrateErr error
+	lockMu sync.Mutex
+	lockCount int          // Holders of the writer lock in this process.
+	lockFile *os.File
 }
 
 func openDB(c *sqlCatalog) (*sql.DB, error) {
@@ -28,9 +144,45 @@ func openDB(c *sqlCatalog) (*sql.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot open db file: %w", err)
 	}
+	c.migrateOnce.Do(func() {
+		c.migrateErr = migrate(db)
+	})
+	if c.migrateErr != nil {
+		db.Close()
+		return nil, c.migrateErr
+	}
 	return db, nil
 }
 
+// Apply the migrations that have not been applied yet.
+func migrate(db *sql.DB) error {
+	row := db.QueryRow("PRAGMA user_version")
+	var version int
+	if err := row.Scan(&version); err != nil {
+		return fmt.Errorf("db.QueryRow: %w", err)
+	}
+	for version < len(MIGRATIONS) {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("db.Begin: %w", err)
+		}
+		if _, err := tx.Exec(MIGRATIONS[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version + 1, err)
+		}
+		// PRAGMA does not take parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version + 1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version + 1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("tx.Commit: %w", err)
+		}
+		version++
+	}
+	return nil
+}
+
 func (c *sqlCatalog) FetchDrives() (map[int]DriveDescriptor, error) {
 	db, err := openDB(c)
 	if err != nil {
@@ -39,7 +191,10 @@ func (c *sqlCatalog) FetchDrives() (map[int]DriveDescriptor, error) {
 	defer db.Close()
 	
 	drives:= make(map[int]DriveDescriptor)
-	rows, err := db.Query("SELECT * FROM drives")
+	rows, err := db.Query("SELECT id, name, description, host, address FROM drives")
+	if err != nil {
+		return nil, fmt.Errorf("db.Query(drives): %w", err)
+	}
 	var id int
 	var name string
 	var description string
@@ -81,6 +236,50 @@ func (c *sqlCatalog) FetchDirectories(driveId int) (map[int]DirectoryDescriptor,
 	return directories, nil
 }
 
+// Folders and files of a drive directly within folder `dirId` (-1 for the
+// top of the drive).
+func (c *sqlCatalog) FetchDirectoryContent(driveId int, dirId int) (map[int]DirectoryDescriptor, map[int]FileDescriptor, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, parentId FROM directories WHERE parentId = ? AND driveId = ?", dirId, driveId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.Query(directories): %w", err)
+	}
+	defer rows.Close()
+	directories := make(map[int]DirectoryDescriptor)
+	for rows.Next() {
+		var dir DirectoryDescriptor
+		if err := rows.Scan(&dir.Id, &dir.Name, &dir.ParentId); err != nil {
+			return nil, nil, fmt.Errorf("error reading directories table: %w", err)
+		}
+		directories[dir.Id] = dir
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT id, name, directoryId, uuid, created, updated, metadata, size, hash FROM files WHERE directoryId = ? AND driveId = ?", dirId, driveId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db.Query(files): %w", err)
+	}
+	defer rows.Close()
+	files := make(map[int]FileDescriptor)
+	for rows.Next() {
+		var file FileDescriptor
+		var created int64
+		var updated int64
+		if err := rows.Scan(&file.id, &file.Name, &file.DirectoryId, &file.UUID, &created, &updated, &file.Metadata, &file.Size, &file.Hash); err != nil {
+			return nil, nil, fmt.Errorf("error reading files table: %w", err)
+		}
+		file.Created = time.Unix(created, 0)
+		file.Updated = time.Unix(updated, 0)
+		files[file.id] = file
+	}
+	return directories, files, nil
+}
+
 func (c *sqlCatalog) FetchFiles(driveId int) (map[int]FileDescriptor, error) {
 	db, err := openDB(c)
 	if err != nil {
@@ -88,7 +287,7 @@ func (c *sqlCatalog) FetchFiles(driveId int) (map[int]FileDescriptor, error) {
 	}
 	defer db.Close()
 	
-	rows, err := db.Query("SELECT id, name, directoryId, uuid, created, updated, metadata FROM files WHERE driveId = ?", driveId)
+	rows, err := db.Query("SELECT id, name, directoryId, uuid, created, updated, metadata, size, hash FROM files WHERE driveId = ?", driveId)
 	if err != nil {
 		return nil, fmt.Errorf("db.Query(files): %w", err)
 	}
@@ -100,35 +299,47 @@ func (c *sqlCatalog) FetchFiles(driveId int) (map[int]FileDescriptor, error) {
 	var created int64
 	var updated int64
 	var metadata string
+	var size int64
+	var hash string
 	for rows.Next() {
-		err = rows.Scan(&id, &name, &directoryId, &uuid, &created, &updated, &metadata)
+		err = rows.Scan(&id, &name, &directoryId, &uuid, &created, &updated, &metadata, &size, &hash)
 		if err != nil {
 			return nil, fmt.Errorf("error reading files table: %w", err)
 		}
 		upTime := time.Unix(updated, 0)
 		crTime := time.Unix(created, 0)
-		files[id] = FileDescriptor{id, name, directoryId, uuid, crTime, upTime, metadata}
+		files[id] = FileDescriptor{id, name, directoryId, uuid, crTime, upTime, metadata, size, hash}
 	}
 	return files, nil
 }
 
 
-func (c *sqlCatalog) CreateFile(driveId int, name string, uuid string, dirId int, created time.Time, updated time.Time, metadata string) (int, error) {
+func (c *sqlCatalog) CreateFile(driveId int, name string, uuid string, dirId int, created time.Time, updated time.Time, metadata string, size int64, hash string) (int, error) {
 	db, err := openDB(c)
 	if err != nil {
 		return 0, err
 	}
 	defer db.Close()
 
-	if _, err := db.Exec("INSERT INTO files (driveId, name, directoryId, uuid, created, updated, metadata) values (?, ?, ?, ?, ?, ?, ?)", driveId, name, dirId, uuid, created.Unix(), updated.Unix(), metadata); err != nil {
-		return 0, fmt.Errorf("db.Exec: %w", err)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("db.Begin: %w", err)
 	}
-	row := db.QueryRow("SELECT last_insert_rowid()")
-	var id int64
-	if err := row.Scan(&id); err != nil { 
-		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO files (driveId, name, directoryId, uuid, created, updated, metadata, size, hash) values (?, ?, ?, ?, ?, ?, ?, ?, ?)", driveId, name, dirId, uuid, created.Unix(), updated.Unix(), metadata, size, hash)
+	if err != nil {
+		return 0, fmt.Errorf("tx.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil { 
+		return 0, fmt.Errorf("result.LastInsertId: %w", err)
+	}
+	if err := indexFile(tx, int(id), driveId, name, dirId); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit: %w", err)
 	}
-	db.Close()
 	return int(id), nil
 }
 
@@ -139,15 +350,25 @@ func (c *sqlCatalog) CreateDirectory(driveId int, name string, parentId int) (in
 	}
 	defer db.Close()
 
-	if _, err := db.Exec("INSERT INTO directories (driveId, name, parentId) values (?, ?, ?)", driveId, name, parentId); err != nil {
-		return 0, fmt.Errorf("db.Exec: %w", err)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("db.Begin: %w", err)
 	}
-	row := db.QueryRow("SELECT last_insert_rowid()")
-	var id int64
-	if err := row.Scan(&id); err != nil {
-		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO directories (driveId, name, parentId) values (?, ?, ?)", driveId, name, parentId)
+	if err != nil {
+		return 0, fmt.Errorf("tx.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("result.LastInsertId: %w", err)
+	}
+	if err := indexFolder(tx, int(id), driveId, name, parentId, ""); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit: %w", err)
 	}
-	db.Close()
 	return int(id), nil
 }
 
@@ -158,34 +379,206 @@ func (c *sqlCatalog) UpdateFile(id int, name string, dirId int) error {
 	}
 	defer db.Close()
 	
-	if _, err := db.Exec("UPDATE files SET name = ?, directoryId = ? where id = ?", name, dirId, id); err != nil {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE files SET name = ?, directoryId = ? where id = ?", name, dirId, id); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	var driveId int
+	if err := tx.QueryRow("SELECT driveId FROM files WHERE id = ?", id).Scan(&driveId); err != nil {
+		return fmt.Errorf("tx.QueryRow: %w", err)
+	}
+	if err := indexFile(tx, id, driveId, name, dirId); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
+// Point a file to a new storage object.
+func (c *sqlCatalog) UpdateFileContent(id int, uuid string, updated time.Time, metadata string, size int64, hash string) error {
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE files SET uuid = ?, updated = ?, metadata = ?, size = ?, hash = ? where id = ?", uuid, updated.Unix(), metadata, size, hash, id); err != nil {
 		return fmt.Errorf("db.Exec: %w", err)
 	}
 	db.Close()
 	return nil
 }
 
-func (c *sqlCatalog) UpdateDirectory(id int, name string, parentId int) error {
+// Update the metadata of every file of a drive sharing the storage object `uuid`.
+func (c *sqlCatalog) UpdateObjectMetadata(driveId int, uuid string, metadata string) error {
 	db, err := openDB(c)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	if _, err := db.Exec("UPDATE directories SET name = ?, parentId = ? where id = ?", name, parentId, id); err != nil {
+	if _, err := db.Exec("UPDATE files SET metadata = ? where driveId = ? and uuid = ?", metadata, driveId, uuid); err != nil {
 		return fmt.Errorf("db.Exec: %w", err)
 	}
 	db.Close()
 	return nil
 }
 
+func (c *sqlCatalog) UpdateDirectory(id int, name string, parentId int) error {
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	var driveId int
+	if err := tx.QueryRow("SELECT driveId FROM directories WHERE id = ?", id).Scan(&driveId); err != nil {
+		return fmt.Errorf("tx.QueryRow: %w", err)
+	}
+	oldPath, err := folderPath(tx, driveId, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE directories SET name = ?, parentId = ? where id = ?", name, parentId, id); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	if err := indexFolder(tx, id, driveId, name, parentId, oldPath); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCatalog) DeleteFile(id int) error {
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM files where id = ?", id); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	if err := unindexEntry(tx, KIND_FILE, id); err != nil {
+		return err
+	}
+	if err := deleteAnnotations(tx, KIND_FILE, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
+func (c *sqlCatalog) DeleteDirectory(id int) error {
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow("SELECT (SELECT count(*) FROM files WHERE directoryId = ?) + (SELECT count(*) FROM directories WHERE parentId = ?)", id, id)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return fmt.Errorf("tx.QueryRow: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("directory %d not empty", id)
+	}
+	if _, err := tx.Exec("DELETE FROM directories where id = ?", id); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	if err := unindexEntry(tx, KIND_FOLDER, id); err != nil {
+		return err
+	}
+	if err := deleteAnnotations(tx, KIND_FOLDER, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	return nil
+}
+
 func Load() (Catalog, error) {
 	sqlFile, err := util.ConfigFile(CONFIG_SQLITE)
 	if err != nil {
 		return nil, err
 	}
-	result := &sqlCatalog{sqlFile}
-	return result, nil
+	return Open(sqlFile), nil
+}
+
+// Open the catalog stored in the given database file.
+func Open(dbPath string) Catalog {
+	return &sqlCatalog{dbPath: dbPath}
+}
+
+// Create a fresh catalog in the given database file.
+func Create(dbPath string) (Catalog, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open db file: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(SCHEMA); err != nil {
+		return nil, fmt.Errorf("db.Exec: %w", err)
+	}
+	db.Close()
+	return Open(dbPath), nil
+}
+
+func (c *sqlCatalog) CreateDrive(name string, description string, host string, address string) (int, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO drives (name, description, host, address) values (?, ?, ?, ?)", name, description, host, address)
+	if err != nil {
+		return 0, fmt.Errorf("tx.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("result.LastInsertId: %w", err)
+	}
+	if err := indexEntry(tx, KIND_DRIVE, int(id), name, "/" + name, description); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("tx.Commit: %w", err)
+	}
+	return int(id), nil
 }
 
 func (c *sqlCatalog) CountFilesInDirectory(dirId int) (int, error) {
@@ -225,3 +618,37 @@ func (c *sqlCatalog) CountFilesInDrive(driveId int) (int, error) {
 	db.Close()
 	return count, nil
 }
+
+// Change counter of a drive, bumped by every write to its folders and files.
+func (c *sqlCatalog) DriveVersion(driveId int) (int64, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	
+	row := db.QueryRow(`select version from drives where id = ?`, driveId)
+	var version int64
+	if err := row.Scan(&version); err != nil {
+		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	db.Close()
+	return version, nil
+}
+
+// Number of files of a drive sharing the storage object `uuid`.
+func (c *sqlCatalog) CountReferences(driveId int, uuid string) (int, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	
+	row := db.QueryRow(`select count(*) from files where driveId = ? and uuid = ?`, driveId, uuid)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	db.Close()
+	return count, nil
+}
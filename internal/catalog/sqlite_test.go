@@ -0,0 +1,146 @@
+
+package catalog
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	// A catalog at version 0, with a file.
+	dbPath := filepath.Join(t.TempDir(), "catalog.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(SCHEMA); err != nil {
+		t.Fatalf("db.Exec: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO files (driveId, name, directoryId, uuid, created, updated, metadata) values (1, 'a.txt', -1, 'uuid', 0, 0, '')"); err != nil {
+		t.Fatalf("db.Exec: %v", err)
+	}
+
+	c := Open(dbPath)
+	files, err := c.FetchFiles(1)
+	if err != nil {
+		t.Fatalf("FetchFiles: %v", err)
+	}
+	for _, f := range files {
+		if f.Size != -1 || f.Hash != "" {
+			t.Errorf("legacy file has size %d and hash %q", f.Size, f.Hash)
+		}
+	}
+	var version int
+	db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != len(MIGRATIONS) {
+		t.Errorf("version = %d, want %d", version, len(MIGRATIONS))
+	}
+
+	// Opening again does not reapply migrations.
+	c = Open(dbPath)
+	if _, err := c.CreateFile(1, "b.txt", "uuid2", -1, time.Now(), time.Now(), "", 3, "0000abcd"); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+}
+
+func TestDriveVersion(t *testing.T) {
+	c, err := Create(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	alpha, _ := c.CreateDrive("alpha", "", "local", "/tmp/alpha")
+	beta, _ := c.CreateDrive("beta", "", "local", "/tmp/beta")
+	version := func(driveId int) int64 {
+		t.Helper()
+		v, err := c.DriveVersion(driveId)
+		if err != nil {
+			t.Fatalf("DriveVersion: %v", err)
+		}
+		return v
+	}
+	v := version(alpha)
+	dirId, _ := c.CreateDirectory(alpha, "docs", -1)
+	fileId, _ := c.CreateFile(alpha, "a.txt", "uuid", dirId, time.Now(), time.Now(), "", 1, "")
+	c.UpdateFile(fileId, "b.txt", -1)
+	c.DeleteFile(fileId)
+	if got := version(alpha); got != v + 4 {
+		t.Errorf("version = %d, want %d", got, v + 4)
+	}
+	if got := version(beta); got != 0 {
+		t.Errorf("version of untouched drive = %d", got)
+	}
+	drives, err := c.FetchDrives()
+	if err != nil || len(drives) != 2 {
+		t.Errorf("FetchDrives = %v, %v", drives, err)
+	}
+
+	// The lock can be taken again by the same process.
+	if err := c.Lock(); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := c.Lock(); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	c.Unlock()
+	c.Unlock()
+	if err := c.Unlock(); err == nil {
+		t.Errorf("Unlock of unlocked catalog should fail")
+	}
+}
+
+func TestFetchDirectoryContent(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := Create(dbPath)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	alpha, _ := c.CreateDrive("alpha", "", "local", "/tmp/alpha")
+	beta, _ := c.CreateDrive("beta", "", "local", "/tmp/beta")
+	docs, _ := c.CreateDirectory(alpha, "docs", -1)
+	c.CreateDirectory(alpha, "sub", docs)
+	c.CreateFile(alpha, "a.txt", "uuid", docs, time.Now(), time.Now(), "", 1, "")
+	c.CreateFile(alpha, "b.txt", "uuid", -1, time.Now(), time.Now(), "", 1, "")
+	c.CreateFile(beta, "c.txt", "uuid", -1, time.Now(), time.Now(), "", 1, "")
+
+	dirs, files, err := c.FetchDirectoryContent(alpha, -1)
+	if err != nil {
+		t.Fatalf("FetchDirectoryContent: %v", err)
+	}
+	if len(dirs) != 1 || dirs[docs].Name != "docs" || len(files) != 1 {
+		t.Errorf("top of alpha = %v, %v", dirs, files)
+	}
+	dirs, files, _ = c.FetchDirectoryContent(alpha, docs)
+	if len(dirs) != 1 || len(files) != 1 {
+		t.Errorf("docs = %v, %v", dirs, files)
+	}
+	for _, file := range files {
+		if file.Name != "a.txt" || file.DirectoryId != docs || file.Size != 1 {
+			t.Errorf("file = %+v", file)
+		}
+	}
+
+	// Folders are loaded through indices.
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		"SELECT id FROM directories WHERE parentId = 1 AND driveId = 1",
+		"SELECT id FROM files WHERE directoryId = 1 AND driveId = 1",
+		"SELECT count(*) FROM files WHERE driveId = 1 AND uuid = 'uuid'",
+	} {
+		var id, parent, notused int
+		var detail string
+		if err := db.QueryRow("EXPLAIN QUERY PLAN " + query).Scan(&id, &parent, &notused, &detail); err != nil {
+			t.Fatalf("EXPLAIN QUERY PLAN: %v", err)
+		}
+		if !strings.Contains(detail, "INDEX") {
+			t.Errorf("%s: plan %s", query, detail)
+		}
+	}
+}
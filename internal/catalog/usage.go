@@ -0,0 +1,82 @@
+
+package catalog
+
+import (
+	"fmt"
+	"time"
+)
+
+// Folders and files below a folder, read from the catalog for commands such
+// as du and stats that add up a whole subtree, without going through the
+// tree of the drive.
+
+// Folders below folder `dirId` of a drive (-1 for the top of the drive), at
+// any depth, not including the folder itself.
+func (c *sqlCatalog) FetchSubdirectories(driveId int, dirId int) (map[int]DirectoryDescriptor, error) {
+	db, err := openDB(c)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`WITH RECURSIVE sub(id, name, parentId) AS
+	                         (SELECT id, name, parentId FROM directories WHERE driveId = ? AND parentId = ?
+	                          UNION ALL
+	                          SELECT d.id, d.name, d.parentId FROM directories d JOIN sub ON d.parentId = sub.id WHERE d.driveId = ?)
+	                       SELECT id, name, parentId FROM sub`, driveId, dirId, driveId)
+	if err != nil {
+		return nil, fmt.Errorf("db.Query(directories): %w", err)
+	}
+	defer rows.Close()
+	directories := make(map[int]DirectoryDescriptor)
+	for rows.Next() {
+		var dir DirectoryDescriptor
+		if err := rows.Scan(&dir.Id, &dir.Name, &dir.ParentId); err != nil {
+			return nil, fmt.Errorf("error reading directories table: %w", err)
+		}
+		directories[dir.Id] = dir
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading directories table: %w", err)
+	}
+	return directories, nil
+}
+
+// Call `visit` on every file below folder `dirId` of a drive (-1 for the top
+// of the drive), at any depth, as they are read. Files come sorted by UUID,
+// so that the files sharing a storage object come one after the other.
+func (c *sqlCatalog) WalkFiles(driveId int, dirId int, visit func(FileDescriptor) error) error {
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`WITH RECURSIVE sub(id) AS
+	                         (SELECT ?
+	                          UNION ALL
+	                          SELECT d.id FROM directories d JOIN sub ON d.parentId = sub.id WHERE d.driveId = ?)
+	                       SELECT id, name, directoryId, uuid, created, updated, metadata, size, hash FROM files
+	                       WHERE driveId = ? AND directoryId IN (SELECT id FROM sub) ORDER BY uuid, id`, dirId, driveId, driveId)
+	if err != nil {
+		return fmt.Errorf("db.Query(files): %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file FileDescriptor
+		var created int64
+		var updated int64
+		if err := rows.Scan(&file.id, &file.Name, &file.DirectoryId, &file.UUID, &created, &updated, &file.Metadata, &file.Size, &file.Hash); err != nil {
+			return fmt.Errorf("error reading files table: %w", err)
+		}
+		file.Created = time.Unix(created, 0)
+		file.Updated = time.Unix(updated, 0)
+		if err := visit(file); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading files table: %w", err)
+	}
+	return nil
+}
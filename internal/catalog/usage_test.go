@@ -0,0 +1,56 @@
+
+package catalog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubtree(t *testing.T) {
+	c, err := Create(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	archive, _ := c.CreateDrive("archive", "", "local", "/tmp/archive")
+	other, _ := c.CreateDrive("other", "", "local", "/tmp/other")
+	docs, _ := c.CreateDirectory(archive, "docs", -1)
+	old, _ := c.CreateDirectory(archive, "old", docs)
+	media, _ := c.CreateDirectory(archive, "media", -1)
+	c.CreateDirectory(other, "docs", -1)
+	c.CreateFile(archive, "top.txt", "uuid3", -1, time.Now(), time.Now(), "", 10, "")
+	c.CreateFile(archive, "a.txt", "uuid2", docs, time.Now(), time.Now(), "", 20, "")
+	c.CreateFile(archive, "b.txt", "uuid1", old, time.Now(), time.Now(), "", 30, "")
+	c.CreateFile(archive, "copy of a.txt", "uuid2", old, time.Now(), time.Now(), "", 20, "")
+	c.CreateFile(archive, "movie.mov", "uuid4", media, time.Now(), time.Now(), "", 40, "")
+	c.CreateFile(other, "c.txt", "uuid5", -1, time.Now(), time.Now(), "", 50, "")
+
+	folders, err := c.FetchSubdirectories(archive, docs)
+	if err != nil || len(folders) != 1 || folders[old] != (DirectoryDescriptor{old, "old", docs}) {
+		t.Errorf("folders below docs = %v, %v", folders, err)
+	}
+	if folders, err := c.FetchSubdirectories(archive, -1); err != nil || len(folders) != 3 {
+		t.Errorf("folders of drive = %v, %v", folders, err)
+	}
+
+	names := make([]string, 0)
+	err = c.WalkFiles(archive, docs, func(file FileDescriptor) error {
+		names = append(names, file.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkFiles: %v", err)
+	}
+	// By UUID, so copies of a.txt come together.
+	if len(names) != 3 || names[0] != "b.txt" || names[1] != "a.txt" || names[2] != "copy of a.txt" {
+		t.Errorf("files below docs = %v", names)
+	}
+	count := 0
+	c.WalkFiles(archive, -1, func(file FileDescriptor) error {
+		count++
+		return nil
+	})
+	if count != 5 {
+		t.Errorf("%d files in drive, expected 5", count)
+	}
+}
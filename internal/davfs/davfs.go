@@ -0,0 +1,440 @@
+
+package davfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// WebDAV access to a virtualfs tree.
+// Drives appear as top-level folders. Reading a file streams its content
+// from storage, and writing a file uploads new content under a new UUID,
+// so that copies sharing the old content are left untouched.
+
+type FileSystem struct {
+	root virtualfs.Root
+}
+
+var _ = (webdav.FileSystem)((*FileSystem)(nil))
+
+func NewFileSystem(root virtualfs.Root) *FileSystem {
+	return &FileSystem{root: root}
+}
+
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// Find the entry at `name`, a /-separated path from the root. Fails only
+// if a folder on the way cannot be loaded.
+func (fsys *FileSystem) lookup(name string) (virtualfs.VirtualFS, bool, error) {
+	curr := fsys.root.AsVirtualFS()
+	for _, component := range strings.Split(path.Clean("/" + name), "/") {
+		if component == "" {
+			continue
+		}
+		if !curr.IsDir() {
+			return nil, false, nil
+		}
+		sub, found, err := curr.GetContent(component)
+		if err != nil || !found {
+			return nil, false, err
+		}
+		curr = sub
+	}
+	return curr, true, nil
+}
+
+// Find the parent folder of `name`, along with the final path element.
+func (fsys *FileSystem) lookupParent(op string, name string) (virtualfs.VirtualFS, string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	parent, found, err := fsys.lookup(path.Dir(clean))
+	if err != nil {
+		return nil, "", err
+	}
+	if !found || !parent.IsDir() {
+		return nil, "", notExist(op, name)
+	}
+	return parent, path.Base(clean), nil
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parent, base, err := fsys.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, found, err := parent.GetContent(base); err != nil {
+		return err
+	} else if found {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := virtualfs.ValidateName(base); err != nil {
+		return err
+	}
+	_, err = virtualfs.CreateDirectory(parent, base)
+	return err
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag & (os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND) != 0
+	vfs, found, err := fsys.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !writing {
+		if !found {
+			return nil, notExist("open", name)
+		}
+		if vfs.IsDir() {
+			return &dirFile{vfs, newFileInfo(vfs), 0}, nil
+		}
+		return newReadFile(vfs), nil
+	}
+	if flag & os.O_APPEND != 0 {
+		return nil, fmt.Errorf("open %s: appending is not supported", name)
+	}
+	if found && flag & os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if found && vfs.IsDir() {
+		return nil, fmt.Errorf("open %s: is a folder", name)
+	}
+	if !found && flag & os.O_CREATE == 0 {
+		return nil, notExist("open", name)
+	}
+	parent, base, err := fsys.lookupParent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if parent.IsRoot() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	if err := virtualfs.ValidateName(base); err != nil {
+		return nil, err
+	}
+	return newWriteFile(parent, base, vfs, requestBodyOf(ctx)), nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	vfs, found, err := fsys.lookup(name)
+	if err != nil || !found {
+		return err
+	}
+	if vfs.IsRoot() || vfs.IsDrive() {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return virtualfs.Delete(vfs)
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName string, newName string) error {
+	vfs, found, err := fsys.lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return notExist("rename", oldName)
+	}
+	parent, base, err := fsys.lookupParent("rename", newName)
+	if err != nil {
+		return err
+	}
+	return vfs.Move(parent, base)
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	vfs, found, err := fsys.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, notExist("stat", name)
+	}
+	return newFileInfo(vfs), nil
+}
+
+// Information about an entry, as of when it was looked up.
+type fileInfo struct {
+	name string
+	size int64
+	modTime time.Time
+	isDir bool
+	uuid string
+}
+
+func newFileInfo(vfs virtualfs.VirtualFS) *fileInfo {
+	info := &fileInfo{name: vfs.Name(), isDir: vfs.IsDir()}
+	if vfs.IsRoot() {
+		info.name = "/"
+	}
+	if file := vfs.AsFile(); file != nil {
+		info.size = file.Size()
+		if info.size < 0 {
+			info.size = 0
+		}
+		info.modTime = file.Updated()
+		info.uuid = file.UUID()
+	}
+	return info
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.isDir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// Guess the content type from the name, rather than by reading the content.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(fi.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// Content is never updated in place, so the UUID identifies the content.
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.uuid == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fmt.Sprintf(`"%s"`, fi.uuid), nil
+}
+
+// An open folder.
+type dirFile struct {
+	vfs virtualfs.VirtualFS
+	info *fileInfo
+	read int              // Entries already returned by Readdir.
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := f.vfs.ContentList()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	result := make([]os.FileInfo, 0)
+	for _, name := range names[f.read:] {
+		if count > 0 && len(result) == count {
+			break
+		}
+		sub, found, err := f.vfs.GetContent(name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result = append(result, newFileInfo(sub))
+		}
+		f.read++
+	}
+	if count > 0 && len(result) == 0 {
+		return nil, io.EOF
+	}
+	return result, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is a folder", f.info.name)
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is a folder", f.info.name)
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+// A file open for reading.
+// Content is streamed from storage, restarting the download when seeking
+// backwards. Files whose size is not recorded in the catalog are
+// downloaded to a temporary file first, since serving them requires
+// seeking to the end.
+type readFile struct {
+	info *fileInfo
+	*storage.Reader
+}
+
+func newReadFile(vfs virtualfs.VirtualFS) *readFile {
+	file := vfs.AsFile()
+	return &readFile{
+		info: newFileInfo(vfs),
+		Reader: storage.NewReader(vfs.Drive().Storage(), file.UUID(), file.Metadata(), file.Size()),
+	}
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("%s is not a folder", f.info.name)
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	if size := f.Size(); size >= 0 {
+		f.info.size = size
+	}
+	return f.info, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is open for reading", f.info.name)
+}
+
+// A file open for writing.
+// Content is streamed to storage as it is written, and added to the
+// catalog when the file is closed. The WebDAV handler closes the file
+// even when copying the request body failed, so the content is only
+// added if every write succeeded and the body was read in full.
+type writeFile struct {
+	parent virtualfs.VirtualFS
+	name string
+	existing virtualfs.VirtualFS    // File being replaced, if any.
+	store storage.Storage
+	uuid string
+	body *io.PipeWriter
+	crc *util.CRCWriter
+	size int64
+	err error                       // First error writing the content.
+	request *requestBody            // Body of the PUT request, if known.
+	done chan error
+	metadata string
+}
+
+func newWriteFile(parent virtualfs.VirtualFS, name string, existing virtualfs.VirtualFS, request *requestBody) *writeFile {
+	pr, pw := io.Pipe()
+	f := &writeFile{
+		parent: parent,
+		name: name,
+		existing: existing,
+		store: parent.Drive().Storage(),
+		uuid: uuid.NewString(),
+		body: pw,
+		crc: util.NewCRCWriter(io.Discard),
+		request: request,
+		done: make(chan error, 1),
+	}
+	go func() {
+		metadata, err := storage.Upload(f.store, pr, f.uuid)
+		f.metadata = metadata
+		// Unblock writers if the upload stopped early.
+		pr.CloseWithError(fmt.Errorf("upload stopped: %v", err))
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.body.Write(p)
+	f.crc.Write(p[:n])
+	f.size += int64(n)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Check that the content written is the whole request body.
+func (f *writeFile) incomplete() error {
+	if f.err != nil {
+		return fmt.Errorf("%s: %v", f.name, f.err)
+	}
+	if f.request == nil {
+		return nil
+	}
+	if f.request.err != nil {
+		return fmt.Errorf("%s: reading request body: %v", f.name, f.request.err)
+	}
+	if f.request.length >= 0 && f.size != f.request.length {
+		return fmt.Errorf("%s: received %d bytes of %d", f.name, f.size, f.request.length)
+	}
+	return nil
+}
+
+func (f *writeFile) Close() error {
+	if f.done == nil {
+		return nil
+	}
+	f.body.Close()
+	err := <-f.done
+	f.done = nil
+	if err != nil {
+		return err
+	}
+	if err := f.incomplete(); err != nil {
+		f.store.DeleteFile(f.uuid, f.metadata)
+		return err
+	}
+	hash := util.FormatHash(f.crc.Sum())
+	if f.existing != nil {
+		err = virtualfs.ReplaceContent(f.existing, f.uuid, f.metadata, f.size, hash)
+	} else {
+		_, err = virtualfs.CreateFile(f.parent, f.name, f.uuid, f.metadata, f.size, hash)
+	}
+	if err != nil {
+		f.store.DeleteFile(f.uuid, f.metadata)
+		return err
+	}
+	return nil
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: f.name, size: f.size, modTime: time.Now(), uuid: f.uuid}, nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is open for writing", f.name)
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return f.size, nil
+	}
+	return 0, fmt.Errorf("%s: cannot seek while writing", f.name)
+}
+
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("%s is not a folder", f.name)
+}
@@ -0,0 +1,201 @@
+
+package davfs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func newServer(t *testing.T) (*httptest.Server, *vhdtest.Env) {
+	t.Helper()
+	env := vhdtest.New(t, "alpha", "beta")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	users := map[string]string{"alice": string(hash)}
+	server := httptest.NewServer(NewHandler(env.Root, users, func(string) {}))
+	t.Cleanup(server.Close)
+	return server, env
+}
+
+func request(t *testing.T, server *httptest.Server, method string, path string, body string, headers ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL + path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	for i := 0; i + 1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i + 1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestAuth(t *testing.T) {
+	server, _ := newServer(t)
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous request: status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", server.URL + "/", nil)
+	req.SetBasicAuth("alice", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d", resp.StatusCode)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	server, env := newServer(t)
+	if status, _ := request(t, server, "MKCOL", "/alpha/docs", ""); status != http.StatusCreated {
+		t.Fatalf("MKCOL: status %d", status)
+	}
+	if status, _ := request(t, server, "PUT", "/alpha/docs/a.txt", "content a"); status != http.StatusCreated {
+		t.Fatalf("PUT: status %d", status)
+	}
+	fileObj, err := virtualfs.NavigateFile(env.Root.AsVirtualFS(), "/alpha/docs/a.txt")
+	if err != nil {
+		t.Fatalf("NavigateFile: %v", err)
+	}
+	file := fileObj.AsFile()
+	if got := env.Memory["alpha"].Object(file.UUID()); string(got) != "content a" {
+		t.Errorf("stored content = %q", got)
+	}
+	if file.Size() != 9 || file.Hash() == "" {
+		t.Errorf("size/hash not recorded: %d %q", file.Size(), file.Hash())
+	}
+
+	status, body := request(t, server, "GET", "/alpha/docs/a.txt", "")
+	if status != http.StatusOK || body != "content a" {
+		t.Errorf("GET = %d %q", status, body)
+	}
+	status, body = request(t, server, "GET", "/alpha/docs/a.txt", "", "Range", "bytes=3-6")
+	if status != http.StatusPartialContent || body != "tent" {
+		t.Errorf("GET range = %d %q", status, body)
+	}
+
+	// Replacing the content gives the file a new object.
+	oldUUID := file.UUID()
+	if status, _ := request(t, server, "PUT", "/alpha/docs/a.txt", "new content"); status != http.StatusNoContent && status != http.StatusCreated {
+		t.Fatalf("PUT over existing file: status %d", status)
+	}
+	status, body = request(t, server, "GET", "/alpha/docs/a.txt", "")
+	if body != "new content" {
+		t.Errorf("GET after update = %d %q", status, body)
+	}
+	if env.Memory["alpha"].Object(oldUUID) != nil {
+		t.Errorf("old content not deleted")
+	}
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1})
+	if status, _ := request(t, server, "PUT", "/alpha/docs/b.txt", "b"); status < 400 {
+		t.Errorf("PUT with failing upload: status %d", status)
+	}
+	if obj, _ := virtualfs.CheckPath(env.Root.AsVirtualFS(), "/alpha/docs/b.txt"); obj != nil {
+		t.Errorf("file added to catalog despite failed upload")
+	}
+}
+
+func TestTruncatedPut(t *testing.T) {
+	server, env := newServer(t)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer conn.Close()
+	// Announce more content than is sent, then hang up.
+	fmt.Fprintf(conn, "PUT /alpha/short.txt HTTP/1.1\r\nHost: vhd\r\nAuthorization: Basic YWxpY2U6c2VjcmV0\r\nContent-Length: 100\r\n\r\nonly part")
+	conn.(*net.TCPConn).CloseWrite()
+	io.ReadAll(conn)
+	if obj, _ := virtualfs.CheckPath(env.Root.AsVirtualFS(), "/alpha/short.txt"); obj != nil {
+		t.Errorf("truncated file added to catalog")
+	}
+	if names, _ := env.Memory["alpha"].ListFiles(); len(names) != 0 {
+		t.Errorf("truncated content left in storage: %v", names)
+	}
+}
+
+func TestPropfind(t *testing.T) {
+	server, _ := newServer(t)
+	request(t, server, "MKCOL", "/alpha/docs", "")
+	request(t, server, "PUT", "/alpha/docs/a.txt", "content a")
+	status, body := request(t, server, "PROPFIND", "/alpha/", "", "Depth", "1")
+	if status != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: status %d", status)
+	}
+	if !strings.Contains(body, "/alpha/docs/") {
+		t.Errorf("PROPFIND does not list folder:\n%s", body)
+	}
+	status, body = request(t, server, "PROPFIND", "/alpha/docs/", "", "Depth", "1")
+	if !strings.Contains(body, "<D:getcontentlength>9</D:getcontentlength>") {
+		t.Errorf("PROPFIND does not report size:\n%s", body)
+	}
+}
+
+func TestMoveDelete(t *testing.T) {
+	server, env := newServer(t)
+	request(t, server, "PUT", "/alpha/a.txt", "content a")
+	status, _ := request(t, server, "MOVE", "/alpha/a.txt", "", "Destination", server.URL + "/alpha/b.txt")
+	if status != http.StatusCreated {
+		t.Fatalf("MOVE: status %d", status)
+	}
+	if _, err := virtualfs.NavigateFile(env.Root.AsVirtualFS(), "/alpha/b.txt"); err != nil {
+		t.Errorf("moved file: %v", err)
+	}
+	// Across drives.
+	status, _ = request(t, server, "MOVE", "/alpha/b.txt", "", "Destination", server.URL + "/beta/b.txt")
+	if status != http.StatusCreated {
+		t.Fatalf("MOVE across drives: status %d", status)
+	}
+	if status, body := request(t, server, "GET", "/beta/b.txt", ""); body != "content a" {
+		t.Errorf("GET moved file = %d %q", status, body)
+	}
+	if status, _ := request(t, server, "DELETE", "/beta/b.txt", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: status %d", status)
+	}
+	if status, _ := request(t, server, "GET", "/beta/b.txt", ""); status != http.StatusNotFound {
+		t.Errorf("GET deleted file: status %d", status)
+	}
+	if status, _ := request(t, server, "DELETE", "/beta", ""); status < 400 {
+		t.Errorf("DELETE of a drive: status %d", status)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	server, env := newServer(t)
+	request(t, server, "PROPFIND", "/alpha/", "", "Depth", "1")
+	// Another process sharing the catalog creates a folder.
+	alpha, _ := virtualfs.NavigateDirectory(env.Reload(t).AsVirtualFS(), "/alpha")
+	if _, err := virtualfs.CreateDirectory(alpha, "docs"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	if _, body := request(t, server, "PROPFIND", "/alpha/", "", "Depth", "1"); !strings.Contains(body, "/alpha/docs/") {
+		t.Errorf("PROPFIND does not list folder created elsewhere:\n%s", body)
+	}
+}
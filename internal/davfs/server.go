@@ -0,0 +1,86 @@
+
+package davfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Handler serving `root` over WebDAV to the users in `users`, mapping
+// user names to bcrypt hashes of their passwords. Every request is
+// reported to `log`.
+func NewHandler(root virtualfs.Root, users map[string]string, log func(string)) http.Handler {
+	dav := &webdav.Handler{
+		FileSystem: NewFileSystem(root),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log(fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, err))
+			} else {
+				log(fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !checkPassword(users, user, password) {
+			if ok {
+				log(fmt.Sprintf("%s %s: authentication failed for %s", r.Method, r.URL.Path, user))
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="vhd"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// See the changes made by other processes sharing the catalog.
+		if _, err := root.Refresh(); err != nil {
+			log(fmt.Sprintf("%s %s: cannot check catalog: %s", r.Method, r.URL.Path, err))
+			http.Error(w, "cannot check catalog", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPut {
+			body := &requestBody{ReadCloser: r.Body, length: r.ContentLength}
+			r = r.WithContext(context.WithValue(r.Context(), requestBodyKey{}, body))
+			r.Body = body
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// Body of a PUT request, recording read errors.
+// The WebDAV handler does not tell the file system when copying the body
+// fails, so files being written look it up from the request context.
+type requestBody struct {
+	io.ReadCloser
+	length int64          // Content-Length, or -1 if unknown.
+	err error             // First error reading the body, other than io.EOF.
+}
+
+type requestBodyKey struct{}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func requestBodyOf(ctx context.Context) *requestBody {
+	body, _ := ctx.Value(requestBodyKey{}).(*requestBody)
+	return body
+}
+
+func checkPassword(users map[string]string, user string, password string) bool {
+	hash, found := users[user]
+	if !found {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
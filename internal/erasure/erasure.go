@@ -0,0 +1,271 @@
+
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8).
+//
+// An encoder for k data shards and m parity shards uses a (k+m) x k
+// encoding matrix whose top k rows are the identity, so that data shards
+// are stored as is. The matrix is derived from a Vandermonde matrix, which
+// guarantees that any k of its rows are invertible: any k shards out of
+// k+m are enough to rebuild the others.
+
+var ErrTooFewShards = errors.New("too few shards")
+
+// Arithmetic in GF(2^8) with polynomial x^8 + x^4 + x^3 + x^2 + 1.
+
+const gfPoly = 0x11d
+
+var gfExp [510]byte
+var gfLog [256]int
+var gfMulTable [256][256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x = x << 1
+		if x & 0x100 != 0 {
+			x = x ^ gfPoly
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i - 255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[gfLog[a] + gfLog[b]]
+		}
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255 - gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a] * n) % 255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows int, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range result {
+		for c := range result[r] {
+			var v byte
+			for i := range other {
+				v = v ^ gfMul(m[r][i], other[i][c])
+			}
+			result[r][c] = v
+		}
+	}
+	return result
+}
+
+// Invert a square matrix using Gauss-Jordan elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2 * n)
+	for r := 0; r < n; r++ {
+		copy(work[r], m[r])
+		work[r][n + r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] = work[r][i] ^ gfMul(factor, work[c][i])
+			}
+		}
+	}
+	result := newMatrix(n, n)
+	for r := 0; r < n; r++ {
+		copy(result[r], work[r][n:])
+	}
+	return result, nil
+}
+
+type Encoder struct {
+	k int
+	m int
+	matrix matrix      // (k+m) x k encoding matrix.
+}
+
+func NewEncoder(k int, m int) (*Encoder, error) {
+	if k < 1 || m < 0 || k + m > 256 {
+		return nil, fmt.Errorf("invalid erasure code %d+%d", k, m)
+	}
+	vandermonde := newMatrix(k + m, k)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top := matrix(vandermonde[:k])
+	topInv, err := top.invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{k, m, vandermonde.multiply(topInv)}, nil
+}
+
+func (e *Encoder) DataShards() int {
+	return e.k
+}
+
+func (e *Encoder) ParityShards() int {
+	return e.m
+}
+
+// Multiply `coeffs` by the shards in `inputs`, one output shard per row of
+// `coeffs`.
+func apply(coeffs matrix, inputs [][]byte, outputs [][]byte) {
+	for r, out := range outputs {
+		for i := range out {
+			out[i] = 0
+		}
+		for c, in := range inputs {
+			coeff := coeffs[r][c]
+			if coeff == 0 {
+				continue
+			}
+			table := &gfMulTable[coeff]
+			for i, b := range in {
+				out[i] = out[i] ^ table[b]
+			}
+		}
+	}
+}
+
+func (e *Encoder) checkShards(shards [][]byte) (int, error) {
+	if len(shards) != e.k + e.m {
+		return 0, fmt.Errorf("expected %d shards, got %d", e.k + e.m, len(shards))
+	}
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return 0, fmt.Errorf("shards of different sizes")
+		}
+		size = len(shard)
+	}
+	return size, nil
+}
+
+// Fill in the m parity shards from the k data shards.
+// All shards must be allocated and have the same size.
+func (e *Encoder) Encode(shards [][]byte) error {
+	if _, err := e.checkShards(shards); err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if shard == nil {
+			return fmt.Errorf("missing shard")
+		}
+	}
+	apply(e.matrix[e.k:], shards[:e.k], shards[e.k:])
+	return nil
+}
+
+// Rebuild the shards that are nil from the others.
+// At least k shards must be present.
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	size, err := e.checkShards(shards)
+	if err != nil {
+		return err
+	}
+	present := make([]int, 0, e.k)
+	for i, shard := range shards {
+		if shard != nil && len(present) < e.k {
+			present = append(present, i)
+		}
+	}
+	if len(present) < e.k {
+		return ErrTooFewShards
+	}
+
+	missingData := false
+	for i := 0; i < e.k; i++ {
+		if shards[i] == nil {
+			missingData = true
+		}
+	}
+	if missingData {
+		sub := newMatrix(e.k, e.k)
+		inputs := make([][]byte, e.k)
+		for r, i := range present {
+			copy(sub[r], e.matrix[i])
+			inputs[r] = shards[i]
+		}
+		decode, err := sub.invert()
+		if err != nil {
+			return err
+		}
+		rows := make(matrix, 0)
+		outputs := make([][]byte, 0)
+		for i := 0; i < e.k; i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, size)
+				rows = append(rows, decode[i])
+				outputs = append(outputs, shards[i])
+			}
+		}
+		apply(rows, inputs, outputs)
+	}
+
+	rows := make(matrix, 0)
+	outputs := make([][]byte, 0)
+	for i := e.k; i < e.k + e.m; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rows = append(rows, e.matrix[i])
+			outputs = append(outputs, shards[i])
+		}
+	}
+	apply(rows, shards[:e.k], outputs)
+	return nil
+}
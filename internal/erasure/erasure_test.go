@@ -0,0 +1,82 @@
+
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomShards(k int, m int, size int, seed int64) [][]byte {
+	random := rand.New(rand.NewSource(seed))
+	shards := make([][]byte, k + m)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < k {
+			random.Read(shards[i])
+		}
+	}
+	return shards
+}
+
+func copyShards(shards [][]byte) [][]byte {
+	result := make([][]byte, len(shards))
+	for i, shard := range shards {
+		result[i] = append([]byte(nil), shard...)
+	}
+	return result
+}
+
+func TestReconstructAnyMissing(t *testing.T) {
+	k, m := 4, 2
+	enc, err := NewEncoder(k, m)
+	if err != nil {
+		t.Fatalf("NewEncoder: %v", err)
+	}
+	shards := randomShards(k, m, 1000, 1)
+	if err := enc.Encode(shards); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// Lose every possible pair of shards.
+	for a := 0; a < k + m; a++ {
+		for b := a + 1; b < k + m; b++ {
+			damaged := copyShards(shards)
+			damaged[a] = nil
+			damaged[b] = nil
+			if err := enc.Reconstruct(damaged); err != nil {
+				t.Fatalf("Reconstruct without %d, %d: %v", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Errorf("shard %d wrong after losing %d, %d", i, a, b)
+				}
+			}
+		}
+	}
+}
+
+func TestReconstructTooFew(t *testing.T) {
+	enc, _ := NewEncoder(3, 2)
+	shards := randomShards(3, 2, 10, 2)
+	enc.Encode(shards)
+	shards[0] = nil
+	shards[2] = nil
+	shards[4] = nil
+	if err := enc.Reconstruct(shards); err != ErrTooFewShards {
+		t.Errorf("Reconstruct = %v, want ErrTooFewShards", err)
+	}
+}
+
+func TestNoParity(t *testing.T) {
+	enc, err := NewEncoder(2, 0)
+	if err != nil {
+		t.Fatalf("NewEncoder: %v", err)
+	}
+	shards := randomShards(2, 0, 10, 3)
+	if err := enc.Encode(shards); err != nil {
+		t.Errorf("Encode: %v", err)
+	}
+	if _, err := NewEncoder(0, 2); err == nil {
+		t.Errorf("NewEncoder(0, 2) should fail")
+	}
+}
@@ -0,0 +1,194 @@
+
+package fusefs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Local cache of the content of remote files.
+// Content is downloaded the first time a file is needed, and kept in the
+// cache folder under the UUID of its storage object, so that copies sharing
+// an object share its cached content. When the cache holds more than its
+// limit, the content used least recently is removed. Content is opened
+// under the lock of the cache, so that it cannot be removed in between, and
+// stays readable until closed once removed.
+
+type Cache struct {
+	folder string
+	limit int64                          // Bytes kept, 0 for no limit.
+	mu sync.Mutex
+	locks map[string]*sync.Mutex         // One per UUID, held while downloading.
+	entries map[string]*list.Element     // Of lru, by UUID.
+	lru *list.List                       // Cached content, most recently used first.
+	size int64                           // Bytes of cached content.
+}
+
+type cacheEntry struct {
+	uuid string
+	size int64
+}
+
+const CACHE_TMP_PREFIX = ".tmp-"
+
+// Open the cache in `folder`, keeping at most `limit` bytes (0 for no
+// limit). Content cached by earlier mounts is kept, in the order of its
+// last use.
+func NewCache(folder string, limit int64) (*Cache, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %v", err)
+	}
+	dirEntries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir: %v", err)
+	}
+	infos := make([]os.FileInfo, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() || strings.HasPrefix(dirEntry.Name(), CACHE_TMP_PREFIX) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i int, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	c := &Cache{folder, limit, sync.Mutex{}, make(map[string]*sync.Mutex), make(map[string]*list.Element), list.New(), 0}
+	for _, info := range infos {
+		c.entries[info.Name()] = c.lru.PushBack(&cacheEntry{info.Name(), info.Size()})
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *Cache) lock(uuid string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, found := c.locks[uuid]
+	if !found {
+		lock = &sync.Mutex{}
+		c.locks[uuid] = lock
+	}
+	return lock
+}
+
+// Open the cached content of storage object `uuid`, if any, as most recently
+// used.
+func (c *Cache) openCached(uuid string) (*os.File, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[uuid]
+	if !found {
+		return nil, false, nil
+	}
+	path := filepath.Join(c.folder, uuid)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Removed from outside: download it again.
+		c.remove(elem)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("os.Open: %v", err)
+	}
+	c.lru.MoveToFront(elem)
+	touch(path)
+	return f, true, nil
+}
+
+// Record the use of cached content, so that the order of use is kept across
+// mounts by the modification times of the files of the cache. They are set
+// explicitly, since filesystems may record a coarser time on writes.
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// Open a local copy of the content of `fileObj`, downloading it first if
+// it is not in the cache. When the catalog records a hash for the file, the
+// downloaded content is checked against it.
+func (c *Cache) Open(fileObj virtualfs.VirtualFS) (*os.File, error) {
+	file := fileObj.AsFile()
+	if file == nil {
+		return nil, fmt.Errorf("%s is not a file", fileObj.Path())
+	}
+	lock := c.lock(file.UUID())
+	lock.Lock()
+	defer lock.Unlock()
+
+	if f, found, err := c.openCached(file.UUID()); err != nil || found {
+		return f, err
+	}
+	tmp, err := os.CreateTemp(c.folder, CACHE_TMP_PREFIX + "*")
+	if err != nil {
+		return nil, fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	crcw := util.NewCRCWriter(io.Discard)
+	if err := storage.Download(fileObj.Drive().Storage(), file.UUID(), file.Metadata(), io.MultiWriter(tmp, crcw)); err != nil {
+		return nil, err
+	}
+	if file.Hash() != "" && util.FormatHash(crcw.Sum()) != file.Hash() {
+		return nil, fmt.Errorf("crc32c of %s is %s, expected %s", fileObj.Path(), util.FormatHash(crcw.Sum()), file.Hash())
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("tmp.Stat: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("tmp.Close: %v", err)
+	}
+	path := filepath.Join(c.folder, file.UUID())
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("os.Rename: %v", err)
+	}
+	touch(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %v", err)
+	}
+	c.entries[file.UUID()] = c.lru.PushFront(&cacheEntry{file.UUID(), info.Size()})
+	c.size += info.Size()
+	c.evict()
+	return f, nil
+}
+
+// Remove the content used least recently until the cache fits its limit,
+// always keeping the content used last.
+// Must be called with c.mu held.
+func (c *Cache) evict() {
+	for c.limit > 0 && c.size > c.limit && c.lru.Len() > 1 {
+		elem := c.lru.Back()
+		os.Remove(filepath.Join(c.folder, elem.Value.(*cacheEntry).uuid))
+		c.remove(elem)
+	}
+}
+
+// Must be called with c.mu held.
+func (c *Cache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.uuid)
+	c.size -= entry.size
+}
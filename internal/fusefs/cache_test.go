@@ -0,0 +1,99 @@
+
+package fusefs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func readCached(t *testing.T, cache *Cache, fileObj virtualfs.VirtualFS) string {
+	t.Helper()
+	f, err := cache.Open(fileObj)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("io.ReadAll: %v", err)
+	}
+	return string(content)
+}
+
+func TestCache(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	fileObj := env.PutFile(t, "/alpha/a.txt", "content a")
+	folder := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewCache(folder, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if got := readCached(t, cache, fileObj); got != "content a" {
+		t.Errorf("cached content = %q", got)
+	}
+	// Cached content is not downloaded again.
+	env.Faulty["alpha"].SetFaults(storage.Faults{DownloadFailureRate: 1})
+	if got := readCached(t, cache, fileObj); got != "content a" {
+		t.Errorf("cached content = %q", got)
+	}
+
+	// Corrupted content is not cached.
+	other := env.PutFile(t, "/alpha/b.txt", "content b")
+	env.Faulty["alpha"].SetFaults(storage.Faults{CorruptionRate: 1})
+	if _, err := cache.Open(other); err == nil {
+		t.Errorf("Open of corrupted content should fail")
+	}
+	entries, _ := os.ReadDir(folder)
+	if len(entries) != 1 {
+		t.Errorf("cache holds %d entries, want 1", len(entries))
+	}
+}
+
+func TestCacheLimit(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	a := env.PutFile(t, "/alpha/a.txt", strings.Repeat("a", 100))
+	b := env.PutFile(t, "/alpha/b.txt", strings.Repeat("b", 100))
+	c := env.PutFile(t, "/alpha/c.txt", strings.Repeat("c", 100))
+	folder := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewCache(folder, 250)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	cached := func(fileObj virtualfs.VirtualFS) bool {
+		_, err := os.Stat(filepath.Join(folder, fileObj.AsFile().UUID()))
+		return err == nil
+	}
+
+	readCached(t, cache, a)
+	open, err := cache.Open(b)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer open.Close()
+	readCached(t, cache, a)
+	// Over the limit: b was used least recently.
+	readCached(t, cache, c)
+	if !cached(a) || cached(b) || !cached(c) {
+		t.Errorf("cached a, b, c = %v, %v, %v, want b removed", cached(a), cached(b), cached(c))
+	}
+	// Content removed stays readable until closed.
+	if content, err := io.ReadAll(open); err != nil || string(content) != strings.Repeat("b", 100) {
+		t.Errorf("content of removed b = %q, %v", content, err)
+	}
+
+	// The order of use is kept across mounts.
+	cache, err = NewCache(folder, 150)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if cached(a) || !cached(c) {
+		t.Errorf("cached a, c = %v, %v after reopening, want a removed", cached(a), cached(c))
+	}
+}
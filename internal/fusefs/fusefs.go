@@ -0,0 +1,234 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fusefs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Read-only FUSE filesystem exposing a virtualfs tree.
+// Folders map to directories, and files to regular files whose content
+// is downloaded into the cache when they are first opened. Nodes find
+// their entry by path on every operation, so that drives changed by other
+// processes, which are reloaded, are seen through the mount.
+
+type filesystem struct {
+	root virtualfs.Root
+	cache *Cache
+	log func(string)
+	mu sync.Mutex
+	refreshed time.Time         // Last check for drives changed by other processes.
+}
+
+type node struct {
+	fs.Inode
+	fsys *filesystem
+	path string
+}
+
+// The catalog is checked at most this often, since the kernel may look up
+// many entries in a row.
+const REFRESH_INTERVAL = time.Second
+
+var _ = (fs.NodeLookuper)((*node)(nil))
+var _ = (fs.NodeReaddirer)((*node)(nil))
+var _ = (fs.NodeGetattrer)((*node)(nil))
+var _ = (fs.NodeOpener)((*node)(nil))
+
+// Stable inode number derived from the catalog identifier of the entry.
+// Files, folders and drives are numbered independently in the catalog.
+func inode(vfs virtualfs.VirtualFS) uint64 {
+	if vfs.IsRoot() {
+		return 1
+	}
+	kind := uint64(2)
+	if vfs.IsFile() {
+		kind = 1
+	} else if vfs.IsDrive() {
+		kind = 3
+	}
+	return uint64(vfs.CatalogId()) << 2 | kind
+}
+
+func mode(vfs virtualfs.VirtualFS) uint32 {
+	if vfs.IsFile() {
+		return fuse.S_IFREG
+	}
+	return fuse.S_IFDIR
+}
+
+func fillAttr(vfs virtualfs.VirtualFS, out *fuse.Attr) {
+	out.Ino = inode(vfs)
+	if file := vfs.AsFile(); file != nil {
+		out.Mode = fuse.S_IFREG | 0444
+		if file.Size() > 0 {
+			out.Size = uint64(file.Size())
+		}
+		updated := file.Updated()
+		created := file.Created()
+		out.SetTimes(&updated, &updated, &created)
+		return
+	}
+	out.Mode = fuse.S_IFDIR | 0555
+}
+
+// Reload the drives changed by other processes since they were checked,
+// unless checked recently.
+func (fsys *filesystem) refresh() {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if time.Since(fsys.refreshed) < REFRESH_INTERVAL {
+		return
+	}
+	fsys.refreshed = time.Now()
+	if _, err := fsys.root.Refresh(); err != nil {
+		fsys.log(fmt.Sprintf("cannot check catalog: %s", err))
+	}
+}
+
+// The entry of `n` in the current tree.
+func (n *node) entry() (virtualfs.VirtualFS, syscall.Errno) {
+	n.fsys.refresh()
+	curr := n.fsys.root.AsVirtualFS()
+	for _, component := range strings.Split(n.path, "/") {
+		if component == "" {
+			continue
+		}
+		if !curr.IsDir() {
+			return nil, syscall.ENOENT
+		}
+		sub, found, err := curr.GetContent(component)
+		if err != nil {
+			n.fsys.log(err.Error())
+			return nil, syscall.EIO
+		}
+		if !found {
+			return nil, syscall.ENOENT
+		}
+		curr = sub
+	}
+	return curr, 0
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	vfs, errno := n.entry()
+	if errno != 0 {
+		return nil, errno
+	}
+	if !vfs.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	sub, found, err := vfs.GetContent(name)
+	if err != nil {
+		n.fsys.log(err.Error())
+		return nil, syscall.EIO
+	}
+	if !found {
+		return nil, syscall.ENOENT
+	}
+	fillAttr(sub, &out.Attr)
+	child := &node{fsys: n.fsys, path: path.Join(n.path, name)}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: mode(sub), Ino: inode(sub)}), 0
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	vfs, errno := n.entry()
+	if errno != 0 {
+		return nil, errno
+	}
+	if !vfs.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	names, err := vfs.ContentList()
+	if err != nil {
+		n.fsys.log(err.Error())
+		return nil, syscall.EIO
+	}
+	sort.Strings(names)
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		sub, found, err := vfs.GetContent(name)
+		if err != nil || !found {
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode(sub), Ino: inode(sub)})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	vfs, errno := n.entry()
+	if errno != 0 {
+		return errno
+	}
+	fillAttr(vfs, &out.Attr)
+	return 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags & (syscall.O_WRONLY | syscall.O_RDWR | syscall.O_APPEND | syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	vfs, errno := n.entry()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	size := int64(-1)
+	if file := vfs.AsFile(); file != nil {
+		size = file.Size()
+	}
+	if vfs.IsDir() {
+		return nil, 0, syscall.EISDIR
+	}
+	f, err := n.fsys.cache.Open(vfs)
+	if err != nil {
+		n.fsys.log(fmt.Sprintf("cannot fetch %s: %s", vfs.Path(), err))
+		return nil, 0, syscall.EIO
+	}
+	// The loopback file owns its descriptor, which f would close.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	// Without a known size, bypass the page cache so that reads are not
+	// limited by the size reported by Getattr.
+	var fuseFlags uint32 = fuse.FOPEN_KEEP_CACHE
+	if size < 0 {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
+	return fs.NewLoopbackFile(fd), fuseFlags, 0
+}
+
+// Mount `root` read-only at `mountpoint`, fetching content through `cache`
+// and reporting errors through `log`.
+func Mount(root virtualfs.Root, mountpoint string, cache *Cache, log func(string)) (Server, error) {
+	fsys := &filesystem{root: root, cache: cache, log: log}
+	top := &node{fsys: fsys, path: "/"}
+	options := &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "vhd",
+			Name: "vhd",
+			// Mount without fusermount when running as root.
+			DirectMount: true,
+		},
+	}
+	server, err := fs.Mount(mountpoint, top, options)
+	if err != nil {
+		return nil, fmt.Errorf("fs.Mount: %w", err)
+	}
+	return server, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package fusefs
+
+import (
+	"fmt"
+	"runtime"
+
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func Mount(root virtualfs.Root, mountpoint string, cache *Cache, log func(string)) (Server, error) {
+	return nil, fmt.Errorf("mounting is not supported on %s", runtime.GOOS)
+}
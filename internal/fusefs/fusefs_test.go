@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package fusefs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func TestMount(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	if _, err := virtualfs.CreateDirectory(alpha, "docs"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	env.PutFile(t, "/alpha/docs/a.txt", "content a")
+	cache, err := NewCache(filepath.Join(t.TempDir(), "cache"), 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	mountpoint := t.TempDir()
+	// Mount a tree of its own, as another process would.
+	server, err := Mount(env.Reload(t), mountpoint, cache, func(string) {})
+	if err != nil {
+		t.Skipf("cannot mount: %v", err)
+	}
+	defer server.Unmount()
+
+	entries, err := os.ReadDir(filepath.Join(mountpoint, "alpha"))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "docs" || !entries[0].IsDir() {
+		t.Errorf("ReadDir = %v, %v", entries, err)
+	}
+	path := filepath.Join(mountpoint, "alpha", "docs", "a.txt")
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len("content a")) {
+		t.Errorf("Stat = %v, %v", info, err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "content a" {
+		t.Errorf("ReadFile = %q, %v", got, err)
+	}
+	if _, err := os.OpenFile(path, os.O_WRONLY, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("opening for writing = %v, want EROFS", err)
+	}
+
+	// Changes made by other processes show once the catalog is checked.
+	env.PutFile(t, "/alpha/docs/b.txt", "content b")
+	time.Sleep(REFRESH_INTERVAL)
+	if got, err := os.ReadFile(filepath.Join(mountpoint, "alpha", "docs", "b.txt")); err != nil || string(got) != "content b" {
+		t.Errorf("ReadFile of new file = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,8 @@
+
+package fusefs
+
+// A mounted filesystem.
+type Server interface {
+	Wait()
+	Unmount() error
+}
@@ -0,0 +1,520 @@
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"rpucella.net/virtual-hard-drive/internal/erasure"
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Erasure-coded storage.
+// A file is cut into stripes of k blocks, and each stripe is Reed-Solomon
+// encoded into k data blocks and m parity blocks. Shard i is the
+// concatenation of block i of every stripe, and is stored on backend i under
+// a UUID derived from the file's UUID. Any k shards are enough to rebuild
+// the file, so any m backends can be lost.
+//
+// The metadata records the layout:
+//   {"v":1,"k":4,"m":2,"size":1234,"block":309,"shards":[
+//     {"backend":"local::/mnt/a","uuid":"...","metadata":"","crc32c":1234},
+//     ...]}
+// A shard marked missing was not stored (see Repair).
+
+const MAX_BLOCK_SIZE = 1048576   // 1MB
+
+type Erasure struct {
+	encoder *erasure.Encoder
+	backends []Storage
+}
+
+type shardInfo struct {
+	Backend string `json:"backend"`
+	UUID string `json:"uuid"`
+	Metadata string `json:"metadata"`
+	CRC32C uint32 `json:"crc32c"`
+	Missing bool `json:"missing,omitempty"`
+}
+
+type erasureMetadata struct {
+	Metadata
+	K int `json:"k"`
+	M int `json:"m"`
+	Size int64 `json:"size"`
+	Block int64 `json:"block"`
+	Shards []shardInfo `json:"shards"`
+}
+
+func NewErasure(k int, m int, backends []Storage) (*Erasure, error) {
+	if len(backends) != k + m {
+		return nil, fmt.Errorf("erasure code %d+%d needs %d backends, got %d", k, m, k + m, len(backends))
+	}
+	encoder, err := erasure.NewEncoder(k, m)
+	if err != nil {
+		return nil, err
+	}
+	return &Erasure{encoder, backends}, nil
+}
+
+func (s *Erasure) log(text string) {
+	fmt.Printf("[erasure] %s\n", text)
+}
+
+func (s *Erasure) Name() string {
+	names := make([]string, 0, len(s.backends))
+	for _, b := range s.backends {
+		names = append(names, b.Name())
+	}
+	return fmt.Sprintf("erasure::%d+%d(%s)", s.encoder.DataShards(), s.encoder.ParityShards(), strings.Join(names, ", "))
+}
+
+func (s *Erasure) parseMetadata(metadata string) (erasureMetadata, error) {
+	meta := erasureMetadata{}
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		return meta, fmt.Errorf("wrong metadata: %s", metadata)
+	}
+	if meta.K < 1 || len(meta.Shards) != meta.K + meta.M || len(meta.Shards) > len(s.backends) {
+		return meta, fmt.Errorf("wrong shard layout: %s", metadata)
+	}
+	if err := checkVersion(meta.Version); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+func (m erasureMetadata) String() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// Backend holding shard `i`, looked up by name so that the metadata stays
+// valid if backends are listed in a different order.
+func (s *Erasure) backend(meta erasureMetadata, i int) Storage {
+	for _, b := range s.backends {
+		if b.Name() == meta.Shards[i].Backend {
+			return b
+		}
+	}
+	return s.backends[i]
+}
+
+// Sum of the shards stored, each holding one block of every stripe.
+func (s *Erasure) StoredSize(size int64, metadata string) int64 {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil || meta.Block == 0 {
+		return size
+	}
+	stripe := int64(meta.K) * meta.Block
+	shardSize := (meta.Size + stripe - 1) / stripe * meta.Block
+	total := int64(0)
+	for i, shard := range meta.Shards {
+		if !shard.Missing {
+			total += StoredSize(s.backend(meta, i), shardSize, shard.Metadata)
+		}
+	}
+	return total
+}
+
+// Size of the blocks of the stripes of an object of `size` bytes split
+// into `k` data shards.
+func blockSize(size int64, k int) int64 {
+	block := (size + int64(k) - 1) / int64(k)
+	if block > MAX_BLOCK_SIZE {
+		block = MAX_BLOCK_SIZE
+	}
+	return block
+}
+
+func (s *Erasure) UploadSize(size int64) int64 {
+	k := s.encoder.DataShards()
+	block := blockSize(size, k)
+	if block == 0 {
+		return 0
+	}
+	stripe := int64(k) * block
+	shardSize := (size + stripe - 1) / stripe * block
+	total := int64(0)
+	for _, b := range s.backends {
+		total += UploadSize(b, shardSize)
+	}
+	return total
+}
+
+func shardUUID(fileUUID string, i int) (string, error) {
+	space, err := uuid.Parse(fileUUID)
+	if err != nil {
+		return "", fmt.Errorf("uuid.Parse: %v", err)
+	}
+	return uuid.NewSHA1(space, []byte(fmt.Sprintf("shard-%d", i))).String(), nil
+}
+
+func tempFiles(n int) ([]*os.File, func(), error) {
+	files := make([]*os.File, 0, n)
+	cleanup := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		f, err := os.CreateTemp("", "vhd-shard-*")
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("os.CreateTemp: %v", err)
+		}
+		files = append(files, f)
+	}
+	return files, cleanup, nil
+}
+
+func (s *Erasure) ListFiles() ([]string, error) {
+	result := make([]string, 0)
+	for _, b := range s.backends {
+		files, err := b.ListFiles()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		result = append(result, files...)
+	}
+	return result, nil
+}
+
+func (s *Erasure) UploadFile(file string, uuid string) (string, error) {
+	k := s.encoder.DataShards()
+	m := s.encoder.ParityShards()
+
+	src, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %v", err)
+	}
+	defer src.Close()
+	attrs, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("f.Stat: %v", err)
+	}
+	size := attrs.Size()
+	block := blockSize(size, k)
+	meta := erasureMetadata{Metadata: NewMetadata(), K: k, M: m, Size: size, Block: block, Shards: make([]shardInfo, k + m)}
+
+	files, cleanup, err := tempFiles(k + m)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	writers := make([]*util.CRCWriter, k + m)
+	for i, f := range files {
+		writers[i] = util.NewCRCWriter(f)
+	}
+
+	// Encode every stripe.
+	stripe := make([]byte, int64(k) * block)
+	shards := make([][]byte, k + m)
+	for i := range shards {
+		if i < k {
+			shards[i] = stripe[int64(i) * block:int64(i + 1) * block]
+		} else {
+			shards[i] = make([]byte, block)
+		}
+	}
+	for remaining := size; remaining > 0; {
+		n, err := io.ReadFull(src, stripe)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("io.ReadFull: %v", err)
+		}
+		for i := n; i < len(stripe); i++ {
+			stripe[i] = 0
+		}
+		remaining = remaining - int64(n)
+		if err := s.encoder.Encode(shards); err != nil {
+			return "", err
+		}
+		for i, shard := range shards {
+			if _, err := writers[i].Write(shard); err != nil {
+				return "", fmt.Errorf("Writer.Write: %v", err)
+			}
+		}
+	}
+
+	// Store every shard.
+	stored := 0
+	var lastErr error
+	for i, f := range files {
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("f.Close: %v", err)
+		}
+		b := s.backends[i]
+		shardId, err := shardUUID(uuid, i)
+		if err != nil {
+			return "", err
+		}
+		meta.Shards[i] = shardInfo{Backend: b.Name(), UUID: shardId, CRC32C: writers[i].Sum()}
+		s.log(fmt.Sprintf("storing shard %d on %s", i, b.Name()))
+		shardMetadata, err := b.UploadFile(f.Name(), shardId)
+		if err != nil {
+			s.log(fmt.Sprintf("shard %d failed: %s", i, err))
+			meta.Shards[i].Missing = true
+			lastErr = err
+			continue
+		}
+		meta.Shards[i].Metadata = shardMetadata
+		stored++
+	}
+	if stored < k {
+		return "", fmt.Errorf("only %d of %d shards stored: %w", stored, k + m, lastErr)
+	}
+	if stored < k + m {
+		s.log(fmt.Sprintf("only %d of %d shards stored - use repair", stored, k + m))
+	}
+	return meta.String(), nil
+}
+
+// Download the available shards of a file, checking their CRC32C.
+// Returns open files positioned at the start, with nil for shards that are
+// missing, lost, or corrupted, and the indices of the corrupted shards.
+func (s *Erasure) fetchShards(meta erasureMetadata) ([]*os.File, []int, func(), error) {
+	files, cleanup, err := tempFiles(len(meta.Shards))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	result := make([]*os.File, len(files))
+	corrupted := make([]int, 0)
+	available := 0
+	for i, shard := range meta.Shards {
+		if shard.Missing {
+			continue
+		}
+		f := files[i]
+		b := s.backend(meta, i)
+		if err := b.DownloadFile(shard.UUID, shard.Metadata, f.Name()); err != nil {
+			s.log(fmt.Sprintf("shard %d unavailable: %s", i, err))
+			continue
+		}
+		// The download replaced the file, so read it through a fresh handle.
+		reopened, err := os.Open(f.Name())
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("os.Open: %v", err)
+		}
+		f.Close()
+		files[i] = reopened
+		crcw := util.NewCRCWriter(io.Discard)
+		if _, err := io.Copy(crcw, reopened); err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("io.Copy: %v", err)
+		}
+		if crcw.Sum() != shard.CRC32C {
+			s.log(fmt.Sprintf("shard %d corrupted", i))
+			corrupted = append(corrupted, i)
+			continue
+		}
+		if _, err := reopened.Seek(0, io.SeekStart); err != nil {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("f.Seek: %v", err)
+		}
+		result[i] = reopened
+		available++
+	}
+	if available < meta.K {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("only %d shards available, need %d: %w", available, meta.K, erasure.ErrTooFewShards)
+	}
+	return result, corrupted, cleanup, nil
+}
+
+// Go through the stripes of a file, rebuilding blocks of missing shards.
+// Data is written to `out` (if not nil), and rebuilt shards to the writers
+// in `rebuilt`.
+func (s *Erasure) decode(meta erasureMetadata, inputs []*os.File, out io.Writer, rebuilt map[int]io.Writer) error {
+	encoder, err := erasure.NewEncoder(meta.K, meta.M)
+	if err != nil {
+		return err
+	}
+	stripes := int64(0)
+	if meta.Size > 0 {
+		stripes = (meta.Size + int64(meta.K) * meta.Block - 1) / (int64(meta.K) * meta.Block)
+	}
+	buffers := make([][]byte, len(inputs))
+	for i := range buffers {
+		buffers[i] = make([]byte, meta.Block)
+	}
+	shards := make([][]byte, len(inputs))
+	remaining := meta.Size
+	for stripe := int64(0); stripe < stripes; stripe++ {
+		for i, f := range inputs {
+			shards[i] = nil
+			if f == nil {
+				continue
+			}
+			if _, err := io.ReadFull(f, buffers[i]); err != nil {
+				return fmt.Errorf("shard %d: io.ReadFull: %v", i, err)
+			}
+			shards[i] = buffers[i]
+		}
+		if err := encoder.Reconstruct(shards); err != nil {
+			return err
+		}
+		if out != nil {
+			for i := 0; i < meta.K && remaining > 0; i++ {
+				n := meta.Block
+				if remaining < n {
+					n = remaining
+				}
+				if _, err := out.Write(shards[i][:n]); err != nil {
+					return fmt.Errorf("Writer.Write: %v", err)
+				}
+				remaining = remaining - n
+			}
+		}
+		for i, w := range rebuilt {
+			if _, err := w.Write(shards[i]); err != nil {
+				return fmt.Errorf("Writer.Write: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Erasure) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	inputs, _, cleanup, err := s.fetchShards(meta)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	dest, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("os.Create: %v", err)
+	}
+	defer dest.Close()
+	if err := s.decode(meta, inputs, dest, nil); err != nil {
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return fmt.Errorf("dest.Close: %v", err)
+	}
+	return nil
+}
+
+func (s *Erasure) Exists(uuid string, metadata string) (bool, error) {
+	// The object exists if enough shards exist to rebuild it.
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
+	count := 0
+	for i, shard := range meta.Shards {
+		if shard.Missing {
+			continue
+		}
+		if exists, err := s.backend(meta, i).Exists(shard.UUID, shard.Metadata); err == nil && exists {
+			count++
+		}
+	}
+	return count >= meta.K, nil
+}
+
+func (s *Erasure) DeleteFile(uuid string, metadata string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for i, shard := range meta.Shards {
+		if shard.Missing {
+			continue
+		}
+		b := s.backend(meta, i)
+		if err := b.DeleteFile(shard.UUID, shard.Metadata); err != nil {
+			s.log(fmt.Sprintf("shard %d failed: %s", i, err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *Erasure) RemoteInfo(uuid string, metadata string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Remote:      %s\n", s.Name())
+	fmt.Printf("Size:        %d\n", meta.Size)
+	fmt.Printf("Shards:      %d data + %d parity, %d bytes per block\n", meta.K, meta.M, meta.Block)
+	for i, shard := range meta.Shards {
+		b := s.backend(meta, i)
+		fmt.Printf(" %d  %s  %s  %s\n", i, shard.UUID, b.Name(), replicaStatus(b, shard.UUID, shard.Metadata, !shard.Missing))
+	}
+	return nil
+}
+
+// Rebuild the shards that are missing, lost, or corrupted and store them
+// again. Shards are checked against their own checksums, so that `hash` is
+// not needed.
+func (s *Erasure) Repair(uuid string, metadata string, hash string) (string, int, error) {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return metadata, 0, err
+	}
+	missing := make([]int, 0)
+	for i, shard := range meta.Shards {
+		if replicaStatus(s.backend(meta, i), shard.UUID, shard.Metadata, !shard.Missing) != "ok" {
+			missing = append(missing, i)
+			meta.Shards[i].Missing = true
+		}
+	}
+	// Every shard is fetched, since corrupted shards are only found by
+	// checking their content.
+	inputs, corrupted, cleanup, err := s.fetchShards(meta)
+	if err != nil {
+		return metadata, 0, err
+	}
+	defer cleanup()
+	for _, i := range corrupted {
+		missing = append(missing, i)
+		meta.Shards[i].Missing = true
+	}
+	if len(missing) == 0 {
+		return metadata, 0, nil
+	}
+	outputs, cleanupOutputs, err := tempFiles(len(missing))
+	if err != nil {
+		return metadata, 0, err
+	}
+	defer cleanupOutputs()
+	rebuilt := make(map[int]io.Writer)
+	for j, i := range missing {
+		rebuilt[i] = outputs[j]
+	}
+	if err := s.decode(meta, inputs, nil, rebuilt); err != nil {
+		return metadata, 0, err
+	}
+
+	count := 0
+	for j, i := range missing {
+		if err := outputs[j].Close(); err != nil {
+			return meta.String(), count, fmt.Errorf("f.Close: %v", err)
+		}
+		b := s.backend(meta, i)
+		s.log(fmt.Sprintf("restoring shard %d on %s", i, b.Name()))
+		shardMetadata, err := b.UploadFile(outputs[j].Name(), meta.Shards[i].UUID)
+		if err != nil {
+			return meta.String(), count, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		meta.Shards[i].Metadata = shardMetadata
+		meta.Shards[i].Missing = false
+		count++
+	}
+	return meta.String(), count, nil
+}
@@ -0,0 +1,151 @@
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestErasure(t *testing.T, k int, m int) (*Erasure, []*Memory) {
+	t.Helper()
+	mems := make([]*Memory, 0, k + m)
+	backends := make([]Storage, 0, k + m)
+	for i := 0; i < k + m; i++ {
+		mem := NewMemory(string(rune('a' + i)))
+		mems = append(mems, mem)
+		backends = append(backends, mem)
+	}
+	s, err := NewErasure(k, m, backends)
+	if err != nil {
+		t.Fatalf("NewErasure: %v", err)
+	}
+	return s, mems
+}
+
+func shardUUIDs(t *testing.T, metadata string) []string {
+	t.Helper()
+	meta := erasureMetadata{}
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	result := make([]string, 0)
+	for _, shard := range meta.Shards {
+		result = append(result, shard.UUID)
+	}
+	return result
+}
+
+func checkDownload(t *testing.T, s Storage, metadata string, content []byte) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out")
+	if err := s.DownloadFile(testUUID, metadata, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, not matching the %d uploaded", len(got), len(content))
+	}
+}
+
+func TestErasureLoseBackends(t *testing.T) {
+	for _, size := range []int{0, 1, 1000, 3 * MAX_BLOCK_SIZE + 17} {
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+		s, mems := newTestErasure(t, 3, 2)
+		metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+		if err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+		uuids := shardUUIDs(t, metadata)
+		checkDownload(t, s, metadata, content)
+
+		// Lose two backends, one holding data and one holding parity.
+		mems[0].Drop(uuids[0])
+		mems[4].Drop(uuids[4])
+		checkDownload(t, s, metadata, content)
+
+		metadata, count, err := s.Repair(testUUID, metadata, "")
+		if err != nil || count != 2 {
+			t.Fatalf("Repair() = %d, %v", count, err)
+		}
+		// Lose two other backends.
+		mems[1].Drop(uuids[1])
+		mems[2].Drop(uuids[2])
+		checkDownload(t, s, metadata, content)
+
+		mems[3].Drop(uuids[3])
+		if err := s.DownloadFile(testUUID, metadata, filepath.Join(t.TempDir(), "out")); err == nil {
+			t.Errorf("DownloadFile with three shards lost should fail")
+		}
+	}
+}
+
+func TestErasureCorruption(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	mems := []*Memory{NewMemory("a"), NewMemory("b"), NewMemory("c")}
+	corrupting := NewFaulty(mems[0], Faults{CorruptionRate: 1}, 1)
+	s, err := NewErasure(2, 1, []Storage{corrupting, mems[1], mems[2]})
+	if err != nil {
+		t.Fatalf("NewErasure: %v", err)
+	}
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	// The corrupted shard is detected and rebuilt from the others.
+	checkDownload(t, s, metadata, content)
+}
+
+func TestErasureRepairCorrupted(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	s, mems := newTestErasure(t, 3, 2)
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	uuids := shardUUIDs(t, metadata)
+	good := mems[1].Object(uuids[1])
+	mems[1].Corrupt(uuids[1])
+
+	metadata, count, err := s.Repair(testUUID, metadata, "")
+	if err != nil || count != 1 {
+		t.Fatalf("Repair() = %d, %v", count, err)
+	}
+	if !bytes.Equal(mems[1].Object(uuids[1]), good) {
+		t.Errorf("corrupted shard not restored")
+	}
+	// The restored shard is needed once two others are lost.
+	mems[0].Drop(uuids[0])
+	mems[2].Drop(uuids[2])
+	checkDownload(t, s, metadata, content)
+	if _, count, err := s.Repair(testUUID, metadata, ""); err != nil || count != 2 {
+		t.Errorf("Repair() = %d, %v", count, err)
+	}
+}
+
+func TestErasurePartialUpload(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	mems := []*Memory{NewMemory("a"), NewMemory("b"), NewMemory("c")}
+	failing := NewFaulty(mems[2], Faults{UploadFailureRate: 1}, 1)
+	s, _ := NewErasure(2, 1, []Storage{mems[0], mems[1], failing})
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	checkDownload(t, s, metadata, content)
+	failing.SetFaults(Faults{})
+	metadata, count, err := s.Repair(testUUID, metadata, "")
+	if err != nil || count != 1 {
+		t.Fatalf("Repair() = %d, %v", count, err)
+	}
+	mems[0].Drop(shardUUIDs(t, metadata)[0])
+	checkDownload(t, s, metadata, content)
+
+	if _, err := NewErasure(2, 1, []Storage{mems[0]}); err == nil {
+		t.Errorf("NewErasure with too few backends should fail")
+	}
+}
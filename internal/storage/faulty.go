@@ -0,0 +1,175 @@
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fault-injecting storage.
+// Wraps another storage and makes operations fail, slow down, or return
+// corrupted data according to a configurable set of faults. Mostly useful
+// for testing.
+
+var ErrInjected = errors.New("injected fault")
+
+type Faults struct {
+	UploadFailureRate float64      // Probability in [0, 1] that an upload fails.
+	DownloadFailureRate float64    // Probability in [0, 1] that a download fails.
+	CorruptionRate float64         // Probability in [0, 1] that a download is corrupted.
+	Latency time.Duration          // Delay added to every operation.
+}
+
+type Faulty struct {
+	store Storage
+	mu sync.Mutex
+	faults Faults
+	random *rand.Rand
+}
+
+func NewFaulty(store Storage, faults Faults, seed int64) *Faulty {
+	return &Faulty{store: store, faults: faults, random: rand.New(rand.NewSource(seed))}
+}
+
+func (s *Faulty) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+func (s *Faulty) Faults() Faults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+// Wait out the latency and decide whether a fault with probability `rate`
+// should fire.
+func (s *Faulty) inject(rate float64) bool {
+	s.mu.Lock()
+	latency := s.faults.Latency
+	fire := rate > 0 && s.random.Float64() < rate
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return fire
+}
+
+func (s *Faulty) log(text string) {
+	s.store.log(text)
+}
+
+func (s *Faulty) Name() string {
+	return s.store.Name()
+}
+
+func (s *Faulty) ListFiles() ([]string, error) {
+	s.inject(0)
+	return s.store.ListFiles()
+}
+
+func (s *Faulty) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	faults := s.Faults()
+	if s.inject(faults.DownloadFailureRate) {
+		return fmt.Errorf("download %s: %w", uuid, ErrInjected)
+	}
+	if err := s.store.DownloadFile(uuid, metadata, outputFileName); err != nil {
+		return err
+	}
+	if s.inject(faults.CorruptionRate) {
+		return corruptFile(outputFileName)
+	}
+	return nil
+}
+
+func (s *Faulty) UploadFile(file string, uuid string) (string, error) {
+	faults := s.Faults()
+	if s.inject(faults.UploadFailureRate) {
+		return "", fmt.Errorf("upload %s: %w", uuid, ErrInjected)
+	}
+	return s.store.UploadFile(file, uuid)
+}
+
+func (s *Faulty) Download(uuid string, metadata string, w io.Writer) error {
+	faults := s.Faults()
+	if s.inject(faults.DownloadFailureRate) {
+		return fmt.Errorf("download %s: %w", uuid, ErrInjected)
+	}
+	if s.inject(faults.CorruptionRate) {
+		w = &corruptWriter{w, false}
+	}
+	return Download(s.store, uuid, metadata, w)
+}
+
+func (s *Faulty) Upload(r io.Reader, uuid string) (string, error) {
+	faults := s.Faults()
+	if s.inject(faults.UploadFailureRate) {
+		return "", fmt.Errorf("upload %s: %w", uuid, ErrInjected)
+	}
+	return Upload(s.store, r, uuid)
+}
+
+func (s *Faulty) DeleteFile(uuid string, metadata string) error {
+	s.inject(0)
+	return s.store.DeleteFile(uuid, metadata)
+}
+
+func (s *Faulty) Exists(uuid string, metadata string) (bool, error) {
+	s.inject(0)
+	return s.store.Exists(uuid, metadata)
+}
+
+func (s *Faulty) RemoteInfo(uuid string, metadata string) error {
+	s.inject(0)
+	return s.store.RemoteInfo(uuid, metadata)
+}
+
+func (s *Faulty) StoredSize(size int64, metadata string) int64 {
+	return StoredSize(s.store, size, metadata)
+}
+
+func (s *Faulty) UploadSize(size int64) int64 {
+	return UploadSize(s.store, size)
+}
+
+// Flip the bits of the first byte written through.
+type corruptWriter struct {
+	w io.Writer
+	done bool
+}
+
+func (c *corruptWriter) Write(p []byte) (int, error) {
+	if c.done || len(p) == 0 {
+		return c.w.Write(p)
+	}
+	c.done = true
+	q := make([]byte, len(p))
+	copy(q, p)
+	q[0] = ^q[0]
+	return c.w.Write(q)
+}
+
+// Flip the bits of the first byte of a file.
+func corruptFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if n, _ := f.ReadAt(b, 0); n == 0 {
+		// Nothing to corrupt.
+		return nil
+	}
+	b[0] = ^b[0]
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("f.WriteAt: %v", err)
+	}
+	return f.Close()
+}
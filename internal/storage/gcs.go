@@ -2,14 +2,14 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"time"
 	"io"
 	"io/ioutil"
 	"os"
-	"math"
-	"strconv"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
@@ -48,17 +48,26 @@ func (s GoogleCloud) Name() string {
 	return fmt.Sprintf("gcs::%s", s.bucket)
 }
 
-// Convert a UUID to a path on Cloud Storage.
-// E.g.,
-//   7b5d41cc-86d6-11eca8a3-0242ac120002
-// to
-//   7b/5d/41/cc/7b5d41cc-86d6-11eca8a3-0242ac120002
+// Metadata of an object, where objects stored before metadata was
+// versioned are always negated.
+func parseGCSMetadata(metadata string) (Metadata, error) {
+	meta, err := ParseMetadata(metadata)
+	if err != nil {
+		return meta, err
+	}
+	if meta.Version == 0 {
+		meta.Transforms = []string{TRANSFORM_NEGATE}
+	}
+	return meta, nil
+}
 
-func uuidToPath(uuid string) (string, error) {
-	if len(uuid) != 36 {
-		return "", fmt.Errorf("length of UUID %s <> 36", uuid)
+// Names of the objects making up a file stored at `target`.
+func objectTargets(target string, metadata string) ([]string, error) {
+	meta, err := parseGCSMetadata(metadata)
+	if err != nil {
+		return nil, err
 	}
-	return fmt.Sprintf("%s/%s/%s/%s/%s", uuid[:2], uuid[2:4], uuid[4:6], uuid[6:8], uuid), nil
+	return meta.pieces(target), nil
 }
 
 func (s GoogleCloud) log(text string) {
@@ -140,6 +149,24 @@ func (s GoogleCloud) WriteFile(content []byte, target string) error {
 }
 
 func (s GoogleCloud) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	f, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("os.Create: %v", err)
+	}
+	defer f.Close()
+
+	if err := s.Download(uuid, metadata, f); err != nil {
+		return err
+	}
+	
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %w", err)
+	}
+	
+	return nil
+}
+
+func (s GoogleCloud) Download(uuid string, metadata string, w io.Writer) error {
 	bucket := s.bucket
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx, option.WithCredentialsFile(s.privKey))
@@ -153,69 +180,54 @@ func (s GoogleCloud) DownloadFile(uuid string, metadata string, outputFileName s
 		return err
 	}
 	
-	f, err := os.Create(outputFileName)
+	meta, err := parseGCSMetadata(metadata)
 	if err != nil {
-		return fmt.Errorf("os.Create: %v", err)
+		return err
+	}
+	content, err := meta.untransform(w)
+	if err != nil {
+		return err
 	}
-	negf := util.NewNegateWriter(f)
 
-	if metadata != "" {
-		// We have chunks.
-		numParts, err := strconv.ParseInt(metadata, 10, 64)
-		if err != nil {
-			return fmt.Errorf("wrong metadata: %s", metadata)
-		}
-		s.log(fmt.Sprintf("objects: %d", numParts))
-		for i := int64(0); i < numParts; i++ {
-			currTarget := fmt.Sprintf("%s.%03d", target, i)
-			s.log(fmt.Sprintf("downloading object %s", currTarget))
-
-			// Setup a timeout.
-			ctx, cancel := context.WithTimeout(ctx, time.Second * DOWNLOAD_TIMEOUT)
-			defer cancel()
-			
-			obj := client.Bucket(bucket).Object(currTarget)
-			rc, err := obj.NewReader(ctx)
-			if err != nil {
-				return fmt.Errorf("Object(%q).NewReader: %w", currTarget, err)
-			}
-			defer rc.Close()
-			
-			if _, err := io.Copy(negf, rc); err != nil {
-				return fmt.Errorf("io.Copy: %w", err)
-			}
-		
-			if err = rc.Close(); err != nil {
-				return fmt.Errorf("rc.Close: %w", err)
-			}
-		}
-	} else {
-		s.log(fmt.Sprintf("downloading object %s", target))
+	targets := meta.pieces(target)
+	s.log(fmt.Sprintf("objects: %d", len(targets)))
+	for _, currTarget := range targets {
+		s.log(fmt.Sprintf("downloading object %s", currTarget))
 
 		// Setup a timeout.
 		ctx, cancel := context.WithTimeout(ctx, time.Second * DOWNLOAD_TIMEOUT)
 		defer cancel()
-		
-		obj := client.Bucket(bucket).Object(target)
+
+		obj := client.Bucket(bucket).Object(currTarget)
 		rc, err := obj.NewReader(ctx)
 		if err != nil {
-			return fmt.Errorf("Object(%q).NewReader: %v", target, err)
+			return fmt.Errorf("Object(%q).NewReader: %w", currTarget, err)
 		}
 		defer rc.Close()
-		
-		if _, err := io.Copy(negf, rc); err != nil {
-			return fmt.Errorf("io.Copy: %v", err)
+
+		if _, err := io.Copy(content, rc); err != nil {
+			return fmt.Errorf("io.Copy: %w", err)
+		}
+
+		if err = rc.Close(); err != nil {
+			return fmt.Errorf("rc.Close: %w", err)
 		}
 	}
-	
-	if err = f.Close(); err != nil {
-		return fmt.Errorf("f.Close: %w", err)
-	}
-	
+
 	return nil
 }
 
 func (s GoogleCloud) UploadFile(path string, uuid string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %v", err)
+	}
+	defer f.Close()
+
+	return s.Upload(f, uuid)
+}
+
+func (s GoogleCloud) Upload(src io.Reader, uuid string) (string, error) {
 	bucket := s.bucket
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx, option.WithCredentialsFile(s.privKey))
@@ -229,26 +241,20 @@ func (s GoogleCloud) UploadFile(path string, uuid string) (string, error) {
 		return "", err
 	}
 
-	// Get source file size.
-	attrs, err := os.Stat(path)
-	if err != nil {
-		return "", fmt.Errorf("os.Stat: %v", err)
-	}
-	fileSize := attrs.Size()
-	// Calculate total number of parts the file will be chunked into.
-	totalPartsNum := int(math.Ceil(float64(fileSize) / float64(CHUNK_SIZE)))
-	s.log(fmt.Sprintf("objects: %d", totalPartsNum))
-
-	f, err := os.Open(path)
-	if err != nil {
-		return "", fmt.Errorf("os.Open: %v", err)
-	}
-	defer f.Close()
-
-	// From:
-	// https://socketloop.com/tutorials/golang-how-to-split-or-chunking-a-file-to-smaller-pieces
-	for i := 0; i < totalPartsNum; i++ {
-		currTarget := fmt.Sprintf("%s.%03d", target, i)
+	// The size of the source is not known in advance, so read it one
+	// chunk at a time until we run out.
+	partBuffer := &bytes.Buffer{}
+	totalPartsNum := 0
+	for {
+		partBuffer.Reset()
+		partSize, err := io.CopyN(partBuffer, src, CHUNK_SIZE)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("io.CopyN: %v", err)
+		}
+		if partSize == 0 {
+			break
+		}
+		currTarget := chunkPath(target, int64(totalPartsNum))
 		s.log(fmt.Sprintf("uploading object %s", currTarget))
 
 		// Setup a timeout.
@@ -262,17 +268,12 @@ func (s GoogleCloud) UploadFile(path string, uuid string) (string, error) {
 		negw := util.NewNegateWriter(wc)
 		crcw := util.NewCRCWriter(negw)
 		
-		partSize := int(math.Min(CHUNK_SIZE, float64(fileSize - int64(i * CHUNK_SIZE))))
-		partBuffer := make([]byte, partSize)
-		
-		f.Read(partBuffer)
-		
 		// write to disk
-		n, err := crcw.Write(partBuffer)
+		n, err := crcw.Write(partBuffer.Bytes())
 		if err != nil {
 			return "", fmt.Errorf("Writer.Writer: %v", err)
 		}
-		if n < partSize {
+		if int64(n) < partSize {
 			return "", fmt.Errorf("Too few bytes written - expected %d wrote %d", partSize, n)
 		}
 		time.Sleep(UPLOAD_PAUSE * time.Second)
@@ -282,7 +283,7 @@ func (s GoogleCloud) UploadFile(path string, uuid string) (string, error) {
 		crc32c := crcw.Sum()
 		attrs, err := obj.Attrs(ctx)
 		if err != nil {
-			return "", fmt.Errorf("Object(%q).Attrs: %v", obj, err)
+			return "", fmt.Errorf("Object(%q).Attrs: %v", currTarget, err)
 		}
 		if (crc32c != attrs.CRC32C) {
 			return "", fmt.Errorf("crc32c of uploaded file different from %x", crc32c)
@@ -290,9 +291,15 @@ func (s GoogleCloud) UploadFile(path string, uuid string) (string, error) {
 
 		// Cancel the timeout.
 		cancel()
+		totalPartsNum++
+		if partSize < CHUNK_SIZE {
+			break
+		}
 	}
-	metadata := fmt.Sprintf("%d", totalPartsNum)
-	return metadata, nil
+	s.log(fmt.Sprintf("objects: %d", totalPartsNum))
+	meta := NewChunkedMetadata(int64(totalPartsNum), CHUNK_SIZE)
+	meta.Transforms = []string{TRANSFORM_NEGATE}
+	return meta.String(), nil
 }
 
 func (s GoogleCloud) uploadFileSingle_OBSOLETE(path string, target string) error {
@@ -333,7 +340,7 @@ func (s GoogleCloud) uploadFileSingle_OBSOLETE(path string, target string) error
 	crc32c := crcw.Sum()
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		return fmt.Errorf("Object(%q).Attrs: %v", obj, err)
+		return fmt.Errorf("Object(%q).Attrs: %v", target, err)
 	}
 	if (crc32c != attrs.CRC32C) {
 		return fmt.Errorf("crc32c of uploaded file different from %x", crc32c)
@@ -341,6 +348,70 @@ func (s GoogleCloud) uploadFileSingle_OBSOLETE(path string, target string) error
 	return nil
 }
 
+func (s GoogleCloud) Exists(uuid string, metadata string) (bool, error) {
+	bucket := s.bucket
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(s.privKey))
+	if err != nil {
+		return false, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	target, err := uuidToPath(uuid)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second * DOWNLOAD_TIMEOUT)
+	defer cancel()
+
+	targets, err := objectTargets(target, metadata)
+	if err != nil {
+		return false, err
+	}
+	for _, currTarget := range targets {
+		_, err := client.Bucket(bucket).Object(currTarget).Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("ObjectHandle.Attrs: %v", err)
+		}
+	}
+	return true, nil
+}
+
+func (s GoogleCloud) DeleteFile(uuid string, metadata string) error {
+	bucket := s.bucket
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(s.privKey))
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	target, err := uuidToPath(uuid)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second * UPLOAD_TIMEOUT)
+	defer cancel()
+
+	targets, err := objectTargets(target, metadata)
+	if err != nil {
+		return err
+	}
+	for _, currTarget := range targets {
+		s.log(fmt.Sprintf("deleting object %s", currTarget))
+		err := client.Bucket(bucket).Object(currTarget).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("Object(%q).Delete: %v", currTarget, err)
+		}
+	}
+	return nil
+}
+
 func (s GoogleCloud) RemoteInfo(uuid string, metadata string) error {
 	bucket := s.bucket
 	ctx := context.Background()
@@ -358,35 +429,16 @@ func (s GoogleCloud) RemoteInfo(uuid string, metadata string) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second * UPLOAD_TIMEOUT)
 	defer cancel()
 
-	if metadata != "" {
-		// We have chunks.
-		numParts, err := strconv.ParseInt(metadata, 10, 64)
-		if err != nil {
-			return fmt.Errorf("wrong metadata: %s", metadata)
-		}
-		fmt.Printf("Remote:      %s\n", s.Name())
-		for i := int64(0); i < numParts; i++ {
-			currTarget := fmt.Sprintf("%s.%03d", target, i)
-			attrs, err := client.Bucket(bucket).Object(currTarget).Attrs(ctx)
-			if err != nil {
-				return fmt.Errorf("ObjectHandle.Attrs: %v", err)
-			}
-			if attrs.Size < 1024 {
-				fmt.Printf(" %s  %4d B  %x\n", attrs.Name, attrs.Size, attrs.CRC32C)
-			} else if attrs.Size < 1024 * 1024 {
-				size := attrs.Size / 1024
-				fmt.Printf(" %s  %4d MiB  %x\n", attrs.Name, size, attrs.CRC32C)
-			} else {
-				size := attrs.Size / (1024 * 1024)
-				fmt.Printf(" %s  %4d GiB  %x\n", attrs.Name, size, attrs.CRC32C)
-			}
-		}
-	} else {
-		attrs, err := client.Bucket(bucket).Object(target).Attrs(ctx)
+	targets, err := objectTargets(target, metadata)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Remote:      %s\n", s.Name())
+	for _, currTarget := range targets {
+		attrs, err := client.Bucket(bucket).Object(currTarget).Attrs(ctx)
 		if err != nil {
 			return fmt.Errorf("ObjectHandle.Attrs: %v", err)
 		}
-		fmt.Printf("Remote:      %s\n", s.Name())
 		if attrs.Size < 1024 {
 			fmt.Printf(" %s  %4d B  %x\n", attrs.Name, attrs.Size, attrs.CRC32C)
 		} else if attrs.Size < 1024 * 1024 {
@@ -2,19 +2,38 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"path"
+	"strings"
 )
 
+// Objects are stored under the same sharded layout as on Cloud Storage,
+//   <root>/7b/5d/41/cc/7b5d41cc-86d6-11eca8a3-0242ac120002
+// optionally split into chunks
+//   <root>/7b/5d/41/cc/7b5d41cc-86d6-11eca8a3-0242ac120002.000
+// in which case the metadata records the number of chunks (see metadata.go).
+//
+// Older drives stored every object flat in the root as <root>/<uuid>.
+// Those objects are still readable, and Migrate() moves them to the
+// sharded layout.
+
+const TEMP_MARKER = ".tmp-"
+
 type LocalFileSystem struct {
 	root string
+	chunkSize int64     // 0 = no chunking.
 }
 
 func NewLocalFileSystem(root string) LocalFileSystem {
-	return LocalFileSystem{root}
+	return LocalFileSystem{root, 0}
+}
+
+func NewLocalFileSystemChunked(root string, chunkSize int64) LocalFileSystem {
+	return LocalFileSystem{root, chunkSize}
 }
 
 func (s LocalFileSystem) log(text string) {
@@ -31,7 +50,7 @@ func (s LocalFileSystem) ListFiles() ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if info.Mode().IsRegular() {
+		if info.Mode().IsRegular() && !strings.Contains(info.Name(), TEMP_MARKER) {
 			result = append(result, path)
 		}
 		return nil
@@ -61,14 +80,40 @@ func (s LocalFileSystem) WriteFile(content []byte, target string) error {
 	return nil
 }
 
-func (s LocalFileSystem) DownloadFile(uuid string, metadata string, outputFileName string) error {
-	path := path.Join(s.root, uuid)
-	src, err := os.Open(path)
+// Path of the object for `uuid` under the sharded layout.
+func (s LocalFileSystem) objectPath(uuid string) (string, error) {
+	target, err := uuidToPath(uuid)
 	if err != nil {
-		return fmt.Errorf("os.Open: %v", err)
+		return "", err
 	}
-	defer src.Close()
+	return filepath.Join(s.root, filepath.FromSlash(target)), nil
+}
+
+// Paths of all the pieces of the object for `uuid`, in order.
+// Falls back to the flat layout for unchunked objects that have not been
+// migrated yet.
+func (s LocalFileSystem) objectPieces(uuid string, metadata string) ([]string, error) {
+	target, err := s.objectPath(uuid)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ParseMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Chunked {
+		return meta.pieces(target), nil
+	}
+	if _, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		flat := filepath.Join(s.root, uuid)
+		if _, err := os.Stat(flat); err == nil {
+			return []string{flat}, nil
+		}
+	}
+	return []string{target}, nil
+}
 
+func (s LocalFileSystem) DownloadFile(uuid string, metadata string, outputFileName string) error {
 	dest, err := os.Create(outputFileName)
 	if err != nil {
 		return fmt.Errorf("os.Create: %v", err)
@@ -76,50 +121,236 @@ func (s LocalFileSystem) DownloadFile(uuid string, metadata string, outputFileNa
 	defer dest.Close()
 
 	s.log(fmt.Sprintf("copying %s", outputFileName))
+	if err := s.Download(uuid, metadata, dest); err != nil {
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return fmt.Errorf("dest.Close: %v", err)
+	}
+	return nil
+}
+
+func (s LocalFileSystem) Download(uuid string, metadata string, w io.Writer) error {
+	pieces, err := s.objectPieces(uuid, metadata)
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		if err := copyFrom(w, piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFrom(dest io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open: %v", err)
+	}
+	defer src.Close()
 	if _, err := io.Copy(dest, src); err != nil {
 		return fmt.Errorf("io.Copy: %v", err)
 	}
-
 	return nil
 }
 
-func (s LocalFileSystem) UploadFile(file string, target string) (string, error) {
+func (s LocalFileSystem) UploadFile(file string, uuid string) (string, error) {
 	src, err := os.Open(file)
 	if err != nil {
 		return "", fmt.Errorf("os.Open: %v", err)
 	}
 	defer src.Close()
 
-	path := path.Join(s.root, target)
-	dest, err := os.Create(path)
+	s.log(fmt.Sprintf("copying %s", file))
+	return s.Upload(src, uuid)
+}
+
+func (s LocalFileSystem) Upload(src io.Reader, uuid string) (string, error) {
+	target, err := s.objectPath(uuid)
 	if err != nil {
-		return "", fmt.Errorf("os.Create: %v", err)
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return "", fmt.Errorf("os.MkdirAll: %v", err)
 	}
-	defer dest.Close()
 
-	s.log(fmt.Sprintf("copying %s", file))
-	if _, err := io.Copy(dest, src); err != nil {
-		return "", fmt.Errorf("io.Copy: %v", err)
+	if s.chunkSize <= 0 {
+		if _, err := writeAtomic(target, src, -1, false); err != nil {
+			return "", err
+		}
+		return NewMetadata().String(), nil
+	}
+
+	totalPartsNum := int64(0)
+	for {
+		currTarget := chunkPath(target, totalPartsNum)
+		n, err := writeAtomic(currTarget, src, s.chunkSize, true)
+		if err != nil {
+			// Do not leave a partial object behind.
+			for i := int64(0); i < totalPartsNum; i++ {
+				os.Remove(chunkPath(target, i))
+			}
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		s.log(fmt.Sprintf("wrote object %s", filepath.Base(currTarget)))
+		totalPartsNum++
+		if n < s.chunkSize {
+			break
+		}
+	}
+	s.log(fmt.Sprintf("objects: %d", totalPartsNum))
+	return NewChunkedMetadata(totalPartsNum, s.chunkSize).String(), nil
+}
+
+// Write up to `size` bytes from `src` to `target` (or everything if `size`
+// < 0), returning the number of bytes written.
+// Data goes to a temporary file in the same folder that is flushed to disk
+// before being renamed to `target`, so that `target` is either absent or
+// complete. If `skipEmpty` is set and there is nothing to write, `target`
+// is not created.
+func writeAtomic(target string, src io.Reader, size int64, skipEmpty bool) (int64, error) {
+	dir := filepath.Dir(target)
+	tmp, err := os.CreateTemp(dir, filepath.Base(target) + TEMP_MARKER + "*")
+	if err != nil {
+		return 0, fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	tmpName := tmp.Name()
+	// Clean up on failure. Harmless once the file has been renamed.
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+
+	if size >= 0 {
+		src = io.LimitReader(src, size)
+	}
+	n, err := io.Copy(tmp, src)
+	if err != nil {
+		return n, fmt.Errorf("io.Copy: %v", err)
+	}
+	if n == 0 && skipEmpty {
+		return 0, nil
+	}
+	if err := tmp.Sync(); err != nil {
+		return n, fmt.Errorf("f.Sync: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, fmt.Errorf("f.Close: %v", err)
 	}
-	
-	return "", nil
+	if err := os.Rename(tmpName, target); err != nil {
+		return n, fmt.Errorf("os.Rename: %v", err)
+	}
+	return n, syncDir(dir)
+}
+
+// Flush a folder so that a rename into it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("os.Open: %v", err)
+	}
+	defer d.Close()
+	// Not every platform (or file system) supports syncing a folder.
+	d.Sync()
+	return nil
+}
+
+func (s LocalFileSystem) Exists(uuid string, metadata string) (bool, error) {
+	pieces, err := s.objectPieces(uuid, metadata)
+	if err != nil {
+		return false, err
+	}
+	for _, piece := range pieces {
+		_, err := os.Stat(piece)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("os.Stat: %v", err)
+		}
+	}
+	return true, nil
+}
+
+func (s LocalFileSystem) DeleteFile(uuid string, metadata string) error {
+	pieces, err := s.objectPieces(uuid, metadata)
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		if err := os.Remove(piece); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("os.Remove: %v", err)
+		}
+	}
+	return nil
 }
 
 func (s LocalFileSystem) RemoteInfo(uuid string, metadata string) error {
-	path := path.Join(s.root, uuid)
-	attrs, err := os.Stat(path)
+	pieces, err := s.objectPieces(uuid, metadata)
 	if err != nil {
-		fmt.Errorf("os.Stat: %v", err)
+		return err
 	}
 	fmt.Printf("Remote:      %s\n", s.Name())
-	if attrs.Size() < 1024 {
-		fmt.Printf(" %s  %4d B\n", attrs.Name(), attrs.Size())
-	} else if attrs.Size() < 1024 * 1024 {
-		size := attrs.Size() / 1024
-		fmt.Printf(" %s  %4d MiB\n", attrs.Name(), size)
-	} else {
-		size := attrs.Size() / (1024 * 1024)
-		fmt.Printf(" %s  %4d GiB\n", attrs.Name(), size)
+	for _, piece := range pieces {
+		attrs, err := os.Stat(piece)
+		if err != nil {
+			return fmt.Errorf("os.Stat: %v", err)
+		}
+		rel, _ := filepath.Rel(s.root, piece)
+		if attrs.Size() < 1024 {
+			fmt.Printf(" %s  %4d B\n", rel, attrs.Size())
+		} else if attrs.Size() < 1024 * 1024 {
+			size := attrs.Size() / 1024
+			fmt.Printf(" %s  %4d KiB\n", rel, size)
+		} else if attrs.Size() < 1024 * 1024 * 1024 {
+			size := attrs.Size() / (1024 * 1024)
+			fmt.Printf(" %s  %4d MiB\n", rel, size)
+		} else {
+			size := attrs.Size() / (1024 * 1024 * 1024)
+			fmt.Printf(" %s  %4d GiB\n", rel, size)
+		}
 	}
 	return nil
 }
+
+// Move objects stored under the flat layout into the sharded layout.
+// Returns the number of objects moved.
+// Safe to interrupt and run again.
+func (s LocalFileSystem) Migrate() (int, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return 0, fmt.Errorf("os.ReadDir: %v", err)
+	}
+	count := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || len(name) != 36 || strings.Count(name, "-") != 4 {
+			// Not a flat object.
+			continue
+		}
+		target, err := s.objectPath(name)
+		if err != nil {
+			return count, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return count, fmt.Errorf("os.MkdirAll: %v", err)
+		}
+		if _, err := os.Stat(target); err == nil {
+			return count, fmt.Errorf("object %s exists under both layouts", name)
+		}
+		s.log(fmt.Sprintf("moving %s", name))
+		if err := os.Rename(filepath.Join(s.root, name), target); err != nil {
+			return count, fmt.Errorf("os.Rename: %v", err)
+		}
+		if err := syncDir(filepath.Dir(target)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := syncDir(s.root); err != nil {
+		return count, err
+	}
+	return count, nil
+}
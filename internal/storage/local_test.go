@@ -0,0 +1,100 @@
+
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalShardedLayout(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("hello, world")
+	s := NewLocalFileSystem(root)
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if meta, err := ParseMetadata(metadata); err != nil || meta.Chunked {
+		t.Errorf("metadata = %q, want an unchunked object", metadata)
+	}
+	if _, err := os.Stat(filepath.Join(root, "7b", "5d", "41", "cc", testUUID)); err != nil {
+		t.Errorf("object not stored under sharded path: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := s.DownloadFile(testUUID, metadata, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+	files, _ := s.ListFiles()
+	for _, f := range files {
+		if strings.Contains(f, TEMP_MARKER) {
+			t.Errorf("temporary file left behind: %s", f)
+		}
+	}
+}
+
+func TestLocalChunked(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("0123456789abcdefghij-")
+	s := NewLocalFileSystemChunked(root, 10)
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if meta, err := ParseMetadata(metadata); err != nil || !meta.Chunked || meta.Chunks != 3 || meta.ChunkSize != 10 {
+		t.Errorf("metadata = %q, want 3 chunks of 10 bytes", metadata)
+	}
+	last, err := os.ReadFile(filepath.Join(root, "7b", "5d", "41", "cc", testUUID + ".002"))
+	if err != nil || string(last) != "-" {
+		t.Errorf("last chunk = %q, %v", last, err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	// Reading back does not depend on the chunk size of the backend.
+	if err := NewLocalFileSystem(root).DownloadFile(testUUID, metadata, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+}
+
+func TestLocalMigrate(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("legacy")
+	if err := os.WriteFile(filepath.Join(root, testUUID), content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "README"), content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	s := NewLocalFileSystem(root)
+	out := filepath.Join(t.TempDir(), "out")
+	if err := s.DownloadFile(testUUID, "", out); err != nil {
+		t.Fatalf("DownloadFile before migration: %v", err)
+	}
+
+	count, err := s.Migrate()
+	if err != nil || count != 1 {
+		t.Fatalf("Migrate() = %d, %v", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, testUUID)); err == nil {
+		t.Errorf("flat object still present after migration")
+	}
+	if _, err := os.Stat(filepath.Join(root, "README")); err != nil {
+		t.Errorf("unrelated file moved by migration")
+	}
+	if err := s.DownloadFile(testUUID, "", out); err != nil {
+		t.Fatalf("DownloadFile after migration: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+	if count, err := s.Migrate(); err != nil || count != 0 {
+		t.Errorf("second Migrate() = %d, %v", count, err)
+	}
+}
@@ -0,0 +1,145 @@
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// In-memory storage.
+// Objects are kept in a map keyed by UUID. Mostly useful for testing.
+
+type Memory struct {
+	name string
+	mu sync.Mutex
+	objects map[string][]byte
+}
+
+func NewMemory(name string) *Memory {
+	return &Memory{name: name, objects: make(map[string][]byte)}
+}
+
+func (s *Memory) log(text string) {
+	// Stay quiet.
+}
+
+func (s *Memory) Name() string {
+	return fmt.Sprintf("memory::%s", s.name)
+}
+
+func (s *Memory) ListFiles() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Return the content of an object, or nil if the object does not exist.
+func (s *Memory) Object(uuid string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, found := s.objects[uuid]
+	if !found {
+		return nil
+	}
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
+
+// Remove an object behind the catalog's back.
+func (s *Memory) Drop(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, uuid)
+}
+
+// Change the content of an object behind the catalog's back.
+func (s *Memory) Corrupt(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, found := s.objects[uuid]
+	if !found {
+		return
+	}
+	corrupted := append([]byte{}, data...)
+	if len(corrupted) == 0 {
+		corrupted = append(corrupted, 0)
+	} else {
+		corrupted[0] ^= 0xff
+	}
+	s.objects[uuid] = corrupted
+}
+
+func (s *Memory) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	data := s.Object(uuid)
+	if data == nil {
+		return fmt.Errorf("object %s not found", uuid)
+	}
+	if err := os.WriteFile(outputFileName, data, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %v", err)
+	}
+	return nil
+}
+
+func (s *Memory) Download(uuid string, metadata string, w io.Writer) error {
+	data := s.Object(uuid)
+	if data == nil {
+		return fmt.Errorf("object %s not found", uuid)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("Writer.Write: %v", err)
+	}
+	return nil
+}
+
+func (s *Memory) UploadFile(file string, uuid string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("os.ReadFile: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[uuid] = data
+	return NewMetadata().String(), nil
+}
+
+func (s *Memory) Upload(r io.Reader, uuid string) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("io.ReadAll: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[uuid] = data
+	return NewMetadata().String(), nil
+}
+
+func (s *Memory) DeleteFile(uuid string, metadata string) error {
+	s.Drop(uuid)
+	return nil
+}
+
+func (s *Memory) Exists(uuid string, metadata string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.objects[uuid]
+	return found, nil
+}
+
+func (s *Memory) RemoteInfo(uuid string, metadata string) error {
+	data := s.Object(uuid)
+	if data == nil {
+		return fmt.Errorf("object %s not found", uuid)
+	}
+	fmt.Printf("Remote:      %s\n", s.Name())
+	fmt.Printf(" %s  %4d B\n", uuid, len(data))
+	return nil
+}
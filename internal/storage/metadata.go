@@ -0,0 +1,104 @@
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Metadata of a stored object, recorded in the catalog with every file and
+// handed back to the storage to read the object. Backends write it as
+// versioned JSON, leaving out the fields they do not use:
+//   {"v":1,"chunked":true,"chunks":3,"chunkSize":209715200,"transforms":["negate"]}
+// Mirror and erasure storage add their own fields (see mirror.go and
+// erasure.go), and record the metadata of their backends as strings.
+//
+// Metadata written before that format is version 0, and still read: an
+// empty string for an object stored whole, or the number of chunks of a
+// chunked object. A version newer than METADATA_VERSION is refused rather
+// than misread.
+
+const METADATA_VERSION = 1
+
+// Transforms applied to the content of an object before it is stored.
+const (
+	TRANSFORM_NEGATE = "negate"      // Every bit flipped.
+)
+
+type Metadata struct {
+	Version int `json:"v"`
+	Chunked bool `json:"chunked,omitempty"`
+	Chunks int64 `json:"chunks,omitempty"`           // Chunked objects only.
+	ChunkSize int64 `json:"chunkSize,omitempty"`     // Size of every chunk but the last, if known.
+	Transforms []string `json:"transforms,omitempty"` // In the order they were applied.
+}
+
+// Metadata of the current version for an object stored whole.
+func NewMetadata() Metadata {
+	return Metadata{Version: METADATA_VERSION}
+}
+
+// Metadata of the current version for an object stored as `chunks` chunks
+// of `chunkSize` bytes.
+func NewChunkedMetadata(chunks int64, chunkSize int64) Metadata {
+	return Metadata{Version: METADATA_VERSION, Chunked: true, Chunks: chunks, ChunkSize: chunkSize}
+}
+
+func ParseMetadata(metadata string) (Metadata, error) {
+	if metadata == "" {
+		return Metadata{}, nil
+	}
+	if chunks, err := strconv.ParseInt(metadata, 10, 64); err == nil && chunks >= 0 {
+		return Metadata{Chunked: true, Chunks: chunks}, nil
+	}
+	meta := Metadata{}
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil || meta.Version < 1 {
+		return meta, fmt.Errorf("wrong metadata: %s", metadata)
+	}
+	if err := checkVersion(meta.Version); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+func checkVersion(version int) error {
+	if version > METADATA_VERSION {
+		return fmt.Errorf("metadata version %d not supported (at most %d), upgrade vhd", version, METADATA_VERSION)
+	}
+	return nil
+}
+
+func (m Metadata) String() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// Names of the objects holding the content stored at `target`, in order.
+func (m Metadata) pieces(target string) []string {
+	if !m.Chunked {
+		return []string{target}
+	}
+	result := make([]string, 0, m.Chunks)
+	for i := int64(0); i < m.Chunks; i++ {
+		result = append(result, chunkPath(target, i))
+	}
+	return result
+}
+
+// Writer undoing the transforms of the content written to it, to `w`. The
+// last transform applied is undone first, by the outermost writer.
+func (m Metadata) untransform(w io.Writer) (io.Writer, error) {
+	for _, transform := range m.Transforms {
+		switch transform {
+		case TRANSFORM_NEGATE:
+			w = util.NewNegateWriter(w)
+		default:
+			return nil, fmt.Errorf("unknown transform %s", transform)
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,66 @@
+
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct{
+		metadata string
+		want Metadata
+	}{
+		{"", Metadata{}},
+		{"3", Metadata{Chunked: true, Chunks: 3}},
+		{"0", Metadata{Chunked: true}},
+		{`{"v":1}`, NewMetadata()},
+		{`{"v":1,"chunked":true,"chunks":2,"chunkSize":10,"transforms":["negate"]}`, Metadata{1, true, 2, 10, []string{TRANSFORM_NEGATE}}},
+	}
+	for _, test := range tests {
+		meta, err := ParseMetadata(test.metadata)
+		if err != nil || meta.String() != test.want.String() {
+			t.Errorf("ParseMetadata(%q) = %v, %v, want %v", test.metadata, meta, err, test.want)
+		}
+	}
+	for _, metadata := range []string{"x", "-1", `{"chunks":2}`, `{"v":2}`} {
+		if _, err := ParseMetadata(metadata); err == nil {
+			t.Errorf("ParseMetadata(%q) should fail", metadata)
+		}
+	}
+	meta := NewChunkedMetadata(2, 10)
+	if parsed, err := ParseMetadata(meta.String()); err != nil || parsed.Chunks != 2 || parsed.ChunkSize != 10 || parsed.Version != METADATA_VERSION {
+		t.Errorf("round trip of %s = %v, %v", meta, parsed, err)
+	}
+
+	// Objects on Cloud Storage written before versioning are negated.
+	if legacy, _ := parseGCSMetadata("3"); len(legacy.Transforms) != 1 || legacy.Transforms[0] != TRANSFORM_NEGATE {
+		t.Errorf("transforms of legacy metadata = %v", legacy.Transforms)
+	}
+	var buf bytes.Buffer
+	w, err := Metadata{Transforms: []string{TRANSFORM_NEGATE}}.untransform(&buf)
+	if err != nil {
+		t.Fatalf("untransform: %v", err)
+	}
+	w.Write([]byte{0xff, 0x0f})
+	if !bytes.Equal(buf.Bytes(), []byte{0x00, 0xf0}) {
+		t.Errorf("untransformed = %x", buf.Bytes())
+	}
+	if _, err := (Metadata{Transforms: []string{"rot13"}}).untransform(&buf); err == nil {
+		t.Errorf("unknown transform should fail")
+	}
+}
+
+func TestLegacyChunkedMetadata(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "7b", "5d", "41", "cc", testUUID)
+	os.MkdirAll(filepath.Dir(target), 0700)
+	os.WriteFile(chunkPath(target, 0), []byte("abc"), 0600)
+	os.WriteFile(chunkPath(target, 1), []byte("de"), 0600)
+	var buf bytes.Buffer
+	if err := NewLocalFileSystem(root).Download(testUUID, "2", &buf); err != nil || buf.String() != "abcde" {
+		t.Errorf("Download with legacy metadata = %q, %v", buf.String(), err)
+	}
+}
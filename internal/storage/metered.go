@@ -0,0 +1,120 @@
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Metered storage.
+// Wraps a storage that can stream its objects, such as a local or Cloud
+// Storage backend, and limits the content going to and from it with the
+// given limiters (see util/limit.go): content is read at the limited rate
+// before it goes through the transforms of the backend (NegateWriter and
+// CRCWriter), and written at the limited rate after them. The bytes going
+// through are reported to a progress, if any (see util/progress.go). Mirror
+// and erasure storage are limited through their backends, so that every
+// copy and shard counts. A storage that can migrate its objects is wrapped
+// in a MeteredMigrator, so that the wrapper is a Migrator only if the
+// storage is.
+
+type Metered struct {
+	store Storage
+	progress *util.Progress     // nil if not reported.
+	limiters []*util.Limiter
+}
+
+type MeteredMigrator struct {
+	*Metered
+	migrator Migrator
+}
+
+func NewMetered(store Storage, progress *util.Progress, limiters ...*util.Limiter) Storage {
+	metered := &Metered{store, progress, limiters}
+	if migrator, ok := store.(Migrator); ok {
+		return &MeteredMigrator{metered, migrator}
+	}
+	return metered
+}
+
+func (s *Metered) log(text string) {
+	s.store.log(text)
+}
+
+func (s *Metered) Name() string {
+	return s.store.Name()
+}
+
+func (s *Metered) ListFiles() ([]string, error) {
+	return s.store.ListFiles()
+}
+
+func (s *Metered) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	f, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("os.Create: %v", err)
+	}
+	defer f.Close()
+
+	s.log(fmt.Sprintf("copying %s", outputFileName))
+	if err := s.Download(uuid, metadata, f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %v", err)
+	}
+	return nil
+}
+
+func (s *Metered) UploadFile(file string, uuid string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %v", err)
+	}
+	defer f.Close()
+
+	s.log(fmt.Sprintf("copying %s", file))
+	return s.Upload(f, uuid)
+}
+
+func (s *Metered) Download(uuid string, metadata string, w io.Writer) error {
+	if s.progress != nil {
+		w = util.NewProgressWriter(w, s.progress)
+	}
+	return Download(s.store, uuid, metadata, util.NewLimitedWriter(w, s.limiters...))
+}
+
+func (s *Metered) Upload(r io.Reader, uuid string) (string, error) {
+	r = util.NewLimitedReader(r, s.limiters...)
+	if s.progress != nil {
+		r = util.NewProgressReader(r, s.progress)
+	}
+	return Upload(s.store, r, uuid)
+}
+
+func (s *Metered) DeleteFile(uuid string, metadata string) error {
+	return s.store.DeleteFile(uuid, metadata)
+}
+
+func (s *Metered) Exists(uuid string, metadata string) (bool, error) {
+	return s.store.Exists(uuid, metadata)
+}
+
+func (s *Metered) RemoteInfo(uuid string, metadata string) error {
+	return s.store.RemoteInfo(uuid, metadata)
+}
+
+func (s *Metered) StoredSize(size int64, metadata string) int64 {
+	return StoredSize(s.store, size, metadata)
+}
+
+func (s *Metered) UploadSize(size int64) int64 {
+	return UploadSize(s.store, size)
+}
+
+func (s *MeteredMigrator) Migrate() (int, error) {
+	return s.migrator.Migrate()
+}
@@ -0,0 +1,65 @@
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+func TestMetered(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 30 << 10)
+	limiter := util.NewLimiter(200 << 10)
+	store := NewMetered(NewLocalFileSystem(t.TempDir()), nil, limiter)
+	// One second of bandwidth goes through at once, the rest at the rate.
+	start := time.Now()
+	metadata, err := store.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400 * time.Millisecond {
+		t.Errorf("300 KiB at 200 KiB/s uploaded in %v", elapsed)
+	}
+
+	// No second of bandwidth is left for the download.
+	start = time.Now()
+	var buf bytes.Buffer
+	if err := Download(store, testUUID, metadata, &buf); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1000 * time.Millisecond {
+		t.Errorf("300 KiB at 200 KiB/s downloaded in %v", elapsed)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("downloaded content differs")
+	}
+
+	// Only storage that can migrate its objects can be migrated.
+	migrator, ok := store.(Migrator)
+	if !ok {
+		t.Fatalf("metered local storage should be a Migrator")
+	}
+	if count, err := migrator.Migrate(); err != nil || count != 0 {
+		t.Errorf("Migrate() = %d, %v", count, err)
+	}
+	if _, ok := NewMetered(NewMemory("m"), nil).(Migrator); ok {
+		t.Errorf("metered memory storage should not be a Migrator")
+	}
+
+	// Transfers are reported both ways.
+	progress := util.NewProgress()
+	progress.Start(2, 2 * int64(len(content)))
+	reported := NewMetered(NewMemory("m"), progress)
+	metadata, err = reported.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if err := reported.DownloadFile(testUUID, metadata, writeTemp(t, nil)); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if s := progress.Snapshot(); s.Done != 2 * int64(len(content)) {
+		t.Errorf("bytes reported = %d, want %d", s.Done, 2 * len(content))
+	}
+}
@@ -0,0 +1,294 @@
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Mirrored storage.
+// Every object is uploaded under the same UUID to each of several replicas.
+// The metadata records, for each replica (by its identifier, the address
+// of the replica in the address of the drive), the replica's own metadata
+// for the object:
+//   {"v":1,"replicas":{"local:/mnt/nas":"{\"v\":1}","gcs:bucket":"3"}}
+// A replica missing from the metadata does not hold a copy of the object.
+//
+// Metadata that is not in that format (e.g., for files uploaded before
+// a drive was mirrored) is taken to be the metadata of the first replica.
+// Metadata written before it was versioned has no version.
+
+type Mirror struct {
+	ids []string
+	replicas []Storage
+}
+
+type mirrorMetadata struct {
+	Metadata
+	Replicas map[string]string `json:"replicas"`
+}
+
+// Mirror over `replicas`, identified by `ids` in the metadata.
+func NewMirror(ids []string, replicas []Storage) *Mirror {
+	return &Mirror{ids, replicas}
+}
+
+func (s *Mirror) log(text string) {
+	fmt.Printf("[mirror] %s\n", text)
+}
+
+func (s *Mirror) Name() string {
+	names := make([]string, 0, len(s.replicas))
+	for _, r := range s.replicas {
+		names = append(names, r.Name())
+	}
+	return fmt.Sprintf("mirror::(%s)", strings.Join(names, ", "))
+}
+
+func (s *Mirror) Replicas() []Storage {
+	return s.replicas
+}
+
+func (s *Mirror) parseMetadata(metadata string) (mirrorMetadata, error) {
+	result := mirrorMetadata{}
+	if err := json.Unmarshal([]byte(metadata), &result); err != nil || result.Replicas == nil {
+		// Metadata of the first replica.
+		result = mirrorMetadata{NewMetadata(), make(map[string]string)}
+		if len(s.replicas) > 0 {
+			result.Replicas[s.ids[0]] = metadata
+		}
+	}
+	if err := checkVersion(result.Version); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func (m mirrorMetadata) String() string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+func (s *Mirror) ListFiles() ([]string, error) {
+	result := make([]string, 0)
+	for _, r := range s.replicas {
+		files, err := r.ListFiles()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Name(), err)
+		}
+		result = append(result, files...)
+	}
+	return result, nil
+}
+
+func (s *Mirror) DownloadFile(uuid string, metadata string, outputFileName string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	var lastErr error = fmt.Errorf("no replica holds object %s", uuid)
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		if !found {
+			continue
+		}
+		err := r.DownloadFile(uuid, replicaMetadata, outputFileName)
+		if err == nil {
+			return nil
+		}
+		s.log(fmt.Sprintf("replica %s failed: %s", r.Name(), err))
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (s *Mirror) UploadFile(file string, uuid string) (string, error) {
+	meta := mirrorMetadata{NewMetadata(), make(map[string]string)}
+	var lastErr error
+	for i, r := range s.replicas {
+		replicaMetadata, err := r.UploadFile(file, uuid)
+		if err != nil {
+			s.log(fmt.Sprintf("replica %s failed: %s", r.Name(), err))
+			lastErr = err
+			continue
+		}
+		meta.Replicas[s.ids[i]] = replicaMetadata
+	}
+	if len(meta.Replicas) == 0 {
+		return "", fmt.Errorf("upload failed on every replica: %w", lastErr)
+	}
+	if len(meta.Replicas) < len(s.replicas) {
+		s.log(fmt.Sprintf("only %d of %d replicas written - use repair", len(meta.Replicas), len(s.replicas)))
+	}
+	return meta.String(), nil
+}
+
+func (s *Mirror) Exists(uuid string, metadata string) (bool, error) {
+	// The object exists if any replica has it.
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return false, err
+	}
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		if !found {
+			continue
+		}
+		if exists, err := r.Exists(uuid, replicaMetadata); err == nil && exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Mirror) DeleteFile(uuid string, metadata string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		if !found {
+			continue
+		}
+		if err := r.DeleteFile(uuid, replicaMetadata); err != nil {
+			s.log(fmt.Sprintf("replica %s failed: %s", r.Name(), err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Status of a replica for a given object: "ok", "missing", or an error.
+func replicaStatus(r Storage, uuid string, replicaMetadata string, found bool) string {
+	if !found {
+		return "missing"
+	}
+	exists, err := r.Exists(uuid, replicaMetadata)
+	if err != nil {
+		return fmt.Sprintf("error (%s)", err)
+	}
+	if !exists {
+		return "lost"
+	}
+	return "ok"
+}
+
+func (s *Mirror) RemoteInfo(uuid string, metadata string) error {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Remote:      %s\n", s.Name())
+	fmt.Printf("Replicas:\n")
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		fmt.Printf(" %s  %s\n", r.Name(), replicaStatus(r, uuid, replicaMetadata, found))
+	}
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		if !found {
+			continue
+		}
+		if err := r.RemoteInfo(uuid, replicaMetadata); err != nil {
+			fmt.Printf(" %s: %s\n", r.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Sum of the copies recorded in the metadata.
+func (s *Mirror) StoredSize(size int64, metadata string) int64 {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return size
+	}
+	total := int64(0)
+	for i, r := range s.replicas {
+		if replicaMetadata, found := meta.Replicas[s.ids[i]]; found {
+			total += StoredSize(r, size, replicaMetadata)
+		}
+	}
+	return total
+}
+
+func (s *Mirror) UploadSize(size int64) int64 {
+	total := int64(0)
+	for _, r := range s.replicas {
+		total += UploadSize(r, size)
+	}
+	return total
+}
+
+// Copy the object from a healthy replica to every replica that is missing it.
+// A copy not matching `hash` (when known) is not used, and is replaced.
+func (s *Mirror) Repair(uuid string, metadata string, hash string) (string, int, error) {
+	meta, err := s.parseMetadata(metadata)
+	if err != nil {
+		return metadata, 0, err
+	}
+	missing := make([]int, 0)
+	sources := make([]int, 0)
+	for i, r := range s.replicas {
+		replicaMetadata, found := meta.Replicas[s.ids[i]]
+		if replicaStatus(r, uuid, replicaMetadata, found) == "ok" {
+			sources = append(sources, i)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return metadata, 0, nil
+	}
+
+	tmp, err := os.CreateTemp("", "vhd-repair-*")
+	if err != nil {
+		return metadata, 0, fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpName)
+
+	source := -1
+	for _, i := range sources {
+		r := s.replicas[i]
+		s.log(fmt.Sprintf("copying %s from %s", uuid, r.Name()))
+		if err := r.DownloadFile(uuid, meta.Replicas[s.ids[i]], tmpName); err != nil {
+			s.log(fmt.Sprintf("cannot read %s from %s: %s", uuid, r.Name(), err))
+			continue
+		}
+		if hash != "" {
+			sum, _, err := util.HashFile(tmpName)
+			if err != nil {
+				return metadata, 0, err
+			}
+			if sum != hash {
+				s.log(fmt.Sprintf("copy of %s on %s corrupted", uuid, r.Name()))
+				missing = append(missing, i)
+				continue
+			}
+		}
+		source = i
+		break
+	}
+	if source < 0 {
+		return metadata, 0, fmt.Errorf("no healthy replica for object %s", uuid)
+	}
+	count := 0
+	for _, i := range missing {
+		r := s.replicas[i]
+		s.log(fmt.Sprintf("copying %s to %s", uuid, r.Name()))
+		replicaMetadata, err := r.UploadFile(tmpName, uuid)
+		if err != nil {
+			return meta.String(), count, fmt.Errorf("%s: %w", r.Name(), err)
+		}
+		meta.Replicas[s.ids[i]] = replicaMetadata
+		count++
+	}
+	return meta.String(), count, nil
+}
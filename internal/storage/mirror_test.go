@@ -0,0 +1,136 @@
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+func TestMirror(t *testing.T) {
+	content := []byte("hello, world")
+	a := NewMemory("a")
+	b := NewMemory("b")
+	s := NewMirror([]string{"a", "b"}, []Storage{a, b})
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if a.Object(testUUID) == nil || b.Object(testUUID) == nil {
+		t.Fatalf("object not written to every replica")
+	}
+
+	// Lose the first replica: downloads fall back to the second one.
+	a.Drop(testUUID)
+	out := filepath.Join(t.TempDir(), "out")
+	if err := s.DownloadFile(testUUID, metadata, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+
+	newMetadata, count, err := s.Repair(testUUID, metadata, "")
+	if err != nil || count != 1 {
+		t.Fatalf("Repair() = %d, %v", count, err)
+	}
+	if !bytes.Equal(a.Object(testUUID), content) {
+		t.Errorf("replica not restored")
+	}
+	if _, count, _ := s.Repair(testUUID, newMetadata, ""); count != 0 {
+		t.Errorf("second Repair() restored %d replicas", count)
+	}
+}
+
+func TestMirrorCorruptedSource(t *testing.T) {
+	content := []byte("hello, world")
+	a := NewMemory("a")
+	b := NewMemory("b")
+	c := NewMemory("c")
+	corrupting := NewFaulty(a, Faults{}, 1)
+	s := NewMirror([]string{"a", "b", "c"}, []Storage{corrupting, b, c})
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	c.Drop(testUUID)
+
+	// The copy read from the first replica does not match the hash, so the
+	// second one is used, and the first one rewritten.
+	corrupting.SetFaults(Faults{CorruptionRate: 1})
+	crc := util.NewCRCWriter(io.Discard)
+	crc.Write(content)
+	hash := util.FormatHash(crc.Sum())
+	if _, count, err := s.Repair(testUUID, metadata, hash); err != nil || count != 2 {
+		t.Fatalf("Repair() = %d, %v", count, err)
+	}
+	if !bytes.Equal(c.Object(testUUID), content) {
+		t.Errorf("replica restored with %q, want %q", c.Object(testUUID), content)
+	}
+
+	// Without a hash, copies cannot be checked.
+	c.Drop(testUUID)
+	if _, _, err := s.Repair(testUUID, metadata, ""); err != nil || bytes.Equal(c.Object(testUUID), content) {
+		t.Errorf("Repair() without hash = %q, %v", c.Object(testUUID), err)
+	}
+	b.Drop(testUUID)
+	if _, _, err := s.Repair(testUUID, metadata, hash); err == nil {
+		t.Errorf("Repair() should fail when every copy is corrupted")
+	}
+}
+
+func TestMirrorPartialUpload(t *testing.T) {
+	content := []byte("hello, world")
+	a := NewMemory("a")
+	b := NewMemory("b")
+	failing := NewFaulty(b, Faults{UploadFailureRate: 1}, 1)
+	s := NewMirror([]string{"a", "failing"}, []Storage{a, failing})
+	metadata, err := s.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if strings.Contains(metadata, `"failing"`) {
+		t.Errorf("metadata %s records the failed replica", metadata)
+	}
+	if _, _, err := s.Repair(testUUID, metadata, ""); err == nil {
+		t.Errorf("Repair() should fail while the replica is failing")
+	}
+	failing.SetFaults(Faults{})
+	metadata, count, err := s.Repair(testUUID, metadata, "")
+	if err != nil || count != 1 || !strings.Contains(metadata, `"failing"`) {
+		t.Errorf("Repair() = %s, %d, %v", metadata, count, err)
+	}
+
+	// Every replica failing is an error.
+	failing.SetFaults(Faults{UploadFailureRate: 1})
+	if _, err := NewMirror([]string{"failing"}, []Storage{failing}).UploadFile(writeTemp(t, content), testUUID); err == nil {
+		t.Errorf("UploadFile should fail when every replica fails")
+	}
+}
+
+func TestMirrorLegacyMetadata(t *testing.T) {
+	content := []byte("hello, world")
+	a := NewMemory("a")
+	if _, err := a.UploadFile(writeTemp(t, content), testUUID); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	b := NewMemory("b")
+	s := NewMirror([]string{"a", "b"}, []Storage{a, b})
+	// Files uploaded before the drive was mirrored live on the first replica.
+	metadata, count, err := s.Repair(testUUID, "", "")
+	if err != nil || count != 1 {
+		t.Fatalf("Repair() = %d, %v", count, err)
+	}
+	if !bytes.Equal(b.Object(testUUID), content) {
+		t.Errorf("replica not restored")
+	}
+	if exists, _ := s.Exists(testUUID, metadata); !exists {
+		t.Errorf("Exists() = false after repair")
+	}
+
+}
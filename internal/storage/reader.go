@@ -0,0 +1,136 @@
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Seekable access to the content of an object.
+// Content is streamed from storage. Seeking backwards restarts the
+// download, and seeking forwards skips content. Objects whose size is not
+// known are downloaded to a temporary file when first read or when seeking
+// relative to the end.
+
+type Reader struct {
+	store Storage
+	uuid string
+	metadata string
+	size int64
+	pos int64
+	body *io.PipeReader     // Current download, if any,
+	offset int64            // at this position.
+	tmp *os.File
+}
+
+// Reader for object `uuid` of `size` bytes (-1 if unknown).
+func NewReader(s Storage, uuid string, metadata string, size int64) *Reader {
+	return &Reader{store: s, uuid: uuid, metadata: metadata, size: size}
+}
+
+// Size of the object, -1 if still unknown.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) download() *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		err := Download(r.store, r.uuid, r.metadata, pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (r *Reader) fetchTemp() error {
+	tmp, err := os.CreateTemp("", "vhd-read-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	os.Remove(tmp.Name())
+	if err := Download(r.store, r.uuid, r.metadata, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp.Seek: %v", err)
+	}
+	r.tmp = tmp
+	r.size = size
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.size < 0 {
+		if err := r.fetchTemp(); err != nil {
+			return 0, err
+		}
+	}
+	if r.tmp != nil {
+		n, err := r.tmp.ReadAt(p, r.pos)
+		r.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.pos < r.offset {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		r.body = r.download()
+		r.offset = 0
+	}
+	if r.pos > r.offset {
+		skipped, err := io.CopyN(io.Discard, r.body, r.pos - r.offset)
+		r.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if r.size < 0 && whence == io.SeekEnd {
+		if err := r.fetchTemp(); err != nil {
+			return 0, err
+		}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.tmp != nil {
+		r.tmp.Close()
+		r.tmp = nil
+	}
+	return nil
+}
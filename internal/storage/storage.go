@@ -1,12 +1,79 @@
 
 package storage
 
+import (
+	"fmt"
+)
+
 type Storage interface {
 	Name() string
 	ListFiles() ([]string, error)
 	DownloadFile(string, string, string) error
 	UploadFile(string, string) (string, error)
 	RemoteInfo(string, string) error
+	Exists(string, string) (bool, error)
+	DeleteFile(string, string) error
 	log(string) 
 }
 
+// Storage that keeps several copies of each object.
+// Repair() restores missing copies and returns updated metadata along with
+// the number of copies restored. It takes the hash of the content recorded
+// in the catalog ("" if unknown), against which copies are checked.
+type Replicated interface {
+	Repair(string, string, string) (string, int, error)
+}
+
+// Storage whose objects take more room than their content, such as copies
+// or parity. StoredSize() returns the bytes stored for an object holding
+// `size` bytes, given its metadata.
+type Sizer interface {
+	StoredSize(int64, string) int64
+}
+
+// Bytes stored by `s` for an object holding `size` bytes.
+func StoredSize(s Storage, size int64, metadata string) int64 {
+	if sizer, ok := s.(Sizer); ok {
+		return sizer.StoredSize(size, metadata)
+	}
+	return size
+}
+
+// Storage that sends more than the content of an object to upload it, such
+// as copies or parity. UploadSize() returns the bytes sent to upload an
+// object of `size` bytes.
+type Uploader interface {
+	UploadSize(int64) int64
+}
+
+// Bytes sent by `s` to upload an object of `size` bytes, to report progress.
+func UploadSize(s Storage, size int64) int64 {
+	if uploader, ok := s.(Uploader); ok {
+		return uploader.UploadSize(size)
+	}
+	return size
+}
+
+// Storage that can move objects written under an older layout to the
+// current one.
+type Migrator interface {
+	Migrate() (int, error)
+}
+
+// Convert a UUID to a path on storage.
+// E.g.,
+//   7b5d41cc-86d6-11eca8a3-0242ac120002
+// to
+//   7b/5d/41/cc/7b5d41cc-86d6-11eca8a3-0242ac120002
+
+func uuidToPath(uuid string) (string, error) {
+	if len(uuid) != 36 {
+		return "", fmt.Errorf("length of UUID %s <> 36", uuid)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", uuid[:2], uuid[2:4], uuid[4:6], uuid[6:8], uuid), nil
+}
+
+// Name of chunk `i` of an object stored at `target`.
+func chunkPath(target string, i int64) string {
+	return fmt.Sprintf("%s.%03d", target, i)
+}
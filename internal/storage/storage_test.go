@@ -0,0 +1,109 @@
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testUUID = "7b5d41cc-86d6-11ec-a8a3-0242ac120002"
+
+func writeTemp(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	content := []byte("hello, world")
+	mem := NewMemory("test")
+	metadata, err := mem.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := mem.DownloadFile(testUUID, metadata, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+	mem.Drop(testUUID)
+	if err := mem.DownloadFile(testUUID, metadata, out); err == nil {
+		t.Errorf("DownloadFile of a dropped object should fail")
+	}
+}
+
+func TestFaulty(t *testing.T) {
+	content := []byte("hello, world")
+	src := writeTemp(t, content)
+	out := filepath.Join(t.TempDir(), "out")
+	store := NewFaulty(NewMemory("test"), Faults{UploadFailureRate: 1}, 1)
+
+	if _, err := store.UploadFile(src, testUUID); !errors.Is(err, ErrInjected) {
+		t.Fatalf("UploadFile = %v, want injected fault", err)
+	}
+	store.SetFaults(Faults{})
+	if _, err := store.UploadFile(src, testUUID); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	store.SetFaults(Faults{DownloadFailureRate: 1})
+	if err := store.DownloadFile(testUUID, "", out); !errors.Is(err, ErrInjected) {
+		t.Fatalf("DownloadFile = %v, want injected fault", err)
+	}
+	store.SetFaults(Faults{CorruptionRate: 1})
+	if err := store.DownloadFile(testUUID, "", out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	if bytes.Equal(got, content) || len(got) != len(content) {
+		t.Errorf("downloaded %q, expected a corrupted copy", got)
+	}
+}
+
+func TestStoredSize(t *testing.T) {
+	content := make([]byte, 1000)
+	mem := NewMemory("a")
+	if got := StoredSize(mem, 1000, ""); got != 1000 {
+		t.Errorf("stored size on memory = %d", got)
+	}
+
+	// A mirror stores a copy per replica holding the object.
+	b := NewFaulty(NewMemory("b"), Faults{}, 1)
+	mirror := NewMirror([]string{"mem", "b"}, []Storage{mem, b})
+	metadata, _ := mirror.UploadFile(writeTemp(t, content), testUUID)
+	if got := StoredSize(mirror, 1000, metadata); got != 2000 {
+		t.Errorf("stored size on mirror = %d, want 2000", got)
+	}
+	b.SetFaults(Faults{UploadFailureRate: 1})
+	metadata, _ = mirror.UploadFile(writeTemp(t, content), testUUID)
+	if got := StoredSize(mirror, 1000, metadata); got != 1000 {
+		t.Errorf("stored size on mirror with a missing copy = %d, want 1000", got)
+	}
+
+	// Erasure coding 3+2 stores 5 shards of a third of the content each,
+	// rounded up to whole blocks.
+	erasure, _ := newTestErasure(t, 3, 2)
+	metadata, _ = erasure.UploadFile(writeTemp(t, content), testUUID)
+	if got := StoredSize(erasure, 1000, metadata); got != 5 * 334 {
+		t.Errorf("stored size on erasure = %d, want %d", got, 5 * 334)
+	}
+
+	// Uploads send every copy and shard.
+	if got := UploadSize(mem, 1000); got != 1000 {
+		t.Errorf("upload size on memory = %d", got)
+	}
+	if got := UploadSize(mirror, 1000); got != 2000 {
+		t.Errorf("upload size on mirror = %d, want 2000", got)
+	}
+	if got := UploadSize(erasure, 1000); got != 5 * 334 {
+		t.Errorf("upload size on erasure = %d, want %d", got, 5 * 334)
+	}
+}
@@ -0,0 +1,85 @@
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Streaming access to storage.
+// Backends that can read and write objects without going through a local
+// file implement Streamer. Download() and Upload() work with every backend,
+// going through a temporary file for the others.
+
+type Streamer interface {
+	Download(string, string, io.Writer) error
+	Upload(io.Reader, string) (string, error)
+}
+
+func Download(s Storage, uuid string, metadata string, w io.Writer) error {
+	if streamer, ok := s.(Streamer); ok {
+		return streamer.Download(uuid, metadata, w)
+	}
+	tmp, err := os.CreateTemp("", "vhd-download-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := s.DownloadFile(uuid, metadata, tmp.Name()); err != nil {
+		return err
+	}
+	return copyFrom(w, tmp.Name())
+}
+
+func Upload(s Storage, r io.Reader, uuid string) (string, error) {
+	if streamer, ok := s.(Streamer); ok {
+		return streamer.Upload(r, uuid)
+	}
+	tmp, err := os.CreateTemp("", "vhd-upload-*")
+	if err != nil {
+		return "", fmt.Errorf("os.CreateTemp: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return "", fmt.Errorf("io.Copy: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("f.Close: %v", err)
+	}
+	return s.UploadFile(tmp.Name(), uuid)
+}
+
+// Copy an object from one storage to another (possibly the same) under
+// a new UUID, streaming the data through. The copy is read back and its
+// CRC32C checked against the original before returning the metadata of the
+// new object. A failed copy is deleted.
+func Transfer(src Storage, srcUUID string, srcMetadata string, dst Storage, dstUUID string) (string, error) {
+	pr, pw := io.Pipe()
+	srcCRC := util.NewCRCWriter(io.Discard)
+	go func() {
+		err := Download(src, srcUUID, srcMetadata, io.MultiWriter(pw, srcCRC))
+		pw.CloseWithError(err)
+	}()
+	dstMetadata, err := Upload(dst, pr, dstUUID)
+	// Unblock the download if the upload stopped early.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", err
+	}
+
+	dstCRC := util.NewCRCWriter(io.Discard)
+	err = Download(dst, dstUUID, dstMetadata, dstCRC)
+	if err == nil && dstCRC.Sum() != srcCRC.Sum() {
+		err = fmt.Errorf("crc32c of copy %x different from original %x", dstCRC.Sum(), srcCRC.Sum())
+	}
+	if err != nil {
+		dst.DeleteFile(dstUUID, dstMetadata)
+		return "", fmt.Errorf("verifying copy: %w", err)
+	}
+	return dstMetadata, nil
+}
@@ -0,0 +1,42 @@
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	src := NewMemory("src")
+	srcMetadata, err := src.UploadFile(writeTemp(t, content), testUUID)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	// Destination re-chunks the object.
+	dst := NewLocalFileSystemChunked(t.TempDir(), 4096)
+	dstUUID := "8c6e52dd-86d6-11ec-a8a3-0242ac120002"
+	dstMetadata, err := Transfer(src, testUUID, srcMetadata, dst, dstUUID)
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if meta, err := ParseMetadata(dstMetadata); err != nil || meta.Chunks != 3 {
+		t.Errorf("metadata = %q, want 3 chunks", dstMetadata)
+	}
+	var buf bytes.Buffer
+	if err := Download(dst, dstUUID, dstMetadata, &buf); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("transferred content differs")
+	}
+
+	// A copy that does not read back correctly is deleted.
+	faulty := NewFaulty(NewMemory("dst"), Faults{CorruptionRate: 1}, 1)
+	if _, err := Transfer(src, testUUID, srcMetadata, faulty, dstUUID); err == nil {
+		t.Fatalf("Transfer to corrupting storage should fail")
+	}
+	if exists, _ := faulty.Exists(dstUUID, ""); exists {
+		t.Errorf("failed copy was not deleted")
+	}
+}
@@ -2,9 +2,11 @@
 package util
 
 import (
+    "fmt"
     "hash"
     "hash/crc32"
     "io"
+    "os"
 )
 
 const (
@@ -39,3 +41,21 @@ func (c *CRCWriter) Sum() uint32 {
 	return c.h.Sum32() // final hash
 }
 
+// CRC32C (as stored in the catalog) and size of a local file.
+func HashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("os.Open: %v", err)
+	}
+	defer f.Close()
+	crcw := NewCRCWriter(io.Discard)
+	size, err := io.Copy(crcw, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("io.Copy: %v", err)
+	}
+	return FormatHash(crcw.Sum()), size, nil
+}
+
+func FormatHash(sum uint32) string {
+	return fmt.Sprintf("%08x", sum)
+}
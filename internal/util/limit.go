@@ -0,0 +1,159 @@
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth limits of transfers.
+// A Limiter lets through a number of bytes per second, shared by all the
+// readers and writers limited by it, possibly in several goroutines. Up to
+// one second of unused bandwidth can be spent at once.
+
+// Largest piece of data let through at once, to keep transfers smooth.
+const LIMIT_BLOCK = 32 * 1024
+
+type Limiter struct {
+	mu sync.Mutex
+	rate int64              // Bytes per second, 0 for no limit.
+	allowance float64       // Bytes that can go through now, negative when owed.
+	last time.Time          // When the allowance was last updated.
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Change the rate of the limiter, 0 for no limit.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.allowance = 0
+	l.last = time.Now()
+}
+
+// Wait until `n` more bytes can go through.
+func (l *Limiter) Wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.allowance += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.allowance > float64(l.rate) {
+		l.allowance = float64(l.rate)
+	}
+	l.last = now
+	l.allowance -= float64(n)
+	wait := time.Duration(0)
+	if l.allowance < 0 {
+		wait = time.Duration(-l.allowance / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+type limitedReader struct {
+	r io.Reader
+	limiters []*Limiter
+}
+
+// Reader of `r` going no faster than any of `limiters`, nil ones included.
+func NewLimitedReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return &limitedReader{r, limiters}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > LIMIT_BLOCK {
+		p = p[:LIMIT_BLOCK]
+	}
+	n, err := lr.r.Read(p)
+	waitAll(lr.limiters, n)
+	return n, err
+}
+
+type limitedWriter struct {
+	w io.Writer
+	limiters []*Limiter
+}
+
+// Writer to `w` going no faster than any of `limiters`, nil ones included.
+func NewLimitedWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	return &limitedWriter{w, limiters}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		block := p[written:]
+		if len(block) > LIMIT_BLOCK {
+			block = block[:LIMIT_BLOCK]
+		}
+		waitAll(lw.limiters, len(block))
+		n, err := lw.w.Write(block)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func waitAll(limiters []*Limiter, n int) {
+	if n <= 0 {
+		return
+	}
+	for _, l := range limiters {
+		if l != nil {
+			l.Wait(n)
+		}
+	}
+}
+
+// Parse a rate such as 5MB/s or 500K, in bytes per second, with the units
+// of ParseSize. "none" and 0 are no limit.
+func ParseRate(s string) (int64, error) {
+	clean := strings.TrimSpace(s)
+	if strings.EqualFold(clean, "none") {
+		return 0, nil
+	}
+	if strings.HasSuffix(strings.ToLower(clean), "/s") {
+		clean = clean[:len(clean) - 2]
+	}
+	rate, err := ParseSize(clean)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	return rate, nil
+}
+
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return "none"
+	}
+	return FormatSize(rate) + "/s"
+}
+
+// A rate that can be read from the settings file.
+type Rate int64
+
+func (r *Rate) UnmarshalText(text []byte) error {
+	rate, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = Rate(rate)
+	return nil
+}
@@ -0,0 +1,74 @@
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"5MB/s": 5 << 20,
+		"500k": 500 << 10,
+		"1.5 KiB/s": 1536,
+		"none": 0,
+		"0": 0,
+	}
+	for s, want := range cases {
+		got, err := ParseRate(s)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "/s", "fast", "-1MB/s"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) should fail", s)
+		}
+	}
+	var settings Settings
+	data := []byte("limit: 5MB/s\ndrives:\n  archive:\n    limit: 100K/s\n")
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+	if settings.Limit != 5 << 20 || settings.Drive("archive").Limit != 100 << 10 || settings.Drive("other").Limit != 0 {
+		t.Errorf("limits = %d, %d", settings.Limit, settings.Drive("archive").Limit)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 300 << 10)
+	// One second of bandwidth goes through at once, the rest at the rate.
+	limiter := NewLimiter(200 << 10)
+	start := time.Now()
+	var out bytes.Buffer
+	if _, err := io.Copy(NewLimitedWriter(&out, limiter, nil), bytes.NewReader(content)); err != nil {
+		t.Fatalf("io.Copy: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400 * time.Millisecond || elapsed > 2 * time.Second {
+		t.Errorf("300 KiB at 200 KiB/s took %v", elapsed)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("content changed by limited writer")
+	}
+
+	// The limiter is shared: a reader now waits for the bytes written.
+	start = time.Now()
+	read, err := io.ReadAll(NewLimitedReader(bytes.NewReader(content[:20 << 10]), limiter))
+	if err != nil || len(read) != 20 << 10 {
+		t.Fatalf("io.ReadAll = %d, %v", len(read), err)
+	}
+	if elapsed := time.Since(start); elapsed < 50 * time.Millisecond {
+		t.Errorf("20 KiB at 200 KiB/s after a burst took %v", elapsed)
+	}
+
+	limiter.SetRate(0)
+	start = time.Now()
+	io.Copy(NewLimitedWriter(io.Discard, limiter), bytes.NewReader(content))
+	if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+		t.Errorf("unlimited copy took %v", elapsed)
+	}
+}
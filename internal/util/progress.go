@@ -0,0 +1,166 @@
+
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress of transfers.
+// A command starts an operation with the number of files and bytes it will
+// transfer, and each file as it goes, while the storage backends add the
+// bytes they send and receive (see storage/metered.go). Bytes added when
+// no operation is under way are ignored. Snapshot() gives the state of the
+// operation, to be shown while it runs.
+
+type Progress struct {
+	mu sync.Mutex
+	active bool
+	start time.Time
+	files int               // Files of the operation.
+	total int64             // Bytes of the operation, -1 if unknown.
+	filesDone int
+	done int64
+	file string             // Current file, if any.
+	fileTotal int64
+	fileDone int64
+}
+
+type ProgressSnapshot struct {
+	Active bool
+	Elapsed time.Duration
+	Files int
+	FilesDone int
+	Total int64             // -1 if unknown.
+	Done int64
+	File string             // "" between files.
+	FileTotal int64
+	FileDone int64
+	Rate float64            // Bytes per second since the start.
+	ETA time.Duration       // -1 if unknown.
+}
+
+func NewProgress() *Progress {
+	return &Progress{}
+}
+
+// Start an operation transferring `files` files and `bytes` bytes, -1 if
+// unknown.
+func (p *Progress) Start(files int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = true
+	p.start = time.Now()
+	p.files = files
+	p.total = bytes
+	p.filesDone = 0
+	p.done = 0
+	p.file = ""
+}
+
+func (p *Progress) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = false
+}
+
+func (p *Progress) StartFile(name string, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file = name
+	p.fileTotal = bytes
+	p.fileDone = 0
+}
+
+// End the current file. Bytes it was expected to transfer but did not, if
+// it failed, are not counted.
+func (p *Progress) EndFile() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == "" {
+		return
+	}
+	p.filesDone++
+	if p.total >= 0 && p.fileDone < p.fileTotal {
+		p.total -= p.fileTotal - p.fileDone
+	}
+	p.file = ""
+}
+
+// Count `n` bytes transferred.
+func (p *Progress) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active || n <= 0 {
+		return
+	}
+	p.done += n
+	p.fileDone += n
+}
+
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := ProgressSnapshot{
+		Active: p.active,
+		Files: p.files,
+		FilesDone: p.filesDone,
+		Total: p.total,
+		Done: p.done,
+		File: p.file,
+		FileTotal: p.fileTotal,
+		FileDone: p.fileDone,
+		ETA: -1,
+	}
+	if !p.active {
+		return s
+	}
+	// Estimates may fall short, as for files whose size changed.
+	if s.Total >= 0 && s.Done > s.Total {
+		s.Total = s.Done
+	}
+	if s.FileDone > s.FileTotal {
+		s.FileTotal = s.FileDone
+	}
+	s.Elapsed = time.Since(p.start)
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Done) / s.Elapsed.Seconds()
+	}
+	if s.Total >= 0 && s.Rate > 0 {
+		s.ETA = time.Duration(float64(s.Total - s.Done) / s.Rate * float64(time.Second))
+	}
+	return s
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+// Reader of `r` adding the bytes read to `p`.
+func NewProgressReader(r io.Reader, p *Progress) io.Reader {
+	return &progressReader{r, p}
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.Add(int64(n))
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+// Writer to `w` adding the bytes written to `p`.
+func NewProgressWriter(w io.Writer, p *Progress) io.Writer {
+	return &progressWriter{w, p}
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.Add(int64(n))
+	return n, err
+}
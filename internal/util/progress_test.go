@@ -0,0 +1,45 @@
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := NewProgress()
+	p.Add(100)
+	if s := p.Snapshot(); s.Active || s.Done != 0 {
+		t.Errorf("bytes counted outside an operation: %+v", s)
+	}
+
+	p.Start(2, 3000)
+	p.StartFile("a.txt", 1000)
+	io.Copy(NewProgressWriter(io.Discard, p), bytes.NewReader(make([]byte, 1000)))
+	p.EndFile()
+	p.StartFile("b.txt", 2000)
+	io.Copy(io.Discard, NewProgressReader(bytes.NewReader(make([]byte, 500)), p))
+	time.Sleep(10 * time.Millisecond)
+	s := p.Snapshot()
+	if s.Done != 1500 || s.Total != 3000 || s.FilesDone != 1 || s.File != "b.txt" || s.FileDone != 500 || s.FileTotal != 2000 {
+		t.Errorf("snapshot = %+v", s)
+	}
+	if s.Rate <= 0 || s.ETA < 0 {
+		t.Errorf("rate = %v, ETA = %v", s.Rate, s.ETA)
+	}
+	// The rest of a failed file is not expected anymore.
+	p.EndFile()
+	if s := p.Snapshot(); s.Total != 1500 || s.FilesDone != 2 || s.File != "" || s.ETA != 0 {
+		t.Errorf("snapshot after failed file = %+v", s)
+	}
+	p.Stop()
+
+	p.Start(1, -1)
+	p.StartFile("c.txt", -1)
+	p.Add(10)
+	if s := p.Snapshot(); s.Total != -1 || s.ETA != -1 || s.Done != 10 || s.FileTotal != 10 {
+		t.Errorf("snapshot of unknown size = %+v", s)
+	}
+}
@@ -0,0 +1,72 @@
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Optional settings, read from VHDCONFIG/config.yaml.
+//
+//   limit: 5MB/s                  # all transfers of a session
+//   drives:
+//     archive:
+//       chunk_size: 100MB
+//       limit: 2MB/s
+//     photos:
+//       preload: true
+//   webdav:
+//     users:
+//       alice: $2y$10$...        # bcrypt hash, e.g., from htpasswd -nB alice
+//   api:
+//     tokens:
+//       backups: 9f86d0...        # SHA-256 of the token, e.g., from sha256sum
+
+const CONFIG_SETTINGS = "config.yaml"
+
+type DriveSettings struct {
+	ChunkSize Size `yaml:"chunk_size"`     // Local drives only; 0 = no chunking.
+	Preload bool `yaml:"preload"`           // Load the whole catalog of the drive on first use.
+	Limit Rate `yaml:"limit"`               // Bytes per second to and from the drive; 0 = no limit.
+}
+
+type WebDAVSettings struct {
+	Users map[string]string `yaml:"users"`   // User name to bcrypt hash of password.
+}
+
+type APISettings struct {
+	Tokens map[string]string `yaml:"tokens"`   // Token name to hex SHA-256 of token.
+}
+
+type Settings struct {
+	Limit Rate `yaml:"limit"`               // Bytes per second of all transfers; 0 = no limit.
+	Drives map[string]DriveSettings `yaml:"drives"`
+	WebDAV WebDAVSettings `yaml:"webdav"`
+	API APISettings `yaml:"api"`
+}
+
+func LoadSettings() (Settings, error) {
+	settings := Settings{}
+	path, err := ConfigFile(CONFIG_SETTINGS)
+	if err != nil {
+		return settings, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	} else if err != nil {
+		return settings, fmt.Errorf("cannot read settings: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Settings for a given drive (zero values if the drive is not mentioned).
+func (s Settings) Drive(name string) DriveSettings {
+	return s.Drives[name]
+}
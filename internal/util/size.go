@@ -0,0 +1,64 @@
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Sizes are written as a number followed by an optional unit, e.g., 200MB.
+// Units are powers of 1024 whether written KB or KiB.
+
+var sizeUnits = []struct{
+	suffix string
+	factor int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func ParseSize(s string) (int64, error) {
+	clean := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(clean, unit.suffix) {
+			clean = strings.TrimSpace(clean[:len(clean) - len(unit.suffix)])
+			factor = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(clean, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(value * float64(factor)), nil
+}
+
+func FormatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	value := float64(size) / 1024
+	i := 0
+	for value >= 1024 && i < len(units) - 1 {
+		value = value / 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// A size that can be read from the settings file.
+type Size int64
+
+func (s *Size) UnmarshalText(text []byte) error {
+	size, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Size(size)
+	return nil
+}
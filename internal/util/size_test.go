@@ -0,0 +1,45 @@
+
+package util
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"0": 0,
+		"512": 512,
+		"10B": 10,
+		"4k": 4096,
+		"1.5 KiB": 1536,
+		"200MB": 200 << 20,
+		"2G": 2 << 30,
+	}
+	for s, want := range cases {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1", "12XB"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) should fail", s)
+		}
+	}
+}
+
+func TestSettingsSize(t *testing.T) {
+	var settings Settings
+	data := []byte("drives:\n  archive:\n    chunk_size: 100MB\n")
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		t.Fatalf("yaml.Unmarshal: %v", err)
+	}
+	if got := settings.Drive("archive").ChunkSize; got != 100 << 20 {
+		t.Errorf("chunk size = %d", got)
+	}
+	if got := settings.Drive("other").ChunkSize; got != 0 {
+		t.Errorf("chunk size of unknown drive = %d", got)
+	}
+}
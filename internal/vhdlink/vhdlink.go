@@ -0,0 +1,16 @@
+
+package vhdlink
+
+import (
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Constructors of pkg/vhd over the internal types of the vhd tool, so that
+// its servers and commands share their tree with the library without the
+// library exporting internal types. They are set by pkg/vhd when it is
+// initialized, and are available to any package importing it.
+
+var (
+	NewClient func(root virtualfs.Root) interface{}          // A *vhd.Client over `root`.
+	NewEntry func(vfs virtualfs.VirtualFS) interface{}       // The vhd.Entry describing `vfs`.
+)
@@ -0,0 +1,118 @@
+
+package vhdtest
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Test environment: a temporary sqlite catalog with drives backed by
+// in-memory storage, each wrapped in a fault-injecting storage.
+
+type Env struct {
+	Dir string
+	Catalog catalog.Catalog
+	Root virtualfs.Root
+	Memory map[string]*storage.Memory
+	Faulty map[string]*storage.Faulty
+	Custom map[string]storage.Storage
+}
+
+func New(t testing.TB, drives ...string) *Env {
+	t.Helper()
+	dir := t.TempDir()
+	// Keep configuration and state out of the real home folder.
+	t.Setenv("HOME", dir)
+	if err := os.Mkdir(filepath.Join(dir, util.CONFIG_FOLDER), 0700); err != nil {
+		t.Fatalf("os.Mkdir: %v", err)
+	}
+	cat, err := catalog.Create(filepath.Join(dir, "catalog.db"))
+	if err != nil {
+		t.Fatalf("catalog.Create: %v", err)
+	}
+	env := &Env{
+		Dir: dir,
+		Catalog: cat,
+		Memory: make(map[string]*storage.Memory),
+		Faulty: make(map[string]*storage.Faulty),
+		Custom: make(map[string]storage.Storage),
+	}
+	for _, name := range drives {
+		if _, err := cat.CreateDrive(name, "test drive " + name, "memory", name); err != nil {
+			t.Fatalf("CreateDrive: %v", err)
+		}
+		mem := storage.NewMemory(name)
+		env.Memory[name] = mem
+		env.Faulty[name] = storage.NewFaulty(mem, storage.Faults{}, 1)
+	}
+	env.Root = env.Reload(t)
+	return env
+}
+
+// Build a fresh root from the catalog, sharing the same storage.
+func (env *Env) Reload(t testing.TB) virtualfs.Root {
+	t.Helper()
+	return env.ReloadFrom(t, env.Catalog)
+}
+
+// Build a fresh root from `cat`, a view of the catalog of the environment
+// (for instance, one recording calls), sharing the same storage.
+func (env *Env) ReloadFrom(t testing.TB, cat catalog.Catalog) virtualfs.Root {
+	t.Helper()
+	open := func(driveDesc catalog.DriveDescriptor) (storage.Storage, error) {
+		if driveDesc.Type == "custom" {
+			return env.Custom[driveDesc.Location], nil
+		}
+		store, found := env.Faulty[driveDesc.Location]
+		if !found {
+			return nil, nil
+		}
+		return store, nil
+	}
+	root, err := virtualfs.NewRootWithStorage(cat, open)
+	if err != nil {
+		t.Fatalf("NewRootWithStorage: %v", err)
+	}
+	return root
+}
+
+// Add a drive backed by the given storage and reload the root.
+func (env *Env) AddDrive(t testing.TB, name string, store storage.Storage) {
+	t.Helper()
+	if _, err := env.Catalog.CreateDrive(name, "test drive " + name, "custom", name); err != nil {
+		t.Fatalf("CreateDrive: %v", err)
+	}
+	env.Custom[name] = store
+	env.Root = env.Reload(t)
+}
+
+// Upload `content` and add it to the catalog as file `path`.
+func (env *Env) PutFile(t testing.TB, path string, content string) virtualfs.VirtualFS {
+	t.Helper()
+	dir, name, err := virtualfs.NavigateParent(env.Root.AsVirtualFS(), path)
+	if err != nil {
+		t.Fatalf("NavigateParent: %v", err)
+	}
+	crc := util.NewCRCWriter(io.Discard)
+	crc.Write([]byte(content))
+	uuid := uuid.NewString()
+	metadata, err := storage.Upload(dir.Drive().Storage(), strings.NewReader(content), uuid)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	fileObj, err := virtualfs.CreateFile(dir, name, uuid, metadata, int64(len(content)), util.FormatHash(crc.Sum()))
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	return fileObj
+}
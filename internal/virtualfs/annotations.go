@@ -0,0 +1,123 @@
+
+package virtualfs
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+)
+
+// Tags and user-defined attributes of folders and files. They are kept in
+// the catalog and not loaded with the tree, but follow their entry when it
+// is moved or copied, including across drives.
+
+// Tags and attribute names are single words, such as legal-hold or client.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+	if strings.IndexFunc(tag, unicode.IsSpace) >= 0 || strings.Contains(tag, "=") {
+		return fmt.Errorf("tag %q may not contain spaces or =", tag)
+	}
+	return nil
+}
+
+func ValidateAttribute(name string, value string) error {
+	if name == "" {
+		return fmt.Errorf("empty attribute name")
+	}
+	if strings.IndexFunc(name, unicode.IsSpace) >= 0 || strings.Contains(name, "=") {
+		return fmt.Errorf("attribute name %q may not contain spaces or =", name)
+	}
+	if value == "" {
+		return fmt.Errorf("empty value for attribute %s", name)
+	}
+	return nil
+}
+
+// The catalog entry of a folder or file, to look up its annotations.
+func EntryRef(vfs VirtualFS) catalog.EntryRef {
+	if vfs.IsFile() {
+		return catalog.EntryRef{Kind: catalog.KIND_FILE, Id: vfs.CatalogId()}
+	}
+	return catalog.EntryRef{Kind: catalog.KIND_FOLDER, Id: vfs.CatalogId()}
+}
+
+func annotated(vfs VirtualFS) (*drive, catalog.EntryRef, error) {
+	if vfs.IsRoot() || vfs.IsDrive() {
+		return nil, catalog.EntryRef{}, fmt.Errorf("cannot annotate %s", vfs.Path())
+	}
+	return driveOf(vfs), EntryRef(vfs), nil
+}
+
+func Annotations(vfs VirtualFS) (catalog.Annotations, error) {
+	drive, ref, err := annotated(vfs)
+	if err != nil {
+		return catalog.Annotations{}, err
+	}
+	return drive.catalog.FetchAnnotations(ref.Kind, ref.Id)
+}
+
+// Change the annotations of an entry through `update`, under the locks of
+// its drive and of the catalog, so that the entry cannot be deleted by
+// another process in the meantime.
+func annotate(vfs VirtualFS, update func(catalog.Catalog, catalog.EntryRef) error) error {
+	drive, ref, err := annotated(vfs)
+	if err != nil {
+		return err
+	}
+	drive.mu.Lock()
+	defer drive.mu.Unlock()
+	if detached(vfs) {
+		return fmt.Errorf("cannot annotate %s: deleted", vfs.Name())
+	}
+	if err := drive.beginWrite(); err != nil {
+		return err
+	}
+	defer drive.endWrite()
+	return update(drive.catalog, ref)
+}
+
+func AddTag(vfs VirtualFS, tag string) error {
+	if err := ValidateTag(tag); err != nil {
+		return err
+	}
+	return annotate(vfs, func(cat catalog.Catalog, ref catalog.EntryRef) error {
+		return cat.AddTag(ref.Kind, ref.Id, tag)
+	})
+}
+
+func RemoveTag(vfs VirtualFS, tag string) error {
+	return annotate(vfs, func(cat catalog.Catalog, ref catalog.EntryRef) error {
+		return cat.RemoveTag(ref.Kind, ref.Id, tag)
+	})
+}
+
+func SetAttribute(vfs VirtualFS, name string, value string) error {
+	if err := ValidateAttribute(name, value); err != nil {
+		return err
+	}
+	return annotate(vfs, func(cat catalog.Catalog, ref catalog.EntryRef) error {
+		return cat.SetAttribute(ref.Kind, ref.Id, name, value)
+	})
+}
+
+func RemoveAttribute(vfs VirtualFS, name string) error {
+	return annotate(vfs, func(cat catalog.Catalog, ref catalog.EntryRef) error {
+		return cat.RemoveAttribute(ref.Kind, ref.Id, name)
+	})
+}
+
+// Give copy `dst` the annotations of `src`. Entry ids never change, so no
+// drive lock is needed.
+func copyAnnotations(src VirtualFS, dst VirtualFS) error {
+	cat := driveOf(dst).catalog
+	if err := cat.Lock(); err != nil {
+		return err
+	}
+	defer cat.Unlock()
+	ref := EntryRef(src)
+	return cat.CopyAnnotations(ref.Kind, ref.Id, dst.CatalogId())
+}
@@ -3,14 +3,14 @@ package virtualfs
 
 import (
 	"fmt"
-	"strings"
 )
 
 type vfs_dir struct {
 	name string
-	content map[string]VirtualFS
-	parent VirtualFS
+	content map[string]VirtualFS      // nil until loaded from the catalog.
+	parent VirtualFS    // nil once deleted.
 	id int              // Identifier in catalog.db.
+	drive *drive
 }
 
 func (d *vfs_dir) IsFile() bool {
@@ -42,22 +42,38 @@ func (d *vfs_dir) AsDrive() Drive {
 }
 
 func (d *vfs_dir) Drive() Drive {
-	return findDrive(d)
+	return d.drive
 }
 
 func (d *vfs_dir) Name() string {
+	d.drive.mu.RLock()
+	defer d.drive.mu.RUnlock()
 	return d.name
 }
 
 func (d *vfs_dir) Path() string {
-	return constructPath(d) + "/"
+	d.drive.mu.RLock()
+	defer d.drive.mu.RUnlock()
+	return pathOf(d) + "/"
 }
 
 func (d *vfs_dir) Parent() VirtualFS {
+	d.drive.mu.RLock()
+	defer d.drive.mu.RUnlock()
 	return d.parent
 }
 
-func (d *vfs_dir) ContentList() []string {
+func (d *vfs_dir) ContentList() ([]string, error) {
+	if err := d.drive.load(d); err != nil {
+		return nil, err
+	}
+	d.drive.mu.RLock()
+	defer d.drive.mu.RUnlock()
+	return d.names(), nil
+}
+
+// Names of the entries. Must be called with the lock of the drive held.
+func (d *vfs_dir) names() []string {
 	result := make([]string, 0, len(d.content))
 	for k, _ := range d.content {
 		result = append(result, k)
@@ -65,16 +81,29 @@ func (d *vfs_dir) ContentList() []string {
 	return result
 }
 
-func (d *vfs_dir) GetContent(field string) (VirtualFS, bool) {
+func (d *vfs_dir) GetContent(field string) (VirtualFS, bool, error) {
+	if err := d.drive.load(d); err != nil {
+		return nil, false, err
+	}
+	d.drive.mu.RLock()
+	defer d.drive.mu.RUnlock()
 	result, found := d.content[field]
-	return result, found
+	return result, found, nil
 }
 
-func (d *vfs_dir) SetContent(field string, value VirtualFS) {
+func (d *vfs_dir) SetContent(field string, value VirtualFS) error {
+	d.drive.mu.Lock()
+	defer d.drive.mu.Unlock()
+	if err := d.drive.loadLocked(d); err != nil {
+		return err
+	}
 	d.content[field] = value
+	return nil
 }
 
 func (d *vfs_dir) DelContent(field string) {
+	d.drive.mu.Lock()
+	defer d.drive.mu.Unlock()
 	delete(d.content, field)
 }
 
@@ -83,13 +112,13 @@ func (d *vfs_dir) CatalogId () int {
 }
 
 func (d *vfs_dir) Print() {
-	fmt.Printf("Name:       %s\n", d.name)
+	fmt.Printf("Name:       %s\n", d.Name())
 	fmt.Printf("Path:       %s\n", d.Path())
 	fmt.Printf("Catalog ID: %d\n", d.id)
 }
 
 func (d *vfs_dir) Root() VirtualFS {
-	return findRoot(d)
+	return d.drive.root
 }
 
 func (d *vfs_dir) Move(targetDir VirtualFS, name string) error {
@@ -97,14 +126,30 @@ func (d *vfs_dir) Move(targetDir VirtualFS, name string) error {
 	if err := ValidateName(name); err != nil {
 		return err
 	}
-	if _, found := targetDir.GetContent(name); found {
-		return fmt.Errorf("name %s already exists in %s", name, targetDir.Name())
-	}
 	if targetDir.IsRoot() {
 		return fmt.Errorf("cannot move directory to root")
 	}
-	if d.Drive() != targetDir.Drive() {
-		return fmt.Errorf("cannot move directory across drives")
+	if !targetDir.IsDir() {
+		return fmt.Errorf("not a folder: %s", targetDir.Path())
+	}
+	if Drive(d.drive) != targetDir.Drive() {
+		return moveAcrossDrives(d, targetDir, name)
+	}
+	d.drive.mu.Lock()
+	defer d.drive.mu.Unlock()
+	if detached(d) || detached(targetDir) {
+		return fmt.Errorf("cannot move %s: deleted", d.name)
+	}
+	if err := d.drive.beginWrite(); err != nil {
+		return err
+	}
+	defer d.drive.endWrite()
+	target, err := contentOf(targetDir)
+	if err != nil {
+		return err
+	}
+	if _, found := target[name]; found {
+		return fmt.Errorf("name %s already exists in %s", name, pathOf(targetDir) + "/")
 	}
 	// Also check that the source directory is not an ancestor of the target directory!
 	curr := targetDir
@@ -114,21 +159,21 @@ func (d *vfs_dir) Move(targetDir VirtualFS, name string) error {
 		if curr == d {
 			return fmt.Errorf("trying to move directory to a descendant")
 		}
-		curr = curr.Parent()
+		curr = curr.(*vfs_dir).parent
 	}
 	parentId := targetDir.CatalogId()
 	if targetDir.IsDrive() {
 		// Override if we're putting it in a drive
 		parentId = -1
 	}
-	if err := d.Drive().updateDirectory(d.id, name, parentId); err != nil {
+	if err := d.drive.updateDirectory(d.id, name, parentId); err != nil {
 		return err
 	}
 	// If update was successful, update the tree.
-	d.parent.DelContent(d.name)
+	delete(parentContent(d.parent), d.name)
 	d.parent = targetDir
 	d.name = name
-	targetDir.SetContent(name, d)
+	target[name] = d
 	return nil
 }
 
@@ -137,23 +182,6 @@ func (d *vfs_dir) CountFiles() (int, error) {
 	return count, err
 }
 
-func (f *vfs_dir) Find(search string) []VirtualFS {
-	///fmt.Printf("About to search directory %s\n", f.name)
-	var results []VirtualFS = nil
-	if strings.Contains(strings.ToLower(f.name), search) {
-		results = []VirtualFS{f}
-	}
-	for _, vf := range f.content {
-		temp := vf.Find(search)
-		if len(temp) > 0 {
-			if results == nil {
-				results = temp
-			} else {
-				for _, r := range temp {
-					results = append(results, r)
-				}
-			}
-		}
-	}
-	return results
+func (f *vfs_dir) Find(search string) ([]VirtualFS, error) {
+	return find(f, search)
 }
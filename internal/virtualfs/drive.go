@@ -3,6 +3,7 @@ package virtualfs
 
 import (
 	"fmt"
+	"sync"
 	"time"
 	
 	"rpucella.net/virtual-hard-drive/internal/storage"
@@ -15,7 +16,12 @@ type drive struct{
 	id int                  // Identifier in catalog.db.
 	catalog catalog.Catalog              
 	storage storage.Storage
-	top VirtualFS           // This is a horrible name.
+	mu sync.RWMutex         // Guards the names, parents, content and file fields of the tree.
+	loadMu sync.Mutex       // Guards top, files and version.
+	top *vfs_dir            // This is a horrible name.
+	files map[string][]*vfs_file    // Loaded files by storage object, guarded by mu once set.
+	version int64           // Version of the drive in the catalog that the tree reflects.
+	preload bool            // Load the whole tree at once rather than folder by folder.
 	root VirtualFS
 	// Add possible restriction flags (i.e., warn in case of too recent deletes, etc)
 }
@@ -89,50 +95,231 @@ func (r *drive) Print() {
 	fmt.Printf("<Drive %s>\n", r.name)
 }
 
-func (r *drive) ContentList() []string {
+// The top folder of the drive, created on first use, and again after being
+// dropped. Folders are loaded from the catalog as they are opened, or all at
+// once if the drive is preloaded. If the catalog cannot be read, the error
+// is returned and the tree fetched again on next use.
+// This does not take the lock, so it can be called with the lock held.
+func (r *drive) tree() (*vfs_dir, error) {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
 	if r.top == nil {
 		if err := fetchCatalog(r); err != nil {
-			fmt.Printf("ERROR when fetching catalog for %s\n%w\n", r.name, err)
+			return nil, fmt.Errorf("cannot load %s: %w", pathOf(r) + "/", err)
 		}
 	}
-	return r.top.ContentList()
+	return r.top, nil
 }
 
-func (r *drive) GetContent(field string) (VirtualFS, bool) {
-	if r.top == nil {
-		if err := fetchCatalog(r); err != nil {
-			fmt.Printf("ERROR when fetching catalog for %s\n%w\n", r.name, err)
+// Files of the tree loaded so far, indexed by the UUID of their storage
+// object, to find the files sharing an object without walking the tree.
+// The index must be read with the lock held, and updated with the write
+// lock held.
+func (r *drive) index() map[string][]*vfs_file {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	return r.files
+}
+
+// Must be called with the write lock held.
+func (r *drive) indexFile(file *vfs_file) {
+	files := r.index()
+	if files == nil {
+		// The tree was dropped, and its files with it.
+		return
+	}
+	files[file.uuid] = append(files[file.uuid], file)
+}
+
+// Must be called with the write lock held.
+func (r *drive) unindexFile(file *vfs_file) {
+	files := r.index()
+	sharing := files[file.uuid]
+	for i, other := range sharing {
+		if other == file {
+			sharing = append(sharing[:i], sharing[i + 1:]...)
+			break
 		}
 	}
-	result, found := r.top.GetContent(field)
-	return result, found
+	if len(sharing) == 0 {
+		delete(files, file.uuid)
+	} else {
+		files[file.uuid] = sharing
+	}
 }
 
-func (r *drive) SetContent(name string, value VirtualFS) {
-	// Do nothing silently?
-	if r.top == nil {
-		if err := fetchCatalog(r); err != nil {
-			fmt.Printf("ERROR when fetching catalog for %s\n%w\n", r.name, err)
+// Load the entries of folder `dir` from the catalog, unless already loaded.
+// Folders loaded after the top of the drive may reflect later changes of
+// the catalog than the rest of the tree, which is dropped on the next write
+// or refresh anyway.
+func (r *drive) load(dir *vfs_dir) error {
+	r.mu.RLock()
+	loaded := dir.content != nil
+	r.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked(dir)
+}
+
+// Must be called with the lock held.
+func (r *drive) loadLocked(dir *vfs_dir) error {
+	if dir.content != nil {
+		return nil
+	}
+	// Entries at the top of the drive have the drive as parent.
+	var parent VirtualFS = dir
+	if dir.id < 0 {
+		parent = r
+	}
+	directories, files, err := r.catalog.FetchDirectoryContent(r.id, dir.id)
+	if err != nil {
+		return fmt.Errorf("cannot load %s: %w", pathOf(parent) + "/", err)
+	}
+	content := make(map[string]VirtualFS, len(directories) + len(files))
+	for id, sub := range directories {
+		content[sub.Name] = &vfs_dir{sub.Name, nil, parent, id, r}
+	}
+	for id, file := range files {
+		fileObj := &vfs_file{file.Name, file.UUID, parent, file.Created, file.Updated, file.Metadata, file.Size, file.Hash, id, r}
+		content[file.Name] = fileObj
+		r.indexFile(fileObj)
+	}
+	dir.content = content
+	return nil
+}
+
+// Drop the tree, to be loaded again from the catalog on next use. Entries
+// of the old tree are detached, so that writes to them fail.
+// Must be called with the lock held.
+func (r *drive) drop() {
+	r.loadMu.Lock()
+	top := r.top
+	r.top = nil
+	r.files = nil
+	r.loadMu.Unlock()
+	if top == nil {
+		return
+	}
+	var detach func(dir *vfs_dir)
+	detach = func(dir *vfs_dir) {
+		for _, sub := range dir.content {
+			switch node := sub.(type) {
+			case *vfs_file:
+				node.parent = nil
+			case *vfs_dir:
+				detach(node)
+				node.parent = nil
+			}
 		}
 	}
-	r.top.SetContent(name, value)
+	detach(top)
+}
+
+// Whether the drive was changed in the catalog since its tree was loaded,
+// by another process. A drive not loaded yet is never stale.
+// Must be called with the lock held.
+func (r *drive) stale() (bool, error) {
+	r.loadMu.Lock()
+	loaded, version := r.top != nil, r.version
+	r.loadMu.Unlock()
+	if !loaded {
+		return false, nil
+	}
+	current, err := r.catalog.DriveVersion(r.id)
+	if err != nil {
+		return false, err
+	}
+	return current != version, nil
+}
+
+// Start a write to the catalog: take the catalog lock, and check that the
+// tree is up to date. A stale tree is dropped and the write refused, since
+// the entries it was about to change may not exist anymore.
+// Must be called with the lock held, and followed by endWrite if successful.
+func (r *drive) beginWrite() error {
+	if _, err := r.tree(); err != nil {
+		return err
+	}
+	if err := r.catalog.Lock(); err != nil {
+		return err
+	}
+	stale, err := r.stale()
+	if err != nil {
+		r.catalog.Unlock()
+		return err
+	}
+	if stale {
+		r.drop()
+		r.catalog.Unlock()
+		return fmt.Errorf("%w: %s", ErrStale, r.name)
+	}
+	return nil
+}
+
+// Record the writes made since beginWrite as reflected in the tree, and
+// release the catalog lock.
+func (r *drive) endWrite() {
+	if version, err := r.catalog.DriveVersion(r.id); err == nil {
+		r.loadMu.Lock()
+		r.version = version
+		r.loadMu.Unlock()
+	}
+	// If the version cannot be read, the next write reloads the tree.
+	r.catalog.Unlock()
+}
+
+func (r *drive) ContentList() ([]string, error) {
+	top, err := r.tree()
+	if err != nil {
+		return nil, err
+	}
+	return top.ContentList()
+}
+
+func (r *drive) GetContent(field string) (VirtualFS, bool, error) {
+	top, err := r.tree()
+	if err != nil {
+		return nil, false, err
+	}
+	return top.GetContent(field)
+}
+
+func (r *drive) SetContent(name string, value VirtualFS) error {
+	top, err := r.tree()
+	if err != nil {
+		return err
+	}
+	return top.SetContent(name, value)
 }
 
 func (r *drive) DelContent(name string) {
-	// Do nothing silently?
-	if r.top == nil {
-		if err := fetchCatalog(r); err != nil {
-			fmt.Printf("ERROR when fetching catalog for %s\n%w\n", r.name, err)
-		}
+	if top, err := r.tree(); err == nil {
+		top.DelContent(name)
 	}
-	r.top.DelContent(name)
 }
 
 func (r *drive) Move(targetDir VirtualFS, name string) error {
 	return fmt.Errorf("cannot move drive")
 }
 
+// Create the top folder of the drive, loading the whole tree if the drive
+// is preloaded. Must be called with loadMu held.
 func fetchCatalog(r *drive) error {
+	// Read the version first: changes made while fetching cause a reload
+	// later on rather than going unnoticed.
+	version, err := r.catalog.DriveVersion(r.id)
+	if err != nil {
+		return err
+	}
+	if !r.preload {
+		r.top = &vfs_dir{"", nil, r, -1, r}
+		r.files = make(map[string][]*vfs_file)
+		r.version = version
+		return nil
+	}
 	directories, err := r.catalog.FetchDirectories(r.id)
 	if err != nil {
 		return err
@@ -142,40 +329,46 @@ func fetchCatalog(r *drive) error {
 		return err
 	}
 	
+	// The tree is not visible to other goroutines until loaded, so it is
+	// built without taking the lock.
 	dirMap := make(map[int]*vfs_dir)
 	parentMap := make(map[int]int)
 	for id, dir := range directories {
-		dirMap[id] = &vfs_dir{dir.Name, make(map[string]VirtualFS), nil, id}
+		dirMap[id] = &vfs_dir{dir.Name, make(map[string]VirtualFS), nil, id, r}
 		parentMap[id] = dir.ParentId
 	}
-	r.top = &vfs_dir{"", make(map[string]VirtualFS), r.root, -1}
+	top := &vfs_dir{"", make(map[string]VirtualFS), r, -1, r}
+	index := make(map[string][]*vfs_file)
 	for _, dir := range dirMap {
-		name := dir.name
-		var parent VirtualFS
 		if parentMap[dir.id] < 0 {
-			parent = r
+			dir.parent = r
+			top.content[dir.name] = dir
 		} else {
-			parent = dirMap[parentMap[dir.id]]
+			parent := dirMap[parentMap[dir.id]]
+			dir.parent = parent
+			parent.content[dir.name] = dir
 		}
-		dir.parent = parent
-		parent.SetContent(name, dir)
 	}
 	for id, file := range files {
-		name := file.Name
-		var dir VirtualFS
+		fileObj := &vfs_file{file.Name, file.UUID, nil, file.Created, file.Updated, file.Metadata, file.Size, file.Hash, id, r}
 		if file.DirectoryId < 0 {
-			dir = r
+			fileObj.parent = r
+			top.content[file.Name] = fileObj
 		} else {
-			dir = dirMap[file.DirectoryId]
+			dir := dirMap[file.DirectoryId]
+			fileObj.parent = dir
+			dir.content[file.Name] = fileObj
 		}
-		fileObj := &vfs_file{name, file.UUID, dir, file.Created, file.Updated, file.Metadata, id}
-		dir.SetContent(name, fileObj)
+		index[file.UUID] = append(index[file.UUID], fileObj)
 	}
+	r.top = top
+	r.files = index
+	r.version = version
 	return nil
 }
 
-func (r *drive) createFile(name string, uuid string, dirId int, created time.Time, updated time.Time, metadata string) (int, error) {
-	fileId, err := r.catalog.CreateFile(r.id, name, uuid, dirId, created, updated, metadata)
+func (r *drive) createFile(name string, uuid string, dirId int, created time.Time, updated time.Time, metadata string, size int64, hash string) (int, error) {
+	fileId, err := r.catalog.CreateFile(r.id, name, uuid, dirId, created, updated, metadata, size, hash)
 	if err != nil {
 		return 0, err
 	}
@@ -195,11 +388,36 @@ func (r *drive) updateFile(id int, name string, dirId int) error {
 	return err
 }
 
+func (r *drive) updateFileContent(id int, uuid string, updated time.Time, metadata string, size int64, hash string) error {
+	err := r.catalog.UpdateFileContent(id, uuid, updated, metadata, size, hash)
+	return err
+}
+
+func (r *drive) updateObjectMetadata(uuid string, metadata string) error {
+	err := r.catalog.UpdateObjectMetadata(r.id, uuid, metadata)
+	return err
+}
+
+func (r *drive) countReferences(uuid string) (int, error) {
+	count, err := r.catalog.CountReferences(r.id, uuid)
+	return count, err
+}
+
 func (r *drive) updateDirectory(id int, name string, parentId int) error {
 	err := r.catalog.UpdateDirectory(id, name, parentId)
 	return err
 }
 
+func (r *drive) deleteFile(id int) error {
+	err := r.catalog.DeleteFile(id)
+	return err
+}
+
+func (r *drive) deleteDirectory(id int) error {
+	err := r.catalog.DeleteDirectory(id)
+	return err
+}
+
 func (r *drive) countFilesInDir(dirId int) (int, error) {
 	count, err := r.catalog.CountFilesInDirectory(dirId)
 	if err != nil {
@@ -216,12 +434,6 @@ func (d *drive) CountFiles() (int, error) {
 	return count, nil
 }
 
-func (d *drive) Find(search string) []VirtualFS {
-	///fmt.Printf("About to search drive %s\n", d.name)
-	if d.top == nil {
-		if err := fetchCatalog(d); err != nil {
-			fmt.Printf("ERROR when fetching catalog for %s\n%w\n", d.name, err)
-		}
-	}
-	return d.top.Find(search)
+func (d *drive) Find(search string) ([]VirtualFS, error) {
+	return find(d, search)
 }
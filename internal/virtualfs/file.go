@@ -4,17 +4,19 @@ package virtualfs
 import (
 	"fmt"
 	"time"
-	"strings"
 )
 
 type vfs_file struct {
 	name string
 	uuid string
-	parent VirtualFS
+	parent VirtualFS    // nil once deleted.
 	created time.Time
 	updated time.Time
 	metadata string
+	size int64          // -1 if unknown.
+	hash string         // CRC32C of the content, "" if unknown.
 	id int              // Identifier in catalog.db.
+	drive *drive
 }
 
 func (f *vfs_file) IsFile() bool {
@@ -46,31 +48,38 @@ func (f *vfs_file) AsDrive() Drive {
 }
 
 func (f *vfs_file) Drive() Drive {
-	return findDrive(f)
+	return f.drive
 }
 
 func (f *vfs_file) Name() string {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.name
 }
 
 func (f *vfs_file) Path() string {
-	return constructPath(f)
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
+	return pathOf(f)
 }
 
 func (f *vfs_file) Parent() VirtualFS {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.parent
 }
 
-func (f *vfs_file) ContentList() []string {
-	return nil
+func (f *vfs_file) ContentList() ([]string, error) {
+	return nil, nil
 }
 
-func (f *vfs_file) GetContent(field string) (VirtualFS, bool) {
-	return nil, false
+func (f *vfs_file) GetContent(field string) (VirtualFS, bool, error) {
+	return nil, false, nil
 }
 
-func (f *vfs_file) SetContent(field string, value VirtualFS) {
+func (f *vfs_file) SetContent(field string, value VirtualFS) error {
 	// Do nothing.
+	return nil
 }
 
 func (f *vfs_file) DelContent(field string) {
@@ -78,6 +87,8 @@ func (f *vfs_file) DelContent(field string) {
 }
 
 func (f *vfs_file) UUID() string {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.uuid
 }
 
@@ -86,31 +97,57 @@ func (f *vfs_file) CatalogId() int {
 }
 
 func (f *vfs_file) Print() {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	fmt.Printf("Name:        %s\n", f.name)
-	fmt.Printf("Path:        %s\n", f.Path())
+	fmt.Printf("Path:        %s\n", pathOf(f))
 	fmt.Printf("UUID:        %s\n", f.uuid)
 	fmt.Printf("Created      %s\n", f.created.Format(time.RFC822))
 	fmt.Printf("Updated:     %s\n", f.updated.Format(time.RFC822))
 	fmt.Printf("Metadata:    %s\n", f.metadata)
+	if f.size >= 0 {
+		fmt.Printf("Size:        %d\n", f.size)
+	}
+	if f.hash != "" {
+		fmt.Printf("CRC32C:      %s\n", f.hash)
+	}
 	fmt.Printf("Catalog ID:  %d\n", f.id)
 }
 
 func (f *vfs_file) Root() VirtualFS {
-	return findRoot(f)
+	return f.drive.root
 }
 
 func (f *vfs_file) Created() time.Time {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.created
 }
 
 func (f *vfs_file) Updated() time.Time {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.updated
 }
 
 func (f *vfs_file) Metadata() string {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
 	return f.metadata
 }
 
+func (f *vfs_file) Size() int64 {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
+	return f.size
+}
+
+func (f *vfs_file) Hash() string {
+	f.drive.mu.RLock()
+	defer f.drive.mu.RUnlock()
+	return f.hash
+}
+
 func (r *vfs_file) CountFiles() (int, error) {
 	return 0, nil
 }
@@ -120,35 +157,48 @@ func (f *vfs_file) Move(targetDir VirtualFS, name string) error {
 	if err := ValidateName(name); err != nil {
 		return err
 	}
-	if _, found := targetDir.GetContent(name); found {
-		return fmt.Errorf("name %s already exists in %s", name, targetDir.Path())
-	}
 	if targetDir.IsRoot() {
 		return fmt.Errorf("cannot move file to root")
 	}
-	if f.Drive() != targetDir.Drive() {
-		return fmt.Errorf("cannot move file across drives")
+	if !targetDir.IsDir() {
+		return fmt.Errorf("not a folder: %s", targetDir.Path())
+	}
+	if Drive(f.drive) != targetDir.Drive() {
+		return moveAcrossDrives(f, targetDir, name)
+	}
+	f.drive.mu.Lock()
+	defer f.drive.mu.Unlock()
+	if detached(f) || detached(targetDir) {
+		return fmt.Errorf("cannot move %s: deleted", f.name)
+	}
+	if err := f.drive.beginWrite(); err != nil {
+		return err
+	}
+	defer f.drive.endWrite()
+	target, err := contentOf(targetDir)
+	if err != nil {
+		return err
+	}
+	if _, found := target[name]; found {
+		return fmt.Errorf("name %s already exists in %s", name, pathOf(targetDir) + "/")
 	}
 	dirId := targetDir.CatalogId()
 	if targetDir.IsDrive() {
 		// Override if we're putting it in a drive
 		dirId = -1
 	}
-	if err := f.Drive().updateFile(f.id, name, dirId); err != nil {
+	if err := f.drive.updateFile(f.id, name, dirId); err != nil {
 		return err
 	}
 	// If update was successful, update the tree.
-	f.parent.DelContent(f.name)
+	delete(parentContent(f.parent), f.name)
 	f.parent = targetDir
 	f.name = name
 	f.updated = time.Now()
-	targetDir.SetContent(name, f)
+	target[name] = f
 	return nil
 }
 
-func (f *vfs_file) Find(search string) []VirtualFS {
-	if strings.Contains(strings.ToLower(f.name), search) {
-		return []VirtualFS{f}
-	}
-	return nil
+func (f *vfs_file) Find(search string) ([]VirtualFS, error) {
+	return find(f, search)
 }
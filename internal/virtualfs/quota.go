@@ -0,0 +1,76 @@
+
+package virtualfs
+
+import (
+	"errors"
+	"fmt"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+)
+
+// Quotas limit the bytes stored and the number of files of a drive. Bytes
+// are those kept by the storage, with the copies of a mirror drive and the
+// parity of an erasure drive. Quotas are checked by commands before they
+// start writing, against the usage recorded in the catalog, so that a
+// transfer is refused up front rather than left half done. Writes made
+// without a check, such as through a server or a mount, are not refused.
+
+// Returned, wrapped, by CheckQuota.
+var ErrQuota = errors.New("quota exceeded")
+
+func Quota(d Drive) (catalog.Quota, error) {
+	return driveOf(d.AsVirtualFS()).catalog.FetchQuota(d.CatalogId())
+}
+
+// Set the quota of a drive, 0 for no limit.
+func SetQuota(d Drive, quota catalog.Quota) error {
+	cat := driveOf(d.AsVirtualFS()).catalog
+	if err := cat.Lock(); err != nil {
+		return err
+	}
+	defer cat.Unlock()
+	return cat.SetQuota(d.CatalogId(), quota)
+}
+
+func Usage(d Drive) (catalog.DriveUsage, error) {
+	stored := func(size int64, metadata string) int64 {
+		return storage.StoredSize(d.Storage(), size, metadata)
+	}
+	return driveOf(d.AsVirtualFS()).catalog.FetchDriveUsage(d.CatalogId(), stored)
+}
+
+// Check that `files` more files storing `bytes` more bytes, as given by
+// storage.UploadSize, fit in the quota of drive `d`, which is nil for the
+// root.
+func CheckQuota(d Drive, files int, bytes int64) error {
+	if d == nil {
+		return nil
+	}
+	quota, err := Quota(d)
+	if err != nil {
+		return err
+	}
+	if quota.Files == 0 && quota.Bytes == 0 {
+		return nil
+	}
+	usage, err := Usage(d)
+	if err != nil {
+		return err
+	}
+	if quota.Files > 0 && usage.Files + files > quota.Files {
+		return fmt.Errorf("%w on drive %s: %d more file(s) would make %d, over the limit of %d", ErrQuota, d.Name(), files, usage.Files + files, quota.Files)
+	}
+	if quota.Bytes > 0 && usage.Bytes + bytes > quota.Bytes {
+		return fmt.Errorf("%w on drive %s: %s more would make %s, over the limit of %s (%s free)", ErrQuota, d.Name(), util.FormatSize(bytes), util.FormatSize(usage.Bytes + bytes), util.FormatSize(quota.Bytes), util.FormatSize(max64(quota.Bytes - usage.Bytes, 0)))
+	}
+	return nil
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -3,18 +3,58 @@ package virtualfs
 
 import (
 	"fmt"
+	"strings"
+
 	"rpucella.net/virtual-hard-drive/internal/catalog"
 	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
 )
 
 type root struct {
 	drives map[string]Drive
+	catalog catalog.Catalog
+	limiter *util.Limiter     // Limit of all transfers, from the settings.
+	progress *util.Progress   // Reported to by the storage of drives.
 }
 
 func (r *root) Drives() map[string]Drive {
 	return r.drives
 }
 
+func (r *root) Catalog() catalog.Catalog {
+	return r.catalog
+}
+
+func (r *root) Limiter() *util.Limiter {
+	return r.limiter
+}
+
+func (r *root) Progress() *util.Progress {
+	return r.progress
+}
+
+// Drop the trees of drives changed in the catalog by another process since
+// they were loaded, so that they are reloaded on next use. Entries obtained
+// from a dropped tree must be looked up again. Returns the names of the
+// dropped drives.
+func (r *root) Refresh() ([]string, error) {
+	dropped := make([]string, 0)
+	for name, d := range r.drives {
+		drive := d.(*drive)
+		drive.mu.Lock()
+		stale, err := drive.stale()
+		if err == nil && stale {
+			drive.drop()
+			dropped = append(dropped, name)
+		}
+		drive.mu.Unlock()
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
 func (r *root) AsVirtualFS() VirtualFS {
 	return r
 }
@@ -71,24 +111,25 @@ func (r *root) Print() {
 	fmt.Println("<Root>")
 }
 
-func (r *root) ContentList() []string {
+func (r *root) ContentList() ([]string, error) {
 	result := make([]string, 0, len(r.drives))
 	for k, _ := range r.drives {
 		result = append(result, k)
 	}
-	return result
+	return result, nil
 }
 
-func (r *root) GetContent(field string) (VirtualFS, bool) {
+func (r *root) GetContent(field string) (VirtualFS, bool, error) {
 	result, found := r.drives[field]
 	if !found {
-		return nil, false
+		return nil, false, nil
 	}
-	return result.AsVirtualFS(), true
+	return result.AsVirtualFS(), true, nil
 }
 
-func (r *root) SetContent(name string, value VirtualFS) {
+func (r *root) SetContent(name string, value VirtualFS) error {
 	// Do nothing.
+	return nil
 }
 
 func (r *root) DelContent(name string) {
@@ -103,35 +144,134 @@ func (r *root) CountFiles() (int, error) {
 	return 0, nil
 }
 
+// Create the storage backend for a drive.
+// Returns nil (and no error) for drives of an unknown type.
+type StorageOpener func(catalog.DriveDescriptor) (storage.Storage, error)
+
+// Backends that transfer content, local and GCS, report to `progress` and
+// are limited by `limiters` (see storage/metered.go).
+func openStorage(driveDesc catalog.DriveDescriptor, settings util.DriveSettings, progress *util.Progress, limiters []*util.Limiter) (storage.Storage, error) {
+	if driveDesc.Type == "gcs" {
+		store, err := storage.NewGoogleCloud(driveDesc.Location)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to GCS: %w", err)
+		}
+		return storage.NewMetered(store, progress, limiters...), nil
+	} else if driveDesc.Type == "local" {
+		if settings.ChunkSize > 0 {
+			return storage.NewMetered(storage.NewLocalFileSystemChunked(driveDesc.Location, int64(settings.ChunkSize)), progress, limiters...), nil
+		}
+		return storage.NewMetered(storage.NewLocalFileSystem(driveDesc.Location), progress, limiters...), nil
+	} else if driveDesc.Type == "mirror" {
+		ids, replicas, err := openBackends(driveDesc, strings.Split(driveDesc.Location, ";"), settings, progress, limiters)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewMirror(ids, replicas), nil
+	} else if driveDesc.Type == "erasure" {
+		// The first element of the address is the code, e.g., 4+2.
+		specs := strings.Split(driveDesc.Location, ";")
+		var k, m int
+		if _, err := fmt.Sscanf(specs[0], "%d+%d", &k, &m); err != nil {
+			return nil, fmt.Errorf("drive %s: erasure code %s is not <k>+<m>", driveDesc.Name, specs[0])
+		}
+		_, backends, err := openBackends(driveDesc, specs[1:], settings, progress, limiters)
+		if err != nil {
+			return nil, err
+		}
+		store, err := storage.NewErasure(k, m, backends)
+		if err != nil {
+			return nil, fmt.Errorf("drive %s: %w", driveDesc.Name, err)
+		}
+		return store, nil
+	}
+	return nil, nil
+}
+
+// The address of a drive made up of several backends is a list of
+// <host>:<address> separated by ;, e.g.,
+//   local:/mnt/nas;gcs:bucket
+// Returns the backends along with their addresses, which identify them.
+func openBackends(driveDesc catalog.DriveDescriptor, specs []string, settings util.DriveSettings, progress *util.Progress, limiters []*util.Limiter) ([]string, []storage.Storage, error) {
+	ids := make([]string, 0)
+	result := make([]storage.Storage, 0)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		fields := strings.SplitN(spec, ":", 2)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("drive %s: backend %s is not <host>:<address>", driveDesc.Name, spec)
+		}
+		backendDesc := driveDesc
+		backendDesc.Type = fields[0]
+		backendDesc.Location = fields[1]
+		store, err := openStorage(backendDesc, settings, progress, limiters)
+		if err != nil {
+			return nil, nil, err
+		}
+		if store == nil || backendDesc.Type == "mirror" || backendDesc.Type == "erasure" {
+			return nil, nil, fmt.Errorf("drive %s: unsupported backend %s", driveDesc.Name, spec)
+		}
+		ids = append(ids, spec)
+		result = append(result, store)
+	}
+	if len(result) == 0 {
+		return nil, nil, fmt.Errorf("drive %s: no backends", driveDesc.Name)
+	}
+	return ids, result, nil
+}
+
 func NewRoot(c catalog.Catalog) (Root, error) {
-	root := &root{}
+	settings, err := util.LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+	// Transfers are limited by the limit of all transfers, which commands
+	// can change, and by the limit of their drive.
+	limiter := util.NewLimiter(int64(settings.Limit))
+	progress := util.NewProgress()
+	open := func(driveDesc catalog.DriveDescriptor) (storage.Storage, error) {
+		driveSettings := settings.Drive(driveDesc.Name)
+		limiters := []*util.Limiter{limiter, util.NewLimiter(int64(driveSettings.Limit))}
+		return openStorage(driveDesc, driveSettings, progress, limiters)
+	}
+	r, err := NewRootWithStorage(c, open)
+	if err != nil {
+		return nil, err
+	}
+	r.(*root).limiter = limiter
+	r.(*root).progress = progress
+	for name, d := range r.Drives() {
+		d.(*drive).preload = settings.Drive(name).Preload
+	}
+	return r, nil
+}
+
+func NewRootWithStorage(c catalog.Catalog, open StorageOpener) (Root, error) {
+	root := &root{catalog: c, limiter: util.NewLimiter(0), progress: util.NewProgress()}
 	content, err := c.FetchDrives()
 	if err != nil {
 		return nil, fmt.Errorf("cannot read drives: %w", err)
 	}
 	root.drives = make(map[string]Drive)
 	for _, driveDesc := range content {
-		var store storage.Storage
-		if driveDesc.Type == "gcs" {
-			newStore, err := storage.NewGoogleCloud(driveDesc.Location)
-			if err != nil {
-				return nil, fmt.Errorf("cannot connect to GCS: %w", err)
-			}
-			store = newStore
-		} else if driveDesc.Type == "local" {
-			store = storage.NewLocalFileSystem(driveDesc.Location)
-		} else {
+		store, err := open(driveDesc)
+		if err != nil {
+			return nil, err
+		}
+		if store == nil {
 			// Unknown type - skip silently.
 			continue
 		}
 		root.drives[driveDesc.Name] = &drive{
-			driveDesc.Name,
-			driveDesc.Description,
-			driveDesc.Id,
-			c,
-			store,
-			nil,
-			root.AsVirtualFS(),
+			name: driveDesc.Name,
+			description: driveDesc.Description,
+			id: driveDesc.Id,
+			catalog: c,
+			storage: store,
+			root: root.AsVirtualFS(),
 		}
 	}
 	return root, nil 
@@ -141,10 +281,13 @@ func (r *root) Move(targetDir VirtualFS, name string) error {
 	return fmt.Errorf("cannot move root")
 }
 
-func (r *root) Find(search string) []VirtualFS {
+func (r *root) Find(search string) ([]VirtualFS, error) {
 	var results []VirtualFS = nil
 	for _, d := range r.drives {
-		temp := d.AsVirtualFS().Find(search)
+		temp, err := d.AsVirtualFS().Find(search)
+		if err != nil {
+			return nil, err
+		}
 		if len(temp) > 0 {
 			if results == nil {
 				results = temp
@@ -155,5 +298,5 @@ func (r *root) Find(search string) []VirtualFS {
 			}
 		}
 	}
-	return results
+	return results, nil
 }
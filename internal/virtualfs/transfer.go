@@ -0,0 +1,174 @@
+
+package virtualfs
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"rpucella.net/virtual-hard-drive/internal/storage"
+)
+
+// Copy the file or folder `src` (recursively) to `targetDir` under name `name`.
+// Within a drive, copies share the storage object of the original.
+// Across drives, the data of every file is copied to the storage of the
+// target drive under a new UUID, and checked against the original. Copies
+// keep the tags and attributes of the originals.
+// If anything fails, whatever was already copied is deleted again.
+func Copy(src VirtualFS, targetDir VirtualFS, name string) (VirtualFS, error) {
+	if src.IsRoot() || src.IsDrive() {
+		return nil, fmt.Errorf("cannot copy %s", src.Path())
+	}
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	if targetDir.IsRoot() {
+		return nil, fmt.Errorf("cannot copy to root")
+	}
+	if _, found, err := targetDir.GetContent(name); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("name %s already exists in %s", name, targetDir.Path())
+	}
+	if src.IsDir() {
+		for curr := targetDir; !curr.IsRoot(); curr = curr.Parent() {
+			if curr == src {
+				return nil, fmt.Errorf("trying to copy directory to a descendant")
+			}
+		}
+	}
+	result, err := copyEntry(src, targetDir, name)
+	if err != nil {
+		if result != nil {
+			if delErr := Delete(result); delErr != nil {
+				return nil, fmt.Errorf("%w (cleaning up: %v)", err, delErr)
+			}
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// Copy `src` without cleaning up on failure. Returns whatever was created
+// so far along with the error.
+func copyEntry(src VirtualFS, targetDir VirtualFS, name string) (VirtualFS, error) {
+	if file, ok := src.(*vfs_file); ok {
+		drive := file.drive
+		if Drive(drive) == targetDir.Drive() {
+			// Under the lock, so that the storage object cannot be released
+			// before the copy refers to it.
+			drive.mu.Lock()
+			defer drive.mu.Unlock()
+			if detached(file) {
+				return nil, fmt.Errorf("cannot copy %s: deleted", file.name)
+			}
+			fileObj, err := createFileLocked(targetDir, name, file.uuid, file.created, file.updated, file.metadata, file.size, file.hash)
+			if err != nil {
+				return nil, err
+			}
+			return fileObj, copyAnnotations(file, fileObj)
+		}
+		drive.mu.RLock()
+		path, srcUUID, srcMetadata := pathOf(file), file.uuid, file.metadata
+		created, updated, size, hash := file.created, file.updated, file.size, file.hash
+		drive.mu.RUnlock()
+		newUUID := uuid.New().String()
+		metadata, err := storage.Transfer(drive.Storage(), srcUUID, srcMetadata, targetDir.Drive().Storage(), newUUID)
+		if err != nil {
+			return nil, fmt.Errorf("copying %s: %w", path, err)
+		}
+		fileObj, err := createFile(targetDir, name, newUUID, created, updated, metadata, size, hash)
+		if err != nil {
+			targetDir.Drive().Storage().DeleteFile(newUUID, metadata)
+			return nil, err
+		}
+		return fileObj, copyAnnotations(file, fileObj)
+	}
+	dirObj, err := CreateDirectory(targetDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyAnnotations(src, dirObj); err != nil {
+		return dirObj, err
+	}
+	// Walk visits parents first, so the copy of the parent always exists.
+	copies := map[VirtualFS]VirtualFS{src: dirObj}
+	err = Walk(src, func(vfs VirtualFS) error {
+		if vfs == src {
+			return nil
+		}
+		parent := copies[vfs.Parent()]
+		if vfs.IsFile() {
+			_, err := copyEntry(vfs, parent, vfs.Name())
+			return err
+		}
+		sub, err := CreateDirectory(parent, vfs.Name())
+		if err != nil {
+			return err
+		}
+		copies[vfs] = sub
+		return copyAnnotations(vfs, sub)
+	})
+	return dirObj, err
+}
+
+// Delete the file or folder `obj` (recursively) from the catalog, along with
+// the storage objects of its files that are not shared with other files.
+// The drive is locked for the duration.
+func Delete(obj VirtualFS) error {
+	if obj.IsRoot() || obj.IsDrive() {
+		return fmt.Errorf("cannot delete %s", obj.Path())
+	}
+	drive := driveOf(obj)
+	drive.mu.Lock()
+	defer drive.mu.Unlock()
+	if detached(obj) {
+		return fmt.Errorf("already deleted")
+	}
+	if err := drive.beginWrite(); err != nil {
+		return err
+	}
+	defer drive.endWrite()
+	return deleteLocked(obj)
+}
+
+func deleteLocked(obj VirtualFS) error {
+	switch node := obj.(type) {
+	case *vfs_file:
+		if err := node.drive.deleteFile(node.id); err != nil {
+			return err
+		}
+		delete(parentContent(node.parent), node.name)
+		node.parent = nil
+		node.drive.unindexFile(node)
+		return release(node.drive, node.uuid, node.metadata)
+	case *vfs_dir:
+		content, err := contentOf(node)
+		if err != nil {
+			return err
+		}
+		for _, sub := range content {
+			if err := deleteLocked(sub); err != nil {
+				return err
+			}
+		}
+		if err := node.drive.deleteDirectory(node.id); err != nil {
+			return err
+		}
+		delete(parentContent(node.parent), node.name)
+		node.parent = nil
+		return nil
+	}
+	return fmt.Errorf("cannot delete %s", pathOf(obj))
+}
+
+// Move across drives: copy, then delete the source once the copy
+// has been fully written and checked.
+func moveAcrossDrives(src VirtualFS, targetDir VirtualFS, name string) error {
+	if _, err := Copy(src, targetDir, name); err != nil {
+		return err
+	}
+	if err := Delete(src); err != nil {
+		return fmt.Errorf("copied to %s but cannot delete source: %w", targetDir.Path(), err)
+	}
+	return nil
+}
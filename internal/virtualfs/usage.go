@@ -0,0 +1,49 @@
+
+package virtualfs
+
+import (
+	"fmt"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+)
+
+// Subtrees read straight from the catalog, for commands that add up
+// everything below a folder. Unlike Walk, they do not load the folders in
+// the tree of the drive.
+
+// Catalog identifier of folder or drive `vfs`, -1 for the top of a drive.
+func folderId(vfs VirtualFS) (int, error) {
+	switch node := vfs.(type) {
+	case *drive:
+		return -1, nil
+	case *vfs_dir:
+		return node.id, nil
+	}
+	return 0, fmt.Errorf("not a folder of a drive: %s", vfs.Path())
+}
+
+// The catalog identifier of folder or drive `vfs` (-1 for a drive), and the
+// folders below it at any depth.
+func Subfolders(vfs VirtualFS) (int, map[int]catalog.DirectoryDescriptor, error) {
+	id, err := folderId(vfs)
+	if err != nil {
+		return 0, nil, err
+	}
+	r := driveOf(vfs)
+	folders, err := r.catalog.FetchSubdirectories(r.id, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, folders, nil
+}
+
+// Call `visit` on every file below folder or drive `vfs` at any depth, with
+// the files sharing a storage object one after the other.
+func WalkFiles(vfs VirtualFS, visit func(catalog.FileDescriptor) error) error {
+	id, err := folderId(vfs)
+	if err != nil {
+		return err
+	}
+	r := driveOf(vfs)
+	return r.catalog.WalkFiles(r.id, id, visit)
+}
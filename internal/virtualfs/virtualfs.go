@@ -2,17 +2,30 @@
 package virtualfs
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 	"regexp"
+	"sort"
 	
+	"rpucella.net/virtual-hard-drive/internal/catalog"
 	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
 )
 
+// Returned by writes to a drive changed in the catalog by another process
+// since its tree was loaded. The tree is reloaded on next use, and entries
+// obtained before must be looked up again.
+var ErrStale = errors.New("drive changed by another process, try again")
+
 type Root interface {
 	Drives() map[string]Drive
 	AsVirtualFS() VirtualFS
+	Catalog() catalog.Catalog
+	Refresh() ([]string, error)
+	Limiter() *util.Limiter       // Limit of all transfers.
+	Progress() *util.Progress     // Progress of transfers.
 }
 
 type Drive interface {
@@ -21,11 +34,16 @@ type Drive interface {
 	Storage() storage.Storage
 	AsVirtualFS() VirtualFS
 	CatalogId() int
-	createFile(string, string, int, time.Time, time.Time, string) (int, error)
+	createFile(string, string, int, time.Time, time.Time, string, int64, string) (int, error)
 	createDirectory(string, int) (int, error)
 	updateFile(int, string, int) error
+	updateFileContent(int, string, time.Time, string, int64, string) error
+	updateObjectMetadata(string, string) error
 	updateDirectory(int, string, int) error
+	deleteFile(int) error
+	deleteDirectory(int) error
 	countFilesInDir(int) (int, error)
+	countReferences(string) (int, error)
 }
 
 type File interface {
@@ -34,6 +52,8 @@ type File interface {
 	Created() time.Time
 	Updated() time.Time
 	Metadata() string       // Storage-specific metadata (such as # of chunks),
+	Size() int64            // -1 if unknown.
+	Hash() string           // CRC32C of the content, "" if unknown.
 }
 
 type Directory interface {
@@ -55,14 +75,14 @@ type VirtualFS interface {
 	Root() VirtualFS
 	Drive() Drive        // Returns the drive of this node (if any).
 	Print()
-	ContentList() []string
-	GetContent(string) (VirtualFS, bool)
-	SetContent(string, VirtualFS)
+	ContentList() ([]string, error)      // Loading folders from the catalog may fail.
+	GetContent(string) (VirtualFS, bool, error)
+	SetContent(string, VirtualFS) error
 	DelContent(string)
 	CatalogId() int      // Meaning depends on the kind of virtual FS node we have.
 	Move(VirtualFS, string) error
 	CountFiles() (int, error)
-	Find(string) []VirtualFS
+	Find(string) ([]VirtualFS, error)
 }
 
 func constructPath(vfs VirtualFS) string {
@@ -98,9 +118,15 @@ func printLevel(curr VirtualFS, indent int) {
 		fmt.Printf("%s%s\n", spaces(indent), curr.Name())
 	} else if curr.IsDir() {
 		fmt.Printf("%s%s/\n", spaces(indent), curr.Name())
-		for _, k := range curr.ContentList() {
-			sub, _ := curr.GetContent(k)
-			printLevel(sub, indent + 2)
+		names, err := curr.ContentList()
+		if err != nil {
+			fmt.Printf("%s%s\n", spaces(indent + 2), err)
+			return
+		}
+		for _, k := range names {
+			if sub, found, _ := curr.GetContent(k); found {
+				printLevel(sub, indent + 2)
+			}
 		}
 	}
 }
@@ -110,26 +136,101 @@ func Print(cat VirtualFS) {
 }
 
 func findRoot(cat VirtualFS) VirtualFS {
-	var curr VirtualFS = cat
-	for {
-		if curr.Parent() == nil {
-			return curr
+	return cat.Root()
+}
+
+// Concurrency: each drive has a lock guarding its tree (names, parents,
+// folder content, and file fields). Methods of VirtualFS and File take the
+// lock of their drive, and the functions below operate on the fields
+// directly, with the lock held.
+
+// The drive of a folder or file.
+func driveOf(vfs VirtualFS) *drive {
+	switch node := vfs.(type) {
+	case *drive:
+		return node
+	case *vfs_dir:
+		return node.drive
+	case *vfs_file:
+		return node.drive
+	}
+	return nil
+}
+
+// The entries of a folder or drive, loaded from the catalog if needed.
+// Must be called with the write lock held.
+func contentOf(vfs VirtualFS) (map[string]VirtualFS, error) {
+	var dir *vfs_dir
+	switch node := vfs.(type) {
+	case *drive:
+		top, err := node.tree()
+		if err != nil {
+			return nil, err
 		}
-		curr = curr.Parent()
+		dir = top
+	case *vfs_dir:
+		dir = node
+	default:
+		return nil, fmt.Errorf("not a folder: %s", pathOf(vfs))
+	}
+	if err := dir.drive.loadLocked(dir); err != nil {
+		return nil, err
 	}
+	return dir.content, nil
 }
 
-func findDrive(cat VirtualFS) Drive {
-	curr := cat
-	for {
-		if curr == nil {
-			return nil
+// The entries of the folder or drive holding an entry, which are loaded
+// since the entry was found there.
+func parentContent(parent VirtualFS) map[string]VirtualFS {
+	switch node := parent.(type) {
+	case *drive:
+		if top, err := node.tree(); err == nil {
+			return top.content
 		}
-		if drive := curr.AsDrive(); drive != nil {
-			return drive
+	case *vfs_dir:
+		return node.content
+	}
+	return nil
+}
+
+// Path without a trailing /, as in constructPath.
+func pathOf(vfs VirtualFS) string {
+	switch node := vfs.(type) {
+	case *drive:
+		return "/" + node.name
+	case *vfs_dir:
+		return pathOf(node.parent) + "/" + node.name
+	case *vfs_file:
+		return pathOf(node.parent) + "/" + node.name
+	}
+	return ""
+}
+
+// Whether a folder or file has been deleted from the tree.
+func detached(vfs VirtualFS) bool {
+	switch node := vfs.(type) {
+	case *vfs_dir:
+		return node.parent == nil
+	case *vfs_file:
+		return node.parent == nil
+	}
+	return false
+}
+
+// Entries under `vfs`, itself included, whose name contains `search`
+// (lowercase), loading folders as needed.
+func find(vfs VirtualFS, search string) ([]VirtualFS, error) {
+	var results []VirtualFS = nil
+	err := Walk(vfs, func(sub VirtualFS) error {
+		if !sub.IsDrive() && strings.Contains(strings.ToLower(sub.Name()), search) {
+			results = append(results, sub)
 		}
-		curr = curr.Parent()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return results, nil
 }
 
 func decomposePath(path string) []string {
@@ -167,7 +268,10 @@ func navigate(cat VirtualFS, path string, forceFile bool, forceDir bool, checkEx
 			if !curr.IsDir() {
 				return nil, fmt.Errorf("not a folder: %s", curr.Name())
 			}
-			newCurr, found := curr.GetContent(dir)
+			newCurr, found, err := curr.GetContent(dir)
+			if err != nil {
+				return nil, err
+			}
 			if !found {
 				if checkExists && (i == len(dirs) - 1) {
 					// We're at the last name and we're checking for existence only.
@@ -226,27 +330,49 @@ func CheckPath(cat VirtualFS, path string) (VirtualFS, error) {
 	return obj, nil
 }
 	
-func CreateFile(dir VirtualFS, name string, uuid string, metadata string) (VirtualFS, error) {
+func CreateFile(dir VirtualFS, name string, uuid string, metadata string, size int64, hash string) (VirtualFS, error) {
+	now := time.Now()
+	return createFile(dir, name, uuid, now, now, metadata, size, hash)
+}
+
+func createFile(dir VirtualFS, name string, uuid string, created time.Time, updated time.Time, metadata string, size int64, hash string) (VirtualFS, error) {
 	if dir.IsRoot() {
 		return nil, fmt.Errorf("cannot create file in root")
 	}
-	_, found := dir.GetContent(name)
-	if found {
-		return nil, fmt.Errorf("entry %s already exists at %s", name, dir.Path())
+	drive := driveOf(dir)
+	drive.mu.Lock()
+	defer drive.mu.Unlock()
+	return createFileLocked(dir, name, uuid, created, updated, metadata, size, hash)
+}
+
+func createFileLocked(dir VirtualFS, name string, uuid string, created time.Time, updated time.Time, metadata string, size int64, hash string) (VirtualFS, error) {
+	if detached(dir) {
+		return nil, fmt.Errorf("cannot create %s: folder deleted", name)
+	}
+	drive := driveOf(dir)
+	if err := drive.beginWrite(); err != nil {
+		return nil, err
+	}
+	defer drive.endWrite()
+	content, err := contentOf(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := content[name]; found {
+		return nil, fmt.Errorf("entry %s already exists at %s", name, pathOf(dir) + "/")
 	}
-	now := time.Now()
 	dirId := dir.CatalogId()
 	if dir.IsDrive() {
 		// Override if we're putting it in a drive
 		dirId = -1
 	}
-	drive := dir.Drive()
-	fileId, err := drive.createFile(name, uuid, dirId, now, now, metadata)
+	fileId, err := drive.createFile(name, uuid, dirId, created, updated, metadata, size, hash)
 	if err != nil {
 		return nil, err
 	}
-	fileObj := &vfs_file{name, uuid, dir, now, now, metadata, fileId}
-	dir.SetContent(name, fileObj)
+	fileObj := &vfs_file{name, uuid, dir, created, updated, metadata, size, hash, fileId, drive}
+	content[name] = fileObj
+	drive.indexFile(fileObj)
 	return fileObj, nil
 }
 
@@ -254,25 +380,151 @@ func CreateDirectory(dir VirtualFS, name string) (VirtualFS, error) {
 	if dir.IsRoot() {
 		return nil, fmt.Errorf("cannot create directory in root")
 	}
-	_, found := dir.GetContent(name)
-	if found {
-		return nil, fmt.Errorf("entry %s already exists at %s", name, dir.Path())
+	drive := driveOf(dir)
+	drive.mu.Lock()
+	defer drive.mu.Unlock()
+	if detached(dir) {
+		return nil, fmt.Errorf("cannot create %s: folder deleted", name)
+	}
+	if err := drive.beginWrite(); err != nil {
+		return nil, err
+	}
+	defer drive.endWrite()
+	content, err := contentOf(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := content[name]; found {
+		return nil, fmt.Errorf("entry %s already exists at %s", name, pathOf(dir) + "/")
 	}
 	parentId := dir.CatalogId()
 	if dir.IsDrive() {
 		// Override if we're putting it in a drive
 		parentId = -1
 	}
-	drive := dir.Drive()
 	dirId, err := drive.createDirectory(name, parentId)
 	if err != nil {
 		return nil, err
 	}
-	dirObj := &vfs_dir{name, make(map[string]VirtualFS), dir, dirId}
-	dir.SetContent(name, dirObj)
+	dirObj := &vfs_dir{name, make(map[string]VirtualFS), dir, dirId, drive}
+	content[name] = dirObj
 	return dirObj, nil
 }
 
+// Update the storage metadata of a file, along with that of every other
+// file of the drive sharing its storage object.
+func UpdateMetadata(fileObj VirtualFS, metadata string) error {
+	file, ok := fileObj.(*vfs_file)
+	if !ok {
+		return fmt.Errorf("not a file: %s", fileObj.Path())
+	}
+	drive := file.drive
+	drive.mu.Lock()
+	defer drive.mu.Unlock()
+	if detached(file) {
+		return fmt.Errorf("cannot update metadata of %s: deleted", file.name)
+	}
+	if err := drive.beginWrite(); err != nil {
+		return err
+	}
+	defer drive.endWrite()
+	if err := drive.updateObjectMetadata(file.uuid, metadata); err != nil {
+		return err
+	}
+	file.metadata = metadata
+	for _, sharing := range drive.index()[file.uuid] {
+		sharing.metadata = metadata
+	}
+	return nil
+}
+
+// Point a file to a new storage object `uuid` holding its updated content.
+// Storage objects are never updated in place, since they may be shared by
+// several files (copy-on-write): the old object is released, and deleted
+// from storage if no other file of the drive still refers to it.
+func ReplaceContent(fileObj VirtualFS, uuid string, metadata string, size int64, hash string) error {
+	file, ok := fileObj.(*vfs_file)
+	if !ok {
+		return fmt.Errorf("not a file: %s", fileObj.Path())
+	}
+	file.drive.mu.Lock()
+	defer file.drive.mu.Unlock()
+	if detached(file) {
+		return fmt.Errorf("cannot replace content of %s: deleted", file.name)
+	}
+	if uuid == file.uuid {
+		return fmt.Errorf("content of %s must be stored under a new UUID", pathOf(file))
+	}
+	if err := file.drive.beginWrite(); err != nil {
+		return err
+	}
+	defer file.drive.endWrite()
+	now := time.Now()
+	if err := file.drive.updateFileContent(file.id, uuid, now, metadata, size, hash); err != nil {
+		return err
+	}
+	oldUUID, oldMetadata := file.uuid, file.metadata
+	file.drive.unindexFile(file)
+	file.uuid = uuid
+	file.metadata = metadata
+	file.size = size
+	file.hash = hash
+	file.updated = now
+	file.drive.indexFile(file)
+	return release(file.drive, oldUUID, oldMetadata)
+}
+
+// Delete storage object `uuid` once no file of the drive refers to it.
+// Must be called with the lock of the drive held, so that no file starts
+// referring to the object in the meantime.
+func release(drive Drive, uuid string, metadata string) error {
+	count, err := drive.countReferences(uuid)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if err := drive.Storage().DeleteFile(uuid, metadata); err != nil {
+		return fmt.Errorf("deleting object %s: %w", uuid, err)
+	}
+	return nil
+}
+
+// Returned by the visit function of Walk to skip the content of a folder.
+var SkipDir = errors.New("skip this folder")
+
+// Call `visit` on `vfs` and everything below it, parents before children.
+// Entries of a folder are visited in name order.
+func Walk(vfs VirtualFS, visit func(VirtualFS) error) error {
+	if err := visit(vfs); err == SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if vfs.IsFile() {
+		return nil
+	}
+	names, err := vfs.ContentList()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, found, err := vfs.GetContent(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if err := Walk(sub, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ExpandPaths(cat VirtualFS, paths []string) ([]string, error) {
 	result := make([]string, 0)
 	for _, path := range paths {
@@ -304,9 +556,16 @@ func ExpandPaths(cat VirtualFS, paths []string) ([]string, error) {
 					globbing = true
 					regex := strings.Replace(regexp.QuoteMeta(component), "\\*", ".*", -1)
 					r, _ := regexp.Compile("^" + regex + "$")
-					for _, content := range curr.ContentList() {
+					names, err := curr.ContentList()
+					if err != nil {
+						return nil, err
+					}
+					for _, content := range names {
 						if r.MatchString(content) {
-							newCurr, found := curr.GetContent(content)
+							newCurr, found, err := curr.GetContent(content)
+							if err != nil {
+								return nil, err
+							}
 							if !found {
 								// Wait - what?
 								continue
@@ -322,7 +581,10 @@ func ExpandPaths(cat VirtualFS, paths []string) ([]string, error) {
 						}
 						return nil, fmt.Errorf("not a folder: %s", curr.Name())
 					}
-					newCurr, found := curr.GetContent(component)
+					newCurr, found, err := curr.GetContent(component)
+					if err != nil {
+						return nil, err
+					}
 					if !found {
 						if globbing {
 							// Skip.
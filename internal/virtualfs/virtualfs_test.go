@@ -0,0 +1,570 @@
+
+package virtualfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+const testUUID = "7b5d41cc-86d6-11ec-a8a3-0242ac120002"
+
+func mustDir(t *testing.T, parent virtualfs.VirtualFS, name string) virtualfs.VirtualFS {
+	t.Helper()
+	dir, err := virtualfs.CreateDirectory(parent, name)
+	if err != nil {
+		t.Fatalf("CreateDirectory(%s): %v", name, err)
+	}
+	return dir
+}
+
+func mustFile(t *testing.T, parent virtualfs.VirtualFS, name string) virtualfs.VirtualFS {
+	t.Helper()
+	file, err := virtualfs.CreateFile(parent, name, testUUID, "", -1, "")
+	if err != nil {
+		t.Fatalf("CreateFile(%s): %v", name, err)
+	}
+	return file
+}
+
+func names(t *testing.T, dir virtualfs.VirtualFS) []string {
+	t.Helper()
+	result, err := dir.ContentList()
+	if err != nil {
+		t.Fatalf("ContentList: %v", err)
+	}
+	return result
+}
+
+func findPaths(t *testing.T, dir virtualfs.VirtualFS, search string) []string {
+	t.Helper()
+	results, err := dir.Find(search)
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	return paths(results)
+}
+
+func paths(objs []virtualfs.VirtualFS) []string {
+	result := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		result = append(result, obj.Path())
+	}
+	sort.Strings(result)
+	return result
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCreateAndNavigate(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	top := env.Root.AsVirtualFS()
+	drive, err := virtualfs.NavigateDirectory(top, "/alpha")
+	if err != nil {
+		t.Fatalf("NavigateDirectory: %v", err)
+	}
+	docs := mustDir(t, drive, "docs")
+	mustFile(t, docs, "a.txt")
+
+	file, err := virtualfs.NavigateFile(top, "/alpha/docs/a.txt")
+	if err != nil {
+		t.Fatalf("NavigateFile: %v", err)
+	}
+	if file.Path() != "/alpha/docs/a.txt" {
+		t.Errorf("Path() = %q", file.Path())
+	}
+	if file.AsFile().UUID() != testUUID {
+		t.Errorf("UUID() = %q", file.AsFile().UUID())
+	}
+	if _, err := virtualfs.NavigateDirectory(docs, "a.txt"); err == nil {
+		t.Errorf("NavigateDirectory on a file should fail")
+	}
+	if _, err := virtualfs.NavigateFile(docs, ".."); err == nil {
+		t.Errorf("NavigateFile on a folder should fail")
+	}
+	if _, err := virtualfs.NavigatePath(docs, "missing"); err == nil {
+		t.Errorf("NavigatePath on a missing entry should fail")
+	}
+	obj, err := virtualfs.CheckPath(docs, "missing")
+	if err != nil || obj != nil {
+		t.Errorf("CheckPath(missing) = %v, %v", obj, err)
+	}
+	if _, err := virtualfs.CreateFile(docs, "a.txt", testUUID, "", -1, ""); err == nil {
+		t.Errorf("CreateFile on an existing name should fail")
+	}
+	if _, err := virtualfs.CreateDirectory(top, "beta"); err == nil {
+		t.Errorf("CreateDirectory in root should fail")
+	}
+}
+
+func TestCatalogPersistence(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	drive, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	docs := mustDir(t, drive, "docs")
+	sub := mustDir(t, docs, "sub")
+	mustFile(t, sub, "a.txt")
+	mustFile(t, drive, "b.txt")
+
+	root := env.Reload(t)
+	for _, path := range []string{"/alpha/docs/sub/a.txt", "/alpha/b.txt"} {
+		if _, err := virtualfs.NavigateFile(root.AsVirtualFS(), path); err != nil {
+			t.Errorf("NavigateFile(%s) after reload: %v", path, err)
+		}
+	}
+	count, err := drive.CountFiles()
+	if err != nil || count != 2 {
+		t.Errorf("CountFiles() = %d, %v", count, err)
+	}
+	count, err = docs.CountFiles()
+	if err != nil || count != 1 {
+		t.Errorf("CountFiles(docs) = %d, %v", count, err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	env := vhdtest.New(t, "alpha", "beta")
+	top := env.Root.AsVirtualFS()
+	alpha, _ := virtualfs.NavigateDirectory(top, "/alpha")
+	beta, _ := virtualfs.NavigateDirectory(top, "/beta")
+	docs := mustDir(t, alpha, "docs")
+	sub := mustDir(t, docs, "sub")
+	file := mustFile(t, alpha, "a.txt")
+
+	if err := file.Move(docs, "b.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if file.Path() != "/alpha/docs/b.txt" {
+		t.Errorf("Path() after move = %q", file.Path())
+	}
+	if _, found, _ := alpha.GetContent("a.txt"); found {
+		t.Errorf("a.txt still present in source folder")
+	}
+	if err := docs.Move(sub, "docs"); err == nil {
+		t.Errorf("moving a folder into its descendant should fail")
+	}
+	if err := file.Move(beta, "b.txt"); err == nil {
+		t.Errorf("moving a file across drives should fail")
+	}
+	if err := file.Move(top, "b.txt"); err == nil {
+		t.Errorf("moving a file to root should fail")
+	}
+	if err := sub.Move(alpha, "docs"); err == nil {
+		t.Errorf("moving onto an existing name should fail")
+	}
+	if err := sub.Move(alpha, "sub"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+
+	root := env.Reload(t)
+	for _, path := range []string{"/alpha/docs/b.txt", "/alpha/sub/"} {
+		if _, err := virtualfs.NavigatePath(root.AsVirtualFS(), path); err != nil {
+			t.Errorf("NavigatePath(%s) after reload: %v", path, err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	env := vhdtest.New(t, "alpha", "beta")
+	top := env.Root.AsVirtualFS()
+	alpha, _ := virtualfs.NavigateDirectory(top, "/alpha")
+	beta, _ := virtualfs.NavigateDirectory(top, "/beta")
+	photos := mustDir(t, alpha, "Photos")
+	mustFile(t, photos, "holiday.jpg")
+	mustFile(t, beta, "photo.png")
+	mustFile(t, beta, "notes.txt")
+
+	got := findPaths(t, top, "photo")
+	want := []string{"/alpha/Photos/", "/beta/photo.png"}
+	if !equalStrings(got, want) {
+		t.Errorf("Find(photo) = %v, want %v", got, want)
+	}
+	got = findPaths(t, beta, "txt")
+	want = []string{"/beta/notes.txt"}
+	if !equalStrings(got, want) {
+		t.Errorf("Find(txt) = %v, want %v", got, want)
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	docs := mustDir(t, alpha, "docs")
+	mustFile(t, docs, "a.txt")
+	mustFile(t, docs, "b.txt")
+	mustFile(t, docs, "c.jpg")
+
+	got, err := virtualfs.ExpandPaths(alpha, []string{"docs/*.txt"})
+	if err != nil {
+		t.Fatalf("ExpandPaths: %v", err)
+	}
+	sort.Strings(got)
+	want := []string{"/alpha/docs/a.txt", "/alpha/docs/b.txt"}
+	if !equalStrings(got, want) {
+		t.Errorf("ExpandPaths = %v, want %v", got, want)
+	}
+	if _, err := virtualfs.ExpandPaths(alpha, []string{"missing/*.txt"}); err == nil {
+		t.Errorf("ExpandPaths through a missing folder should fail")
+	}
+}
+
+// Meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	env := vhdtest.New(t, "alpha", "beta")
+	env.PutFile(t, "/alpha/shared.txt", "shared")
+	// A fresh root, so that drives are loaded concurrently.
+	top := env.Reload(t).AsVirtualFS()
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers * 10)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			alpha, err := virtualfs.NavigateDirectory(top, "/alpha")
+			if err != nil {
+				errs <- err
+				return
+			}
+			dir, err := virtualfs.CreateDirectory(alpha, fmt.Sprintf("dir%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 5; j++ {
+				name := fmt.Sprintf("file%d-%d", i, j)
+				if _, err := virtualfs.CreateFile(dir, name, testUUID, "", -1, ""); err != nil {
+					errs <- err
+				}
+			}
+			shared, err := virtualfs.NavigateFile(top, "/alpha/shared.txt")
+			if err != nil {
+				errs <- err
+				return
+			}
+			copied, err := virtualfs.Copy(shared, dir, "copy.txt")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := copied.Move(alpha, fmt.Sprintf("moved%d.txt", i)); err != nil {
+				errs <- err
+			}
+			if i % 2 == 0 {
+				if err := virtualfs.Delete(dir); err != nil {
+					errs <- err
+				}
+			} else if err := dir.Move(top.Root(), "x"); err == nil {
+				errs <- fmt.Errorf("moving to root should fail")
+			}
+			// Readers.
+			entries, _ := alpha.ContentList()
+			for _, name := range entries {
+				if sub, found, _ := alpha.GetContent(name); found {
+					sub.Path()
+				}
+			}
+			top.Find("file")
+			virtualfs.Walk(top, func(vfs virtualfs.VirtualFS) error {
+				if file := vfs.AsFile(); file != nil {
+					file.UUID()
+					file.Metadata()
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent operation: %v", err)
+	}
+
+	// The tree matches the catalog.
+	var want, got []string
+	collect := func(paths *[]string) func(virtualfs.VirtualFS) error {
+		return func(vfs virtualfs.VirtualFS) error {
+			*paths = append(*paths, vfs.Path())
+			return nil
+		}
+	}
+	virtualfs.Walk(top, collect(&got))
+	virtualfs.Walk(env.Reload(t).AsVirtualFS(), collect(&want))
+	if !equalStrings(got, want) {
+		t.Errorf("tree = %v\ncatalog = %v", got, want)
+	}
+	alpha, _ := virtualfs.NavigateDirectory(top, "/alpha")
+	// shared.txt, workers/2 folders, and workers moved copies.
+	if n := len(names(t, alpha)); n != 1 + workers / 2 + workers {
+		t.Errorf("%d entries in /alpha", n)
+	}
+}
+
+func TestDeletedEntries(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	docs := mustDir(t, alpha, "docs")
+	file := mustFile(t, docs, "a.txt")
+	if err := virtualfs.Delete(docs); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	// Operations racing with the deletion fail rather than resurrect entries.
+	if _, err := virtualfs.CreateFile(docs, "b.txt", testUUID, "", -1, ""); err == nil {
+		t.Errorf("CreateFile in deleted folder should fail")
+	}
+	if err := file.Move(alpha, "a.txt"); err == nil {
+		t.Errorf("Move of deleted file should fail")
+	}
+	if _, err := virtualfs.Copy(file, alpha, "a.txt"); err == nil {
+		t.Errorf("Copy of deleted file should fail")
+	}
+	if err := virtualfs.Delete(file); err == nil {
+		t.Errorf("Delete of deleted file should fail")
+	}
+	if entries := names(t, alpha); len(entries) != 0 {
+		t.Errorf("/alpha = %v", entries)
+	}
+}
+
+func TestStaleDrive(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	// Two sessions on the same catalog.
+	other := env.Reload(t)
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	docs := mustDir(t, alpha, "docs")
+	otherAlpha, _ := virtualfs.NavigateDirectory(other.AsVirtualFS(), "/alpha")
+	otherDocs, _ := virtualfs.NavigateDirectory(otherAlpha, "docs")
+	mustFile(t, otherDocs, "a.txt")
+
+	// Own writes do not make a drive stale.
+	if dropped, err := other.Refresh(); err != nil || len(dropped) != 0 {
+		t.Errorf("Refresh = %v, %v", dropped, err)
+	}
+
+	// Writes to a stale drive are refused, and the drive reloaded.
+	if _, err := virtualfs.CreateFile(docs, "a.txt", testUUID, "", -1, ""); !errors.Is(err, virtualfs.ErrStale) {
+		t.Errorf("CreateFile on stale drive: %v", err)
+	}
+	if _, err := virtualfs.NavigateFile(env.Root.AsVirtualFS(), "/alpha/docs/a.txt"); err != nil {
+		t.Errorf("reloaded drive: %v", err)
+	}
+	if _, err := virtualfs.CreateDirectory(docs, "sub"); err == nil {
+		t.Errorf("CreateDirectory in entry of dropped tree should fail")
+	}
+	docs, _ = virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha/docs")
+	mustFile(t, docs, "b.txt")
+
+	// Refresh drops stale drives without a write.
+	dropped, err := other.Refresh()
+	if err != nil || len(dropped) != 1 || dropped[0] != "alpha" {
+		t.Errorf("Refresh = %v, %v", dropped, err)
+	}
+	if _, err := virtualfs.NavigateFile(other.AsVirtualFS(), "/alpha/docs/b.txt"); err != nil {
+		t.Errorf("refreshed drive: %v", err)
+	}
+}
+
+// Catalog recording which folders are loaded.
+type recordingCatalog struct {
+	catalog.Catalog
+	mu sync.Mutex
+	folders []int
+	drives int
+}
+
+func (c *recordingCatalog) FetchDirectoryContent(driveId int, dirId int) (map[int]catalog.DirectoryDescriptor, map[int]catalog.FileDescriptor, error) {
+	c.mu.Lock()
+	c.folders = append(c.folders, dirId)
+	c.mu.Unlock()
+	return c.Catalog.FetchDirectoryContent(driveId, dirId)
+}
+
+func (c *recordingCatalog) FetchDirectories(driveId int) (map[int]catalog.DirectoryDescriptor, error) {
+	c.mu.Lock()
+	c.drives++
+	c.mu.Unlock()
+	return c.Catalog.FetchDirectories(driveId)
+}
+
+func TestLazyLoading(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	a := mustDir(t, alpha, "a")
+	b := mustDir(t, a, "b")
+	mustFile(t, b, "c.txt")
+	d := mustDir(t, alpha, "d")
+	mustFile(t, d, "e.txt")
+	mustFile(t, alpha, "f.txt")
+
+	// Only the folders on the way are loaded.
+	cat := &recordingCatalog{Catalog: env.Catalog}
+	root := env.ReloadFrom(t, cat)
+	b, err := virtualfs.NavigateDirectory(root.AsVirtualFS(), "/alpha/a/b")
+	if err != nil {
+		t.Fatalf("NavigateDirectory: %v", err)
+	}
+	if entries := names(t, b); !equalStrings(entries, []string{"c.txt"}) {
+		t.Errorf("/alpha/a/b = %v", entries)
+	}
+	if len(cat.folders) != 3 || cat.drives != 0 {
+		t.Errorf("loaded folders %v and %d whole drives, want 3 folders", cat.folders, cat.drives)
+	}
+	b.ContentList()
+	if len(cat.folders) != 3 {
+		t.Errorf("loaded folders %v again", cat.folders)
+	}
+
+	// Find loads whatever it needs.
+	if got := findPaths(t, root.AsVirtualFS(), "txt"); !equalStrings(got, []string{"/alpha/a/b/c.txt", "/alpha/d/e.txt", "/alpha/f.txt"}) {
+		t.Errorf("Find = %v", got)
+	}
+
+	// Writes to folders not loaded yet.
+	root = env.ReloadFrom(t, cat)
+	f, _ := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/f.txt")
+	d, _ = virtualfs.NavigateDirectory(root.AsVirtualFS(), "/alpha/d")
+	if err := f.Move(d, "e.txt"); err == nil {
+		t.Errorf("Move onto existing entry of folder not loaded should fail")
+	}
+	if err := virtualfs.Delete(d); err != nil {
+		t.Fatalf("Delete of folder not loaded: %v", err)
+	}
+	if count, _ := alpha.CountFiles(); count != 2 {
+		t.Errorf("files left = %d, want 2", count)
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	mustFile(t, mustDir(t, alpha, "a"), "b.txt")
+	mustFile(t, mustDir(t, alpha, "c"), "d.txt")
+	mustFile(t, alpha, "e.txt")
+	mustFile(t, alpha, "f.txt")
+
+	root := env.ReloadFrom(t, env.Catalog)
+	b, _ := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/a/b.txt")
+	e, _ := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/e.txt")
+	f, _ := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/f.txt")
+	if err := virtualfs.ReplaceContent(f, "other-uuid", "", -1, ""); err != nil {
+		t.Fatalf("ReplaceContent: %v", err)
+	}
+	if err := virtualfs.UpdateMetadata(b, "new"); err != nil {
+		t.Fatalf("UpdateMetadata: %v", err)
+	}
+	if b.AsFile().Metadata() != "new" || e.AsFile().Metadata() != "new" {
+		t.Errorf("metadata of loaded files = %q %q", b.AsFile().Metadata(), e.AsFile().Metadata())
+	}
+	if f.AsFile().Metadata() != "" {
+		t.Errorf("metadata of file with other content = %q", f.AsFile().Metadata())
+	}
+	// Folders loaded afterwards get the metadata from the catalog.
+	d, _ := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/c/d.txt")
+	if d.AsFile().Metadata() != "new" {
+		t.Errorf("metadata of file loaded later = %q", d.AsFile().Metadata())
+	}
+}
+
+// Catalog failing to load folders.
+type failingCatalog struct {
+	catalog.Catalog
+	content bool         // Whether loading folders fails.
+	version bool         // Whether reading the version of drives fails.
+}
+
+func (c *failingCatalog) DriveVersion(driveId int) (int64, error) {
+	if c.version {
+		return 0, errors.New("injected fault")
+	}
+	return c.Catalog.DriveVersion(driveId)
+}
+
+func (c *failingCatalog) FetchDirectoryContent(driveId int, dirId int) (map[int]catalog.DirectoryDescriptor, map[int]catalog.FileDescriptor, error) {
+	if c.content {
+		return nil, nil, errors.New("injected fault")
+	}
+	return c.Catalog.FetchDirectoryContent(driveId, dirId)
+}
+
+func TestLoadingErrors(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha, _ := virtualfs.NavigateDirectory(env.Root.AsVirtualFS(), "/alpha")
+	mustFile(t, mustDir(t, alpha, "a"), "b.txt")
+
+	root := env.ReloadFrom(t, &failingCatalog{env.Catalog, true, false})
+	alpha, _, _ = root.AsVirtualFS().GetContent("alpha")
+	if _, err := alpha.ContentList(); err == nil {
+		t.Errorf("ContentList of folder failing to load should fail")
+	}
+	if _, _, err := alpha.GetContent("a"); err == nil {
+		t.Errorf("GetContent of folder failing to load should fail")
+	}
+	if _, err := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/a/b.txt"); err == nil {
+		t.Errorf("NavigateFile through folder failing to load should fail")
+	}
+	if _, err := alpha.Find("b"); err == nil {
+		t.Errorf("Find in folder failing to load should fail")
+	}
+
+	// The drive itself cannot be loaded, until the catalog recovers.
+	failing := &failingCatalog{env.Catalog, false, true}
+	root = env.ReloadFrom(t, failing)
+	alpha, _, _ = root.AsVirtualFS().GetContent("alpha")
+	if _, err := alpha.ContentList(); err == nil {
+		t.Errorf("ContentList of drive failing to load should fail")
+	}
+	if _, err := virtualfs.CreateDirectory(alpha, "c"); err == nil {
+		t.Errorf("CreateDirectory in drive failing to load should fail")
+	}
+	failing.version = false
+	if _, err := virtualfs.NavigateFile(root.AsVirtualFS(), "/alpha/a/b.txt"); err != nil {
+		t.Errorf("NavigateFile once the catalog recovers: %v", err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	env := vhdtest.New(t)
+	if _, err := env.Catalog.CreateDrive("local", "", "local", t.TempDir()); err != nil {
+		t.Fatalf("CreateDrive: %v", err)
+	}
+	settings := filepath.Join(env.Dir, util.CONFIG_FOLDER, util.CONFIG_SETTINGS)
+	if err := os.WriteFile(settings, []byte("drives:\n  local:\n    preload: true\n"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	root, err := virtualfs.NewRoot(env.Catalog)
+	if err != nil {
+		t.Fatalf("NewRoot: %v", err)
+	}
+	local, _ := virtualfs.NavigateDirectory(root.AsVirtualFS(), "/local")
+	mustFile(t, mustDir(t, mustDir(t, local, "a"), "b"), "c.txt")
+
+	cat := &recordingCatalog{Catalog: env.Catalog}
+	root, err = virtualfs.NewRoot(cat)
+	if err != nil {
+		t.Fatalf("NewRoot: %v", err)
+	}
+	if _, err := virtualfs.NavigateFile(root.AsVirtualFS(), "/local/a/b/c.txt"); err != nil {
+		t.Errorf("NavigateFile: %v", err)
+	}
+	if len(cat.folders) != 0 || cat.drives != 1 {
+		t.Errorf("loaded folders %v and %d whole drives, want 1 drive", cat.folders, cat.drives)
+	}
+}
@@ -0,0 +1,47 @@
+
+package vhd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Errors returned by the library are *PathError values wrapping one of
+// the errors below, or a *StorageError when a drive's storage fails, so
+// that they can be told apart with errors.Is and errors.As. The first
+// four are those of io/fs.
+
+var (
+	ErrNotExist = fs.ErrNotExist
+	ErrExist = fs.ErrExist
+	ErrPermission = fs.ErrPermission      // Such as creating, moving or deleting a drive.
+	ErrInvalid = fs.ErrInvalid            // Invalid path or name.
+	ErrNotDir = errors.New("not a folder")
+	ErrIsDir = errors.New("is a folder")
+	ErrNotEmpty = errors.New("folder not empty")
+	// The drive was changed by another process sharing the catalog. The
+	// drive is reloaded, and the operation can be retried.
+	ErrStale = virtualfs.ErrStale
+)
+
+type PathError = fs.PathError
+
+type StorageError struct {
+	Drive string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage of drive %s: %v", e.Drive, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+func pathError(op string, path string, err error) error {
+	return &PathError{Op: op, Path: path, Err: err}
+}
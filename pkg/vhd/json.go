@@ -0,0 +1,79 @@
+
+package vhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JSON form of entries, as returned by the HTTP API of the vhd tool and by
+// find -format json. Folder paths end with a /, as in the rest of vhd.
+
+type jsonEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`                   // "root", "drive", "folder" or "file".
+	Size *int64 `json:"size,omitempty"`         // Files only, when known.
+	Hash string `json:"hash,omitempty"`         // CRC32C, files only, when known.
+	UUID string `json:"uuid,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+var kindNames = map[Kind]string{
+	KindRoot: "root",
+	KindDrive: "drive",
+	KindFolder: "folder",
+	KindFile: "file",
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	entry := jsonEntry{Name: e.Name, Path: e.Path, Type: kindNames[e.Kind]}
+	switch e.Kind {
+	case KindDrive, KindFolder:
+		entry.Path += "/"
+	case KindFile:
+		if e.Size >= 0 {
+			size := e.Size
+			entry.Size = &size
+		}
+		entry.Hash = e.Hash
+		entry.UUID = e.UUID
+		created, updated := e.Created, e.Updated
+		entry.Created = &created
+		entry.Updated = &updated
+	}
+	return json.Marshal(entry)
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var entry jsonEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	kind, found := Kind(0), false
+	for k, name := range kindNames {
+		if name == entry.Type {
+			kind, found = k, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown entry type %q", entry.Type)
+	}
+	*e = Entry{Name: entry.Name, Path: entry.Path, Kind: kind, Size: -1, Hash: entry.Hash, UUID: entry.UUID}
+	if kind != KindRoot {
+		e.Path = strings.TrimSuffix(e.Path, "/")
+	}
+	if entry.Size != nil {
+		e.Size = *entry.Size
+	}
+	if entry.Created != nil {
+		e.Created = *entry.Created
+	}
+	if entry.Updated != nil {
+		e.Updated = *entry.Updated
+	}
+	return nil
+}
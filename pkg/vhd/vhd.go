@@ -0,0 +1,438 @@
+
+package vhd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"rpucella.net/virtual-hard-drive/internal/catalog"
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/util"
+	"rpucella.net/virtual-hard-drive/internal/vhdlink"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+	"rpucella.net/virtual-hard-drive/pkg/vhdfs"
+)
+
+// Library access to the drives of a catalog, sharing the catalog and
+// storage layout with the vhd tool.
+// Paths are absolute, /drive/folder/file. A Client can be used from
+// several goroutines. Uploads and downloads stream data without blocking
+// other operations.
+
+type Client struct {
+	root virtualfs.Root
+}
+
+type DriveInfo struct {
+	Name string
+	Description string
+}
+
+type Kind int
+
+const (
+	KindRoot Kind = iota
+	KindDrive
+	KindFolder
+	KindFile
+)
+
+type Entry struct {
+	Name string
+	Path string
+	Kind Kind
+	// Files only.
+	Size int64             // -1 if unknown.
+	Hash string            // CRC32C of the content, "" if unknown.
+	UUID string            // Storage object holding the content.
+	Created time.Time
+	Updated time.Time
+}
+
+func (e Entry) IsDir() bool {
+	return e.Kind != KindFile
+}
+
+// Open the catalog in database file `catalogPath`, or the default catalog
+// ~/.vhd/catalog.db if `catalogPath` is empty. Drive settings are read
+// from ~/.vhd/config.yaml.
+func Open(catalogPath string) (*Client, error) {
+	var cat catalog.Catalog
+	if catalogPath == "" {
+		c, err := catalog.Load()
+		if err != nil {
+			return nil, err
+		}
+		cat = c
+	} else {
+		if _, err := os.Stat(catalogPath); err != nil {
+			return nil, err
+		}
+		cat = catalog.Open(catalogPath)
+	}
+	root, err := virtualfs.NewRoot(cat)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read catalog: %w", err)
+	}
+	return newClient(root), nil
+}
+
+// Client over a tree already loaded by the vhd tool, so that its servers
+// share the tree with the rest of the session. Reached through vhdlink.
+func newClient(root virtualfs.Root) *Client {
+	return &Client{root: root}
+}
+
+func init() {
+	vhdlink.NewClient = func(root virtualfs.Root) interface{} {
+		return newClient(root)
+	}
+	vhdlink.NewEntry = func(vfs virtualfs.VirtualFS) interface{} {
+		return newEntry(vfs)
+	}
+}
+
+// Reload the drives changed in the catalog by other processes, such as the
+// vhd tool, since they were read. Without it, a Client sees the drives as
+// they were when first used, and writes to changed drives fail with
+// ErrStale.
+func (c *Client) Refresh() error {
+	if _, err := c.root.Refresh(); err != nil {
+		return fmt.Errorf("cannot check catalog: %w", err)
+	}
+	return nil
+}
+
+// Drives of the catalog, sorted by name.
+func (c *Client) Drives() []DriveInfo {
+	drives := make([]DriveInfo, 0, len(c.root.Drives()))
+	for _, drive := range c.root.Drives() {
+		drives = append(drives, DriveInfo{drive.Name(), drive.Description()})
+	}
+	sort.Slice(drives, func(i int, j int) bool {
+		return drives[i].Name < drives[j].Name
+	})
+	return drives
+}
+
+// Entry describing `vfs`.
+func newEntry(vfs virtualfs.VirtualFS) Entry {
+	entry := Entry{Name: vfs.Name(), Path: strings.TrimSuffix(vfs.Path(), "/"), Size: -1}
+	switch {
+	case vfs.IsRoot():
+		entry.Kind = KindRoot
+		entry.Path = "/"
+	case vfs.IsDrive():
+		entry.Kind = KindDrive
+	case vfs.IsDir():
+		entry.Kind = KindFolder
+	default:
+		file := vfs.AsFile()
+		entry.Kind = KindFile
+		entry.Size = file.Size()
+		entry.Hash = file.Hash()
+		entry.UUID = file.UUID()
+		entry.Created = file.Created()
+		entry.Updated = file.Updated()
+	}
+	return entry
+}
+
+// Find the entry at absolute path `p`.
+func (c *Client) lookup(op string, p string) (virtualfs.VirtualFS, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, pathError(op, p, ErrInvalid)
+	}
+	curr := c.root.AsVirtualFS()
+	for _, component := range strings.Split(path.Clean(p), "/") {
+		if component == "" {
+			continue
+		}
+		if !curr.IsDir() {
+			return nil, pathError(op, p, ErrNotDir)
+		}
+		sub, found, err := curr.GetContent(component)
+		if err != nil {
+			return nil, pathError(op, p, err)
+		}
+		if !found {
+			return nil, pathError(op, p, ErrNotExist)
+		}
+		curr = sub
+	}
+	return curr, nil
+}
+
+// Find the folder that would hold absolute path `p`, along with the final
+// path element.
+func (c *Client) lookupParent(op string, p string) (virtualfs.VirtualFS, string, error) {
+	if !strings.HasPrefix(p, "/") || path.Clean(p) == "/" {
+		return nil, "", pathError(op, p, ErrInvalid)
+	}
+	clean := path.Clean(p)
+	parent, err := c.lookup(op, path.Dir(clean))
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.IsDir() {
+		return nil, "", pathError(op, p, ErrNotDir)
+	}
+	if parent.IsRoot() {
+		return nil, "", pathError(op, p, ErrPermission)
+	}
+	name := path.Base(clean)
+	if err := virtualfs.ValidateName(name); err != nil {
+		return nil, "", pathError(op, p, fmt.Errorf("%w: %v", ErrInvalid, err))
+	}
+	return parent, name, nil
+}
+
+func (c *Client) Stat(p string) (Entry, error) {
+	vfs, err := c.lookup("stat", p)
+	if err != nil {
+		return Entry{}, err
+	}
+	return newEntry(vfs), nil
+}
+
+// Entries of folder `p`, sorted by name.
+func (c *Client) List(p string) ([]Entry, error) {
+	dir, err := c.lookup("list", p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.IsDir() {
+		return nil, pathError("list", p, ErrNotDir)
+	}
+	names, err := dir.ContentList()
+	if err != nil {
+		return nil, pathError("list", p, err)
+	}
+	sort.Strings(names)
+	entries := make([]Entry, 0, len(names))
+	for _, name := range names {
+		sub, found, err := dir.GetContent(name)
+		if err != nil {
+			return nil, pathError("list", p, err)
+		}
+		if !found {
+			continue
+		}
+		entries = append(entries, newEntry(sub))
+	}
+	return entries, nil
+}
+
+func (c *Client) Mkdir(p string) (Entry, error) {
+	parent, name, err := c.lookupParent("mkdir", p)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, found, err := parent.GetContent(name); err != nil {
+		return Entry{}, pathError("mkdir", p, err)
+	} else if found {
+		return Entry{}, pathError("mkdir", p, ErrExist)
+	}
+	dir, err := virtualfs.CreateDirectory(parent, name)
+	if err != nil {
+		return Entry{}, pathError("mkdir", p, err)
+	}
+	return newEntry(dir), nil
+}
+
+// Upload the content of `r` to file `p`, replacing the content of an
+// existing file only if `overwrite` is set. The catalog is only updated
+// once the content has been stored successfully.
+func (c *Client) Upload(p string, r io.Reader, overwrite bool) (Entry, error) {
+	check := func() (virtualfs.VirtualFS, string, virtualfs.VirtualFS, error) {
+		parent, name, err := c.lookupParent("upload", p)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		existing, found, err := parent.GetContent(name)
+		if err != nil {
+			return nil, "", nil, pathError("upload", p, err)
+		}
+		if found && existing.IsDir() {
+			return nil, "", nil, pathError("upload", p, ErrIsDir)
+		}
+		if found && !overwrite {
+			return nil, "", nil, pathError("upload", p, ErrExist)
+		}
+		return parent, name, existing, nil
+	}
+	parent, _, _, err := check()
+	if err != nil {
+		return Entry{}, err
+	}
+	drive := parent.Drive()
+	store := drive.Storage()
+	newUUID := uuid.NewString()
+	crc := util.NewCRCWriter(io.Discard)
+	counter := &countWriter{}
+	metadata, err := storage.Upload(store, io.TeeReader(r, io.MultiWriter(crc, counter)), newUUID)
+	if err != nil {
+		return Entry{}, pathError("upload", p, &StorageError{drive.Name(), err})
+	}
+	size, hash := counter.n, util.FormatHash(crc.Sum())
+
+	// The tree may have changed during the upload.
+	parent, name, existing, err := check()
+	if err == nil && parent.Drive() != drive {
+		err = pathError("upload", p, ErrNotExist)
+	}
+	if err != nil {
+		store.DeleteFile(newUUID, metadata)
+		return Entry{}, err
+	}
+	fileObj := existing
+	if existing != nil {
+		err = virtualfs.ReplaceContent(existing, newUUID, metadata, size, hash)
+	} else {
+		fileObj, err = virtualfs.CreateFile(parent, name, newUUID, metadata, size, hash)
+	}
+	if err != nil {
+		store.DeleteFile(newUUID, metadata)
+		return Entry{}, pathError("upload", p, err)
+	}
+	return newEntry(fileObj), nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// Write the content of file `p` to `w`.
+func (c *Client) Download(p string, w io.Writer) error {
+	fileObj, err := c.lookup("download", p)
+	if err == nil && fileObj.IsDir() {
+		err = pathError("download", p, ErrIsDir)
+	}
+	if err != nil {
+		return err
+	}
+	file := fileObj.AsFile()
+	drive := fileObj.Drive()
+	fileUUID, metadata := file.UUID(), file.Metadata()
+	if err := storage.Download(drive.Storage(), fileUUID, metadata, w); err != nil {
+		return pathError("download", p, &StorageError{drive.Name(), err})
+	}
+	return nil
+}
+
+// Move `from` to `to`, or into `to` if it is an existing folder, possibly
+// across drives. Returns the moved entry.
+func (c *Client) Move(from string, to string) (Entry, error) {
+	src, err := c.lookup("move", from)
+	if err != nil {
+		return Entry{}, err
+	}
+	if src.IsRoot() || src.IsDrive() {
+		return Entry{}, pathError("move", from, ErrPermission)
+	}
+	var tgtParent virtualfs.VirtualFS
+	var tgtName string
+	if tgt, err := c.lookup("move", to); err == nil && tgt.IsDir() {
+		tgtParent, tgtName = tgt, src.Name()
+	} else if err == nil {
+		return Entry{}, pathError("move", to, ErrExist)
+	} else if tgtParent, tgtName, err = c.lookupParent("move", to); err != nil {
+		return Entry{}, err
+	}
+	if tgtParent.IsRoot() {
+		return Entry{}, pathError("move", to, ErrPermission)
+	}
+	if _, found, err := tgtParent.GetContent(tgtName); err != nil {
+		return Entry{}, pathError("move", to, err)
+	} else if found {
+		return Entry{}, pathError("move", to, ErrExist)
+	}
+	for curr := tgtParent; curr != nil; curr = curr.Parent() {
+		if curr == src {
+			return Entry{}, pathError("move", to, ErrInvalid)
+		}
+	}
+	if err := src.Move(tgtParent, tgtName); err != nil {
+		return Entry{}, pathError("move", from, err)
+	}
+	// Moving across drives replaces the source by a copy.
+	moved, found, err := tgtParent.GetContent(tgtName)
+	if err == nil && !found {
+		err = ErrNotExist
+	}
+	if err != nil {
+		return Entry{}, pathError("move", to, err)
+	}
+	return newEntry(moved), nil
+}
+
+// Delete `p`, and everything it contains if `recursive` is set. Storage
+// objects are deleted once no file refers to them anymore.
+func (c *Client) Delete(p string, recursive bool) error {
+	vfs, err := c.lookup("delete", p)
+	if err != nil {
+		return err
+	}
+	if vfs.IsRoot() || vfs.IsDrive() {
+		return pathError("delete", p, ErrPermission)
+	}
+	if vfs.IsDir() && !recursive {
+		names, err := vfs.ContentList()
+		if err != nil {
+			return pathError("delete", p, err)
+		}
+		if len(names) > 0 {
+			return pathError("delete", p, ErrNotEmpty)
+		}
+	}
+	if err := virtualfs.Delete(vfs); err != nil {
+		return pathError("delete", p, err)
+	}
+	return nil
+}
+
+// Entries under `p` whose name contains `text`, ignoring case, sorted by
+// path.
+func (c *Client) Find(p string, text string) ([]Entry, error) {
+	dir, err := c.lookup("find", p)
+	if err != nil {
+		return nil, err
+	}
+	results, err := dir.Find(strings.ToLower(text))
+	if err != nil {
+		return nil, pathError("find", p, err)
+	}
+	entries := make([]Entry, 0, len(results))
+	for _, result := range results {
+		entries = append(entries, newEntry(result))
+	}
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// Read-only io/fs view of folder `p`.
+func (c *Client) FS(p string) (fs.FS, error) {
+	dir, err := c.lookup("fs", p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.IsDir() {
+		return nil, pathError("fs", p, ErrNotDir)
+	}
+	return vhdfs.New(dir), nil
+}
@@ -0,0 +1,215 @@
+
+package vhd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+)
+
+func newTestClient(t *testing.T) (*vhdtest.Env, *Client) {
+	t.Helper()
+	env := vhdtest.New(t, "alpha", "beta")
+	return env, newClient(env.Root)
+}
+
+func mustUpload(t *testing.T, c *Client, p string, content string) Entry {
+	t.Helper()
+	entry, err := c.Upload(p, strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	return entry
+}
+
+func TestOpen(t *testing.T) {
+	env := vhdtest.New(t)
+	if _, err := env.Catalog.CreateDrive("alpha", "local drive", "local", t.TempDir()); err != nil {
+		t.Fatalf("CreateDrive: %v", err)
+	}
+	c, err := Open(filepath.Join(env.Dir, "catalog.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	drives := c.Drives()
+	if len(drives) != 1 || drives[0].Name != "alpha" {
+		t.Errorf("Drives = %v", drives)
+	}
+	if _, err := c.Upload("/alpha/a.txt", strings.NewReader("content a"), false); err != nil {
+		t.Errorf("Upload: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := c.Download("/alpha/a.txt", &buf); err != nil || buf.String() != "content a" {
+		t.Errorf("Download = %q, %v", buf.String(), err)
+	}
+	if _, err := Open(filepath.Join(env.Dir, "missing.db")); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Open of missing catalog: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(env.Dir, "missing.db")); err == nil {
+		t.Errorf("Open of missing catalog created it")
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	env, c := newTestClient(t)
+	if _, err := c.Mkdir("/alpha/docs"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	entry := mustUpload(t, c, "/alpha/docs/a.txt", "content a")
+	if entry.Kind != KindFile || entry.Path != "/alpha/docs/a.txt" || entry.Size != 9 || entry.Hash == "" {
+		t.Errorf("Upload = %+v", entry)
+	}
+	var buf bytes.Buffer
+	if err := c.Download("/alpha/docs/a.txt", &buf); err != nil || buf.String() != "content a" {
+		t.Errorf("Download = %q, %v", buf.String(), err)
+	}
+	if _, err := c.Upload("/alpha/docs/a.txt", strings.NewReader("new"), false); !errors.Is(err, ErrExist) {
+		t.Errorf("Upload over existing file: %v", err)
+	}
+	replaced, err := c.Upload("/alpha/docs/a.txt", strings.NewReader("new"), true)
+	if err != nil || replaced.UUID == entry.UUID || replaced.Size != 3 {
+		t.Errorf("Upload with overwrite = %+v, %v", replaced, err)
+	}
+	if env.Memory["alpha"].Object(entry.UUID) != nil {
+		t.Errorf("old content not deleted")
+	}
+
+	if _, err := c.Upload("/alpha/docs", strings.NewReader("x"), true); !errors.Is(err, ErrIsDir) {
+		t.Errorf("Upload over folder: %v", err)
+	}
+	if _, err := c.Upload("/alpha/missing/b.txt", strings.NewReader("x"), false); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Upload to missing folder: %v", err)
+	}
+	if _, err := c.Upload("/gamma", strings.NewReader("x"), false); !errors.Is(err, ErrPermission) {
+		t.Errorf("Upload to root: %v", err)
+	}
+	if _, err := c.Upload("alpha/b.txt", strings.NewReader("x"), false); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Upload to relative path: %v", err)
+	}
+	if err := c.Download("/alpha/docs", &buf); !errors.Is(err, ErrIsDir) {
+		t.Errorf("Download of folder: %v", err)
+	}
+
+	env.Faulty["alpha"].SetFaults(storage.Faults{UploadFailureRate: 1, DownloadFailureRate: 1})
+	_, err = c.Upload("/alpha/b.txt", strings.NewReader("b"), false)
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) || storageErr.Drive != "alpha" {
+		t.Errorf("Upload with failing storage: %v", err)
+	}
+	if _, err := c.Stat("/alpha/b.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("failed upload added to catalog: %v", err)
+	}
+	if err := c.Download("/alpha/docs/a.txt", &buf); !errors.As(err, &storageErr) {
+		t.Errorf("Download with failing storage: %v", err)
+	}
+}
+
+func TestMoveDeleteFind(t *testing.T) {
+	env, c := newTestClient(t)
+	c.Mkdir("/alpha/docs")
+	mustUpload(t, c, "/alpha/docs/report.txt", "report")
+	mustUpload(t, c, "/alpha/notes.txt", "notes")
+
+	moved, err := c.Move("/alpha/notes.txt", "/alpha/docs")
+	if err != nil || moved.Path != "/alpha/docs/notes.txt" {
+		t.Errorf("Move into folder = %+v, %v", moved, err)
+	}
+	moved, err = c.Move("/alpha/docs", "/beta/papers")
+	if err != nil || moved.Path != "/beta/papers" || moved.Kind != KindFolder {
+		t.Fatalf("Move across drives = %+v, %v", moved, err)
+	}
+	var buf bytes.Buffer
+	if err := c.Download("/beta/papers/report.txt", &buf); err != nil || buf.String() != "report" {
+		t.Errorf("Download of moved file = %q, %v", buf.String(), err)
+	}
+	if _, err := c.Move("/beta", "/alpha"); !errors.Is(err, ErrPermission) {
+		t.Errorf("Move of drive: %v", err)
+	}
+	c.Mkdir("/beta/papers/old")
+	if _, err := c.Move("/beta/papers", "/beta/papers/old"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Move into itself: %v", err)
+	}
+	if _, err := c.Move("/beta/papers/report.txt", "/beta/papers/notes.txt"); !errors.Is(err, ErrExist) {
+		t.Errorf("Move onto existing file: %v", err)
+	}
+
+	found, err := c.Find("/", "REPORT")
+	if err != nil || len(found) != 1 || found[0].Path != "/beta/papers/report.txt" {
+		t.Errorf("Find = %+v, %v", found, err)
+	}
+
+	if err := c.Delete("/beta/papers", false); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Delete of non-empty folder: %v", err)
+	}
+	report, _ := c.Stat("/beta/papers/report.txt")
+	if err := c.Delete("/beta/papers", true); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Stat("/beta/papers"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat of deleted folder: %v", err)
+	}
+	if env.Memory["beta"].Object(report.UUID) != nil {
+		t.Errorf("content of deleted file not deleted")
+	}
+	if err := c.Delete("/beta", true); !errors.Is(err, ErrPermission) {
+		t.Errorf("Delete of drive: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	_, c := newTestClient(t)
+	mustUpload(t, c, "/alpha/b.txt", "b")
+	c.Mkdir("/alpha/a")
+	entries, err := c.List("/alpha")
+	if err != nil || len(entries) != 2 || entries[0].Name != "a" || !entries[0].IsDir() || entries[1].Name != "b.txt" {
+		t.Errorf("List = %+v, %v", entries, err)
+	}
+	root, err := c.List("/")
+	if err != nil || len(root) != 2 || root[0].Kind != KindDrive || root[0].Path != "/alpha" {
+		t.Errorf("List of root = %+v, %v", root, err)
+	}
+	if _, err := c.List("/alpha/b.txt"); !errors.Is(err, ErrNotDir) {
+		t.Errorf("List of file: %v", err)
+	}
+	var pathErr *PathError
+	if _, err := c.List("/alpha/missing"); !errors.As(err, &pathErr) || pathErr.Op != "list" || pathErr.Path != "/alpha/missing" {
+		t.Errorf("List of missing folder: %v", err)
+	}
+	fsys, err := c.FS("/alpha")
+	if err != nil {
+		t.Fatalf("FS: %v", err)
+	}
+	if data, err := fs.ReadFile(fsys, "b.txt"); err != nil || string(data) != "b" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+}
+
+func TestEntryJSON(t *testing.T) {
+	_, c := newTestClient(t)
+	c.Mkdir("/alpha/docs")
+	file := mustUpload(t, c, "/alpha/docs/a.txt", "content a")
+	folder, _ := c.Stat("/alpha/docs")
+
+	data, err := json.Marshal([]Entry{folder, file})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if !strings.Contains(string(data), `"path":"/alpha/docs/","type":"folder"}`) || !strings.Contains(string(data), `"size":9`) {
+		t.Errorf("json = %s", data)
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(entries) != 2 || entries[0] != folder || entries[1].Path != file.Path || entries[1].Size != 9 || entries[1].UUID != file.UUID || !entries[1].Updated.Equal(file.Updated) {
+		t.Errorf("decoded %v, want %v", entries, []Entry{folder, file})
+	}
+}
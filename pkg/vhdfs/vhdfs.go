@@ -0,0 +1,232 @@
+
+package vhdfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"rpucella.net/virtual-hard-drive/internal/storage"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+// Read-only io/fs access to a virtualfs subtree, for use with fs.WalkDir,
+// http.FS, template.ParseFS, and the like.
+// Opening a file streams its content from the storage of its drive, and
+// file information comes from the catalog.
+
+type FS struct {
+	root virtualfs.VirtualFS
+}
+
+var (
+	_ fs.FS = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS = (*FS)(nil)
+)
+
+// File system rooted at `root`, which may be the root of the virtual file
+// system, a drive, or a folder. Since virtualfs is internal, code outside
+// this module cannot call New, and gets a file system from vhd.Client.FS.
+func New(root virtualfs.VirtualFS) *FS {
+	return &FS{root: root}
+}
+
+// Find the entry at `name`, a valid io/fs path relative to the root.
+func (fsys *FS) lookup(op string, name string) (virtualfs.VirtualFS, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	curr := fsys.root
+	if name == "." {
+		return curr, nil
+	}
+	for _, component := range strings.Split(name, "/") {
+		if !curr.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		sub, found, err := curr.GetContent(component)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if !found {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		curr = sub
+	}
+	return curr, nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	vfs, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if vfs.IsDir() {
+		entries, err := fsys.entries(vfs)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dir{info: fsys.newFileInfo(vfs, name), entries: entries}, nil
+	}
+	file := vfs.AsFile()
+	return &openFile{
+		info: fsys.newFileInfo(vfs, name),
+		Reader: storage.NewReader(vfs.Drive().Storage(), file.UUID(), file.Metadata(), file.Size()),
+	}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	vfs, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.newFileInfo(vfs, name), nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	vfs, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !vfs.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a folder")}
+	}
+	entries, err := fsys.entries(vfs)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Entries of folder `vfs`, sorted by name.
+func (fsys *FS) entries(vfs virtualfs.VirtualFS) ([]fs.DirEntry, error) {
+	names, err := vfs.ContentList()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		sub, found, err := vfs.GetContent(name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entries = append(entries, newFileInfo(sub, name))
+		}
+	}
+	return entries, nil
+}
+
+// Information about an entry, as of when it was looked up. Sys() returns
+// the virtualfs entry.
+type fileInfo struct {
+	name string
+	size int64
+	modTime time.Time
+	vfs virtualfs.VirtualFS
+}
+
+func (fsys *FS) newFileInfo(vfs virtualfs.VirtualFS, name string) *fileInfo {
+	// The root of the file system is named after the last element of its path.
+	return newFileInfo(vfs, name[strings.LastIndex(name, "/") + 1:])
+}
+
+func newFileInfo(vfs virtualfs.VirtualFS, name string) *fileInfo {
+	info := &fileInfo{name: name, vfs: vfs}
+	if file := vfs.AsFile(); file != nil {
+		info.size = file.Size()
+		if info.size < 0 {
+			info.size = 0
+		}
+		info.modTime = file.Updated()
+	}
+	return info
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.vfs.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.vfs.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return fi.vfs
+}
+
+// As a directory entry.
+
+func (fi *fileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
+
+func (fi *fileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
+
+// An open folder, listing its entries as of when it was opened.
+type dir struct {
+	info *fileInfo
+	entries []fs.DirEntry
+	read int              // Entries already returned by ReadDir.
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.read:]
+	if count > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && count < len(remaining) {
+		remaining = remaining[:count]
+	}
+	d.read += len(remaining)
+	return remaining, nil
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("is a folder")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+// An open file, streaming its content from storage. Seeking backwards
+// restarts the download.
+type openFile struct {
+	info *fileInfo
+	*storage.Reader
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	if size := f.Size(); size >= 0 {
+		f.info.size = size
+	}
+	return f.info, nil
+}
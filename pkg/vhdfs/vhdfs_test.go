@@ -0,0 +1,96 @@
+
+package vhdfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"rpucella.net/virtual-hard-drive/internal/vhdtest"
+	"rpucella.net/virtual-hard-drive/internal/virtualfs"
+)
+
+func TestFS(t *testing.T) {
+	env := vhdtest.New(t, "alpha", "beta")
+	alpha := env.Root.Drives()["alpha"].AsVirtualFS()
+	if _, err := virtualfs.CreateDirectory(alpha, "docs"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	env.PutFile(t, "/alpha/docs/a.txt", "content a")
+	env.PutFile(t, "/alpha/docs/b.txt", strings.Repeat("content b ", 1000))
+	env.PutFile(t, "/beta/c.txt", "content c")
+
+	if err := fstest.TestFS(New(env.Root.AsVirtualFS()), "alpha/docs/a.txt", "alpha/docs/b.txt", "beta/c.txt"); err != nil {
+		t.Errorf("TestFS: %v", err)
+	}
+	// A subtree.
+	if err := fstest.TestFS(New(alpha), "docs/a.txt", "docs/b.txt"); err != nil {
+		t.Errorf("TestFS on a drive: %v", err)
+	}
+
+	fsys := New(alpha)
+	info, err := fs.Stat(fsys, "docs/a.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	fileObj, _ := virtualfs.NavigateFile(alpha, "docs/a.txt")
+	if info.Size() != 9 || !info.ModTime().Equal(fileObj.AsFile().Updated()) || info.IsDir() {
+		t.Errorf("Stat = %d %v %v", info.Size(), info.ModTime(), info.IsDir())
+	}
+	if _, err := fsys.Open("docs/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open of missing file: %v", err)
+	}
+	if _, err := fsys.Open("/docs"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open of invalid path: %v", err)
+	}
+}
+
+func TestStandardLibrary(t *testing.T) {
+	env := vhdtest.New(t, "alpha")
+	alpha := env.Root.Drives()["alpha"].AsVirtualFS()
+	if _, err := virtualfs.CreateDirectory(alpha, "templates"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	env.PutFile(t, "/alpha/templates/hello.tmpl", "Hello, {{.}}!")
+	env.PutFile(t, "/alpha/index.html", "<p>index</p>")
+	fsys := New(alpha)
+
+	walked := make([]string, 0)
+	fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if strings.Join(walked, " ") != ". index.html templates templates/hello.tmpl" {
+		t.Errorf("WalkDir visited %v", walked)
+	}
+
+	tmpl, err := template.ParseFS(fsys, "templates/*.tmpl")
+	if err != nil {
+		t.Fatalf("ParseFS: %v", err)
+	}
+	var out strings.Builder
+	tmpl.Execute(&out, "world")
+	if out.String() != "Hello, world!" {
+		t.Errorf("template output = %q", out.String())
+	}
+
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL + "/templates/hello.tmpl", nil)
+	req.Header.Set("Range", "bytes=7-11")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "{{.}}" {
+		t.Errorf("GET range = %d %q", resp.StatusCode, body)
+	}
+}